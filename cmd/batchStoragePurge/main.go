@@ -0,0 +1,134 @@
+// batchStoragePurge is a command purging file versions that are no longer to be retained from S3 storage
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/storage/s3/retention"
+	"github.com/iryonetwork/wwm/utils/keyProvider"
+)
+
+func main() {
+	// initialize logger
+	logger := zerolog.New(os.Stdout).With().
+		Timestamp().
+		Str("service", "batchStoragePurge").
+		Logger()
+
+	// Create context with cancel func
+	ctx, cancelContext := context.WithCancel(context.Background())
+	defer cancelContext()
+
+	// get config
+	cfg, err := GetConfig()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to get config")
+	}
+
+	// read retention policies
+	policies, err := retention.LoadPolicies(cfg.RetentionPoliciesFilepath)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to load retention policies")
+	}
+
+	// initialize promethues metrics registry
+	metricsRegistry := prometheus.NewRegistry()
+
+	// initialize keyProvider
+	key, err := base64.StdEncoding.DecodeString(cfg.StorageEncryptionKey)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to decode storage encryption key")
+	}
+	var keys s3.KeyProvider = keyProvider.New(string(key))
+	if cfg.StorageKeyringFilepath != "" {
+		keys, err = keyProvider.NewKeyring(cfg.StorageKeyringFilepath, string(key))
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize storage keyring")
+		}
+	}
+
+	// initialize storage
+	s3cfg := &s3.Config{
+		Endpoint:     cfg.S3Endpoint,
+		AccessKey:    cfg.S3AccessKey,
+		AccessSecret: cfg.S3Secret,
+		Secure:       true,
+		Region:       cfg.S3Region,
+	}
+	storage, err := s3.New(s3cfg, keys, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize storage")
+	}
+
+	// initialize bolt key value storage to keep audit records
+	audit, err := keyvalue.NewBolt(ctx, cfg.BoltDBFilepath, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize key value storage")
+	}
+	// get metrics collection for key value storage and register in registry
+	m := audit.GetPrometheusMetricsCollection()
+	for _, metric := range m {
+		metricsRegistry.MustRegister(metric)
+	}
+
+	// initialize purge
+	retentionCfg := retention.Cfg{
+		Policies:         policies,
+		MinimumRetention: time.Duration(cfg.RetentionMinimumDays) * 24 * time.Hour,
+		DryRun:           cfg.DryRun,
+	}
+	p := retention.New(storage, audit, retentionCfg, logger)
+
+	// get prometheus metrics collection for purge and register in registry
+	m = p.GetPrometheusMetricsCollection()
+	for _, metric := range m {
+		metricsRegistry.MustRegister(metric)
+	}
+
+	// initialize prometheus metrics pusher
+	metricsPusher := push.New(cfg.PrometheusPushGatewayAddress, "batchStoragePurge").Gatherer(metricsRegistry)
+
+	// Run purge
+	exitCh := make(chan error)
+	go func() {
+		exitCh <- p.Purge(ctx)
+	}()
+
+	// Run cleanup when sigint or sigterm is received
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+
+Loop:
+	for {
+		select {
+		case err := <-exitCh:
+			if err != nil {
+				logger.Error().Err(err).Msg("batch purge failed")
+			} else {
+				logger.Info().Bool("dryRun", cfg.DryRun).Msg("batch purge successfull")
+			}
+			break Loop
+		case <-signalChan:
+			logger.Info().Msg("stopping batch purge due to interrupt")
+			cancelContext()
+			break Loop
+		}
+	}
+
+	// push metrics to the push gateway
+	err = metricsPusher.Add()
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to push metrics to push gateway")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/caarlos0/env"
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/config"
+)
+
+// storage backends
+const (
+	storageBackendS3         = "s3"
+	storageBackendFilesystem = "filesystem"
+)
+
+// Config represents configuration of batchStorageScrub
+type Config struct {
+	config.Config
+
+	StorageBackend        string `env:"STORAGE_BACKEND" envDefault:"s3"`
+	StorageFilesystemRoot string `env:"STORAGE_FILESYSTEM_ROOT" envDefault:"/data/storage"`
+
+	S3Endpoint  string `env:"S3_ENDPOINT" envDefault:"localMinio:9000"`
+	S3AccessKey string `env:"S3_ACCESS_KEY" envDefault:"local"`
+	S3Region    string `env:"S3_REGION" envDefault:"us-east-1"`
+	S3Secret    string `env:"S3_SECRET"`
+
+	StorageEncryptionKey   string `env:"STORAGE_ENCRYPTION_KEY,required"`
+	StorageKeyringFilepath string `env:"STORAGE_KEYRING_FILEPATH"`
+
+	BucketsToSkip []string `env:"BUCKETS_TO_SKIP" envSeparator:","`
+	Repair        bool     `env:"REPAIR" envDefault:"false"`
+
+	CloudStorageHost             string `env:"CLOUD_STORAGE_HOST" envDefault:"cloudStorage"`
+	CloudStoragePath             string `env:"CLOUD_STORAGE_PATH" envDefault:"storage"`
+	ReportFilepath               string `env:"REPORT_FILEPATH" envDefault:"/data/batchStorageScrub.json"`
+	PrometheusPushGatewayAddress string `env:"PROMETHEUS_PUSH_GATEWAY_ADDRESS" envDefault:"http://localPrometheusPushGateway:9091"`
+}
+
+// GetConfig parses environment variables and returns pointer to config and error
+func GetConfig() (*Config, error) {
+	common, err := config.New()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{Config: *common}
+	if err := env.Parse(cfg); err != nil {
+		return nil, err
+	}
+
+	switch cfg.StorageBackend {
+	case storageBackendS3:
+		if cfg.S3Secret == "" {
+			return nil, errors.New("S3_SECRET is required for s3 storage backend")
+		}
+	case storageBackendFilesystem:
+	default:
+		return nil, errors.Errorf("unknown storage backend %s", cfg.StorageBackend)
+	}
+
+	return cfg, nil
+}
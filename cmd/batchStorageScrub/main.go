@@ -0,0 +1,169 @@
+// batchStorageScrub is a command verifying checksums of all the file versions in storage
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	runtimeClient "github.com/go-openapi/runtime/client"
+	"github.com/go-openapi/strfmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/client"
+	"github.com/iryonetwork/wwm/service/serviceAuthenticator"
+	"github.com/iryonetwork/wwm/service/storage"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/storage/s3/scrub"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/utils"
+	"github.com/iryonetwork/wwm/utils/contentEncoding"
+	"github.com/iryonetwork/wwm/utils/keyProvider"
+)
+
+func main() {
+	// initialize logger
+	logger := zerolog.New(os.Stdout).With().
+		Timestamp().
+		Str("service", "batchStorageScrub").
+		Logger()
+
+	// Create context with cancel func
+	ctx, cancelContext := context.WithCancel(context.Background())
+	defer cancelContext()
+
+	// get config
+	cfg, err := GetConfig()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to get config")
+	}
+
+	// initialize promethues metrics registry
+	metricsRegistry := prometheus.NewRegistry()
+
+	// initialize keyProvider
+	key, err := base64.StdEncoding.DecodeString(cfg.StorageEncryptionKey)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to decode storage encryption key")
+	}
+	var keys s3.KeyProvider = keyProvider.New(string(key))
+	if cfg.StorageKeyringFilepath != "" {
+		keys, err = keyProvider.NewKeyring(cfg.StorageKeyringFilepath, string(key))
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize storage keyring")
+		}
+	}
+
+	// initialize storage
+	var s s3.Storage
+	switch cfg.StorageBackend {
+	case storageBackendFilesystem:
+		s, err = s3.NewFilesystem(cfg.StorageFilesystemRoot, keys, logger)
+	default:
+		s3cfg := &s3.Config{
+			Endpoint:     cfg.S3Endpoint,
+			AccessKey:    cfg.S3AccessKey,
+			AccessSecret: cfg.S3Secret,
+			Secure:       true,
+			Region:       cfg.S3Region,
+		}
+		s, err = s3.New(s3cfg, keys, logger)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize storage")
+	}
+
+	// initialize handlers fetching contents from cloud storage for repairs
+	var fetcher scrub.Fetcher
+	if cfg.Repair {
+		local := runtimeClient.New(cfg.StorageHost, cfg.StoragePath, []string{"https"})
+		local.Consumers = utils.ConsumersForSync()
+		local.Transport = contentEncoding.Transport(local.Transport)
+		localClient := client.New(local, strfmt.Default)
+
+		cloud := runtimeClient.New(cfg.CloudStorageHost, cfg.CloudStoragePath, []string{"https"})
+		cloud.Consumers = utils.ConsumersForSync()
+		cloud.Transport = contentEncoding.Transport(cloud.Transport)
+		cloudClient := client.New(cloud, strfmt.Default)
+
+		auth, err := serviceAuthenticator.New(cfg.CertPath, cfg.KeyPath, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize storage API request authenticator")
+		}
+
+		fetcher = storageSync.NewHandlers(cloudClient.Operations, auth, storageSync.CloudStorageID, localClient.Operations, auth, logger)
+	}
+
+	// initialize scrub, checksums are calculated the same way storage service does
+	scrubCfg := scrub.Cfg{
+		BucketsToSkip: cfg.BucketsToSkip,
+		Repair:        cfg.Repair,
+	}
+	sc := scrub.New(s, storage.New(s, keys, nil, 0, storage.Quotas{}, nil, logger), fetcher, scrubCfg, logger)
+
+	// get prometheus metrics collection for scrub and register in registry
+	m := sc.GetPrometheusMetricsCollection()
+	for _, metric := range m {
+		metricsRegistry.MustRegister(metric)
+	}
+
+	// initialize prometheus metrics pusher
+	metricsPusher := push.New(cfg.PrometheusPushGatewayAddress, "batchStorageScrub").Gatherer(metricsRegistry)
+
+	// Run scrub
+	type result struct {
+		report *scrub.Report
+		err    error
+	}
+	exitCh := make(chan result)
+	go func() {
+		report, err := sc.Scrub(ctx)
+		exitCh <- result{report, err}
+	}()
+
+	// Run cleanup when sigint or sigterm is received
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+
+Loop:
+	for {
+		select {
+		case r := <-exitCh:
+			if r.err != nil {
+				logger.Error().Err(r.err).Msg("batch scrub failed")
+			} else {
+				logger.Info().Int("verified", r.report.Verified).Int("failures", len(r.report.Failures)).Msg("batch scrub successfull")
+			}
+			if r.report != nil {
+				writeReport(cfg.ReportFilepath, r.report, logger)
+			}
+			break Loop
+		case <-signalChan:
+			logger.Info().Msg("stopping batch scrub due to interrupt")
+			cancelContext()
+			break Loop
+		}
+	}
+
+	// push metrics to the push gateway
+	err = metricsPusher.Add()
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to push metrics to push gateway")
+	}
+}
+
+func writeReport(path string, report *scrub.Report, logger zerolog.Logger) {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(path, b, 0600)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to write report")
+	}
+}
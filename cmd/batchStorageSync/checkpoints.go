@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/batch"
+)
+
+// checkpoint commands
+const (
+	checkpointsList  = "list"
+	checkpointsReset = "reset"
+	// allBuckets is the bucket ID selecting checkpoints of all the buckets to reset
+	allBuckets = "all"
+)
+
+// manageCheckpoints runs the checkpoints command for buckets synced in the directions and writes its output
+func manageCheckpoints(storage keyvalue.Storage, directions []storageSync.Direction, command, bucketID string, out io.Writer) error {
+	switch command {
+	case checkpointsList:
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "DIRECTION\tBUCKET\tCHECKPOINT")
+		for _, direction := range directions {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", direction, "*", formatCheckpoint(batch.LastSuccessfulRun(storage, direction)))
+
+			list, err := batch.NewCheckpoints(storage, direction).List()
+			if err != nil {
+				return err
+			}
+			buckets := []string{}
+			for b := range list {
+				buckets = append(buckets, b)
+			}
+			sort.Strings(buckets)
+			for _, b := range buckets {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", direction, b, formatCheckpoint(list[b]))
+			}
+		}
+		return w.Flush()
+	case checkpointsReset:
+		for _, direction := range directions {
+			checkpoints := batch.NewCheckpoints(storage, direction)
+			if bucketID != allBuckets {
+				if err := checkpoints.Reset(bucketID); err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "%s %s: reset\n", direction, bucketID)
+				continue
+			}
+
+			// buckets without checkpoint are synced since the last successful run
+			if err := batch.SaveSuccessfulRun(storage, direction, time.Unix(0, 0)); err != nil {
+				return err
+			}
+			list, err := checkpoints.List()
+			if err != nil {
+				return err
+			}
+			for b := range list {
+				if err := checkpoints.Reset(b); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(out, "%s: %d bucket(s) reset\n", direction, len(list))
+		}
+		return nil
+	}
+
+	return errors.Errorf("unknown checkpoints command %s", command)
+}
+
+// formatCheckpoint formats the checkpoint, beginning of Unix time means that whole history is synced
+func formatCheckpoint(checkpoint time.Time) string {
+	if checkpoint.Equal(time.Unix(0, 0)) {
+		return "-"
+	}
+	return checkpoint.UTC().Format("2006-01-02T15:04:05Z")
+}
@@ -2,8 +2,17 @@ package main
 
 import (
 	"github.com/caarlos0/env"
+	"github.com/pkg/errors"
 
 	"github.com/iryonetwork/wwm/config"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// sync directions
+const (
+	syncDirectionLocalToCloud  = string(storageSync.LocalToCloud)
+	syncDirectionCloudToLocal  = string(storageSync.CloudToLocal)
+	syncDirectionBidirectional = "bidirectional"
 )
 
 // Config represents configuration of batchStorageSync
@@ -13,9 +22,15 @@ type Config struct {
 	BucketsRateLimit        int      `env:"BUCKETS_RATE_LIMIT" envDefault:"2"`
 	FilesPerBucketRateLimit int      `env:"FILES_PER_BUCKET_RATE_LIMIT" envDefault:"3"`
 	BucketsToSkip           []string `env:"BUCKETS_TO_SKIP" envSeparator:"," envDefault:"c8220891-c582-41a3-893d-19e211985db5"`
+	SyncDirection           string   `env:"SYNC_DIRECTION" envDefault:"localToCloud"`
+	LocationID              string   `env:"LOCATION_ID"`
+	EvictOnUnlink           bool     `env:"EVICT_ON_UNLINK" envDefault:"false"`
+	ScheduleRulesFilepath   string   `env:"SCHEDULE_RULES_FILEPATH"`
 
 	CloudStorageHost             string `env:"CLOUD_STORAGE_HOST" envDefault:"cloudStorage"`
 	CloudStoragePath             string `env:"CLOUD_STORAGE_PATH" envDefault:"storage"`
+	DiscoveryHost                string `env:"DISCOVERY_HOST" envDefault:"localDiscovery"`
+	DiscoveryPath                string `env:"DISCOVERY_PATH" envDefault:"discovery"`
 	BoltDBFilepath               string `env:"BOLT_DB_FILEPATH" envDefault:"/data/batchStorageSync.db"`
 	PrometheusPushGatewayAddress string `env:"PROMETHEUS_PUSH_GATEWAY_ADDRESS" envDefault:"http://localPrometheusPushGateway:9091"`
 }
@@ -28,6 +43,19 @@ func GetConfig() (*Config, error) {
 	}
 
 	cfg := &Config{Config: *common}
+	if err := env.Parse(cfg); err != nil {
+		return nil, err
+	}
+
+	switch cfg.SyncDirection {
+	case syncDirectionLocalToCloud:
+	case syncDirectionCloudToLocal, syncDirectionBidirectional:
+		if cfg.LocationID == "" {
+			return nil, errors.Errorf("LOCATION_ID is required for %s sync", cfg.SyncDirection)
+		}
+	default:
+		return nil, errors.Errorf("unknown sync direction %s", cfg.SyncDirection)
+	}
 
-	return cfg, env.Parse(cfg)
+	return cfg, nil
 }
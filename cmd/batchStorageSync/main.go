@@ -4,6 +4,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"os"
 	"os/signal"
 	"syscall"
@@ -15,18 +16,17 @@ import (
 	"github.com/prometheus/client_golang/prometheus/push"
 	"github.com/rs/zerolog"
 
+	discoveryAPI "github.com/iryonetwork/wwm/gen/discovery/client"
 	"github.com/iryonetwork/wwm/gen/storage/client"
 	"github.com/iryonetwork/wwm/log/errorChecker"
 	"github.com/iryonetwork/wwm/service/serviceAuthenticator"
 	"github.com/iryonetwork/wwm/storage/keyvalue"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
 	"github.com/iryonetwork/wwm/sync/storage/batch"
+	"github.com/iryonetwork/wwm/sync/storage/scheduler"
+	"github.com/iryonetwork/wwm/sync/storage/selective"
 	"github.com/iryonetwork/wwm/utils"
-)
-
-const (
-	storageBucket string = "batchStorageSync"
-	storageKey    string = "lastSuccessfulRun"
+	"github.com/iryonetwork/wwm/utils/contentEncoding"
 )
 
 func main() {
@@ -46,13 +46,25 @@ func main() {
 		logger.Fatal().Err(err).Msg("failed to get config")
 	}
 
+	// parse flags
+	checkpointsCommand := flag.String("checkpoints", "", "manage checkpoints of buckets instead of running the sync: list or reset")
+	checkpointsBucket := flag.String("bucket", "", "ID of the bucket whose checkpoint to reset, 'all' to reset all of them")
+	flag.Parse()
+	if *checkpointsCommand == checkpointsReset && *checkpointsBucket == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// local changes are pushed before cloud changes are pulled
+	directions := []storageSync.Direction{storageSync.Direction(cfg.SyncDirection)}
+	if cfg.SyncDirection == syncDirectionBidirectional {
+		directions = []storageSync.Direction{storageSync.LocalToCloud, storageSync.CloudToLocal}
+	}
+
 	// initialize promethues metrics registry
 	metricsRegistry := prometheus.NewRegistry()
 
-	// initialize last successful run with 0 value
-	lastSuccessfulRun := time.Unix(0, 0)
-
-	// initialize bolt key value storage to read last succesful run
+	// initialize bolt key value storage keeping last succesful run of each direction
 	storage, err := keyvalue.NewBolt(ctx, cfg.BoltDBFilepath, logger)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to initialize key value storage")
@@ -63,23 +75,24 @@ func main() {
 		metricsRegistry.MustRegister(metric)
 	}
 
-	// read last succesful run
-	storedTimestamp := storage.Get(storageBucket, storageKey)
-	if storedTimestamp != nil {
-		timestamp, err := strfmt.ParseDateTime(string(storedTimestamp))
-		if err == nil {
-			lastSuccessfulRun = time.Time(timestamp)
+	// run checkpoints command
+	if *checkpointsCommand != "" {
+		if err := manageCheckpoints(storage, directions, *checkpointsCommand, *checkpointsBucket, os.Stdout); err != nil {
+			logger.Fatal().Err(err).Msgf("failed to %s checkpoints", *checkpointsCommand)
 		}
+		return
 	}
 
 	// initialize local storage API client
 	local := runtimeClient.New(cfg.StorageHost, cfg.StoragePath, []string{"https"})
 	local.Consumers = utils.ConsumersForSync()
+	local.Transport = contentEncoding.Transport(local.Transport)
 	localClient := client.New(local, strfmt.Default)
 
 	// initialize cloud storage API client
 	cloud := runtimeClient.New(cfg.CloudStorageHost, cfg.CloudStoragePath, []string{"https"})
 	cloud.Consumers = utils.ConsumersForSync()
+	cloud.Transport = contentEncoding.Transport(cloud.Transport)
 	cloudClient := client.New(cloud, strfmt.Default)
 
 	// initialize request authenticator
@@ -88,34 +101,89 @@ func main() {
 		logger.Fatal().Err(err).Msg("failed to initialize storage API request authenticator")
 	}
 
-	// initialize handlers
-	handlers := storageSync.NewHandlers(localClient.Operations, auth, cloudClient.Operations, auth, logger)
-
 	// initialize batchStorageSync
 	batchCfg := batch.Cfg{
 		BucketsRateLimit:        cfg.BucketsRateLimit,
 		FilesPerBucketRateLimit: cfg.FilesPerBucketRateLimit,
 		BucketsToSkip:           cfg.BucketsToSkip,
 	}
-	s := batch.New(handlers, batchCfg, logger)
 
-	// get prometheus metrics collection for batch sync and register in registry
-	m = s.GetPrometheusMetricsCollection()
-	for _, metric := range m {
-		metricsRegistry.MustRegister(metric)
+	// initialize scheduler shared by all directions to keep bandwidth limit for the whole sync
+	if cfg.ScheduleRulesFilepath != "" {
+		rules, err := scheduler.LoadRules(cfg.ScheduleRulesFilepath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load scheduler rules")
+		}
+		batchCfg.Scheduler, err = scheduler.New(rules, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize scheduler")
+		}
+		// get prometheus metrics collection for scheduler and register in registry
+		m = batchCfg.Scheduler.GetPrometheusMetricsCollection()
+		for _, metric := range m {
+			metricsRegistry.MustRegister(metric)
+		}
+	}
+
+	// initialize batchStorageSync for each direction
+	syncs := make(map[storageSync.Direction]storageSync.BatchSync)
+	for _, direction := range directions {
+		directionCfg := batchCfg
+		directionCfg.Direction = direction
+		directionCfg.Checkpoints = batch.NewCheckpoints(storage, direction)
+
+		var handlers storageSync.Handlers
+		switch direction {
+		case storageSync.CloudToLocal:
+			handlers = storageSync.NewHandlers(cloudClient.Operations, auth, storageSync.CloudStorageID, localClient.Operations, auth, logger)
+
+			// only buckets of patients linked to the location are pulled
+			discovery := runtimeClient.New(cfg.DiscoveryHost, cfg.DiscoveryPath, []string{"https"})
+			discoveryClient := discoveryAPI.New(discovery, strfmt.Default)
+			patients := selective.DiscoveryPatients(discoveryClient.Operations, auth, cfg.LocationID)
+			directionCfg.Selector = selective.New(patients, storage, logger)
+			directionCfg.EvictOnUnlink = cfg.EvictOnUnlink
+
+			// versions pushed from the clinic are not pulled back, versions pushed late are still pulled
+			directionCfg.SkipSource = cfg.DomainID
+			directionCfg.SinceReceived = true
+		default:
+			handlers = storageSync.NewHandlers(localClient.Operations, auth, cfg.DomainID, cloudClient.Operations, auth, logger)
+
+			// versions pulled from cloud storage are not pushed back
+			directionCfg.SkipSyncedVersions = true
+		}
+
+		s := batch.New(handlers, directionCfg, logger)
+
+		// get prometheus metrics collection for batch sync and register in registry
+		m = s.GetPrometheusMetricsCollection()
+		for _, metric := range m {
+			metricsRegistry.MustRegister(metric)
+		}
+		syncs[direction] = s
 	}
 
 	// initialize prometheus metrics pusher
 	metricsPusher := push.New(cfg.PrometheusPushGatewayAddress, "batchStorageSync").Gatherer(metricsRegistry)
 
-	// get current time to be saved as lastSuccesfulRun
-	// do it before sync to account for anything that might have happened during sync duration
-	startTime := strfmt.DateTime(time.Now())
-
-	// Run sync
-	exitCh := make(chan error)
+	// Run sync in each direction
+	exitCh := make(chan bool)
 	go func() {
-		exitCh <- s.Sync(ctx, time.Time(lastSuccessfulRun))
+		for _, direction := range directions {
+			// get current time to be saved as last succesful run of the direction
+			// do it before sync to account for anything that might have happened during sync duration
+			startTime := time.Now()
+
+			err := syncs[direction].Sync(ctx, batch.LastSuccessfulRun(storage, direction))
+			if err != nil {
+				logger.Error().Err(err).Str("direction", string(direction)).Msg("batch sync failed")
+				continue
+			}
+			logger.Info().Str("direction", string(direction)).Msg("batch sync successfull")
+			errorChecker.LogError(batch.SaveSuccessfulRun(storage, direction, startTime))
+		}
+		close(exitCh)
 	}()
 
 	// Run cleanup when sigint or sigterm is received
@@ -125,14 +193,7 @@ func main() {
 Loop:
 	for {
 		select {
-		case err := <-exitCh:
-			if err != nil {
-				logger.Error().Err(err).Msg("batch sync failed")
-			} else {
-				logger.Info().Msg("batch sync successfull")
-				// save lastSuccesfulRun
-				errorChecker.LogError(storage.Update(storageBucket, storageKey, []byte(startTime.String())))
-			}
+		case <-exitCh:
 			break Loop
 		case <-signalChan:
 			logger.Info().Msg("stopping batch sync due to interrupt")
@@ -95,6 +95,7 @@ func main() {
 	api.FetchHandler = discoveryHandlers.Fetch()
 	api.LinkHandler = discoveryHandlers.Link()
 	api.UnlinkHandler = discoveryHandlers.Unlink()
+	api.LocationPatientsHandler = discoveryHandlers.LocationPatients()
 	api.CodesGetHandler = discoveryHandlers.CodesGet()
 	api.CodeGetHandler = discoveryHandlers.CodeGet()
 
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/caarlos0/env"
 
 	"github.com/iryonetwork/wwm/config"
@@ -15,7 +17,18 @@ type Config struct {
 	S3Region    string `env:"S3_REGION" envDefault:"us-east-1"`
 	S3Secret    string `env:"S3_SECRET,required"`
 
-	StorageEncryptionKey string `env:"STORAGE_ENCRYPTION_KEY,required"`
+	StorageEncryptionKey   string `env:"STORAGE_ENCRYPTION_KEY,required"`
+	StorageKeyringFilepath string `env:"STORAGE_KEYRING_FILEPATH"`
+
+	UploadTTL        time.Duration `env:"UPLOAD_TTL" envDefault:"24h"`
+	UploadGCInterval time.Duration `env:"UPLOAD_GC_INTERVAL" envDefault:"1h"`
+
+	QuotaSoftSize    int64 `env:"QUOTA_SOFT_SIZE"`
+	QuotaSoftObjects int64 `env:"QUOTA_SOFT_OBJECTS"`
+	QuotaHardSize    int64 `env:"QUOTA_HARD_SIZE"`
+	QuotaHardObjects int64 `env:"QUOTA_HARD_OBJECTS"`
+
+	ValidationRulesFilepath string `env:"VALIDATION_RULES_FILEPATH"`
 }
 
 // GetConfig parses environment variables and returns pointer to config and error
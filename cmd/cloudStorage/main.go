@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	loads "github.com/go-openapi/loads"
 	flags "github.com/jessevdk/go-flags"
@@ -61,7 +62,14 @@ func main() {
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to decode storage encryption key")
 	}
-	keys := keyProvider.New(string(key))
+	var keys s3.KeyProvider = keyProvider.New(string(key))
+	if cfg.StorageKeyringFilepath != "" {
+		// derive per bucket keys from the keyring, the encryption key is used for objects written before keyring was introduced
+		keys, err = keyProvider.NewKeyring(cfg.StorageKeyringFilepath, string(key))
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize storage keyring")
+		}
+	}
 
 	// initialize storage
 	s3cfg := &s3.Config{
@@ -77,7 +85,21 @@ func main() {
 	}
 
 	// initialize the service
-	service := storage.New(s3, keys, publisher.NewNullPublisher(ctx), logger)
+	quotas := storage.Quotas{
+		SoftSize:    cfg.QuotaSoftSize,
+		SoftObjects: cfg.QuotaSoftObjects,
+		HardSize:    cfg.QuotaHardSize,
+		HardObjects: cfg.QuotaHardObjects,
+	}
+	var validator storage.Validator
+	if cfg.ValidationRulesFilepath != "" {
+		rules, err := storage.LoadValidationRules(cfg.ValidationRulesFilepath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to load validation rules")
+		}
+		validator = storage.NewValidator(rules)
+	}
+	service := storage.New(s3, keys, publisher.NewNullPublisher(ctx), cfg.UploadTTL, quotas, validator, logger)
 
 	// initialize authorizer
 	auth := authorizer.New(cfg.DomainType, cfg.DomainID, fmt.Sprintf("https://%s/%s/validate", cfg.AuthHost, cfg.AuthPath), logger.With().Str("component", "service/authorizer").Logger())
@@ -93,7 +115,7 @@ func main() {
 	server.TLSCertificateKey = flags.Filename(cfg.KeyPath)
 	server.TLSCertificate = flags.Filename(cfg.CertPath)
 
-	storageHandlers := storage.NewHandlers(service, logger)
+	storageHandlers := storage.NewHandlers(service, auth, logger)
 
 	serverLogger := logger.WithLevel(zerolog.InfoLevel).Str("component", "server")
 	api.Logger = serverLogger.Msgf
@@ -102,6 +124,7 @@ func main() {
 	api.FileListHandler = storageHandlers.FileList()
 	api.FileGetHandler = storageHandlers.FileGet()
 	api.FileGetVersionHandler = storageHandlers.FileGetVersion()
+	api.FilePreviewHandler = storageHandlers.FilePreview()
 	api.FileListVersionsHandler = storageHandlers.FileListVersions()
 	api.FileNewHandler = storageHandlers.FileNew()
 	api.FileUpdateHandler = storageHandlers.FileUpdate()
@@ -112,17 +135,29 @@ func main() {
 	api.SyncBucketListHandler = storageHandlers.SyncBucketList()
 	api.SyncFileListHandler = storageHandlers.SyncFileList()
 	api.SyncFileListVersionsHandler = storageHandlers.SyncFileListVersions()
+	api.UploadNewHandler = storageHandlers.UploadNew()
+	api.UploadGetHandler = storageHandlers.UploadGet()
+	api.UploadChunkHandler = storageHandlers.UploadChunk()
+	api.UploadFinalizeHandler = storageHandlers.UploadFinalize()
+	api.UploadDeleteHandler = storageHandlers.UploadDelete()
+	api.FileConflictsHandler = storageHandlers.FileConflicts()
+	api.FileResolveHandler = storageHandlers.FileResolve()
+	api.HoldBucketSetHandler = storageHandlers.HoldBucketSet()
+	api.HoldBucketReleaseHandler = storageHandlers.HoldBucketRelease()
+	api.HoldFileSetHandler = storageHandlers.HoldFileSet()
+	api.HoldFileReleaseHandler = storageHandlers.HoldFileRelease()
+	api.BucketUsageHandler = storageHandlers.BucketUsage()
 
 	api.RegisterConsumer("*/*", &WildcardConsumer{})
 
 	// initialize metrics middleware
 	m := APIMetrics.NewMetrics("api", "").
-		WithURLSanitize(utils.WhitelistURLSanitize([]string{"storage", "versions", "sync"}))
+		WithURLSanitize(utils.WhitelistURLSanitize([]string{"storage", "versions", "sync", "uploads", "holds"}))
 
 	// set API handler with middlewares
 	handler := cors.New(cors.Options{
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "Range", "If-None-Match"},
 	}).Handler(api.Serve(nil))
 	handler = logMW.APILogMiddleware(handler, logger)
 	handler = m.Middleware(handler)
@@ -142,6 +177,20 @@ func main() {
 		ss := statusServer.New(logger)
 		exitCh <- ss.ListenAndServeHTTPs(ctx, fmt.Sprintf("%s:%d", cfg.ServerHost, cfg.StatusPort), cfg.StatusNamespace, cfg.CertPath, cfg.KeyPath)
 	}()
+	// remove expired uploads periodically
+	go func() {
+		ticker := time.NewTicker(cfg.UploadGCInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				errorChecker.LogError(service.UploadCollectGarbage(ctx))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 	// start serving API
 	go func() {
 		defer func() {
@@ -102,6 +102,7 @@ func main() {
 	api.FetchHandler = discoveryHandlers.Fetch()
 	api.LinkHandler = discoveryHandlers.ProxyLink()
 	api.UnlinkHandler = discoveryHandlers.ProxyUnlink()
+	api.LocationPatientsHandler = discoveryHandlers.LocationPatients()
 	api.CodesGetHandler = discoveryHandlers.CodesGet()
 	api.CodeGetHandler = discoveryHandlers.CodeGet()
 
@@ -4,26 +4,63 @@ import (
 	"time"
 
 	"github.com/caarlos0/env"
+	"github.com/pkg/errors"
 
 	"github.com/iryonetwork/wwm/config"
 )
 
+// storage backends
+const (
+	storageBackendS3         = "s3"
+	storageBackendFilesystem = "filesystem"
+)
+
+// event transports
+const (
+	eventTransportStan      = "stan"
+	eventTransportJetStream = "jetstream"
+	eventTransportBolt      = "bolt"
+)
+
 // Config represents configuration of localStorage
 type Config struct {
 	config.Config
 
+	StorageBackend        string `env:"STORAGE_BACKEND" envDefault:"s3"`
+	StorageFilesystemRoot string `env:"STORAGE_FILESYSTEM_ROOT" envDefault:"/data/storage"`
+
 	S3Endpoint  string `env:"S3_ENDPOINT" envDefault:"localMinio:9000"`
 	S3AccessKey string `env:"S3_ACCESS_KEY" envDefault:"local"`
 	S3Region    string `env:"S3_REGION" envDefault:"us-east-1"`
-	S3Secret    string `env:"S3_SECRET,required"`
+	S3Secret    string `env:"S3_SECRET"`
+
+	StorageEncryptionKey   string `env:"STORAGE_ENCRYPTION_KEY,required"`
+	StorageKeyringFilepath string `env:"STORAGE_KEYRING_FILEPATH"`
+
+	UploadTTL        time.Duration `env:"UPLOAD_TTL" envDefault:"24h"`
+	UploadGCInterval time.Duration `env:"UPLOAD_GC_INTERVAL" envDefault:"1h"`
+
+	QuotaSoftSize    int64 `env:"QUOTA_SOFT_SIZE"`
+	QuotaSoftObjects int64 `env:"QUOTA_SOFT_OBJECTS"`
+	QuotaHardSize    int64 `env:"QUOTA_HARD_SIZE"`
+	QuotaHardObjects int64 `env:"QUOTA_HARD_OBJECTS"`
 
-	StorageEncryptionKey string `env:"STORAGE_ENCRYPTION_KEY,required"`
+	ValidationRulesFilepath string `env:"VALIDATION_RULES_FILEPATH"`
+
+	OutboxFilepath      string        `env:"OUTBOX_FILEPATH" envDefault:"/data/localStorageOutbox.db"`
+	OutboxRelayInterval time.Duration `env:"OUTBOX_RELAY_INTERVAL" envDefault:"10s"`
+	OutboxDepthWarning  int           `env:"OUTBOX_DEPTH_WARNING" envDefault:"1000"`
+
+	EventTransport         string        `env:"EVENT_TRANSPORT" envDefault:"stan"`
+	JetStreamStream        string        `env:"JETSTREAM_STREAM" envDefault:"storageSync"`
+	EventQueueFilepath     string        `env:"EVENT_QUEUE_FILEPATH" envDefault:"/data/eventQueue.db"`
+	EventQueuePollInterval time.Duration `env:"EVENT_QUEUE_POLL_INTERVAL" envDefault:"1s"`
 
 	NatsAddr           string        `env:"NATS_ADDR" envDefault:"localNats:4242"`
 	NatsClusterID      string        `env:"NATS_CLUSTER_ID" envDefault:"localNats"`
 	NatsClientID       string        `env:"NATS_CLIENT_ID" envDefault:"localStorage"`
 	NatsUsername       string        `env:"NATS_USERNAME" envDefault:"nats"`
-	NatsSecret         string        `env:"NATS_SECRET,required"`
+	NatsSecret         string        `env:"NATS_SECRET"`
 	NatsConnRetries    int           `env:"NATS_CONN_RETRIES" envDefault:"5"`
 	NatsConnWait       time.Duration `env:"NATS_CONN_WAIT" envDefault:"500ms"`
 	NatsConnWaitFactor float32       `env:"NATS_CONN_WAIT_FACTOR" envDefault:"3.0"`
@@ -37,6 +74,29 @@ func GetConfig() (*Config, error) {
 	}
 
 	cfg := &Config{Config: *common}
+	if err := env.Parse(cfg); err != nil {
+		return nil, err
+	}
+
+	switch cfg.StorageBackend {
+	case storageBackendS3:
+		if cfg.S3Secret == "" {
+			return nil, errors.New("S3_SECRET is required for s3 storage backend")
+		}
+	case storageBackendFilesystem:
+	default:
+		return nil, errors.Errorf("unknown storage backend %s", cfg.StorageBackend)
+	}
+
+	switch cfg.EventTransport {
+	case eventTransportStan, eventTransportJetStream:
+		if cfg.NatsSecret == "" {
+			return nil, errors.Errorf("NATS_SECRET is required for %s event transport", cfg.EventTransport)
+		}
+	case eventTransportBolt:
+	default:
+		return nil, errors.Errorf("unknown event transport %s", cfg.EventTransport)
+	}
 
-	return cfg, env.Parse(cfg)
+	return cfg, nil
 }
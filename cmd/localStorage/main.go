@@ -16,8 +16,6 @@ import (
 
 	loads "github.com/go-openapi/loads"
 	flags "github.com/jessevdk/go-flags"
-	"github.com/nats-io/go-nats"
-	"github.com/nats-io/go-nats-streaming"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/cors"
 	"github.com/rs/zerolog"
@@ -31,8 +29,10 @@ import (
 	"github.com/iryonetwork/wwm/service/authorizer"
 	storage "github.com/iryonetwork/wwm/service/storage"
 	statusServer "github.com/iryonetwork/wwm/status/server"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
 	"github.com/iryonetwork/wwm/storage/s3"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/outbox"
 	"github.com/iryonetwork/wwm/sync/storage/publisher"
 	"github.com/iryonetwork/wwm/utils"
 	"github.com/iryonetwork/wwm/utils/keyProvider"
@@ -66,75 +66,96 @@ func main() {
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to decode storage encryption key")
 	}
-	keys := keyProvider.New(string(key))
+	var keys s3.KeyProvider = keyProvider.New(string(key))
+	if cfg.StorageKeyringFilepath != "" {
+		// derive per bucket keys from the keyring, the encryption key is used for objects written before keyring was introduced
+		keys, err = keyProvider.NewKeyring(cfg.StorageKeyringFilepath, string(key))
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize storage keyring")
+		}
+	}
 
 	// initialize storage
-	s3cfg := &s3.Config{
-		Endpoint:     cfg.S3Endpoint,
-		AccessKey:    cfg.S3AccessKey,
-		AccessSecret: cfg.S3Secret,
-		Secure:       true,
-		Region:       cfg.S3Region,
+	var s s3.Storage
+	switch cfg.StorageBackend {
+	case storageBackendFilesystem:
+		s, err = s3.NewFilesystem(cfg.StorageFilesystemRoot, keys, logger)
+	default:
+		s3cfg := &s3.Config{
+			Endpoint:     cfg.S3Endpoint,
+			AccessKey:    cfg.S3AccessKey,
+			AccessSecret: cfg.S3Secret,
+			Secure:       true,
+			Region:       cfg.S3Region,
+		}
+		s, err = s3.New(s3cfg, keys, logger)
 	}
-	s3, err := s3.New(s3cfg, keys, logger)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	// initialize storageSync publisher
-	// create nats/nats-streaming connection
-	URLs := fmt.Sprintf("tls://%s:%s@%s", cfg.NatsUsername, cfg.NatsSecret, cfg.NatsAddr)
-	ClusterID := cfg.NatsClusterID
-	ClientID := cfg.NatsClientID
-	ClientCert := cfg.CertPath
-	ClientKey := cfg.KeyPath
-	var nc *nats.Conn
-	var sc publisher.StanConnection
+	// connect to the event transport
 	var p storageSync.Publisher
-
-	// Connect to NATS
-	// retry connectng to nats if unsuccesful
-	err = utils.Retry(cfg.NatsConnRetries, cfg.NatsConnWait, cfg.NatsConnWaitFactor, logger.With().Str("connect", "nats").Logger(), func() error {
-		var err error
-		nc, err = nats.Connect(URLs, nats.ClientCert(ClientCert, ClientKey))
-		return err
-	})
-
-	// Connect to NATS-Streaming if NATS connection succesful
-	if err == nil {
-		// retry connecting to nats-straming if unsuccesful
-		err = utils.Retry(cfg.NatsConnRetries, cfg.NatsConnWait, cfg.NatsConnWaitFactor, logger.With().Str("connect", "nats-streaming").Logger(), func() error {
-			var err error
-			sc, err = stan.Connect(ClusterID, ClientID, stan.NatsConn(nc))
-			return err
-		})
-	}
-
-	// Initialize publisher
+	t, err := newTransport(cfg, logger)
 	if err != nil {
-		// if connection to nats-streaming was unsuccesful use null publisher
-		p = publisher.NewNullPublisher(context.Background())
-		logger.Error().Msg("storage service will be started with null storage sync publisher due to failed nats-streaming connection attempts")
+		// if connection to event transport was unsuccesful events are kept in outbox until restart
+		logger.Error().Err(err).Msgf("storage sync events will be kept in outbox due to failed %s connection attempts", cfg.EventTransport)
 	} else {
-		// if connection to nats-streaming was succesful use nats-streaming publisher
+		// if connection to event transport was succesful use publisher
 		cfg := publisher.Cfg{
-			Connection:      sc,
+			Transport:       t,
 			Retries:         5,
 			StartRetryWait:  time.Duration(10 * time.Second),
 			RetryWaitFactor: 2.0,
 		}
 		p = publisher.New(context.Background(), cfg, logger)
-		// Register metrics
-		m := p.GetPrometheusMetricsCollection()
-		for _, metric := range m {
-			prometheus.MustRegister(metric)
-			defer prometheus.Unregister(metric)
-		}
 	}
-	defer p.Close()
+
+	// initialize outbox storing storageSync events until they are published
+	outboxCtx, cancelOutbox := context.WithCancel(context.Background())
+	defer cancelOutbox()
+	outboxStorage, err := keyvalue.NewBolt(outboxCtx, cfg.OutboxFilepath, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize outbox storage")
+	}
+	outboxCfg := outbox.Cfg{
+		Storage:         outboxStorage,
+		Publisher:       p,
+		RelayInterval:   cfg.OutboxRelayInterval,
+		StartRetryWait:  time.Second,
+		RetryWaitFactor: 2.0,
+		MaxRetryWait:    5 * time.Minute,
+		DepthWarning:    cfg.OutboxDepthWarning,
+		Check:           versionWritten(s),
+	}
+	o, err := outbox.New(outboxCtx, outboxCfg, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize outbox")
+	}
+	defer o.Close()
+	// Register metrics
+	for _, metric := range o.GetPrometheusMetricsCollection() {
+		prometheus.MustRegister(metric)
+		defer prometheus.Unregister(metric)
+	}
 
 	// initialize the servicex
-	service := storage.New(s3, keys, p, logger)
+	quotas := storage.Quotas{
+		SoftSize:    cfg.QuotaSoftSize,
+		SoftObjects: cfg.QuotaSoftObjects,
+		HardSize:    cfg.QuotaHardSize,
+		HardObjects: cfg.QuotaHardObjects,
+	}
+	var validator storage.Validator
+	if cfg.ValidationRulesFilepath != "" {
+		rules, err := storage.LoadValidationRules(cfg.ValidationRulesFilepath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to load validation rules")
+		}
+		validator = storage.NewValidator(rules)
+	}
+	service := storage.New(s, keys, o, cfg.UploadTTL, quotas, validator, logger)
 
 	// initialize authorizer
 	auth := authorizer.New(cfg.DomainType, cfg.DomainID, fmt.Sprintf("https://%s/%s/validate", cfg.AuthHost, cfg.AuthPath), logger.With().Str("component", "service/authorizer").Logger())
@@ -150,7 +171,7 @@ func main() {
 	server.TLSCertificateKey = flags.Filename(cfg.KeyPath)
 	server.TLSCertificate = flags.Filename(cfg.CertPath)
 
-	storageHandlers := storage.NewHandlers(service, logger)
+	storageHandlers := storage.NewHandlers(service, auth, logger)
 
 	serverLogger := logger.WithLevel(zerolog.InfoLevel).Str("component", "server")
 	api.Logger = serverLogger.Msgf
@@ -159,24 +180,41 @@ func main() {
 	api.FileListHandler = storageHandlers.FileList()
 	api.FileGetHandler = storageHandlers.FileGet()
 	api.FileGetVersionHandler = storageHandlers.FileGetVersion()
+	api.FilePreviewHandler = storageHandlers.FilePreview()
 	api.FileListVersionsHandler = storageHandlers.FileListVersions()
 	api.FileNewHandler = storageHandlers.FileNew()
 	api.FileUpdateHandler = storageHandlers.FileUpdate()
 	api.FileDeleteHandler = storageHandlers.FileDelete()
+	api.SyncFileMetadataHandler = storageHandlers.SyncFileMetadata()
+	api.SyncFileHandler = storageHandlers.SyncFile()
+	api.SyncFileDeleteHandler = storageHandlers.SyncFileDelete()
+	api.SyncBucketEvictHandler = storageHandlers.SyncBucketEvict()
 	api.SyncBucketListHandler = storageHandlers.SyncBucketList()
 	api.SyncFileListHandler = storageHandlers.SyncFileList()
 	api.SyncFileListVersionsHandler = storageHandlers.SyncFileListVersions()
+	api.UploadNewHandler = storageHandlers.UploadNew()
+	api.UploadGetHandler = storageHandlers.UploadGet()
+	api.UploadChunkHandler = storageHandlers.UploadChunk()
+	api.UploadFinalizeHandler = storageHandlers.UploadFinalize()
+	api.UploadDeleteHandler = storageHandlers.UploadDelete()
+	api.FileConflictsHandler = storageHandlers.FileConflicts()
+	api.FileResolveHandler = storageHandlers.FileResolve()
+	api.HoldBucketSetHandler = storageHandlers.HoldBucketSet()
+	api.HoldBucketReleaseHandler = storageHandlers.HoldBucketRelease()
+	api.HoldFileSetHandler = storageHandlers.HoldFileSet()
+	api.HoldFileReleaseHandler = storageHandlers.HoldFileRelease()
+	api.BucketUsageHandler = storageHandlers.BucketUsage()
 
 	api.RegisterConsumer("*/*", &WildcardConsumer{})
 
 	// initialize metrics middleware
 	m := APIMetrics.NewMetrics("api", "").
-		WithURLSanitize(utils.WhitelistURLSanitize([]string{"storage", "versions", "sync"}))
+		WithURLSanitize(utils.WhitelistURLSanitize([]string{"storage", "versions", "sync", "uploads", "holds"}))
 
 	// set API handler with middlewares
 	handler := cors.New(cors.Options{
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "Range", "If-None-Match"},
 	}).Handler(api.Serve(nil))
 	handler = logMW.APILogMiddleware(handler, logger)
 	handler = m.Middleware(handler)
@@ -194,8 +232,23 @@ func main() {
 	// start serving status
 	go func() {
 		ss := statusServer.New(logger)
+		ss.AddComponent("storageSyncOutbox", o)
 		exitCh <- ss.ListenAndServeHTTPs(ctx, fmt.Sprintf("%s:%d", cfg.ServerHost, cfg.StatusPort), cfg.StatusNamespace, cfg.CertPath, cfg.KeyPath)
 	}()
+	// remove expired uploads periodically
+	go func() {
+		ticker := time.NewTicker(cfg.UploadGCInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				errorChecker.LogError(service.UploadCollectGarbage(ctx))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 	// start serving API
 	go func() {
 		defer func() {
@@ -250,6 +303,27 @@ func main() {
 	}
 }
 
+// versionWritten returns function reporting whether the file version of the storage sync event was written, events
+// recorded before writes that did not finish are discarded
+func versionWritten(s s3.Storage) outbox.CheckFunc {
+	return func(ctx context.Context, _ storageSync.EventType, f *storageSync.FileInfo) (bool, error) {
+		files, err := s.List(ctx, f.BucketID, f.FileID)
+		if err == s3.ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, fd := range files {
+			if fd.Name == f.FileID && fd.Version == f.Version {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+}
+
 type WildcardConsumer struct{}
 
 func (w *WildcardConsumer) Consume(r io.Reader, in interface{}) error {
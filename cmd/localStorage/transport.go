@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nats-io/go-nats"
+	"github.com/nats-io/go-nats-streaming"
+	jetStream "github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/transport"
+	"github.com/iryonetwork/wwm/utils"
+)
+
+// newTransport connects to the event transport selected in the config
+func newTransport(cfg *Config, logger zerolog.Logger) (transport.Transport, error) {
+	if cfg.EventTransport == eventTransportBolt {
+		return transport.NewBolt(cfg.EventQueueFilepath, cfg.EventQueuePollInterval, logger)
+	}
+
+	URLs := fmt.Sprintf("tls://%s:%s@%s", cfg.NatsUsername, cfg.NatsSecret, cfg.NatsAddr)
+	ClusterID := cfg.NatsClusterID
+	ClientID := cfg.NatsClientID
+	ClientCert := cfg.CertPath
+	ClientKey := cfg.KeyPath
+
+	if cfg.EventTransport == eventTransportJetStream {
+		var nc *jetStream.Conn
+		// retry connecting to nats if unsuccesful
+		err := utils.Retry(cfg.NatsConnRetries, cfg.NatsConnWait, cfg.NatsConnWaitFactor, logger.With().Str("connect", "nats").Logger(), func() error {
+			var err error
+			nc, err = jetStream.Connect(URLs, jetStream.ClientCert(ClientCert, ClientKey))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		subjects := []string{string(storageSync.FileNew), string(storageSync.FileUpdate), string(storageSync.FileDelete)}
+		t, err := transport.NewJetStream(nc, cfg.JetStreamStream, subjects)
+		if err != nil {
+			nc.Close()
+		}
+		return t, err
+	}
+
+	var nc *nats.Conn
+	var sc stan.Conn
+
+	// retry connecting to nats if unsuccesful
+	err := utils.Retry(cfg.NatsConnRetries, cfg.NatsConnWait, cfg.NatsConnWaitFactor, logger.With().Str("connect", "nats").Logger(), func() error {
+		var err error
+		nc, err = nats.Connect(URLs, nats.ClientCert(ClientCert, ClientKey))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// retry connecting to nats-streaming if unsuccesful
+	err = utils.Retry(cfg.NatsConnRetries, cfg.NatsConnWait, cfg.NatsConnWaitFactor, logger.With().Str("connect", "nats-streaming").Logger(), func() error {
+		var err error
+		sc, err = stan.Connect(ClusterID, ClientID, stan.NatsConn(nc))
+		return err
+	})
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return transport.NewStan(sc), nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/caarlos0/env"
+)
+
+// Config represents configuration of storageKeyRotate
+type Config struct {
+	S3Endpoint  string `env:"S3_ENDPOINT" envDefault:"localMinio:9000"`
+	S3AccessKey string `env:"S3_ACCESS_KEY" envDefault:"local"`
+	S3Region    string `env:"S3_REGION" envDefault:"us-east-1"`
+	S3Secret    string `env:"S3_SECRET,required"`
+
+	StorageEncryptionKey   string `env:"STORAGE_ENCRYPTION_KEY,required"`
+	StorageKeyringFilepath string `env:"STORAGE_KEYRING_FILEPATH,required"`
+
+	BoltDBFilepath               string `env:"BOLT_DB_FILEPATH" envDefault:"/data/storageKeyRotate.db"`
+	PrometheusPushGatewayAddress string `env:"PROMETHEUS_PUSH_GATEWAY_ADDRESS" envDefault:"http://localPrometheusPushGateway:9091"`
+}
+
+// GetConfig parses environment variables and returns pointer to config and error
+func GetConfig() (*Config, error) {
+	cfg := &Config{}
+
+	return cfg, env.Parse(cfg)
+}
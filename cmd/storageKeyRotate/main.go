@@ -0,0 +1,119 @@
+// storageKeyRotate is a command re-encrypting all files in S3 storage with the current key version from the keyring
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/storage/s3/keyRotation"
+	"github.com/iryonetwork/wwm/utils/keyProvider"
+)
+
+func main() {
+	// initialize logger
+	logger := zerolog.New(os.Stdout).With().
+		Timestamp().
+		Str("service", "storageKeyRotate").
+		Logger()
+
+	// Create context with cancel func
+	ctx, cancelContext := context.WithCancel(context.Background())
+	defer cancelContext()
+
+	// get config
+	cfg, err := GetConfig()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to get config")
+	}
+
+	// initialize promethues metrics registry
+	metricsRegistry := prometheus.NewRegistry()
+
+	// initialize keyring
+	key, err := base64.StdEncoding.DecodeString(cfg.StorageEncryptionKey)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to decode storage encryption key")
+	}
+	keys, err := keyProvider.NewKeyring(cfg.StorageKeyringFilepath, string(key))
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize storage keyring")
+	}
+
+	// initialize storage
+	s3cfg := &s3.Config{
+		Endpoint:     cfg.S3Endpoint,
+		AccessKey:    cfg.S3AccessKey,
+		AccessSecret: cfg.S3Secret,
+		Secure:       true,
+		Region:       cfg.S3Region,
+	}
+	storage, err := s3.New(s3cfg, keys, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize storage")
+	}
+
+	// initialize bolt key value storage to keep rotation checkpoints
+	checkpoints, err := keyvalue.NewBolt(ctx, cfg.BoltDBFilepath, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize key value storage")
+	}
+	// get metrics collection for key value storage and register in registry
+	m := checkpoints.GetPrometheusMetricsCollection()
+	for _, metric := range m {
+		metricsRegistry.MustRegister(metric)
+	}
+
+	// initialize key rotation
+	r := keyRotation.New(storage, keys, checkpoints, logger)
+
+	// get prometheus metrics collection for key rotation and register in registry
+	m = r.GetPrometheusMetricsCollection()
+	for _, metric := range m {
+		metricsRegistry.MustRegister(metric)
+	}
+
+	// initialize prometheus metrics pusher
+	metricsPusher := push.New(cfg.PrometheusPushGatewayAddress, "storageKeyRotate").Gatherer(metricsRegistry)
+
+	// Run rotation
+	exitCh := make(chan error)
+	go func() {
+		exitCh <- r.Rotate(ctx)
+	}()
+
+	// Run cleanup when sigint or sigterm is received
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+
+Loop:
+	for {
+		select {
+		case err := <-exitCh:
+			if err != nil {
+				logger.Error().Err(err).Msg("key rotation failed, run the command again to resume")
+			} else {
+				logger.Info().Msg("key rotation successfull")
+			}
+			break Loop
+		case <-signalChan:
+			logger.Info().Msg("stopping key rotation due to interrupt, run the command again to resume")
+			cancelContext()
+			break Loop
+		}
+	}
+
+	// push metrics to the push gateway
+	err = metricsPusher.Add()
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to push metrics to push gateway")
+	}
+}
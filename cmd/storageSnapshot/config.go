@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/caarlos0/env"
+	"github.com/pkg/errors"
+)
+
+// storage backends
+const (
+	storageBackendS3         = "s3"
+	storageBackendFilesystem = "filesystem"
+)
+
+// Config represents configuration of storageSnapshot
+type Config struct {
+	StorageBackend        string `env:"STORAGE_BACKEND" envDefault:"s3"`
+	StorageFilesystemRoot string `env:"STORAGE_FILESYSTEM_ROOT" envDefault:"/data/storage"`
+
+	S3Endpoint  string `env:"S3_ENDPOINT" envDefault:"localMinio:9000"`
+	S3AccessKey string `env:"S3_ACCESS_KEY" envDefault:"local"`
+	S3Region    string `env:"S3_REGION" envDefault:"us-east-1"`
+	S3Secret    string `env:"S3_SECRET"`
+
+	StorageEncryptionKey   string `env:"STORAGE_ENCRYPTION_KEY,required"`
+	StorageKeyringFilepath string `env:"STORAGE_KEYRING_FILEPATH"`
+
+	SnapshotKey string `env:"SNAPSHOT_KEY,required"`
+
+	OutboxFilepath string `env:"OUTBOX_FILEPATH"`
+}
+
+// GetConfig parses environment variables and returns pointer to config and error
+func GetConfig() (*Config, error) {
+	cfg := &Config{}
+	if err := env.Parse(cfg); err != nil {
+		return nil, err
+	}
+
+	switch cfg.StorageBackend {
+	case storageBackendS3:
+		if cfg.S3Secret == "" {
+			return nil, errors.New("S3_SECRET is required for s3 storage backend")
+		}
+	case storageBackendFilesystem:
+	default:
+		return nil, errors.Errorf("unknown storage backend %s", cfg.StorageBackend)
+	}
+
+	return cfg, nil
+}
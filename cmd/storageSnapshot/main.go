@@ -0,0 +1,168 @@
+// storageSnapshot is a command exporting a bucket from storage into an encrypted archive and importing it back
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/service/storage"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/storage/s3/snapshot"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/outbox"
+	"github.com/iryonetwork/wwm/sync/storage/publisher"
+	"github.com/iryonetwork/wwm/utils/keyProvider"
+)
+
+func main() {
+	// initialize logger
+	logger := zerolog.New(os.Stdout).With().
+		Timestamp().
+		Str("service", "storageSnapshot").
+		Logger()
+
+	// Create context with cancel func
+	ctx, cancelContext := context.WithCancel(context.Background())
+	defer cancelContext()
+
+	// get config
+	cfg, err := GetConfig()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to get config")
+	}
+
+	// parse flags
+	exportBucket := flag.String("export", "", "ID of the bucket to export")
+	importArchive := flag.Bool("import", false, "import the archive")
+	archivePath := flag.String("archive", "", "path to the archive")
+	flag.Parse()
+	if *archivePath == "" || (*exportBucket == "") == !*importArchive {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// initialize keyProvider
+	key, err := base64.StdEncoding.DecodeString(cfg.StorageEncryptionKey)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to decode storage encryption key")
+	}
+	var keys s3.KeyProvider = keyProvider.New(string(key))
+	if cfg.StorageKeyringFilepath != "" {
+		keys, err = keyProvider.NewKeyring(cfg.StorageKeyringFilepath, string(key))
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize storage keyring")
+		}
+	}
+
+	// initialize storage
+	var s s3.Storage
+	switch cfg.StorageBackend {
+	case storageBackendFilesystem:
+		s, err = s3.NewFilesystem(cfg.StorageFilesystemRoot, keys, logger)
+	default:
+		s3cfg := &s3.Config{
+			Endpoint:     cfg.S3Endpoint,
+			AccessKey:    cfg.S3AccessKey,
+			AccessSecret: cfg.S3Secret,
+			Secure:       true,
+			Region:       cfg.S3Region,
+		}
+		s, err = s3.New(s3cfg, keys, logger)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize storage")
+	}
+
+	// initialize snapshots
+	snapshotKey, err := base64.StdEncoding.DecodeString(cfg.SnapshotKey)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to decode snapshot key")
+	}
+	snapshots, err := snapshot.New(s, snapshotKey, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize snapshots")
+	}
+
+	// initialize publisher of storage sync events of imported versions; events are stored in the outbox of
+	// local storage and published once it's started
+	var p storageSync.Publisher = publisher.NewNullPublisher(ctx)
+	if *importArchive && cfg.OutboxFilepath != "" {
+		outboxStorage, err := keyvalue.NewBolt(ctx, cfg.OutboxFilepath, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize outbox storage")
+		}
+		o, err := outbox.New(ctx, outbox.Cfg{Storage: outboxStorage}, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize outbox")
+		}
+		defer o.Close()
+		p = o
+	}
+
+	// Run export or import
+	exitCh := make(chan error)
+	go func() {
+		if *importArchive {
+			// archive is replayed with sync operations of the storage service, events are published by the import
+			exitCh <- importSnapshot(ctx, snapshots, storage.New(s, keys, nil, 0, storage.Quotas{}, nil, logger), p, *archivePath)
+		} else {
+			exitCh <- exportSnapshot(ctx, snapshots, *exportBucket, *archivePath)
+		}
+	}()
+
+	// Run cleanup when sigint or sigterm is received
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-exitCh:
+		if err != nil {
+			logger.Fatal().Err(err).Msg("snapshot failed")
+		}
+		logger.Info().Msg("snapshot successfull")
+	case <-signalChan:
+		logger.Info().Msg("stopping snapshot due to interrupt")
+		cancelContext()
+		<-exitCh
+		os.Exit(1)
+	}
+}
+
+func exportSnapshot(ctx context.Context, snapshots snapshot.Snapshots, bucketID, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = snapshots.Export(ctx, bucketID, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// don't leave incomplete archive behind
+		os.Remove(path)
+	}
+
+	return err
+}
+
+func importSnapshot(ctx context.Context, snapshots snapshot.Snapshots, target snapshot.Syncer, p storageSync.Publisher, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = snapshots.Import(ctx, f, target, p)
+	return err
+}
@@ -4,28 +4,54 @@ import (
 	"time"
 
 	"github.com/caarlos0/env"
+	"github.com/pkg/errors"
 
 	"github.com/iryonetwork/wwm/config"
 )
 
+// event transports
+const (
+	eventTransportStan      = "stan"
+	eventTransportJetStream = "jetstream"
+	eventTransportBolt      = "bolt"
+)
+
 // Config represents configuration of storageSync
 type Config struct {
 	config.Config
 
 	BucketsToSkip []string `env:"BUCKETS_TO_SKIP" envSeparator:"," envDefault:"c8220891-c582-41a3-893d-19e211985db5"`
 
-	CloudStorageHost   string        `env:"CLOUD_STORAGE_HOST" envDefault:"cloudStorage"`
-	CloudStoragePath   string        `env:"CLOUD_STORAGE_PATH" envDefault:"storage"`
+	CloudStorageHost       string        `env:"CLOUD_STORAGE_HOST" envDefault:"cloudStorage"`
+	CloudStoragePath       string        `env:"CLOUD_STORAGE_PATH" envDefault:"storage"`
+	EventTransport         string        `env:"EVENT_TRANSPORT" envDefault:"stan"`
+	JetStreamStream        string        `env:"JETSTREAM_STREAM" envDefault:"storageSync"`
+	EventQueueFilepath     string        `env:"EVENT_QUEUE_FILEPATH" envDefault:"/data/eventQueue.db"`
+	EventQueuePollInterval time.Duration `env:"EVENT_QUEUE_POLL_INTERVAL" envDefault:"1s"`
+
 	NatsAddr           string        `env:"NATS_ADDR" envDefault:"localNats:4242"`
 	NatsClusterID      string        `env:"NATS_CLUSTER_ID" envDefault:"localNats"`
 	NatsClientID       string        `env:"NATS_CLIENT_ID" envDefault:"storageSync"`
 	NatsUsername       string        `env:"NATS_USERNAME" envDefault:"nats"`
-	NatsSecret         string        `env:"NATS_SECRET,required"`
+	NatsSecret         string        `env:"NATS_SECRET"`
 	NatsConnRetries    int           `env:"NATS_CONN_RETRIES" envDefault:"10"`
 	NatsConnWait       time.Duration `env:"NATS_CONN_WAIT" envDefault:"500ms"`
 	NatsConnWaitFactor float32       `env:"NATS_CONN_WAIT_FACTOR" envDefault:"3.0"`
 	AckWait            time.Duration `env:"ACK_WAIT" envDefault:"10000ms"`
 	MaxInflight        int           `env:"MAX_INFLIGHT" envDefault:"10"`
+
+	DeadLetterFilepath    string `env:"DEAD_LETTER_FILEPATH" envDefault:"/data/storageSyncDeadLetters.db"`
+	DeadLetterMaxAttempts int    `env:"DEAD_LETTER_MAX_ATTEMPTS" envDefault:"50"`
+
+	PullInterval                time.Duration `env:"PULL_INTERVAL" envDefault:"0"`
+	PullBucketsRateLimit        int           `env:"PULL_BUCKETS_RATE_LIMIT" envDefault:"2"`
+	PullFilesPerBucketRateLimit int           `env:"PULL_FILES_PER_BUCKET_RATE_LIMIT" envDefault:"3"`
+	PullBoltDBFilepath          string        `env:"PULL_BOLT_DB_FILEPATH" envDefault:"/data/storageSyncPull.db"`
+	PullScheduleRulesFilepath   string        `env:"PULL_SCHEDULE_RULES_FILEPATH"`
+	LocationID                  string        `env:"LOCATION_ID"`
+	EvictOnUnlink               bool          `env:"EVICT_ON_UNLINK" envDefault:"false"`
+	DiscoveryHost               string        `env:"DISCOVERY_HOST" envDefault:"localDiscovery"`
+	DiscoveryPath               string        `env:"DISCOVERY_PATH" envDefault:"discovery"`
 }
 
 // GetConfig parses environment variables and returns pointer to config and error
@@ -36,6 +62,23 @@ func GetConfig() (*Config, error) {
 	}
 
 	cfg := &Config{Config: *common}
+	if err := env.Parse(cfg); err != nil {
+		return nil, err
+	}
+
+	switch cfg.EventTransport {
+	case eventTransportStan, eventTransportJetStream:
+		if cfg.NatsSecret == "" {
+			return nil, errors.Errorf("NATS_SECRET is required for %s event transport", cfg.EventTransport)
+		}
+	case eventTransportBolt:
+	default:
+		return nil, errors.Errorf("unknown event transport %s", cfg.EventTransport)
+	}
+
+	if cfg.PullInterval > 0 && cfg.LocationID == "" {
+		return nil, errors.New("LOCATION_ID is required to pull from cloud storage")
+	}
 
-	return cfg, env.Parse(cfg)
+	return cfg, nil
 }
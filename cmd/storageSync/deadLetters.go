@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/deadLetter"
+)
+
+// dead letter commands
+const (
+	deadLettersList    = "list"
+	deadLettersShow    = "show"
+	deadLettersReplay  = "replay"
+	deadLettersDiscard = "discard"
+	// allDeadLetters is the ID selecting all the dead letters to replay or discard
+	allDeadLetters = "all"
+)
+
+// manageDeadLetters runs the dead letter command and writes its output
+func manageDeadLetters(ctx context.Context, store deadLetter.Store, handlers storageSync.Handlers, command, id string, out io.Writer) error {
+	switch command {
+	case deadLettersList:
+		entries, err := store.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tATTEMPTS\tLAST FAILED\tRESULT\tERROR")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", e.ID, e.Attempts, e.LastFailed.Format("2006-01-02T15:04:05Z"), e.Result, e.Error)
+		}
+		return w.Flush()
+	case deadLettersShow:
+		e, err := store.Get(id)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e)
+	case deadLettersReplay, deadLettersDiscard:
+		entries, err := selectDeadLetters(store, id)
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, e := range entries {
+			if command == deadLettersReplay {
+				if err := replay(ctx, store, handlers, e); err != nil {
+					failed++
+					fmt.Fprintf(out, "%s: replay failed, %v\n", e.ID, err)
+					continue
+				}
+				fmt.Fprintf(out, "%s: replayed\n", e.ID)
+				continue
+			}
+			if err := store.Remove(e.ID); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "%s: discarded\n", e.ID)
+		}
+		if failed > 0 {
+			return errors.Errorf("failed to replay %d of %d dead letters", failed, len(entries))
+		}
+		return nil
+	}
+
+	return errors.Errorf("unknown dead letters command %s", command)
+}
+
+// selectDeadLetters returns the dead letter with the ID or all of them
+func selectDeadLetters(store deadLetter.Store, id string) ([]*deadLetter.Entry, error) {
+	if id == allDeadLetters {
+		return store.List()
+	}
+
+	e, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*deadLetter.Entry{e}, nil
+}
+
+// replay handles the event again, the dead letter is removed if it succeeds and failure is recorded otherwise
+func replay(ctx context.Context, store deadLetter.Store, handlers storageSync.Handlers, e *deadLetter.Entry) error {
+	h := handlers.SyncFile
+	if e.Event == storageSync.FileDelete {
+		h = handlers.SyncFileDelete
+	}
+
+	result, err := h(ctx, e.File.BucketID, e.File.FileID, e.File.Version, e.File.Created)
+	if err != nil {
+		if _, ferr := store.Failed(e.Event, e.File, result, err); ferr != nil {
+			return ferr
+		}
+		return err
+	}
+
+	return store.Remove(e.ID)
+}
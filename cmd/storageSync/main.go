@@ -1,10 +1,12 @@
-// storageSync is a worker receiving messages from localStorage published to NATS to resiliently sync everything to cloudStorage
+// storageSync is a worker receiving messages from localStorage published to the event transport to resiliently sync everything to cloudStorage,
+// optionally it periodically pulls files of patients linked to the location from cloudStorage
 package main
 
 //go:generate sh -c "mkdir -p ../../gen/storage/ && swagger generate client -A storage -t ../../gen/storage/ -f ../../docs/api/storage.yml --principal string"
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -12,8 +14,6 @@ import (
 
 	runtimeClient "github.com/go-openapi/runtime/client"
 	"github.com/go-openapi/strfmt"
-	"github.com/nats-io/go-nats"
-	"github.com/nats-io/go-nats-streaming"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 
@@ -22,9 +22,13 @@ import (
 	metricsServer "github.com/iryonetwork/wwm/metrics/server"
 	"github.com/iryonetwork/wwm/service/serviceAuthenticator"
 	statusServer "github.com/iryonetwork/wwm/status/server"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
 	"github.com/iryonetwork/wwm/sync/storage/consumer"
+	"github.com/iryonetwork/wwm/sync/storage/deadLetter"
+	"github.com/iryonetwork/wwm/sync/storage/scheduler"
 	"github.com/iryonetwork/wwm/utils"
+	"github.com/iryonetwork/wwm/utils/contentEncoding"
 )
 
 func main() {
@@ -44,14 +48,25 @@ func main() {
 		logger.Fatal().Err(err).Msg("failed to get config")
 	}
 
+	// parse flags
+	deadLettersCommand := flag.String("deadLetters", "", "manage dead letters instead of running the service: list, show, replay or discard")
+	deadLetterID := flag.String("id", "", "ID of the dead letter to show, replay or discard, 'all' to replay or discard all of them")
+	flag.Parse()
+	if *deadLettersCommand != "" && *deadLettersCommand != deadLettersList && *deadLetterID == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// initialize local storage API client
 	local := runtimeClient.New(cfg.StorageHost, cfg.StoragePath, []string{"https"})
 	local.Consumers = utils.ConsumersForSync()
+	local.Transport = contentEncoding.Transport(local.Transport)
 	localClient := client.New(local, strfmt.Default)
 
 	// initialize cloud storage API client
 	cloud := runtimeClient.New(cfg.CloudStorageHost, cfg.CloudStoragePath, []string{"https"})
 	cloud.Consumers = utils.ConsumersForSync()
+	cloud.Transport = contentEncoding.Transport(cloud.Transport)
 	cloudClient := client.New(cloud, strfmt.Default)
 
 	// initialize request authenticator
@@ -61,43 +76,36 @@ func main() {
 	}
 
 	// initialize handlers
-	handlers := storageSync.NewHandlers(localClient.Operations, auth, cloudClient.Operations, auth, logger)
-
-	// create nats/nats-streaming connection
-	URLs := fmt.Sprintf("tls://%s:%s@%s", cfg.NatsUsername, cfg.NatsSecret, cfg.NatsAddr)
-	ClusterID := cfg.NatsClusterID
-	ClientID := cfg.NatsClientID
-	ClientCert := cfg.CertPath
-	ClientKey := cfg.KeyPath
-	var nc *nats.Conn
-	var sc stan.Conn
-
-	// retry connection to nats if unsuccesful
-	err = utils.Retry(cfg.NatsConnRetries, cfg.NatsConnWait, cfg.NatsConnWaitFactor, logger.With().Str("connection", "nats").Logger(), func() error {
-		var err error
-		nc, err = nats.Connect(URLs, nats.ClientCert(ClientCert, ClientKey))
-		return err
-	})
+	handlers := storageSync.NewHandlers(localClient.Operations, auth, cfg.DomainID, cloudClient.Operations, auth, logger)
+
+	// initialize dead letter store
+	deadLetters, err := deadLetter.New(cfg.DeadLetterFilepath, cfg.DeadLetterMaxAttempts, logger)
 	if err != nil {
-		logger.Fatal().Msg("failed to connect to nats")
+		logger.Fatal().Err(err).Msg("failed to initialize dead letter store")
 	}
 
-	err = utils.Retry(cfg.NatsConnRetries, cfg.NatsConnWait, cfg.NatsConnWaitFactor, logger.With().Str("connection", "nats").Logger(), func() error {
-		var err error
-		sc, err = stan.Connect(ClusterID, ClientID, stan.NatsConn(nc))
-		return err
-	})
+	// run dead letters command
+	if *deadLettersCommand != "" {
+		if err := manageDeadLetters(ctx, deadLetters, handlers, *deadLettersCommand, *deadLetterID, os.Stdout); err != nil {
+			logger.Fatal().Err(err).Msgf("failed to %s dead letters", *deadLettersCommand)
+		}
+		return
+	}
+
+	// connect to the event transport
+	t, err := newTransport(cfg, logger)
 	if err != nil {
-		logger.Fatal().Msg("failed to connect to nats-streaming")
+		logger.Fatal().Err(err).Msgf("failed to connect to %s event transport", cfg.EventTransport)
 	}
 
 	// initalize consumer
 	consumerCfg := consumer.Cfg{
-		Connection:    sc,
+		Transport:     t,
 		AckWait:       cfg.AckWait,
 		MaxInflight:   cfg.MaxInflight,
 		BucketsToSkip: cfg.BucketsToSkip,
 		Handlers:      handlers,
+		DeadLetters:   deadLetters,
 	}
 	c := consumer.New(ctx, consumerCfg, logger)
 	// Register metrics
@@ -114,7 +122,43 @@ func main() {
 
 	// Start servers
 	// create exit channel that is used to wait for all servers goroutines to exit orderly and carry the errors
-	exitCh := make(chan error, 2)
+	goroutines := 2
+	if cfg.PullInterval > 0 {
+		goroutines++
+	}
+	exitCh := make(chan error, goroutines)
+
+	// start pulling from cloud storage
+	if cfg.PullInterval > 0 {
+		pullStorage, err := keyvalue.NewBolt(ctx, cfg.PullBoltDBFilepath, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize pull key value storage")
+		}
+		var pullScheduler scheduler.Scheduler
+		if cfg.PullScheduleRulesFilepath != "" {
+			rules, err := scheduler.LoadRules(cfg.PullScheduleRulesFilepath)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("failed to load pull scheduler rules")
+			}
+			pullScheduler, err = scheduler.New(rules, logger)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("failed to initialize pull scheduler")
+			}
+			for _, metric := range pullScheduler.GetPrometheusMetricsCollection() {
+				prometheus.MustRegister(metric)
+				defer prometheus.Unregister(metric)
+			}
+		}
+		pull := newPull(cfg, localClient, cloudClient, auth, pullStorage, pullScheduler, logger)
+		for _, metric := range pull.GetPrometheusMetricsCollection() {
+			prometheus.MustRegister(metric)
+			defer prometheus.Unregister(metric)
+		}
+
+		go func() {
+			exitCh <- runPull(ctx, pull, pullStorage, cfg.PullInterval, logger)
+		}()
+	}
 
 	// start serving metrics
 	go func() {
@@ -147,7 +191,7 @@ func main() {
 	}()
 
 	<-ctx.Done()
-	for i := 0; i < 2; i++ {
+	for i := 0; i < goroutines; i++ {
 		err := <-exitCh
 		if err != nil {
 			logger.Debug().Err(err).Msg(fmt.Sprintf("goroutine exit message: %v", err))
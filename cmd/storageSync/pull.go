@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-openapi/runtime"
+	runtimeClient "github.com/go-openapi/runtime/client"
+	"github.com/go-openapi/strfmt"
+	"github.com/rs/zerolog"
+
+	discoveryAPI "github.com/iryonetwork/wwm/gen/discovery/client"
+	"github.com/iryonetwork/wwm/gen/storage/client"
+	"github.com/iryonetwork/wwm/log/errorChecker"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/batch"
+	"github.com/iryonetwork/wwm/sync/storage/scheduler"
+	"github.com/iryonetwork/wwm/sync/storage/selective"
+)
+
+// newPull returns batch sync pulling buckets of patients linked to the location from cloud storage to local storage.
+// Cloud storage does not publish sync events so changes made there are pulled periodically. Scheduler is optional.
+func newPull(cfg *Config, local, cloud *client.Storage, auth runtime.ClientAuthInfoWriter, storage keyvalue.Storage, s scheduler.Scheduler, logger zerolog.Logger) storageSync.BatchSync {
+	handlers := storageSync.NewHandlers(cloud.Operations, auth, storageSync.CloudStorageID, local.Operations, auth, logger)
+
+	discovery := runtimeClient.New(cfg.DiscoveryHost, cfg.DiscoveryPath, []string{"https"})
+	discoveryClient := discoveryAPI.New(discovery, strfmt.Default)
+	patients := selective.DiscoveryPatients(discoveryClient.Operations, auth, cfg.LocationID)
+
+	pullCfg := batch.Cfg{
+		BucketsRateLimit:        cfg.PullBucketsRateLimit,
+		FilesPerBucketRateLimit: cfg.PullFilesPerBucketRateLimit,
+		BucketsToSkip:           cfg.BucketsToSkip,
+		Selector:                selective.New(patients, storage, logger),
+		EvictOnUnlink:           cfg.EvictOnUnlink,
+		Direction:               storageSync.CloudToLocal,
+		SkipSource:              cfg.DomainID,
+		SinceReceived:           true,
+		Checkpoints:             batch.NewCheckpoints(storage, storageSync.CloudToLocal),
+		Scheduler:               s,
+	}
+
+	return batch.New(handlers, pullCfg, logger)
+}
+
+// runPull pulls changes from cloud storage every interval until the context is cancelled. Start time of the
+// last successful pull is kept in the key value storage.
+func runPull(ctx context.Context, s storageSync.BatchSync, storage keyvalue.Storage, interval time.Duration, logger zerolog.Logger) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		startTime := time.Now()
+		err := s.Sync(ctx, batch.LastSuccessfulRun(storage, storageSync.CloudToLocal))
+		if err != nil {
+			logger.Error().Err(err).Msg("pull from cloud storage failed")
+		} else {
+			logger.Info().Msg("pull from cloud storage successfull")
+			errorChecker.LogError(batch.SaveSuccessfulRun(storage, storageSync.CloudToLocal, startTime))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -33,7 +33,7 @@ func (h *handlers) ExportFile(ctx context.Context, bucketID, fileID, version str
 		WithFileID(fileID).
 		WithVersion(version).
 		WithContext(ctx)
-	_, err := h.source.FileGetVersion(getParams, h.sourceAuth, &buf)
+	_, _, err := h.source.FileGetVersion(getParams, h.sourceAuth, &buf)
 
 	if err != nil {
 		if _, ok := err.(*operations.FileGetVersionNotFound); ok {
@@ -31,6 +31,10 @@ type Service interface {
 
 	// GetPrincipalFromToken returns user ID parsed from token
 	GetPrincipalFromToken(tokenString string) (*string, error)
+
+	// AuthorizeResource checks if logged in user has permission to do the action on the resource that is not
+	// derived from the request path, e.g. to guard an operation requiring a privileged role
+	AuthorizeResource(request *http.Request, resource string, action int64) error
 }
 
 type authorizer struct {
@@ -89,81 +93,84 @@ const (
 
 // Authorizer checks if logged in user has permission to do a request
 func (a *authorizer) Authorizer() runtime.Authorizer {
-	logger := a.logger.With().Str("cmd", "Authorizer").Logger()
 	return runtime.AuthorizerFunc(func(request *http.Request, principal interface{}) error {
-		action := methodToAction(request.Method)
-		resource := "/api" + request.URL.EscapedPath()
-		pairs := []*models.ValidationPair{
-			{
-				DomainType: &a.domainType,
-				DomainID:   &a.domainID,
-				Actions:    &action,
-				Resource:   &resource,
-			},
-		}
-		logger.Debug().Str("resource", resource).Msg("Authorizing...")
+		return a.AuthorizeResource(request, "/api"+request.URL.EscapedPath(), methodToAction(request.Method))
+	})
+}
 
-		body, err := swag.WriteJSON(pairs)
-		if err != nil {
-			logger.Error().Err(err).Msg("WriteJSON failed")
-			return err
-		}
+// AuthorizeResource checks if logged in user has permission to do the action on the resource
+func (a *authorizer) AuthorizeResource(request *http.Request, resource string, action int64) error {
+	logger := a.logger.With().Str("cmd", "Authorizer").Logger()
+	pairs := []*models.ValidationPair{
+		{
+			DomainType: &a.domainType,
+			DomainID:   &a.domainID,
+			Actions:    &action,
+			Resource:   &resource,
+		},
+	}
+	logger.Debug().Str("resource", resource).Msg("Authorizing...")
 
-		r, err := http.NewRequest(http.MethodPost, a.validateURL, bytes.NewBuffer(body))
-		if err != nil {
-			logger.Error().Err(err).Msg("Initializing request failed")
-			return err
-		}
-		r.Header.Add("Authorization", request.Header.Get("Authorization"))
-		r.Header.Add("Content-Type", "application/json")
+	body, err := swag.WriteJSON(pairs)
+	if err != nil {
+		logger.Error().Err(err).Msg("WriteJSON failed")
+		return err
+	}
 
-		transport := &http.Transport{}
-		netClient := &http.Client{
-			Transport: transport,
-			Timeout:   time.Second * 10,
-		}
+	r, err := http.NewRequest(http.MethodPost, a.validateURL, bytes.NewBuffer(body))
+	if err != nil {
+		logger.Error().Err(err).Msg("Initializing request failed")
+		return err
+	}
+	r.Header.Add("Authorization", request.Header.Get("Authorization"))
+	r.Header.Add("Content-Type", "application/json")
 
-		response, err := netClient.Do(r)
+	transport := &http.Transport{}
+	netClient := &http.Client{
+		Transport: transport,
+		Timeout:   time.Second * 10,
+	}
 
-		if err != nil {
-			logger.Error().Err(err).Msg("Making request failed")
-			return err
-		}
-		defer response.Body.Close()
+	response, err := netClient.Do(r)
+
+	if err != nil {
+		logger.Error().Err(err).Msg("Making request failed")
+		return err
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		logger.Error().Err(err).Msg("Reading response failed")
+		return err
+	}
 
-		responseBody, err := ioutil.ReadAll(response.Body)
+	if response.StatusCode == http.StatusOK {
+		validationResponse := []*models.ValidationResult{}
+		err := swag.ReadJSON(responseBody, &validationResponse)
 		if err != nil {
-			logger.Error().Err(err).Msg("Reading response failed")
+			logger.Error().Err(err).Msg("Parsing response failed")
 			return err
 		}
 
-		if response.StatusCode == http.StatusOK {
-			validationResponse := []*models.ValidationResult{}
-			err := swag.ReadJSON(responseBody, &validationResponse)
-			if err != nil {
-				logger.Error().Err(err).Msg("Parsing response failed")
-				return err
-			}
-
-			if validationResponse[0].Result == nil || !*validationResponse[0].Result {
-				logger.Debug().Msg(ErrUnauthorized)
-				return fmt.Errorf(ErrUnauthorized)
-			}
-
-			logger.Debug().Msg("Authorized successfully")
-			return nil
+		if validationResponse[0].Result == nil || !*validationResponse[0].Result {
+			logger.Debug().Msg(ErrUnauthorized)
+			return fmt.Errorf(ErrUnauthorized)
 		}
 
-		jsonError := &models.Error{}
-		err = jsonError.UnmarshalBinary(responseBody)
-		if err != nil {
-			logger.Error().Err(err).Msg("Parsing error response failed")
-			return err
-		}
+		logger.Debug().Msg("Authorized successfully")
+		return nil
+	}
 
-		logger.Error().Str("code", jsonError.Code).Str("errorMessage", jsonError.Message).Msg("Error authorizing")
-		return fmt.Errorf(jsonError.Message)
-	})
+	jsonError := &models.Error{}
+	err = jsonError.UnmarshalBinary(responseBody)
+	if err != nil {
+		logger.Error().Err(err).Msg("Parsing error response failed")
+		return err
+	}
+
+	logger.Error().Str("code", jsonError.Code).Str("errorMessage", jsonError.Message).Msg("Error authorizing")
+	return fmt.Errorf(jsonError.Message)
 }
 
 func methodToAction(method string) int64 {
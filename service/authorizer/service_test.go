@@ -193,3 +193,28 @@ func TestAuthorizer(t *testing.T) {
 	}
 
 }
+
+func TestAuthorizeResource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		body, _ := ioutil.ReadAll(r.Body)
+
+		pairs := []*models.ValidationPair{}
+		errorChecker.FatalTesting(t, swag.ReadJSON(body, &pairs))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `[{"result": %t}]`, *pairs[0].Resource == "/storage/legalHold" && *pairs[0].Actions == Update)
+	}))
+	defer ts.Close()
+
+	authorizer := New("domainType", "domainID", ts.URL, zerolog.New(os.Stdout))
+	req, _ := http.NewRequest(http.MethodPut, "/storage/holds/bucket", nil)
+
+	if err := authorizer.AuthorizeResource(req, "/storage/legalHold", Update); err != nil {
+		t.Errorf("AuthorizeResource(/storage/legalHold, %d) err = %s; expected no error", Update, err)
+	}
+	if err := authorizer.AuthorizeResource(req, "/storage/other", Update); err == nil || err.Error() != ErrUnauthorized {
+		t.Errorf("AuthorizeResource(/storage/other, %d) err = %v; expected error to be %s", Update, err, ErrUnauthorized)
+	}
+}
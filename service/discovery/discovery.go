@@ -48,6 +48,9 @@ type (
 		// ProxyUnlink calls Unlink on cloud instance
 		ProxyUnlink(patientID, locationID strfmt.UUID, authToken string) error
 
+		// LocationPatients returns IDs of patients linked to a location
+		LocationPatients(locationID strfmt.UUID) (models.PatientIDs, error)
+
 		// CodesGet returns matching codes
 		CodesGet(category, query, parentID, locale string) (models.Codes, error)
 
@@ -162,6 +165,10 @@ func (svc *service) ProxyUnlink(patientID, locationID strfmt.UUID, authToken str
 	return nil
 }
 
+func (svc *service) LocationPatients(locationID strfmt.UUID) (models.PatientIDs, error) {
+	return svc.storage.LocationPatients(locationID)
+}
+
 func (svc *service) CodesGet(category, query, parentID, locale string) (models.Codes, error) {
 	return svc.storage.CodesGet(category, query, parentID, locale)
 }
@@ -21,6 +21,7 @@ type Handlers interface {
 	ProxyLink() operations.LinkHandler
 	Unlink() operations.UnlinkHandler
 	ProxyUnlink() operations.UnlinkHandler
+	LocationPatients() operations.LocationPatientsHandler
 	CodesGet() operations.CodesGetHandler
 	CodeGet() operations.CodeGetHandler
 }
@@ -204,6 +205,20 @@ func (h *handlers) ProxyUnlink() operations.UnlinkHandler {
 	})
 }
 
+func (h *handlers) LocationPatients() operations.LocationPatientsHandler {
+	return operations.LocationPatientsHandlerFunc(func(params operations.LocationPatientsParams, principal *string) middleware.Responder {
+		ids, err := h.service.LocationPatients(params.LocationID)
+		if err != nil {
+			return operations.NewLocationPatientsInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		return operations.NewLocationPatientsOK().WithPayload(ids)
+	})
+}
+
 func (h *handlers) CodesGet() operations.CodesGetHandler {
 	return operations.CodesGetHandlerFunc(func(params operations.CodesGetParams, principal *string) middleware.Responder {
 		q := ""
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/utils"
+)
+
+// ErrNoConflict is returned when resolving file that is not in conflict
+var ErrNoConflict = errors.New("File is not in conflict")
+
+// ErrNotSibling is returned when the version chosen to resolve the conflict is not one of the sibling versions
+var ErrNotSibling = errors.New("Version is not one of the versions in conflict")
+
+// versionNode holds lineage of the file version
+type versionNode struct {
+	version   string
+	parents   []string
+	created   time.Time
+	operation string
+	checksum  string
+}
+
+func newVersionNode(fd *models.FileDescriptor) *versionNode {
+	return &versionNode{
+		version:   fd.Version,
+		parents:   fd.Parents,
+		created:   time.Time(fd.Created),
+		operation: fd.Operation,
+		checksum:  fd.Checksum,
+	}
+}
+
+// findSiblings returns versions of the file that no other version was derived from if they differ. Versions
+// written without parents or with parents that are not known are considered to be derived from the previous
+// version so that files written before versions were tracked keep the latest version.
+func findSiblings(nodes []*versionNode) []string {
+	if len(nodes) < 2 {
+		return nil
+	}
+
+	sorted := append([]*versionNode{}, nodes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].created.Equal(sorted[j].created) {
+			return sorted[i].version < sorted[j].version
+		}
+		return sorted[i].created.Before(sorted[j].created)
+	})
+
+	known := make(map[string]bool)
+	for _, n := range sorted {
+		known[n.version] = true
+	}
+	derived := make(map[string]bool)
+	for i, n := range sorted {
+		explicit := len(n.parents) > 0
+		for _, parent := range n.parents {
+			explicit = explicit && known[parent]
+		}
+		switch {
+		case explicit:
+			for _, parent := range n.parents {
+				derived[parent] = true
+			}
+		case i > 0:
+			derived[sorted[i-1].version] = true
+		}
+	}
+
+	var heads []*versionNode
+	for _, n := range sorted {
+		if !derived[n.version] {
+			heads = append(heads, n)
+		}
+	}
+
+	// concurrently written versions with the same contents don't conflict
+	for _, h := range heads {
+		if h.operation != heads[0].operation || h.checksum != heads[0].checksum {
+			siblings := make([]string, len(heads))
+			for i, h := range heads {
+				siblings[i] = h.version
+			}
+			return siblings
+		}
+	}
+
+	return nil
+}
+
+// flagSiblings flags listed versions of files that are in conflict
+func flagSiblings(versions []*models.FileDescriptor) {
+	b := newBucketIndex("")
+	for _, fd := range versions {
+		b.update(fd)
+	}
+	for _, fd := range versions {
+		b.flag(fd)
+	}
+}
+
+func (s *service) FileConflicts(ctx context.Context, bucketID string) ([]*models.FileDescriptor, error) {
+	exists, err := s.s3.BucketExists(ctx, bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("method", "FileConflicts").Str("bucket", bucketID).Msg("Failed to check if bucket exists")
+		return nil, err
+	}
+	if !exists {
+		return []*models.FileDescriptor{}, nil
+	}
+
+	return s.index.conflicts(bucketID, s.loadVersions(ctx, bucketID))
+}
+
+func (s *service) FileResolve(ctx context.Context, bucketID, fileID, version string, r io.Reader, contentType string, archetype string, labels []string) (*models.FileDescriptor, error) {
+	siblings, err := s.index.siblings(bucketID, fileID, s.loadVersions(ctx, bucketID))
+	if err != nil {
+		return nil, err
+	}
+	if len(siblings) == 0 {
+		return nil, ErrNoConflict
+	}
+
+	// get the latest version
+	start := time.Now()
+	_, old, err := s.s3.Read(ctx, bucketID, fileID, "")
+	s.logger.Info().Str("method", "FileResolve").Msgf("s3 read time %s", time.Since(start))
+
+	if err != nil {
+		return nil, err
+	}
+	if old.LegalHold {
+		return nil, ErrLegalHold
+	}
+
+	// contents of the chosen version are written again unless merged contents are provided
+	if r == nil {
+		if !utils.SliceContains(siblings, version) {
+			return nil, ErrNotSibling
+		}
+
+		start = time.Now()
+		rc, chosen, err := s.s3.Read(ctx, bucketID, fileID, version)
+		s.logger.Info().Str("method", "FileResolve").Msgf("s3 read time %s", time.Since(start))
+
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		if s3.Operation(chosen.Operation) == s3.Delete {
+			fd, err := s.writeDelete(ctx, bucketID, fileID, old, siblings)
+			if err == nil {
+				s.logger.Info().Str("method", "FileResolve").Str("bucket", bucketID).Str("file", fileID).Msg("Conflict resolved by deletion")
+			}
+			return fd, err
+		}
+		r, contentType, archetype, labels = rc, chosen.ContentType, chosen.Archetype, chosen.Labels
+	} else if contentType == "" {
+		contentType = old.ContentType
+	}
+
+	// spool the contents calculating the checksum
+	f, contents, err := s.spool(r)
+	if err != nil {
+		s.logger.Error().Err(err).Str("method", "FileResolve").Msg("Failed to spool file contents")
+		return nil, err
+	}
+	defer f.Close()
+
+	fd, err := s.writeUpdate(ctx, bucketID, fileID, old, siblings, f, contents, contentType, archetype, labels)
+	if err == nil {
+		s.logger.Info().Str("method", "FileResolve").Str("bucket", bucketID).Str("file", fileID).Msg("Conflict resolved")
+	}
+	return fd, err
+}
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/golang/mock/gomock"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/storage/s3/mock"
+	"github.com/iryonetwork/wwm/storage/s3/object"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	mockStorageSync "github.com/iryonetwork/wwm/sync/storage/mock"
+)
+
+var (
+	conflictV1 = &models.FileDescriptor{
+		Name: "FILE", Version: "V1", Created: time1, Checksum: "CHS1", Operation: "w", ContentType: "text/plain", Path: "BUCKET/FILE/V1",
+	}
+	conflictV2A = &models.FileDescriptor{
+		Name: "FILE", Version: "V2A", Created: time2, Checksum: "CHS2A", Operation: "w", ContentType: "text/plain", Path: "BUCKET/FILE/V2A", Parents: []string{"V1"},
+	}
+	conflictV2B = &models.FileDescriptor{
+		Name: "FILE", Version: "V2B", Created: time3, Checksum: "CHS2B", Operation: "w", ContentType: "text/plain", Path: "BUCKET/FILE/V2B", Parents: []string{"V1"},
+	}
+	conflictV2BDeleted = &models.FileDescriptor{
+		Name: "FILE", Version: "V2B", Created: time3, Operation: "d", ContentType: "text/plain", Path: "BUCKET/FILE/V2B", Parents: []string{"V1"},
+	}
+	conflictVersions = []*models.FileDescriptor{conflictV2B, conflictV1, conflictV2A}
+)
+
+func TestFindSiblings(t *testing.T) {
+	node := func(version string, created strfmt.DateTime, checksum string, parents ...string) *versionNode {
+		return &versionNode{version: version, created: time.Time(created), checksum: checksum, operation: "w", parents: parents}
+	}
+
+	testCases := []struct {
+		description string
+		nodes       []*versionNode
+		expected    []string
+	}{
+		{
+			"Single version",
+			[]*versionNode{node("V1", time1, "CHS1")},
+			nil,
+		},
+		{
+			"Versions without parents are linear",
+			[]*versionNode{node("V3", time3, "CHS3"), node("V1", time1, "CHS1"), node("V2", time2, "CHS2")},
+			nil,
+		},
+		{
+			"Versions derived from each other",
+			[]*versionNode{node("V1", time1, "CHS1"), node("V2", time2, "CHS2", "V1"), node("V3", time3, "CHS3", "V2")},
+			nil,
+		},
+		{
+			"Concurrent versions",
+			[]*versionNode{node("V2B", time3, "CHS2B", "V1"), node("V1", time1, "CHS1"), node("V2A", time2, "CHS2A", "V1")},
+			[]string{"V2A", "V2B"},
+		},
+		{
+			"Concurrent versions with the same contents",
+			[]*versionNode{node("V1", time1, "CHS1"), node("V2A", time2, "CHS2", "V1"), node("V2B", time3, "CHS2", "V1")},
+			nil,
+		},
+		{
+			"Concurrent update and delete",
+			[]*versionNode{node("V1", time1, "CHS1"), node("V2A", time2, "CHS2", "V1"), {version: "V2B", created: time.Time(time3), operation: "d", parents: []string{"V1"}}},
+			[]string{"V2A", "V2B"},
+		},
+		{
+			"Resolved conflict",
+			[]*versionNode{node("V1", time1, "CHS1"), node("V2A", time1, "CHS2A", "V1"), node("V2B", time2, "CHS2B", "V1"), node("V3", time3, "CHS2A", "V2A", "V2B")},
+			nil,
+		},
+		{
+			"Version with unknown parent is derived from the previous version",
+			[]*versionNode{node("V1", time1, "CHS1"), node("V3", time3, "CHS3", "V2")},
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			if out := findSiblings(test.nodes); !reflect.DeepEqual(out, test.expected) {
+				t.Errorf("Expected siblings to equal %v, got %v", test.expected, out)
+			}
+		})
+	}
+}
+
+func TestSyncFileConcurrentVersion(t *testing.T) {
+	svc, s, _, _, c := getTestService(t)
+	defer c()
+
+	written := *conflictV2B
+	gomock.InOrder(
+		s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
+		s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "V2B").Return(nil, nil, s3.ErrNotFound),
+		s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(&written, nil),
+		s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(conflictVersions, nil),
+	)
+
+	out, err := svc.SyncFile(context.TODO(), "BUCKET", "FILE", "V2B", strings.NewReader("contents"), "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug=", "text/plain", time3, "", nil, []string{"V1"}, "")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if !out.Conflict || !reflect.DeepEqual(out.Siblings, []string{"V2A", "V2B"}) {
+		t.Errorf("Expected version to be flagged as in conflict with V2A, got %+v", out)
+	}
+}
+
+func TestFileListVersionsConflict(t *testing.T) {
+	svc, s, _, _, c := getTestService(t)
+	defer c()
+
+	gomock.InOrder(
+		s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+		s.EXPECT().List(gomock.Any(), "BUCKET", "FILE").Return(copyDescriptors(conflictVersions), nil),
+	)
+
+	out, err := svc.FileListVersions(context.TODO(), "BUCKET", "FILE", nil, nil)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	for _, fd := range out {
+		if conflict := fd.Version != "V1"; fd.Conflict != conflict {
+			t.Errorf("Expected version %s conflict to be %t, got %t", fd.Version, conflict, fd.Conflict)
+		}
+	}
+}
+
+func TestFileConflicts(t *testing.T) {
+	svc, s, _, _, c := getTestService(t)
+	defer c()
+
+	gomock.InOrder(
+		s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+		s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(append(copyDescriptors(conflictVersions), file1V1, file1V2), nil),
+	)
+
+	out, err := svc.FileConflicts(context.TODO(), "BUCKET")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	expected := *conflictV2B
+	expected.Conflict = true
+	expected.Siblings = []string{"V2A", "V2B"}
+	if !reflect.DeepEqual(out, []*models.FileDescriptor{&expected}) {
+		t.Errorf("Expected conflicts to equal\n%+v\ngot\n%+v", []*models.FileDescriptor{&expected}, out)
+	}
+}
+
+func TestFileResolve(t *testing.T) {
+	resolution := &models.FileDescriptor{Name: "FILE", Version: "UUID", Created: strfmt.DateTime(time3), Operation: "w", Parents: []string{"V2A", "V2B"}}
+	resolutionNo := func(contentType string) *object.NewObjectInfo {
+		return &object.NewObjectInfo{
+			Checksum:    "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug=",
+			Size:        int64(8),
+			Created:     strfmt.DateTime(time3),
+			ContentType: contentType,
+			Version:     "UUID",
+			Name:        "FILE",
+			Operation:   "w",
+			Parents:     []string{"V2A", "V2B"},
+		}
+	}
+	held := *conflictV2B
+	held.LegalHold = true
+
+	testCases := []struct {
+		description   string
+		version       string
+		contents      string
+		contentType   string
+		calls         func(*mock.MockStorage, *mockStorageSync.MockPublisher)
+		expected      *models.FileDescriptor
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"File is not in conflict",
+			"V1",
+			"",
+			"",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) {
+				s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{conflictV1, conflictV2A}, nil)
+			},
+			nil,
+			withErrors,
+			ErrNoConflict,
+		},
+		{
+			"Chosen version is not sibling",
+			"V1",
+			"",
+			"",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) {
+				s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(conflictVersions, nil)
+				s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, conflictV2B, nil)
+			},
+			nil,
+			withErrors,
+			ErrNotSibling,
+		},
+		{
+			"File is under legal hold",
+			"V2A",
+			"",
+			"",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) {
+				s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(conflictVersions, nil)
+				s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, &held, nil)
+			},
+			nil,
+			withErrors,
+			ErrLegalHold,
+		},
+		{
+			"Chosen version",
+			"V2A",
+			"",
+			"",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) {
+				gomock.InOrder(
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(conflictVersions, nil),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, conflictV2B, nil),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "V2A").Return(ioutil.NopCloser(strings.NewReader("contents")), conflictV2A, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", resolutionNo("text/plain"), gomock.Any()).Return(resolution, nil),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, &storageSync.FileInfo{BucketID: "BUCKET", FileID: "FILE", Version: "UUID", Created: resolution.Created}).Return(nil),
+				)
+			},
+			resolution,
+			noErrors,
+			nil,
+		},
+		{
+			"Merged contents",
+			"",
+			"contents",
+			"text/markdown",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) {
+				gomock.InOrder(
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(conflictVersions, nil),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, conflictV2B, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", resolutionNo("text/markdown"), gomock.Any()).Return(resolution, nil),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, &storageSync.FileInfo{BucketID: "BUCKET", FileID: "FILE", Version: "UUID", Created: resolution.Created}).Return(nil),
+				)
+			},
+			resolution,
+			noErrors,
+			nil,
+		},
+		{
+			"Chosen deletion",
+			"V2B",
+			"",
+			"",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) {
+				no := &object.NewObjectInfo{
+					Created:     strfmt.DateTime(time3),
+					ContentType: "text/plain",
+					Version:     "UUID",
+					Name:        "FILE",
+					Operation:   "d",
+					Parents:     []string{"V2A", "V2B"},
+				}
+				gomock.InOrder(
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{conflictV1, conflictV2A, conflictV2BDeleted}, nil),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, conflictV2BDeleted, nil),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "V2B").Return(ioutil.NopCloser(&bytes.Buffer{}), conflictV2BDeleted, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(resolution, nil),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileDelete, &storageSync.FileInfo{BucketID: "BUCKET", FileID: "FILE", Version: "UUID", Created: resolution.Created}).Return(nil),
+				)
+			},
+			resolution,
+			noErrors,
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			svc, s, _, p, c := getTestService(t)
+			defer c()
+
+			// mock getUUID and getTime
+			getUUID = func() string { return "UUID" }
+			getTime = func() strfmt.DateTime { return strfmt.DateTime(time3) }
+
+			test.calls(s, p)
+
+			// merged contents are provided instead of the chosen version
+			var r io.Reader
+			if test.contents != "" {
+				r = strings.NewReader(test.contents)
+			}
+
+			out, err := svc.FileResolve(context.TODO(), "BUCKET", "FILE", test.version, r, test.contentType, "", nil)
+
+			if !reflect.DeepEqual(out, test.expected) {
+				t.Errorf("Expected file descriptor to equal\n%+v\ngot\n%+v", test.expected, out)
+			}
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
+
+func copyDescriptors(fds []*models.FileDescriptor) []*models.FileDescriptor {
+	out := make([]*models.FileDescriptor, len(fds))
+	for i, fd := range fds {
+		f := *fd
+		out[i] = &f
+	}
+	return out
+}
@@ -16,6 +16,11 @@ type filesCollection map[string]models.FileDescriptor
 type filesCollectionFile []models.FileDescriptor
 
 func (c *filesCollection) Update(fd *models.FileDescriptor) {
+	// time of receipt differs in every storage the collection is synced to
+	f := *fd
+	f.Received = nil
+	fd = &f
+
 	// files collection holds only latest version of the file so we can safely overwrite if passed file is newer
 	old, ok := (*c)[fd.Name]
 	if !ok {
@@ -1,16 +1,22 @@
 package storage
 
 import (
+	"fmt"
+	"io"
 	"strings"
+	"time"
 
 	"github.com/go-openapi/runtime/middleware"
 	"github.com/go-openapi/strfmt"
 	"github.com/go-openapi/swag"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 
 	"github.com/iryonetwork/wwm/gen/storage/models"
 	"github.com/iryonetwork/wwm/gen/storage/restapi/operations"
+	"github.com/iryonetwork/wwm/service/authorizer"
 	"github.com/iryonetwork/wwm/utils"
+	"github.com/iryonetwork/wwm/utils/contentEncoding"
 )
 
 // Handlers describes the actions supported by the storage handlers
@@ -18,6 +24,7 @@ type Handlers interface {
 	FileList() operations.FileListHandler
 	FileGet() operations.FileGetHandler
 	FileGetVersion() operations.FileGetVersionHandler
+	FilePreview() operations.FilePreviewHandler
 	FileListVersions() operations.FileListVersionsHandler
 	FileNew() operations.FileNewHandler
 	FileUpdate() operations.FileUpdateHandler
@@ -28,16 +35,42 @@ type Handlers interface {
 	SyncFileMetadata() operations.SyncFileMetadataHandler
 	SyncFile() operations.SyncFileHandler
 	SyncFileDelete() operations.SyncFileDeleteHandler
+	SyncBucketEvict() operations.SyncBucketEvictHandler
+	FileConflicts() operations.FileConflictsHandler
+	FileResolve() operations.FileResolveHandler
+	UploadNew() operations.UploadNewHandler
+	UploadGet() operations.UploadGetHandler
+	UploadChunk() operations.UploadChunkHandler
+	UploadFinalize() operations.UploadFinalizeHandler
+	UploadDelete() operations.UploadDeleteHandler
+	HoldBucketSet() operations.HoldBucketSetHandler
+	HoldBucketRelease() operations.HoldBucketReleaseHandler
+	HoldFileSet() operations.HoldFileSetHandler
+	HoldFileRelease() operations.HoldFileReleaseHandler
+	BucketUsage() operations.BucketUsageHandler
 }
 
 type handlers struct {
 	service Service
+	auth    authorizer.Service
 	logger  zerolog.Logger
 }
 
+// legalHoldResource is the resource permission to which is required to set and release legal holds. It is outside
+// of the storage API path so that permission to the whole storage API does not grant it.
+const legalHoldResource = "/storage/legalHold"
+
 func (h *handlers) FileList() operations.FileListHandler {
 	return operations.FileListHandlerFunc(func(params operations.FileListParams, principal *string) middleware.Responder {
-		list, err := h.service.FileList(params.HTTPRequest.Context(), params.Bucket.String())
+		query, err := fileListQuery(params.Labels, params.Archetype, params.ContentType, params.CreatedAtSince, params.CreatedAtUntil, params.Offset, params.Limit)
+		if err != nil {
+			return operations.NewFileListBadRequest().WithPayload(&models.Error{
+				Code:    "bad_request",
+				Message: err.Error(),
+			})
+		}
+
+		list, total, err := h.service.FileList(params.HTTPRequest.Context(), params.Bucket.String(), query)
 
 		if err != nil {
 			return operations.NewFileListInternalServerError().WithPayload(&models.Error{
@@ -49,7 +82,7 @@ func (h *handlers) FileList() operations.FileListHandler {
 			return operations.NewFileListNotFound()
 		}
 
-		return operations.NewFileListOK().WithPayload(list)
+		return operations.NewFileListOK().WithPayload(list).WithXTotalCount(total)
 	})
 }
 
@@ -69,8 +102,50 @@ func (h *handlers) FileGet() operations.FileGetHandler {
 			}
 		}
 
-		return utils.UseProducer(operations.NewFileGetOK().
+		// compressible contents are encoded if the client accepts it, ranges always refer to the original contents
+		encoding, vary := contentEncoding.Identity, ""
+		if contentEncoding.Compressible(fd.ContentType) {
+			encoding, vary = contentEncoding.Negotiate(params.HTTPRequest.Header.Get("Accept-Encoding")), "Accept-Encoding"
+		}
+
+		// client already holds the file version
+		tag := encodedETag(fd.Checksum, encoding)
+		if params.IfNoneMatch != nil && matchesETag(*params.IfNoneMatch, tag) {
+			r.Close()
+			return operations.NewFileGetNotModified().WithETag(tag).WithVary(vary)
+		}
+
+		if params.Range != nil {
+			br, ok := parseRange(*params.Range, fd.Size)
+			if !ok {
+				r.Close()
+				return operations.NewFileGetRequestRangeNotSatisfiable().WithContentRange(fmt.Sprintf("bytes */%d", fd.Size))
+			}
+			if br != nil {
+				r.Close()
+				return h.fileGetRange(params, fd.Version, br)
+			}
+		}
+
+		resp := operations.NewFileGetOK()
+		if encoding != contentEncoding.Identity {
+			encoded, err := contentEncoding.Encode(r, encoding)
+			if err != nil {
+				r.Close()
+				return operations.NewFileGetInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+			r = encoded
+			resp.SetContentEncoding(encoding)
+		}
+
+		return utils.UseProducer(resp.
 			WithPayload(r).
+			WithETag(tag).
+			WithVary(vary).
+			WithAcceptRanges("bytes").
 			WithXContentType(fd.ContentType).
 			WithXCreated(fd.Created).
 			WithXVersion(fd.Version).
@@ -98,8 +173,50 @@ func (h *handlers) FileGetVersion() operations.FileGetVersionHandler {
 			}
 		}
 
-		return utils.UseProducer(operations.NewFileGetVersionOK().
+		// compressible contents are encoded if the client accepts it, ranges always refer to the original contents
+		encoding, vary := contentEncoding.Identity, ""
+		if contentEncoding.Compressible(fd.ContentType) {
+			encoding, vary = contentEncoding.Negotiate(params.HTTPRequest.Header.Get("Accept-Encoding")), "Accept-Encoding"
+		}
+
+		// client already holds the file version
+		tag := encodedETag(fd.Checksum, encoding)
+		if params.IfNoneMatch != nil && matchesETag(*params.IfNoneMatch, tag) {
+			r.Close()
+			return operations.NewFileGetVersionNotModified().WithETag(tag).WithVary(vary)
+		}
+
+		if params.Range != nil {
+			br, ok := parseRange(*params.Range, fd.Size)
+			if !ok {
+				r.Close()
+				return operations.NewFileGetVersionRequestRangeNotSatisfiable().WithContentRange(fmt.Sprintf("bytes */%d", fd.Size))
+			}
+			if br != nil {
+				r.Close()
+				return h.fileGetVersionRange(params, params.Version, br)
+			}
+		}
+
+		resp := operations.NewFileGetVersionOK()
+		if encoding != contentEncoding.Identity {
+			encoded, err := contentEncoding.Encode(r, encoding)
+			if err != nil {
+				r.Close()
+				return operations.NewFileGetVersionInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+			r = encoded
+			resp.SetContentEncoding(encoding)
+		}
+
+		return utils.UseProducer(resp.
 			WithPayload(r).
+			WithETag(tag).
+			WithVary(vary).
+			WithAcceptRanges("bytes").
 			WithXContentType(fd.ContentType).
 			WithXCreated(fd.Created).
 			WithXVersion(fd.Version).
@@ -107,7 +224,47 @@ func (h *handlers) FileGetVersion() operations.FileGetVersionHandler {
 			WithXChecksum(fd.Checksum).
 			WithXName(fd.Name).
 			WithXPath(fd.Path).
-			WithXLabels(formatLabelsHeader(fd.Labels)), utils.FileProducer)
+			WithXLabels(formatLabelsHeader(fd.Labels)).
+			WithXParents(formatLabelsHeader(fd.Parents)).
+			WithXSource(fd.Source), utils.FileProducer)
+	})
+}
+
+func (h *handlers) FilePreview() operations.FilePreviewHandler {
+	return operations.FilePreviewHandlerFunc(func(params operations.FilePreviewParams, principal *string) middleware.Responder {
+		size := swag.Int64Value(params.Size)
+		r, fd, err := h.service.FilePreview(params.HTTPRequest.Context(), params.Bucket.String(), params.FileID, params.Version, int(size))
+
+		if err != nil {
+			switch err {
+			case ErrNotFound, ErrDeleted:
+				return operations.NewFilePreviewNotFound()
+			case ErrPreviewUnsupported:
+				return operations.NewFilePreviewUnsupportedMediaType().WithPayload(&models.Error{
+					Code:    "preview_unsupported",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewFilePreviewInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		// client already holds the preview
+		tag := etag(fmt.Sprintf("%s-%d", fd.Checksum, size))
+		if params.IfNoneMatch != nil && matchesETag(*params.IfNoneMatch, tag) {
+			r.Close()
+			return operations.NewFilePreviewNotModified().WithETag(tag)
+		}
+
+		return utils.UseProducer(operations.NewFilePreviewOK().
+			WithPayload(r).
+			WithETag(tag).
+			WithXContentType("image/jpeg").
+			WithXVersion(fd.Version).
+			WithXName(fd.Name), utils.FileProducer)
 	})
 }
 
@@ -140,10 +297,29 @@ func (h *handlers) FileNew() operations.FileNewHandler {
 		fd, err := h.service.FileNew(params.HTTPRequest.Context(), params.Bucket.String(), params.File, params.ContentType, archetype, params.Labels)
 
 		if err != nil {
-			return operations.NewFileNewInternalServerError().WithPayload(&models.Error{
-				Code:    "server_error",
-				Message: err.Error(),
-			})
+			if _, ok := err.(*ValidationError); ok {
+				return operations.NewFileNewUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "validation_failed",
+					Message: err.Error(),
+				})
+			}
+			switch err {
+			case ErrMetadataTooLarge:
+				return operations.NewFileNewUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "metadata_too_large",
+					Message: err.Error(),
+				})
+			case ErrQuotaExceeded:
+				return operations.NewFileNewInsufficientStorage().WithPayload(&models.Error{
+					Code:    "quota_exceeded",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewFileNewInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
 		}
 
 		return operations.NewFileNewCreated().WithPayload(fd)
@@ -161,9 +337,30 @@ func (h *handlers) FileUpdate() operations.FileUpdateHandler {
 		fd, err := h.service.FileUpdate(params.HTTPRequest.Context(), params.Bucket.String(), params.FileID, params.File, params.ContentType, archetype, params.Labels)
 
 		if err != nil {
+			if _, ok := err.(*ValidationError); ok {
+				return operations.NewFileUpdateUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "validation_failed",
+					Message: err.Error(),
+				})
+			}
 			switch err {
+			case ErrMetadataTooLarge:
+				return operations.NewFileUpdateUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "metadata_too_large",
+					Message: err.Error(),
+				})
 			case ErrNotFound:
 				return operations.NewFileUpdateNotFound()
+			case ErrLegalHold:
+				return operations.NewFileUpdateLocked().WithPayload(&models.Error{
+					Code:    "legal_hold",
+					Message: err.Error(),
+				})
+			case ErrQuotaExceeded:
+				return operations.NewFileUpdateInsufficientStorage().WithPayload(&models.Error{
+					Code:    "quota_exceeded",
+					Message: err.Error(),
+				})
 			default:
 				return operations.NewFileUpdateInternalServerError().WithPayload(&models.Error{
 					Code:    "server_error",
@@ -184,6 +381,11 @@ func (h *handlers) FileDelete() operations.FileDeleteHandler {
 			switch err {
 			case ErrNotFound:
 				return operations.NewFileDeleteNotFound()
+			case ErrLegalHold:
+				return operations.NewFileDeleteLocked().WithPayload(&models.Error{
+					Code:    "legal_hold",
+					Message: err.Error(),
+				})
 			default:
 				return operations.NewFileDeleteInternalServerError().WithPayload(&models.Error{
 					Code:    "server_error",
@@ -216,31 +418,25 @@ func (h *handlers) SyncBucketList() operations.SyncBucketListHandler {
 
 func (h *handlers) SyncFileList() operations.SyncFileListHandler {
 	return operations.SyncFileListHandlerFunc(func(params operations.SyncFileListParams, principal *string) middleware.Responder {
-		var createdAtSince *strfmt.DateTime
-		var createdAtUntil *strfmt.DateTime
-
-		if params.CreatedAtSince != nil {
-			d, err := strfmt.ParseDateTime(*params.CreatedAtSince)
-			if err != nil {
-				return operations.NewSyncFileListBadRequest().WithPayload(&models.Error{
-					Code:    "bad_request",
-					Message: "Badly formatted query parameeter createdAtSince",
-				})
-			}
-			createdAtSince = &d
+		query, err := fileListQuery(params.Labels, params.Archetype, params.ContentType, params.CreatedAtSince, params.CreatedAtUntil, params.Offset, params.Limit)
+		if err != nil {
+			return operations.NewSyncFileListBadRequest().WithPayload(&models.Error{
+				Code:    "bad_request",
+				Message: err.Error(),
+			})
 		}
-		if params.CreatedAtUntil != nil {
-			d, err := strfmt.ParseDateTime(*params.CreatedAtUntil)
+		if params.ReceivedSince != nil {
+			d, err := strfmt.ParseDateTime(*params.ReceivedSince)
 			if err != nil {
 				return operations.NewSyncFileListBadRequest().WithPayload(&models.Error{
 					Code:    "bad_request",
-					Message: "Badly formatted query parameeter createdAtUntil",
+					Message: "Badly formatted query parameeter receivedSince",
 				})
 			}
-			createdAtUntil = &d
+			query.ReceivedSince = &d
 		}
 
-		list, err := h.service.SyncFileList(params.HTTPRequest.Context(), params.Bucket.String(), createdAtSince, createdAtUntil)
+		list, total, err := h.service.SyncFileList(params.HTTPRequest.Context(), params.Bucket.String(), query)
 
 		if err != nil {
 			return operations.NewSyncFileListInternalServerError().WithPayload(&models.Error{
@@ -252,7 +448,7 @@ func (h *handlers) SyncFileList() operations.SyncFileListHandler {
 			return operations.NewSyncFileListNotFound()
 		}
 
-		return operations.NewSyncFileListOK().WithPayload(list)
+		return operations.NewSyncFileListOK().WithPayload(list).WithXTotalCount(total)
 	})
 }
 
@@ -281,6 +477,17 @@ func (h *handlers) SyncFileListVersions() operations.SyncFileListVersionsHandler
 			}
 			createdAtUntil = &d
 		}
+		var receivedSince *strfmt.DateTime
+		if params.ReceivedSince != nil {
+			d, err := strfmt.ParseDateTime(*params.ReceivedSince)
+			if err != nil {
+				return operations.NewSyncFileListBadRequest().WithPayload(&models.Error{
+					Code:    "bad_request",
+					Message: "Badly formatted query parameeter receivedSince",
+				})
+			}
+			receivedSince = &d
+		}
 
 		list, err := h.service.FileListVersions(params.HTTPRequest.Context(), params.Bucket.String(), params.FileID, createdAtSince, createdAtUntil)
 
@@ -290,6 +497,16 @@ func (h *handlers) SyncFileListVersions() operations.SyncFileListVersionsHandler
 				Message: err.Error(),
 			})
 		}
+		if receivedSince != nil {
+			// versions synced from other storages are received later than they were created
+			received := list[:0]
+			for _, fd := range list {
+				if fd.Received != nil && time.Time(*fd.Received).After(time.Time(*receivedSince)) {
+					received = append(received, fd)
+				}
+			}
+			list = received
+		}
 		if len(list) == 0 {
 			return operations.NewSyncFileListVersionsNotFound()
 		}
@@ -305,7 +522,7 @@ func (h *handlers) SyncFileMetadata() operations.SyncFileMetadataHandler {
 		if err != nil {
 			switch err {
 			case ErrNotFound:
-				return operations.NewSyncFileMetadataNotFound()
+				return operations.NewSyncFileMetadataNotFound().WithAcceptEncoding(contentEncoding.Accepted())
 			default:
 				h.logger.Error().Err(err).Msg("Failed to fetch the file to return metadata")
 				return operations.NewSyncFileMetadataInternalServerError()
@@ -320,7 +537,10 @@ func (h *handlers) SyncFileMetadata() operations.SyncFileMetadataHandler {
 			WithXChecksum(fd.Checksum).
 			WithXName(fd.Name).
 			WithXPath(fd.Path).
-			WithXLabels(formatLabelsHeader(fd.Labels))
+			WithXLabels(formatLabelsHeader(fd.Labels)).
+			WithXParents(formatLabelsHeader(fd.Parents)).
+			WithXSource(fd.Source).
+			WithAcceptEncoding(contentEncoding.Accepted())
 	})
 }
 
@@ -329,20 +549,66 @@ func (h *handlers) SyncFile() operations.SyncFileHandler {
 		defer params.File.Close()
 		archetype := swag.StringValue(params.Archetype)
 
+		// original contents are stored so that the checksum refers to them
+		encoding := swag.StringValue(params.ContentEncoding)
+		contents, err := contentEncoding.NewReader(params.File, encoding)
+		if err != nil {
+			return operations.NewSyncFileUnprocessableEntity().WithPayload(&models.Error{
+				Code:    "validation_failed",
+				Message: err.Error(),
+			})
+		}
+		defer contents.Close()
+		// decoded contents are limited to their declared size so that small requests can't fill the storage
+		if encoding != "" && encoding != contentEncoding.Identity {
+			if params.Size == nil {
+				return operations.NewSyncFileUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "validation_failed",
+					Message: "Size of encoded contents is required",
+				})
+			}
+			contents = contentEncoding.LimitReader(contents, *params.Size)
+		}
+
 		fd, err := h.service.SyncFile(
 			params.HTTPRequest.Context(),
 			params.Bucket.String(),
 			params.FileID,
 			params.Version,
-			params.File,
+			contents,
+			params.Checksum,
 			params.ContentType,
 			params.Created,
 			archetype,
 			params.Labels,
+			params.Parents,
+			swag.StringValue(params.Source),
 		)
 
 		if err != nil {
+			if _, ok := err.(*ValidationError); ok {
+				return operations.NewSyncFileUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "validation_failed",
+					Message: err.Error(),
+				})
+			}
+			if errors.Cause(err) == contentEncoding.ErrTooLarge {
+				return operations.NewSyncFileUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "contents_too_large",
+					Message: contentEncoding.ErrTooLarge.Error(),
+				})
+			}
 			switch err {
+			case ErrMetadataTooLarge:
+				return operations.NewSyncFileUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "metadata_too_large",
+					Message: err.Error(),
+				})
+			case ErrChecksumMismatch:
+				return operations.NewSyncFileUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "checksum_mismatch",
+					Message: err.Error(),
+				})
 			case ErrAlreadyExists:
 				return operations.NewSyncFileOK().WithPayload(fd)
 			default:
@@ -359,11 +625,21 @@ func (h *handlers) SyncFile() operations.SyncFileHandler {
 
 func (h *handlers) SyncFileDelete() operations.SyncFileDeleteHandler {
 	return operations.SyncFileDeleteHandlerFunc(func(params operations.SyncFileDeleteParams, principal *string) middleware.Responder {
-		err := h.service.SyncFileDelete(params.HTTPRequest.Context(), params.Bucket.String(), params.FileID, params.Version, params.Created)
+		err := h.service.SyncFileDelete(params.HTTPRequest.Context(), params.Bucket.String(), params.FileID, params.Version, params.Created, params.Parents, swag.StringValue(params.Source))
 		if err != nil {
 			switch err {
 			case ErrNotFound:
 				return operations.NewSyncFileDeleteNotFound()
+			case ErrDeleted:
+				return operations.NewSyncFileDeleteConflict().WithPayload(&models.Error{
+					Code:    "conflict",
+					Message: err.Error(),
+				})
+			case ErrLegalHold:
+				return operations.NewSyncFileDeleteLocked().WithPayload(&models.Error{
+					Code:    "legal_hold",
+					Message: err.Error(),
+				})
 			default:
 				return operations.NewSyncFileDeleteInternalServerError().WithPayload(&models.Error{
 					Code:    "server_error",
@@ -376,11 +652,473 @@ func (h *handlers) SyncFileDelete() operations.SyncFileDeleteHandler {
 	})
 }
 
+func (h *handlers) SyncBucketEvict() operations.SyncBucketEvictHandler {
+	return operations.SyncBucketEvictHandlerFunc(func(params operations.SyncBucketEvictParams, principal *string) middleware.Responder {
+		err := h.service.BucketEvict(params.HTTPRequest.Context(), params.Bucket.String())
+		if err != nil {
+			return operations.NewSyncBucketEvictInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		return operations.NewSyncBucketEvictNoContent()
+	})
+}
+
+func (h *handlers) FileConflicts() operations.FileConflictsHandler {
+	return operations.FileConflictsHandlerFunc(func(params operations.FileConflictsParams, principal *string) middleware.Responder {
+		list, err := h.service.FileConflicts(params.HTTPRequest.Context(), params.Bucket.String())
+
+		if err != nil {
+			return operations.NewFileConflictsInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		return operations.NewFileConflictsOK().WithPayload(list)
+	})
+}
+
+func (h *handlers) FileResolve() operations.FileResolveHandler {
+	return operations.FileResolveHandlerFunc(func(params operations.FileResolveParams, principal *string) middleware.Responder {
+		if params.File == nil && params.Version == nil {
+			return operations.NewFileResolveBadRequest().WithPayload(&models.Error{
+				Code:    "bad_request",
+				Message: "Either version or file has to be provided",
+			})
+		}
+		var r io.Reader
+		if params.File != nil {
+			defer params.File.Close()
+			r = params.File
+		}
+
+		fd, err := h.service.FileResolve(
+			params.HTTPRequest.Context(),
+			params.Bucket.String(),
+			params.FileID,
+			swag.StringValue(params.Version),
+			r,
+			swag.StringValue(params.ContentType),
+			swag.StringValue(params.Archetype),
+			params.Labels,
+		)
+
+		if err != nil {
+			if _, ok := err.(*ValidationError); ok {
+				return operations.NewFileResolveUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "validation_failed",
+					Message: err.Error(),
+				})
+			}
+			switch err {
+			case ErrMetadataTooLarge:
+				return operations.NewFileResolveUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "metadata_too_large",
+					Message: err.Error(),
+				})
+			case ErrNotFound:
+				return operations.NewFileResolveNotFound()
+			case ErrNotSibling:
+				return operations.NewFileResolveBadRequest().WithPayload(&models.Error{
+					Code:    "not_sibling",
+					Message: err.Error(),
+				})
+			case ErrNoConflict:
+				return operations.NewFileResolveConflict().WithPayload(&models.Error{
+					Code:    "no_conflict",
+					Message: err.Error(),
+				})
+			case ErrLegalHold:
+				return operations.NewFileResolveLocked().WithPayload(&models.Error{
+					Code:    "legal_hold",
+					Message: err.Error(),
+				})
+			case ErrQuotaExceeded:
+				return operations.NewFileResolveInsufficientStorage().WithPayload(&models.Error{
+					Code:    "quota_exceeded",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewFileResolveInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewFileResolveCreated().WithPayload(fd)
+	})
+}
+
+func (h *handlers) UploadNew() operations.UploadNewHandler {
+	return operations.UploadNewHandlerFunc(func(params operations.UploadNewParams, principal *string) middleware.Responder {
+		u := params.Upload
+		upload, err := h.service.UploadNew(params.HTTPRequest.Context(), params.Bucket.String(), u.FileID, *u.Size, u.Checksum, *u.ContentType, u.Archetype, u.Labels)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound, ErrDeleted:
+				return operations.NewUploadNewNotFound()
+			case ErrLegalHold:
+				return operations.NewUploadNewLocked().WithPayload(&models.Error{
+					Code:    "legal_hold",
+					Message: err.Error(),
+				})
+			case ErrQuotaExceeded:
+				return operations.NewUploadNewInsufficientStorage().WithPayload(&models.Error{
+					Code:    "quota_exceeded",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewUploadNewInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewUploadNewCreated().WithPayload(upload)
+	})
+}
+
+func (h *handlers) UploadGet() operations.UploadGetHandler {
+	return operations.UploadGetHandlerFunc(func(params operations.UploadGetParams, principal *string) middleware.Responder {
+		upload, err := h.service.UploadGet(params.HTTPRequest.Context(), params.Bucket.String(), params.UploadID)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewUploadGetNotFound()
+			default:
+				return operations.NewUploadGetInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewUploadGetOK().WithPayload(upload)
+	})
+}
+
+func (h *handlers) UploadChunk() operations.UploadChunkHandler {
+	return operations.UploadChunkHandlerFunc(func(params operations.UploadChunkParams, principal *string) middleware.Responder {
+		defer params.Chunk.Close()
+
+		upload, err := h.service.UploadChunk(params.HTTPRequest.Context(), params.Bucket.String(), params.UploadID, params.Offset, params.Chunk)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewUploadChunkNotFound()
+			case ErrChunkOutOfRange:
+				return operations.NewUploadChunkBadRequest().WithPayload(&models.Error{
+					Code:    "bad_request",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewUploadChunkInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewUploadChunkOK().WithPayload(upload)
+	})
+}
+
+func (h *handlers) UploadFinalize() operations.UploadFinalizeHandler {
+	return operations.UploadFinalizeHandlerFunc(func(params operations.UploadFinalizeParams, principal *string) middleware.Responder {
+		fd, err := h.service.UploadFinalize(params.HTTPRequest.Context(), params.Bucket.String(), params.UploadID)
+
+		if err != nil {
+			if _, ok := err.(*ValidationError); ok {
+				return operations.NewUploadFinalizeUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "validation_failed",
+					Message: err.Error(),
+				})
+			}
+			switch err {
+			case ErrMetadataTooLarge:
+				return operations.NewUploadFinalizeUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "metadata_too_large",
+					Message: err.Error(),
+				})
+			case ErrNotFound:
+				return operations.NewUploadFinalizeNotFound()
+			case ErrLegalHold:
+				return operations.NewUploadFinalizeLocked().WithPayload(&models.Error{
+					Code:    "legal_hold",
+					Message: err.Error(),
+				})
+			case ErrQuotaExceeded:
+				return operations.NewUploadFinalizeInsufficientStorage().WithPayload(&models.Error{
+					Code:    "quota_exceeded",
+					Message: err.Error(),
+				})
+			case ErrUploadIncomplete, ErrChecksumMismatch:
+				return operations.NewUploadFinalizeConflict().WithPayload(&models.Error{
+					Code:    "conflict",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewUploadFinalizeInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewUploadFinalizeCreated().WithPayload(fd)
+	})
+}
+
+func (h *handlers) UploadDelete() operations.UploadDeleteHandler {
+	return operations.UploadDeleteHandlerFunc(func(params operations.UploadDeleteParams, principal *string) middleware.Responder {
+		err := h.service.UploadDelete(params.HTTPRequest.Context(), params.Bucket.String(), params.UploadID)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewUploadDeleteNotFound()
+			default:
+				return operations.NewUploadDeleteInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewUploadDeleteNoContent()
+	})
+}
+
+func (h *handlers) HoldBucketSet() operations.HoldBucketSetHandler {
+	return operations.HoldBucketSetHandlerFunc(func(params operations.HoldBucketSetParams, principal *string) middleware.Responder {
+		if err := h.auth.AuthorizeResource(params.HTTPRequest, legalHoldResource, authorizer.Update); err != nil {
+			return operations.NewHoldBucketSetForbidden().WithPayload(forbidden(err))
+		}
+
+		err := h.service.HoldSet(params.HTTPRequest.Context(), params.Bucket.String(), "")
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewHoldBucketSetNotFound()
+			default:
+				return operations.NewHoldBucketSetInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewHoldBucketSetNoContent()
+	})
+}
+
+func (h *handlers) HoldBucketRelease() operations.HoldBucketReleaseHandler {
+	return operations.HoldBucketReleaseHandlerFunc(func(params operations.HoldBucketReleaseParams, principal *string) middleware.Responder {
+		if err := h.auth.AuthorizeResource(params.HTTPRequest, legalHoldResource, authorizer.Delete); err != nil {
+			return operations.NewHoldBucketReleaseForbidden().WithPayload(forbidden(err))
+		}
+
+		err := h.service.HoldRelease(params.HTTPRequest.Context(), params.Bucket.String(), "")
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewHoldBucketReleaseNotFound()
+			default:
+				return operations.NewHoldBucketReleaseInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewHoldBucketReleaseNoContent()
+	})
+}
+
+func (h *handlers) HoldFileSet() operations.HoldFileSetHandler {
+	return operations.HoldFileSetHandlerFunc(func(params operations.HoldFileSetParams, principal *string) middleware.Responder {
+		if err := h.auth.AuthorizeResource(params.HTTPRequest, legalHoldResource, authorizer.Update); err != nil {
+			return operations.NewHoldFileSetForbidden().WithPayload(forbidden(err))
+		}
+
+		err := h.service.HoldSet(params.HTTPRequest.Context(), params.Bucket.String(), params.FileID)
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewHoldFileSetNotFound()
+			default:
+				return operations.NewHoldFileSetInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewHoldFileSetNoContent()
+	})
+}
+
+func (h *handlers) HoldFileRelease() operations.HoldFileReleaseHandler {
+	return operations.HoldFileReleaseHandlerFunc(func(params operations.HoldFileReleaseParams, principal *string) middleware.Responder {
+		if err := h.auth.AuthorizeResource(params.HTTPRequest, legalHoldResource, authorizer.Delete); err != nil {
+			return operations.NewHoldFileReleaseForbidden().WithPayload(forbidden(err))
+		}
+
+		err := h.service.HoldRelease(params.HTTPRequest.Context(), params.Bucket.String(), params.FileID)
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewHoldFileReleaseNotFound()
+			default:
+				return operations.NewHoldFileReleaseInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewHoldFileReleaseNoContent()
+	})
+}
+
+func (h *handlers) BucketUsage() operations.BucketUsageHandler {
+	return operations.BucketUsageHandlerFunc(func(params operations.BucketUsageParams, principal *string) middleware.Responder {
+		usage, err := h.service.BucketUsage(params.HTTPRequest.Context(), params.Bucket.String())
+
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewBucketUsageNotFound()
+			default:
+				return operations.NewBucketUsageInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewBucketUsageOK().WithPayload(usage)
+	})
+}
+
+func (h *handlers) fileGetRange(params operations.FileGetParams, version string, br *byteRange) middleware.Responder {
+	r, fd, err := h.service.FileGetRange(params.HTTPRequest.Context(), params.Bucket.String(), params.FileID, version, br.offset, br.length)
+
+	if err != nil {
+		switch err {
+		case ErrNotFound:
+			return operations.NewFileGetNotFound()
+		case ErrInvalidRange:
+			return operations.NewFileGetRequestRangeNotSatisfiable()
+		default:
+			return operations.NewFileGetInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+	}
+
+	return utils.UseProducer(operations.NewFileGetPartialContent().
+		WithPayload(r).
+		WithXContentType(fd.ContentType).
+		WithXCreated(fd.Created).
+		WithXVersion(fd.Version).
+		WithXArchetype(fd.Archetype).
+		WithXChecksum(fd.Checksum).
+		WithXName(fd.Name).
+		WithXPath(fd.Path).
+		WithXLabels(formatLabelsHeader(fd.Labels)).
+		WithETag(etag(fd.Checksum)).
+		WithContentRange(br.contentRange(fd.Size)), utils.FileProducer)
+}
+
+func (h *handlers) fileGetVersionRange(params operations.FileGetVersionParams, version string, br *byteRange) middleware.Responder {
+	r, fd, err := h.service.FileGetRange(params.HTTPRequest.Context(), params.Bucket.String(), params.FileID, version, br.offset, br.length)
+
+	if err != nil {
+		switch err {
+		case ErrNotFound:
+			return operations.NewFileGetVersionNotFound()
+		case ErrInvalidRange:
+			return operations.NewFileGetVersionRequestRangeNotSatisfiable()
+		default:
+			return operations.NewFileGetVersionInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+	}
+
+	return utils.UseProducer(operations.NewFileGetVersionPartialContent().
+		WithPayload(r).
+		WithXContentType(fd.ContentType).
+		WithXCreated(fd.Created).
+		WithXVersion(fd.Version).
+		WithXArchetype(fd.Archetype).
+		WithXChecksum(fd.Checksum).
+		WithXName(fd.Name).
+		WithXPath(fd.Path).
+		WithXLabels(formatLabelsHeader(fd.Labels)).
+		WithXParents(formatLabelsHeader(fd.Parents)).
+		WithXSource(fd.Source).
+		WithETag(etag(fd.Checksum)).
+		WithContentRange(br.contentRange(fd.Size)), utils.FileProducer)
+}
+
 // NewHandlers returns a new instance of authenticator handlers
-func NewHandlers(service Service, logger zerolog.Logger) Handlers {
+func NewHandlers(service Service, auth authorizer.Service, logger zerolog.Logger) Handlers {
 	logger = logger.With().Str("component", "service/storage/handlers").Logger()
 
-	return &handlers{service: service, logger: logger}
+	return &handlers{service: service, auth: auth, logger: logger}
+}
+
+func forbidden(err error) *models.Error {
+	return &models.Error{
+		Code:    "forbidden",
+		Message: err.Error(),
+	}
+}
+
+// fileListQuery builds the query of the list of files from optional query parameters
+func fileListQuery(labels []string, archetype, contentType, createdAtSince, createdAtUntil *string, offset, limit *int64) (*Query, error) {
+	query := &Query{Labels: labels}
+
+	if archetype != nil {
+		query.Archetype = *archetype
+	}
+	if contentType != nil {
+		query.ContentType = *contentType
+	}
+	if createdAtSince != nil {
+		d, err := strfmt.ParseDateTime(*createdAtSince)
+		if err != nil {
+			return nil, errors.New("Badly formatted query parameeter createdAtSince")
+		}
+		query.CreatedAtSince = &d
+	}
+	if createdAtUntil != nil {
+		d, err := strfmt.ParseDateTime(*createdAtUntil)
+		if err != nil {
+			return nil, errors.New("Badly formatted query parameeter createdAtUntil")
+		}
+		query.CreatedAtUntil = &d
+	}
+	if offset != nil {
+		query.Offset = *offset
+	}
+	if limit != nil {
+		query.Limit = *limit
+	}
+
+	return query, nil
 }
 
 func formatLabelsHeader(l []string) string {
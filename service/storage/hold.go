@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+)
+
+func (s *service) HoldSet(ctx context.Context, bucketID, fileID string) error {
+	if err := s.holdExists(ctx, bucketID, fileID); err != nil {
+		return err
+	}
+
+	if err := s.s3.HoldSet(ctx, bucketID, fileID); err != nil {
+		s.logger.Error().Err(err).Str("method", "HoldSet").Msg("Failed to set legal hold")
+		return err
+	}
+	s.logger.Info().Str("method", "HoldSet").Str("bucket", bucketID).Str("file", fileID).Msg("Legal hold set")
+
+	// descriptors in the index carry the legal hold, hold of the whole bucket applies to all of them
+	if fileID == "" {
+		s.index.drop(bucketID)
+	} else {
+		s.index.hold(bucketID, fileID, true)
+	}
+
+	return nil
+}
+
+func (s *service) HoldRelease(ctx context.Context, bucketID, fileID string) error {
+	if err := s.holdExists(ctx, bucketID, fileID); err != nil {
+		return err
+	}
+
+	if err := s.s3.HoldRelease(ctx, bucketID, fileID); err != nil {
+		s.logger.Error().Err(err).Str("method", "HoldRelease").Msg("Failed to release legal hold")
+		return err
+	}
+	s.logger.Info().Str("method", "HoldRelease").Str("bucket", bucketID).Str("file", fileID).Msg("Legal hold released")
+
+	// descriptors in the index carry the legal hold, hold of the whole bucket applies to all of them
+	// and the file stays held while the whole bucket is held
+	if fileID == "" {
+		s.index.drop(bucketID)
+		return nil
+	}
+	held, err := s.s3.Held(ctx, bucketID, fileID)
+	if err != nil {
+		s.index.drop(bucketID)
+		return nil
+	}
+	s.index.hold(bucketID, fileID, held)
+
+	return nil
+}
+
+// holdExists makes sure the file or the bucket if fileID is empty exists. Deleted files can be held
+// to prevent them from being purged.
+func (s *service) holdExists(ctx context.Context, bucketID, fileID string) error {
+	if fileID == "" {
+		exists, err := s.s3.BucketExists(ctx, bucketID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+		return nil
+	}
+
+	versions, err := s.s3.List(ctx, bucketID, fileID+".")
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+)
+
+// Query describes filtering and pagination of the list of files. Zero values are not filtering.
+type Query struct {
+	// Labels lists labels that all the returned files have
+	Labels []string
+	// Archetype of returned files
+	Archetype string
+	// ContentType of returned files
+	ContentType string
+	// CreatedAtSince and CreatedAtUntil limit the time of creation of the latest version of returned files (exclusive)
+	CreatedAtSince *strfmt.DateTime
+	CreatedAtUntil *strfmt.DateTime
+	// ReceivedSince limits the time any version of returned files was received by the storage (exclusive)
+	ReceivedSince *strfmt.DateTime
+	// Offset is the number of matching files to skip
+	Offset int64
+	// Limit is the maximum number of files to return
+	Limit int64
+}
+
+// index keeps latest versions of files in buckets in memory so that lists of files can be filtered without
+// listing all the objects of the bucket. Lineage of all the versions is kept to find conflicting versions of
+// files. Bucket is indexed on the first
+// query and kept up to date by every write done through the service, indexed buckets don't expire.
+type index struct {
+	mu      sync.Mutex
+	buckets map[string]*indexEntry
+}
+
+// indexEntry holds index of the bucket once it's loaded. Bucket is loaded without holding the lock of the
+// index, writes done meanwhile are kept in pending and applied once it's loaded as the list of versions
+// might have missed them.
+type indexEntry struct {
+	loaded  chan struct{}
+	bucket  *bucketIndex
+	err     error
+	pending []func(*bucketIndex)
+}
+
+// bucketIndex holds latest versions of files in the bucket by name together with names of files by label
+// and by archetype, lineage of all the versions, sibling versions of files in conflict and the time the last
+// version of files was received by name
+type bucketIndex struct {
+	bucketID   string
+	files      map[string]*models.FileDescriptor
+	labels     map[string]map[string]bool
+	archetypes map[string]map[string]bool
+	versions   map[string][]*versionNode
+	conflicts  map[string][]string
+	received   map[string]time.Time
+}
+
+// query returns files of the bucket matching the query sorted by name and the total number of matching files
+// before pagination; files marked as deleted are returned only if deleted is set. Not yet indexed bucket is
+// indexed from the list of all versions of files returned by load.
+func (i *index) query(bucketID string, q *Query, deleted bool, load func() ([]*models.FileDescriptor, error)) (list []*models.FileDescriptor, total int64, err error) {
+	err = i.with(bucketID, load, func(b *bucketIndex) {
+		list, total = b.query(q, deleted)
+	})
+	return list, total, err
+}
+
+// conflicts returns latest versions of files of the bucket that are in conflict sorted by name
+func (i *index) conflicts(bucketID string, load func() ([]*models.FileDescriptor, error)) ([]*models.FileDescriptor, error) {
+	list := []*models.FileDescriptor{}
+	err := i.with(bucketID, load, func(b *bucketIndex) {
+		for name := range b.conflicts {
+			if fd, ok := b.files[name]; ok {
+				f := *fd
+				b.flag(&f)
+				list = append(list, &f)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list, nil
+}
+
+// siblings returns versions of the file in conflict, it's empty if the file is not in conflict
+func (i *index) siblings(bucketID, fileID string, load func() ([]*models.FileDescriptor, error)) (siblings []string, err error) {
+	err = i.with(bucketID, load, func(b *bucketIndex) {
+		siblings = append([]string{}, b.conflicts[fileID]...)
+	})
+	return siblings, err
+}
+
+// flag flags provided versions of files of the bucket that are in conflict
+func (i *index) flag(bucketID string, load func() ([]*models.FileDescriptor, error), fds ...*models.FileDescriptor) error {
+	return i.with(bucketID, load, func(b *bucketIndex) {
+		for _, fd := range fds {
+			b.flag(fd)
+		}
+	})
+}
+
+// with calls fn with index of the bucket holding the lock, indexing the bucket first if needed. Concurrent
+// callers wait for the bucket being indexed by the first one instead of listing it again.
+func (i *index) with(bucketID string, load func() ([]*models.FileDescriptor, error), fn func(*bucketIndex)) error {
+	i.mu.Lock()
+	e, ok := i.buckets[bucketID]
+	if !ok {
+		e = &indexEntry{loaded: make(chan struct{})}
+		if i.buckets == nil {
+			i.buckets = make(map[string]*indexEntry)
+		}
+		i.buckets[bucketID] = e
+	}
+	i.mu.Unlock()
+
+	if !ok {
+		i.load(bucketID, e, load)
+	}
+	<-e.loaded
+	if e.err != nil {
+		return e.err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	fn(e.bucket)
+
+	return nil
+}
+
+// load indexes the bucket from the list of all versions of files without holding the lock so that other
+// buckets can be queried and written meanwhile. Failed load is tried again by the next caller.
+func (i *index) load(bucketID string, e *indexEntry, load func() ([]*models.FileDescriptor, error)) {
+	versions, err := load()
+	b := newBucketIndex(bucketID)
+	for _, fd := range versions {
+		b.update(fd)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err != nil {
+		e.err = err
+		if i.buckets[bucketID] == e {
+			delete(i.buckets, bucketID)
+		}
+	} else {
+		for _, fn := range e.pending {
+			fn(b)
+		}
+		e.bucket = b
+	}
+	e.pending = nil
+	close(e.loaded)
+}
+
+// modify applies the write to already indexed bucket or to the bucket being indexed once it's loaded, buckets
+// not indexed yet account for it when they are indexed
+func (i *index) modify(bucketID string, fn func(*bucketIndex)) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	e, ok := i.buckets[bucketID]
+	switch {
+	case !ok:
+	case e.bucket == nil:
+		e.pending = append(e.pending, fn)
+	default:
+		fn(e.bucket)
+	}
+}
+
+// update accounts for the new file version in already indexed bucket and indexes it if it's the latest
+// version of the file
+func (i *index) update(bucketID string, fd *models.FileDescriptor) {
+	i.modify(bucketID, func(b *bucketIndex) {
+		b.update(fd)
+	})
+}
+
+// remove accounts for removal of the file version from already indexed bucket
+func (i *index) remove(bucketID string, fd *models.FileDescriptor) {
+	i.modify(bucketID, func(b *bucketIndex) {
+		b.remove(fd)
+	})
+}
+
+// hold sets legal hold of the latest version of the file in already indexed bucket
+func (i *index) hold(bucketID, fileID string, held bool) {
+	i.modify(bucketID, func(b *bucketIndex) {
+		if fd, ok := b.files[fileID]; ok {
+			f := *fd
+			f.LegalHold = held
+			b.files[fileID] = &f
+		}
+	})
+}
+
+// drop removes the bucket from the index so that it is indexed again on the next query
+func (i *index) drop(bucketID string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.buckets, bucketID)
+}
+
+func newBucketIndex(bucketID string) *bucketIndex {
+	return &bucketIndex{
+		bucketID:   bucketID,
+		files:      make(map[string]*models.FileDescriptor),
+		labels:     make(map[string]map[string]bool),
+		archetypes: make(map[string]map[string]bool),
+		versions:   make(map[string][]*versionNode),
+		conflicts:  make(map[string][]string),
+		received:   make(map[string]time.Time),
+	}
+}
+
+// update accounts for the file version unless it's accounted for already, writes done while the bucket was
+// being loaded might have been listed too
+func (b *bucketIndex) update(fd *models.FileDescriptor) {
+	for _, n := range b.versions[fd.Name] {
+		if n.version == fd.Version {
+			return
+		}
+	}
+
+	b.versions[fd.Name] = append(b.versions[fd.Name], newVersionNode(fd))
+	b.updateConflicts(fd.Name)
+	if fd.Received != nil && time.Time(*fd.Received).After(b.received[fd.Name]) {
+		b.received[fd.Name] = time.Time(*fd.Received)
+	}
+
+	old, ok := b.files[fd.Name]
+	if ok {
+		if time.Time(old.Created).After(time.Time(fd.Created)) {
+			return
+		}
+		for _, label := range old.Labels {
+			delete(b.labels[label], old.Name)
+		}
+		delete(b.archetypes[old.Archetype], old.Name)
+	}
+
+	// keep a copy so that callers can't change the index
+	f := *fd
+	if ok && !f.LegalHold {
+		// descriptors returned by writes don't carry the legal hold
+		f.LegalHold = old.LegalHold
+	}
+	// conflicts are flagged when descriptors are returned
+	f.Conflict, f.Siblings = false, nil
+	b.files[f.Name] = &f
+
+	for _, label := range f.Labels {
+		if _, ok := b.labels[label]; !ok {
+			b.labels[label] = make(map[string]bool)
+		}
+		b.labels[label][f.Name] = true
+	}
+	if _, ok := b.archetypes[f.Archetype]; !ok {
+		b.archetypes[f.Archetype] = make(map[string]bool)
+	}
+	b.archetypes[f.Archetype][f.Name] = true
+}
+
+// remove accounts for removal of the file version unless it's not accounted for
+func (b *bucketIndex) remove(fd *models.FileDescriptor) {
+	versions := b.versions[fd.Name][:0]
+	for _, n := range b.versions[fd.Name] {
+		if n.version != fd.Version {
+			versions = append(versions, n)
+		}
+	}
+	if len(versions) == len(b.versions[fd.Name]) {
+		return
+	}
+
+	b.versions[fd.Name] = versions
+	b.updateConflicts(fd.Name)
+}
+
+func (b *bucketIndex) query(q *Query, deleted bool) ([]*models.FileDescriptor, int64) {
+	// start with the smallest set of names from label and archetype indexes
+	var names map[string]bool
+	indexed := false
+	for _, label := range q.Labels {
+		if !indexed || len(b.labels[label]) < len(names) {
+			names, indexed = b.labels[label], true
+		}
+	}
+	if q.Archetype != "" && (!indexed || len(b.archetypes[q.Archetype]) < len(names)) {
+		names, indexed = b.archetypes[q.Archetype], true
+	}
+
+	list := []*models.FileDescriptor{}
+	if indexed {
+		for name := range names {
+			if fd := b.files[name]; b.matches(fd, q, deleted) {
+				list = append(list, fd)
+			}
+		}
+	} else {
+		for _, fd := range b.files {
+			if b.matches(fd, q, deleted) {
+				list = append(list, fd)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	total := int64(len(list))
+	if q.Offset >= total {
+		return []*models.FileDescriptor{}, total
+	}
+	list = list[q.Offset:]
+	if q.Limit > 0 && q.Limit < int64(len(list)) {
+		list = list[:q.Limit]
+	}
+
+	// return copies so that callers can't change the index
+	out := make([]*models.FileDescriptor, len(list))
+	for i, fd := range list {
+		f := *fd
+		b.flag(&f)
+		out[i] = &f
+	}
+
+	return out, total
+}
+
+// updateConflicts finds sibling versions of the file after its versions changed
+func (b *bucketIndex) updateConflicts(name string) {
+	if siblings := findSiblings(b.versions[name]); len(siblings) > 0 {
+		b.conflicts[name] = siblings
+	} else {
+		delete(b.conflicts, name)
+	}
+}
+
+// flag flags the file version if it's one of sibling versions of the file in conflict
+func (b *bucketIndex) flag(fd *models.FileDescriptor) {
+	siblings := b.conflicts[fd.Name]
+	for _, version := range siblings {
+		if version == fd.Version {
+			fd.Conflict = true
+			fd.Siblings = append([]string{}, siblings...)
+			return
+		}
+	}
+}
+
+func (b *bucketIndex) matches(fd *models.FileDescriptor, q *Query, deleted bool) bool {
+	if !deleted && s3.Operation(fd.Operation) != s3.Write {
+		return false
+	}
+	for _, label := range q.Labels {
+		if !b.labels[label][fd.Name] {
+			return false
+		}
+	}
+	if q.Archetype != "" && fd.Archetype != q.Archetype {
+		return false
+	}
+	if q.ContentType != "" && fd.ContentType != q.ContentType {
+		return false
+	}
+	if q.CreatedAtSince != nil && !time.Time(*q.CreatedAtSince).Before(time.Time(fd.Created)) {
+		return false
+	}
+	if q.CreatedAtUntil != nil && !time.Time(*q.CreatedAtUntil).After(time.Time(fd.Created)) {
+		return false
+	}
+	if q.ReceivedSince != nil && !time.Time(*q.ReceivedSince).Before(b.received[fd.Name]) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/go-openapi/strfmt"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+)
+
+func TestIndex(t *testing.T) {
+	testCases := []struct {
+		description string
+		loaded      []*models.FileDescriptor
+		updates     []*models.FileDescriptor
+		query       *Query
+		deleted     bool
+		expected    []*models.FileDescriptor
+		total       int64
+	}{
+		{
+			"latest versions sorted by name",
+			[]*models.FileDescriptor{file1V2, file3V1, file1V1},
+			nil,
+			&Query{},
+			false,
+			[]*models.FileDescriptor{file3V1, file1V2},
+			2,
+		},
+		{
+			"deleted files are listed only if requested",
+			[]*models.FileDescriptor{file2V2, file1V1, file2V1},
+			nil,
+			&Query{Labels: []string{"basicPatientInfo"}},
+			true,
+			[]*models.FileDescriptor{file1V1, file2V2},
+			2,
+		},
+		{
+			"update replaces older version and its labels",
+			[]*models.FileDescriptor{file1V1},
+			[]*models.FileDescriptor{file1V2},
+			&Query{Labels: []string{"basicPatientInfo"}},
+			false,
+			[]*models.FileDescriptor{},
+			0,
+		},
+		{
+			"update with older version is ignored",
+			[]*models.FileDescriptor{file1V2},
+			[]*models.FileDescriptor{file1V1},
+			&Query{Labels: []string{"vitalSign"}},
+			false,
+			[]*models.FileDescriptor{file1V2},
+			1,
+		},
+		{
+			"update keeps legal hold",
+			[]*models.FileDescriptor{file1V2Held},
+			[]*models.FileDescriptor{file1V2},
+			&Query{},
+			false,
+			[]*models.FileDescriptor{file1V2Held},
+			1,
+		},
+		{
+			"all filters",
+			[]*models.FileDescriptor{file1V2, file3V1, file2V1},
+			nil,
+			&Query{Labels: []string{"vitalSign"}, Archetype: "openEHR-EHR-OBSERVATION.blood_pressure.v1", ContentType: "text/openEhrXml", CreatedAtSince: &time1, CreatedAtUntil: &time3},
+			false,
+			[]*models.FileDescriptor{file1V2},
+			1,
+		},
+		{
+			"files with any version received since",
+			[]*models.FileDescriptor{file1V2, file3V1},
+			[]*models.FileDescriptor{receivedAt(file1V1, time3)},
+			&Query{ReceivedSince: &time2},
+			false,
+			[]*models.FileDescriptor{file1V2},
+			1,
+		},
+		{
+			"unknown archetype",
+			[]*models.FileDescriptor{file1V2, file3V1, file2V1},
+			nil,
+			&Query{Archetype: "UNKNOWN"},
+			false,
+			[]*models.FileDescriptor{},
+			0,
+		},
+		{
+			"pagination",
+			[]*models.FileDescriptor{file1V2, file3V1, file2V1},
+			nil,
+			&Query{Offset: 1, Limit: 1},
+			false,
+			[]*models.FileDescriptor{file1V2},
+			3,
+		},
+		{
+			"offset past the end",
+			[]*models.FileDescriptor{file1V2, file3V1, file2V1},
+			nil,
+			&Query{Offset: 3},
+			false,
+			[]*models.FileDescriptor{},
+			3,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			i := &index{}
+			// updates of not yet indexed bucket are ignored
+			i.update("BUCKET", file3V1ALT)
+
+			load := func() ([]*models.FileDescriptor, error) { return test.loaded, nil }
+			if _, _, err := i.query("BUCKET", &Query{}, true, load); err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+			for _, fd := range test.updates {
+				i.update("BUCKET", fd)
+			}
+
+			out, total, err := i.query("BUCKET", test.query, test.deleted, nil)
+			if err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+			if !reflect.DeepEqual(out, test.expected) {
+				t.Errorf("Expected list to equal\n%+v\ngot\n%+v", test.expected, out)
+			}
+			if total != test.total {
+				t.Errorf("Expected total to equal %d, got %d", test.total, total)
+			}
+		})
+	}
+}
+
+func TestIndexVersions(t *testing.T) {
+	i := &index{}
+	load := func() ([]*models.FileDescriptor, error) {
+		return []*models.FileDescriptor{file1V1, file2V1, file2V2}, nil
+	}
+
+	// all versions are kept, including replaced ones and delete markers, and accounted for only once
+	i.update("BUCKET", file1V2)
+	assertVersions(t, i, load, 3)
+	i.update("BUCKET", file1V2)
+	assertVersions(t, i, nil, 4)
+	i.update("BUCKET", file1V2)
+	assertVersions(t, i, nil, 4)
+	i.remove("BUCKET", file2V1)
+	assertVersions(t, i, nil, 3)
+	i.remove("BUCKET", file2V1)
+	assertVersions(t, i, nil, 3)
+}
+
+func TestIndexLoading(t *testing.T) {
+	i := &index{}
+	loads := 0
+	load := func() ([]*models.FileDescriptor, error) {
+		loads++
+		return []*models.FileDescriptor{file1V1}, nil
+	}
+
+	// bucket is indexed once and doesn't expire
+	assertVersions(t, i, load, 1)
+	assertVersions(t, i, load, 1)
+	if loads != 1 {
+		t.Errorf("Expected bucket to be indexed once, got %d times", loads)
+	}
+
+	// dropped bucket is indexed again
+	i.drop("BUCKET")
+	assertVersions(t, i, load, 1)
+	if loads != 2 {
+		t.Errorf("Expected dropped bucket to be indexed again, got %d loads", loads)
+	}
+
+	// failed load is tried again
+	i.drop("BUCKET")
+	if _, err := i.siblings("BUCKET", "", func() ([]*models.FileDescriptor, error) { return nil, fmt.Errorf("Error") }); err == nil {
+		t.Error("Expected error, got nil")
+	}
+	assertVersions(t, i, load, 1)
+}
+
+func TestIndexConcurrentLoading(t *testing.T) {
+	i := &index{}
+	listed := make(chan struct{})
+	release := make(chan struct{})
+	load := func() ([]*models.FileDescriptor, error) {
+		close(listed)
+		<-release
+		// the listing includes one of the versions written meanwhile
+		return []*models.FileDescriptor{file1V1, file1V2}, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assertVersions(t, i, load, 3)
+	}()
+	<-listed
+
+	// other buckets are not blocked by the bucket being loaded
+	if _, err := i.siblings("OTHER", "", func() ([]*models.FileDescriptor, error) { return nil, nil }); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// writes done while the bucket is being loaded are applied once it's loaded, only once
+	i.update("BUCKET", file1V2)
+	i.update("BUCKET", file2V2)
+	close(release)
+	<-done
+
+	// concurrent callers don't load the bucket again
+	assertVersions(t, i, nil, 3)
+}
+
+func assertVersions(t *testing.T, i *index, load func() ([]*models.FileDescriptor, error), expected int) {
+	var versions int
+	err := i.with("BUCKET", load, func(b *bucketIndex) {
+		for _, v := range b.versions {
+			versions += len(v)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if versions != expected {
+		t.Errorf("Expected %d versions to be indexed, got %d", expected, versions)
+	}
+}
+
+// receivedAt returns copy of the file version received by the storage at the time
+func receivedAt(fd *models.FileDescriptor, received strfmt.DateTime) *models.FileDescriptor {
+	f := *fd
+	f.Received = &received
+	return &f
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif" // register GIF decoder
+	"image/jpeg"
+	_ "image/png" // register PNG decoder
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+)
+
+// ErrPreviewUnsupported is returned when preview of the file can't be generated
+var ErrPreviewUnsupported = errors.New("Preview of the file is not supported")
+
+const (
+	// DefaultPreviewSize is the default size of the longer side of previews in pixels
+	DefaultPreviewSize = 256
+	// previewQuality is the JPEG quality of previews
+	previewQuality = 80
+	// maxPreviewSourcePixels limits dimensions of images that are decoded to generate previews, decoded image takes
+	// up to 4 bytes per pixel
+	maxPreviewSourcePixels = 12 * 1000 * 1000
+	// previewCacheSize is the maximum total size of cached previews in bytes
+	previewCacheSize = 64 << 20
+)
+
+// previewSizes lists sizes of previews that are generated, requested sizes are rounded up to one of them so that
+// the cache holds only a few previews of every file
+var previewSizes = []int{64, 128, 256, 512, 1024}
+
+// previewContentTypes lists content types of files previews of which can be generated
+var previewContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+func (s *service) FilePreview(ctx context.Context, bucketID, fileID, version string, size int) (io.ReadCloser, *models.FileDescriptor, error) {
+	size = previewSize(size)
+
+	if p, fd, ok := s.previews.get(bucketID, fileID, version, size); ok {
+		return ioutil.NopCloser(bytes.NewReader(p)), fd, nil
+	}
+
+	start := time.Now()
+	r, fd, err := s.s3.Read(ctx, bucketID, fileID, version)
+	s.logger.Info().Str("method", "FilePreview").Msgf("s3 read time %s", time.Since(start))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	if !previewContentTypes[fd.ContentType] {
+		return nil, nil, ErrPreviewUnsupported
+	}
+
+	start = time.Now()
+	p, err := preview(r, size)
+	s.logger.Info().Str("method", "FilePreview").Msgf("preview generation time %s", time.Since(start))
+	if err != nil {
+		s.logger.Error().Err(err).Str("method", "FilePreview").Str("bucket", bucketID).Str("file", fileID).Str("version", version).
+			Msg("Failed to generate preview")
+		return nil, nil, err
+	}
+	s.previews.add(bucketID, fileID, version, size, p, fd)
+
+	return ioutil.NopCloser(bytes.NewReader(p)), fd, nil
+}
+
+// previewSize returns the smallest of preview sizes not smaller than the requested size, or the largest one
+func previewSize(size int) int {
+	if size <= 0 {
+		return DefaultPreviewSize
+	}
+	for _, s := range previewSizes {
+		if s >= size {
+			return s
+		}
+	}
+
+	return previewSizes[len(previewSizes)-1]
+}
+
+// preview decodes the image and encodes it as JPEG scaled down to fit into size x size pixels
+func preview(r io.Reader, size int) ([]byte, error) {
+	// bytes read while decoding the config are kept to be decoded again together with the rest of the image
+	head := &bytes.Buffer{}
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, head))
+	if err != nil {
+		return nil, ErrPreviewUnsupported
+	}
+	if cfg.Width*cfg.Height > maxPreviewSourcePixels {
+		return nil, ErrPreviewUnsupported
+	}
+	img, _, err := image.Decode(io.MultiReader(head, r))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode image")
+	}
+
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, scale(img, size), &jpeg.Options{Quality: previewQuality}); err != nil {
+		return nil, errors.Wrap(err, "failed to encode preview")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// scale returns the image flattened on white background and scaled down by averaging pixel areas so that its
+// longer side is at most size pixels
+func scale(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	switch {
+	case sw <= size && sh <= size:
+	case sw >= sh:
+		dw, dh = size, max(1, sh*size/sw)
+	default:
+		dw, dh = max(1, sw*size/sh), size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			var sum [3]uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					// colors are alpha-premultiplied, white shows through the transparent part
+					r, g, bl, a := img.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					sum[0] += uint64(r + 0xffff - a)
+					sum[1] += uint64(g + 0xffff - a)
+					sum[2] += uint64(bl + 0xffff - a)
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				dst.Pix[i+c] = uint8(sum[c] / n >> 8)
+			}
+			dst.Pix[i+3] = 0xff
+		}
+	}
+
+	return dst
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// previewCache holds least recently used previews up to previewCacheSize bytes. Previews are
+// keyed by file version and size; previews of all the versions of the file are removed when a new
+// version is written.
+type previewCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+	size    int
+}
+
+type previewEntry struct {
+	key     string
+	preview []byte
+	fd      *models.FileDescriptor
+}
+
+func (c *previewCache) get(bucketID, fileID, version string, size int) ([]byte, *models.FileDescriptor, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[previewKey(bucketID, fileID, version, size)]
+	if !ok {
+		return nil, nil, false
+	}
+	c.lru.MoveToFront(e)
+	entry := e.Value.(*previewEntry)
+
+	return entry.preview, entry.fd, true
+}
+
+func (c *previewCache) add(bucketID, fileID, version string, size int, preview []byte, fd *models.FileDescriptor) {
+	if len(preview) > previewCacheSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	key := previewKey(bucketID, fileID, version, size)
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&previewEntry{key: key, preview: preview, fd: fd})
+	c.size += len(preview)
+
+	for c.size > previewCacheSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate removes previews of all the versions of the file
+func (c *previewCache) invalidate(bucketID, fileID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix := fmt.Sprintf("%s/%s/", bucketID, fileID)
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(e)
+		}
+	}
+}
+
+// remove removes the entry, caller has to hold the lock
+func (c *previewCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*previewEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.preview)
+}
+
+func previewKey(bucketID, fileID, version string, size int) string {
+	return fmt.Sprintf("%s/%s/%s/%d", bucketID, fileID, version, size)
+}
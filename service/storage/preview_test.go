@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+)
+
+func TestFilePreview(t *testing.T) {
+	photo := &models.FileDescriptor{Name: "PHOTO", Version: "V1", ContentType: "image/png", Checksum: "CHS"}
+	testCases := []struct {
+		description   string
+		image         image.Image
+		size          int
+		fd            *models.FileDescriptor
+		readError     error
+		expectedSize  image.Point
+		expectedColor color.Color
+		exactError    error
+	}{
+		{"Landscape image is scaled down to the size", testImage(400, 200), 256, photo, nil, image.Pt(256, 128), color.RGBA{255, 0, 0, 255}, nil},
+		{"Portrait image is scaled down to the size", testImage(100, 1000), 64, photo, nil, image.Pt(6, 64), color.RGBA{255, 0, 0, 255}, nil},
+		{"Small image is not scaled up", testImage(20, 10), 256, photo, nil, image.Pt(20, 10), color.RGBA{255, 0, 0, 255}, nil},
+		{"Size is rounded up to preview size", testImage(1000, 500), 100, photo, nil, image.Pt(128, 64), color.RGBA{255, 0, 0, 255}, nil},
+		{"Size is limited to the largest preview size", testImage(2000, 1000), 5000, photo, nil, image.Pt(1024, 512), color.RGBA{255, 0, 0, 255}, nil},
+		{"Default size", testImage(1000, 1000), 0, photo, nil, image.Pt(DefaultPreviewSize, DefaultPreviewSize), color.RGBA{255, 0, 0, 255}, nil},
+		{"Transparent image is flattened on white", image.NewNRGBA(image.Rect(0, 0, 10, 10)), 256, photo, nil, image.Pt(10, 10), color.RGBA{255, 255, 255, 255}, nil},
+		{"Content type is not supported", testImage(10, 10), 256, &models.FileDescriptor{ContentType: "application/pdf"}, nil, image.Point{}, nil, ErrPreviewUnsupported},
+		{"Contents are not an image", nil, 256, photo, nil, image.Point{}, nil, ErrPreviewUnsupported},
+		{"Version is deleted", nil, 256, nil, s3.ErrDeleted, image.Point{}, nil, ErrDeleted},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, _, c := getTestService(t)
+			defer c()
+
+			// setup calls
+			contents := []byte("contents")
+			if test.image != nil {
+				buf := &bytes.Buffer{}
+				if err := png.Encode(buf, test.image); err != nil {
+					t.Fatalf("Failed to encode image, %v", err)
+				}
+				contents = buf.Bytes()
+			}
+			s.EXPECT().Read(gomock.Any(), "BUCKET", "PHOTO", "V1").Return(ioutil.NopCloser(bytes.NewReader(contents)), test.fd, test.readError)
+
+			// call FilePreview
+			r, fd, err := svc.FilePreview(context.TODO(), "BUCKET", "PHOTO", "V1", test.size)
+
+			if err != test.exactError {
+				t.Fatalf("Expected error to equal '%v', got %v", test.exactError, err)
+			}
+			if err != nil {
+				return
+			}
+			if fd != test.fd {
+				t.Errorf("Expected file descriptor %+v, got %+v", test.fd, fd)
+			}
+			img, err := jpeg.Decode(r)
+			if err != nil {
+				t.Fatalf("Expected JPEG preview, got error %v", err)
+			}
+			if size := img.Bounds().Size(); size != test.expectedSize {
+				t.Errorf("Expected preview size %v, got %v", test.expectedSize, size)
+			}
+			if center := img.At(img.Bounds().Dx()/2, img.Bounds().Dy()/2); !similar(center, test.expectedColor) {
+				t.Errorf("Expected preview color %v, got %v", test.expectedColor, center)
+			}
+		})
+	}
+}
+
+func TestFilePreviewCache(t *testing.T) {
+	svc, s, _, _, c := getTestService(t)
+	defer c()
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, testImage(10, 10)); err != nil {
+		t.Fatalf("Failed to encode image, %v", err)
+	}
+	fd := &models.FileDescriptor{Name: "PHOTO", Version: "V1", ContentType: "image/png"}
+	s.EXPECT().Read(gomock.Any(), "BUCKET", "PHOTO", "V1").DoAndReturn(
+		func(_ context.Context, _, _, _ string) (io.ReadCloser, *models.FileDescriptor, error) {
+			return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), fd, nil
+		}).Times(3)
+
+	preview := func(size int) {
+		if _, _, err := svc.FilePreview(context.TODO(), "BUCKET", "PHOTO", "V1", size); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+
+	// previews of every size are generated once
+	for i := 0; i < 2; i++ {
+		preview(64)
+		preview(128)
+	}
+
+	// previews are generated again only after new version of the file is written
+	svc.previews.invalidate("BUCKET", "OTHER")
+	preview(64)
+	svc.previews.invalidate("BUCKET", "PHOTO")
+	preview(64)
+
+	if svc.previews.lru.Len() != 1 {
+		t.Errorf("Expected 1 cached preview, got %d", svc.previews.lru.Len())
+	}
+}
+
+// testImage returns red image of the size
+func testImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+3] = 255, 255
+	}
+
+	return img
+}
+
+// similar compares colors allowing for JPEG compression artifacts
+func similar(a, b color.Color) bool {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+	for _, d := range []int64{int64(ar) - int64(br), int64(ag) - int64(bg), int64(ab) - int64(bb)} {
+		if d > 0x1000 || d < -0x1000 {
+			return false
+		}
+	}
+
+	return true
+}
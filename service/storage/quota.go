@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+)
+
+// Quotas limit usage of every bucket. Zero values are not limiting.
+type Quotas struct {
+	// SoftSize and SoftObjects are limits of total size in bytes and number of file versions above which
+	// new files and file updates are still accepted but reported
+	SoftSize    int64
+	SoftObjects int64
+	// HardSize and HardObjects are limits of total size in bytes and number of file versions above which
+	// new files and file updates are refused
+	HardSize    int64
+	HardObjects int64
+}
+
+// ErrQuotaExceeded is returned when writing the file would exceed the hard quota of the bucket
+var ErrQuotaExceeded = errors.New("Bucket quota exceeded")
+
+func (s *service) BucketUsage(ctx context.Context, bucketID string) (*models.BucketUsage, error) {
+	exists, err := s.s3.BucketExists(ctx, bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("method", "BucketUsage").Str("bucket", bucketID).Msg("Failed to check if bucket exists")
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	return s.usage(ctx, bucketID)
+}
+
+// usage returns usage of existing bucket
+func (s *service) usage(ctx context.Context, bucketID string) (*models.BucketUsage, error) {
+	size, objects, err := s.s3.Usage(ctx, bucketID)
+	if err != nil {
+		s.logger.Error().Err(err).Str("method", "usage").Str("bucket", bucketID).Msg("Failed to get bucket usage")
+		return nil, err
+	}
+
+	return &models.BucketUsage{
+		Size:              size,
+		Objects:           objects,
+		SoftQuotaSize:     s.quotas.SoftSize,
+		SoftQuotaObjects:  s.quotas.SoftObjects,
+		HardQuotaSize:     s.quotas.HardSize,
+		HardQuotaObjects:  s.quotas.HardObjects,
+		SoftQuotaExceeded: exceeds(size, s.quotas.SoftSize) || exceeds(objects, s.quotas.SoftObjects),
+	}, nil
+}
+
+// checkQuota returns ErrQuotaExceeded if writing a new file version of the size would exceed the hard quota
+// of the bucket. Exceeding the soft quota is only logged.
+func (s *service) checkQuota(ctx context.Context, bucketID string, size int64) error {
+	if s.quotas == (Quotas{}) {
+		return nil
+	}
+
+	u, err := s.usage(ctx, bucketID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case exceeds(u.Size+size, s.quotas.HardSize) || exceeds(u.Objects+1, s.quotas.HardObjects):
+		s.logger.Error().Str("method", "checkQuota").Str("bucket", bucketID).
+			Int64("size", u.Size).Int64("objects", u.Objects).
+			Msg("Hard quota exceeded, write refused")
+		return ErrQuotaExceeded
+	case exceeds(u.Size+size, s.quotas.SoftSize) || exceeds(u.Objects+1, s.quotas.SoftObjects):
+		s.logger.Warn().Str("method", "checkQuota").Str("bucket", bucketID).
+			Int64("size", u.Size).Int64("objects", u.Objects).
+			Msg("Soft quota exceeded")
+	}
+
+	return nil
+}
+
+// exceeds returns true if the value exceeds the limit, zero limit is never exceeded
+func exceeds(value, limit int64) bool {
+	return limit > 0 && value > limit
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3/mock"
+)
+
+func TestBucketUsage(t *testing.T) {
+	testCases := []struct {
+		description   string
+		calls         func(*mock.MockStorage) []*gomock.Call
+		expected      *models.BucketUsage
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"Bucket not found",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, nil),
+				}
+			},
+			nil,
+			withErrors,
+			ErrNotFound,
+		},
+		{
+			"Usage fails",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().Usage(gomock.Any(), "BUCKET").Return(int64(0), int64(0), fmt.Errorf("Error")),
+				}
+			},
+			nil,
+			withErrors,
+			fmt.Errorf("Error"),
+		},
+		{
+			"Usage is reported together with quotas",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().Usage(gomock.Any(), "BUCKET").Return(int64(15714), int64(4), nil),
+				}
+			},
+			&models.BucketUsage{
+				Size:              15714,
+				Objects:           4,
+				SoftQuotaSize:     10000,
+				HardQuotaObjects:  10,
+				SoftQuotaExceeded: true,
+			},
+			noErrors,
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, _, c := getTestService(t)
+			defer c()
+			svc.quotas = Quotas{SoftSize: 10000, HardObjects: 10}
+
+			// setup calls
+			gomock.InOrder(test.calls(s)...)
+
+			// call BucketUsage
+			out, err := svc.BucketUsage(context.TODO(), "BUCKET")
+
+			// check expected results
+			if !reflect.DeepEqual(out, test.expected) {
+				t.Errorf("Expected usage to equal\n%+v\ngot\n%+v", test.expected, out)
+			}
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError.Error() != err.Error() {
+				t.Errorf("Expected error to equal '%v', got %v", test.exactError, err)
+			}
+		})
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	testCases := []struct {
+		description string
+		quotas      Quotas
+		size        int64
+		exactError  error
+	}{
+		{"No quotas", Quotas{}, 1000000, nil},
+		{"Within quotas", Quotas{SoftSize: 100, HardSize: 200, SoftObjects: 3, HardObjects: 4}, 84, nil},
+		{"Soft size quota exceeded", Quotas{SoftSize: 100, HardSize: 200}, 85, nil},
+		{"Soft objects quota exceeded", Quotas{SoftObjects: 2, HardObjects: 4}, 1, nil},
+		{"Hard size quota exceeded", Quotas{SoftSize: 100, HardSize: 200}, 185, ErrQuotaExceeded},
+		{"Hard objects quota exceeded", Quotas{HardObjects: 2}, 1, ErrQuotaExceeded},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, _, c := getTestService(t)
+			defer c()
+			svc.quotas = test.quotas
+
+			// setup calls
+			s.EXPECT().Usage(gomock.Any(), "BUCKET").Return(int64(16), int64(2), nil).AnyTimes()
+
+			// call checkQuota
+			err := svc.checkQuota(context.TODO(), "BUCKET", test.size)
+
+			if err != test.exactError {
+				t.Errorf("Expected error to equal '%v', got %v", test.exactError, err)
+			}
+		})
+	}
+}
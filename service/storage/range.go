@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/iryonetwork/wwm/utils/contentEncoding"
+)
+
+// byteRange is a range of bytes of the file requested in the Range header
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+// contentRange returns value of the Content-Range header for the range of the file of the size
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.offset, r.offset+r.length-1, size)
+}
+
+// parseRange parses value of the Range header for the file of the size. Returns nil if the header should be
+// ignored and the whole file returned: when it's empty, malformed or requests multiple ranges. Returns false
+// if the range can't be satisfied.
+func parseRange(header string, size int64) (*byteRange, bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, true
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return nil, true
+	}
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return nil, true
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	// suffix range with the length of the last part of the file
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return nil, true
+		}
+		if n == 0 || size == 0 {
+			return nil, false
+		}
+		if n > size {
+			n = size
+		}
+		return &byteRange{offset: size - n, length: n}, true
+	}
+
+	offset, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || offset < 0 {
+		return nil, true
+	}
+	if offset >= size {
+		return nil, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < offset {
+			return nil, true
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return &byteRange{offset: offset, length: end - offset + 1}, true
+}
+
+// etag returns entity tag of the file version with the checksum
+func etag(checksum string) string {
+	return strconv.Quote(checksum)
+}
+
+// encodedETag returns entity tag of the file version encoded with the content coding, encoded contents differ from
+// the original ones byte by byte so they need a tag of their own
+func encodedETag(checksum, encoding string) string {
+	if encoding == "" || encoding == contentEncoding.Identity {
+		return etag(checksum)
+	}
+
+	return etag(checksum + "-" + encoding)
+}
+
+// matchesETag checks if value of the If-None-Match header matches the entity tag
+func matchesETag(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	testCases := []struct {
+		description  string
+		header       string
+		expected     *byteRange
+		satisfiable  bool
+		contentRange string
+	}{
+		{"empty header", "", nil, true, ""},
+		{"unsupported unit", "items=0-1", nil, true, ""},
+		{"multiple ranges", "bytes=0-1,4-5", nil, true, ""},
+		{"malformed range", "bytes=a-b", nil, true, ""},
+		{"first bytes", "bytes=0-3", &byteRange{offset: 0, length: 4}, true, "bytes 0-3/8"},
+		{"open ended range", "bytes=5-", &byteRange{offset: 5, length: 3}, true, "bytes 5-7/8"},
+		{"range past the end", "bytes=6-100", &byteRange{offset: 6, length: 2}, true, "bytes 6-7/8"},
+		{"suffix range", "bytes=-3", &byteRange{offset: 5, length: 3}, true, "bytes 5-7/8"},
+		{"suffix longer than file", "bytes=-100", &byteRange{offset: 0, length: 8}, true, "bytes 0-7/8"},
+		{"range starting after the end", "bytes=8-", nil, false, ""},
+		{"empty suffix", "bytes=-0", nil, false, ""},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			r, satisfiable := parseRange(test.header, 8)
+
+			if !reflect.DeepEqual(r, test.expected) {
+				t.Errorf("Expected range to equal %+v, got %+v", test.expected, r)
+			}
+			if satisfiable != test.satisfiable {
+				t.Errorf("Expected satisfiable to equal %v, got %v", test.satisfiable, satisfiable)
+			}
+			if r != nil && r.contentRange(8) != test.contentRange {
+				t.Errorf("Expected content range to equal %s, got %s", test.contentRange, r.contentRange(8))
+			}
+		})
+	}
+}
+
+func TestMatchesETag(t *testing.T) {
+	tag := etag("CHS")
+
+	testCases := []struct {
+		header   string
+		expected bool
+	}{
+		{`"CHS"`, true},
+		{`W/"CHS"`, true},
+		{`"OTHER", "CHS"`, true},
+		{`*`, true},
+		{`"OTHER"`, false},
+		{`CHS`, false},
+	}
+
+	for _, test := range testCases {
+		if out := matchesETag(test.header, tag); out != test.expected {
+			t.Errorf("Expected matchesETag(%s) to equal %v, got %v", test.header, test.expected, out)
+		}
+	}
+}
+
+func TestEncodedETag(t *testing.T) {
+	testCases := []struct {
+		encoding string
+		expected string
+	}{
+		{"", `"CHS"`},
+		{"identity", `"CHS"`},
+		{"gzip", `"CHS-gzip"`},
+	}
+
+	for _, test := range testCases {
+		if out := encodedETag("CHS", test.encoding); out != test.expected {
+			t.Errorf("Expected encodedETag(%s) to equal %s, got %s", test.encoding, test.expected, out)
+		}
+	}
+
+	// client holding the original contents doesn't hold the encoded ones
+	if matchesETag(`"CHS"`, encodedETag("CHS", "gzip")) {
+		t.Error("Expected tag of the original contents not to match the encoded ones")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/iryonetwork/wwm/storage/s3/object"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
 	"github.com/iryonetwork/wwm/utils"
+	"github.com/iryonetwork/wwm/utils/spool"
 )
 
 // Service describes storage service's public API.
@@ -25,12 +26,15 @@ type Service interface {
 	// Checksum calculates the checksum of a given reader using sha256.Sum.
 	Checksum(r io.Reader) (string, error)
 
-	// BucketList returns list of all the buckets.
+	// BucketList returns list of all the buckets with their usage.
 	BucketList(ctx context.Context) ([]*models.BucketDescriptor, error)
 
-	// FileList returns a list of latest versions of files. Older versions and
-	// files marked as deleted are removed from the list.
-	FileList(ctx context.Context, bucketID string) ([]*models.FileDescriptor, error)
+	// BucketUsage returns total size and number of stored file versions of the bucket together with its quotas.
+	BucketUsage(ctx context.Context, bucketID string) (*models.BucketUsage, error)
+
+	// FileList returns a page of the list of latest versions of files matching the query and the
+	// total number of matching files. Older versions and files marked as deleted are removed from the list.
+	FileList(ctx context.Context, bucketID string, query *Query) ([]*models.FileDescriptor, int64, error)
 
 	// FileGet returns the latest version of the file by returning the reader
 	// and file details.
@@ -39,27 +43,82 @@ type Service interface {
 	// FileGetVersion returns a specific version of a file.
 	FileGetVersion(ctx context.Context, bucketID, fileID, version string) (io.ReadCloser, *models.FileDescriptor, error)
 
-	// FileListVersions returns a list of all modifications to a file.
+	// FileGetRange returns length bytes of a specific version of a file starting at the offset; empty
+	// version refers to the latest version and negative length reads until the end of the file.
+	FileGetRange(ctx context.Context, bucketID, fileID, version string, offset, length int64) (io.ReadCloser, *models.FileDescriptor, error)
+
+	// FilePreview returns JPEG preview of a specific version of an image file scaled down to fit into size x size
+	// pixels. Returns ErrPreviewUnsupported if preview of the file can't be generated.
+	FilePreview(ctx context.Context, bucketID, fileID, version string, size int) (io.ReadCloser, *models.FileDescriptor, error)
+
+	// FileListVersions returns a list of all modifications to a file. Sibling versions in conflict are flagged.
 	FileListVersions(ctx context.Context, bucketID, fileID string, createdAtSince, createdAtUntil *strfmt.DateTime) ([]*models.FileDescriptor, error)
 
-	// FileNew creates a new file.
+	// FileNew creates a new file. Returns *ValidationError if the file is not valid and ErrQuotaExceeded
+	// if the hard quota of the bucket would be exceeded.
 	FileNew(ctx context.Context, bucketID string, r io.Reader, contentType string, archetype string, labels []string) (*models.FileDescriptor, error)
 
-	// FileUpdate creates a new version of a file.
+	// FileUpdate creates a new version of a file. Returns *ValidationError if the file is not valid and
+	// ErrQuotaExceeded if the hard quota of the bucket would be exceeded.
 	FileUpdate(ctx context.Context, bucketID, fileID string, r io.Reader, contentType string, archetype string, labels []string) (*models.FileDescriptor, error)
 
 	// FileDelete marks file as deleted.
 	FileDelete(ctx context.Context, bucketID, fileID string) error
 
-	// SyncFileList returns a list of latest versions of files. Older versions are removed from the list.
-	// Files marked as deleted are kept in the list.
-	SyncFileList(ctx context.Context, bucketID string, createdAtSince, createdAtUntil *strfmt.DateTime) ([]*models.FileDescriptor, error)
+	// SyncFileList returns a page of the list of latest versions of files matching the query and the
+	// total number of matching files. Older versions are removed from the list. Files marked as deleted
+	// are kept in the list.
+	SyncFileList(ctx context.Context, bucketID string, query *Query) ([]*models.FileDescriptor, int64, error)
+
+	// SyncFile syncs file with provided fileID and version derived from parent versions. Quotas are not enforced,
+	// files are validated unless validation of synced files is bypassed for the bucket. Version written
+	// concurrently with other version of the file is kept as its sibling and flagged as in conflict. Source is
+	// the ID of the storage where the version was created, synced versions are not published as sync events.
+	SyncFile(ctx context.Context, bucketID, fileID, version string, r io.Reader, checksum, contentType string, created strfmt.DateTime, archetype string, labels, parents []string, source string) (*models.FileDescriptor, error)
+
+	// SyncFileDelete sync file deletion created in the source storage. Deletion derived from parents that is
+	// concurrent with other versions is kept as their sibling, ErrDeleted is returned if the file is deleted
+	// already by another deletion and the lineage of this one is not known.
+	SyncFileDelete(ctx context.Context, bucketID, fileID, version string, created strfmt.DateTime, parents []string, source string) error
+
+	// BucketEvict removes all the files of the bucket without marking them as deleted so that their removal
+	// is not synced. Files under legal hold are kept.
+	BucketEvict(ctx context.Context, bucketID string) error
+
+	// UploadNew creates a resumable upload of a new file or of a new version of the file if fileID is set.
+	UploadNew(ctx context.Context, bucketID, fileID string, size int64, checksum, contentType, archetype string, labels []string) (*models.UploadDescriptor, error)
+
+	// UploadGet returns the upload with ranges of contents received so far.
+	UploadGet(ctx context.Context, bucketID, uploadID string) (*models.UploadDescriptor, error)
+
+	// UploadChunk stores the chunk of contents of the upload starting at the offset.
+	UploadChunk(ctx context.Context, bucketID, uploadID string, offset int64, r io.Reader) (*models.UploadDescriptor, error)
+
+	// UploadFinalize writes the file from contents of the upload and removes the upload.
+	UploadFinalize(ctx context.Context, bucketID, uploadID string) (*models.FileDescriptor, error)
+
+	// UploadDelete aborts the upload removing received chunks.
+	UploadDelete(ctx context.Context, bucketID, uploadID string) error
+
+	// UploadCollectGarbage removes expired uploads from all the buckets.
+	UploadCollectGarbage(ctx context.Context) error
+
+	// FileConflicts returns latest versions of files of the bucket that have concurrently written sibling
+	// versions in conflict.
+	FileConflicts(ctx context.Context, bucketID string) ([]*models.FileDescriptor, error)
+
+	// FileResolve resolves the conflict of the file by creating a new version derived from all the sibling
+	// versions. The new version holds contents of the chosen sibling version if r is nil, merged contents read
+	// from r otherwise. Returns ErrNoConflict if the file is not in conflict and ErrNotSibling if the chosen
+	// version is not one of the siblings.
+	FileResolve(ctx context.Context, bucketID, fileID, version string, r io.Reader, contentType string, archetype string, labels []string) (*models.FileDescriptor, error)
 
-	// SyncFile syncs file with provided fileID and version.
-	SyncFile(ctx context.Context, bucketID, fileID, version string, r io.Reader, contentType string, created strfmt.DateTime, archetype string, labels []string) (*models.FileDescriptor, error)
+	// HoldSet puts the file under legal hold so that it can't be updated or deleted. Empty fileID
+	// puts the whole bucket under legal hold.
+	HoldSet(ctx context.Context, bucketID, fileID string) error
 
-	// SyncFileDelete sync file deletion.
-	SyncFileDelete(ctx context.Context, bucketID, fileID, version string, created strfmt.DateTime) error
+	// HoldRelease releases legal hold of the file or of the whole bucket if fileID is empty.
+	HoldRelease(ctx context.Context, bucketID, fileID string) error
 }
 
 // Bucket or item was already deleted
@@ -71,6 +130,15 @@ var ErrNotFound = s3.ErrNotFound
 // Item already exists
 var ErrAlreadyExists = s3.ErrAlreadyExists
 
+// Range starts after the end of the file
+var ErrInvalidRange = s3.ErrInvalidRange
+
+// ErrLegalHold is returned when changing or removing file that is under legal hold
+var ErrLegalHold = s3.ErrLegalHold
+
+// ErrMetadataTooLarge is returned when labels, parents and other metadata of the file are too large to be stored
+var ErrMetadataTooLarge = s3.ErrMetadataTooLarge
+
 // forbidden buckets that should not be returned
 var forbiddenBuckets = [...]string{"encounters", "patients"}
 
@@ -78,6 +146,11 @@ type service struct {
 	s3          s3.Storage
 	keyProvider s3.KeyProvider
 	publisher   storageSync.Publisher
+	uploadTTL   time.Duration
+	quotas      Quotas
+	validator   Validator
+	index       index
+	previews    previewCache
 	logger      zerolog.Logger
 }
 
@@ -94,50 +167,29 @@ func (s *service) BucketList(ctx context.Context) ([]*models.BucketDescriptor, e
 	// get the list and return
 	b, err := s.s3.ListBuckets(ctx)
 
+	if err != nil {
+		return nil, err
+	}
+
 	// skip forbidden buckets
 	var buckets []*models.BucketDescriptor
 	for _, bucket := range b {
 		if !utils.SliceContains(forbiddenBuckets[:], bucket.Name) {
-			buckets = append(buckets, bucket)
+			usage, err := s.usage(ctx, bucket.Name)
+			if err != nil {
+				return nil, err
+			}
+			b := *bucket
+			b.Usage = usage
+			buckets = append(buckets, &b)
 		}
 	}
 
-	return buckets, err
+	return buckets, nil
 }
 
-func (s *service) FileList(ctx context.Context, bucketID string) ([]*models.FileDescriptor, error) {
-	// init list to return
-	list := []*models.FileDescriptor{}
-
-	// check if bucket exists
-	exists, err := s.s3.BucketExists(ctx, bucketID)
-	if err != nil {
-		s.logger.Info().Err(err).Str("bucket", bucketID).Msg("Failed to check if bucket exists")
-		return nil, err
-	}
-	if !exists {
-		return list, nil
-	}
-
-	// collect the list
-	l, err := s.s3.List(ctx, bucketID, "")
-	if err != nil {
-		return nil, err
-	}
-
-	// extract only latest versions; latest version is already sorted
-	// on top, add to return list; only include files with a write operation
-	m := map[string]bool{}
-	for _, f := range l {
-		if _, ok := m[f.Name]; !ok {
-			m[f.Name] = true
-			if s3.Operation(f.Operation) == s3.Write {
-				list = append(list, f)
-			}
-		}
-	}
-
-	return list, nil
+func (s *service) FileList(ctx context.Context, bucketID string, query *Query) ([]*models.FileDescriptor, int64, error) {
+	return s.list(ctx, bucketID, query, false)
 }
 
 func (s *service) FileGet(ctx context.Context, bucketID, fileID string) (io.ReadCloser, *models.FileDescriptor, error) {
@@ -156,6 +208,14 @@ func (s *service) FileGetVersion(ctx context.Context, bucketID, fileID, version
 	return rc, fd, err
 }
 
+func (s *service) FileGetRange(ctx context.Context, bucketID, fileID, version string, offset, length int64) (io.ReadCloser, *models.FileDescriptor, error) {
+	start := time.Now()
+	rc, fd, err := s.s3.ReadRange(ctx, bucketID, fileID, version, offset, length)
+	s.logger.Info().Str("method", "FileGetRange").Msgf("s3 read time %s", time.Since(start))
+
+	return rc, fd, err
+}
+
 func (s *service) FileListVersions(ctx context.Context, bucketID, fileID string, createdAtSince, createdAtUntil *strfmt.DateTime) ([]*models.FileDescriptor, error) {
 	// init list to return
 	list := []*models.FileDescriptor{}
@@ -171,8 +231,12 @@ func (s *service) FileListVersions(ctx context.Context, bucketID, fileID string,
 	}
 
 	l, err := s.s3.List(ctx, bucketID, fileID)
-	if (createdAtSince == nil && createdAtUntil == nil) || err != nil {
-		return l, err
+	if err != nil {
+		return nil, err
+	}
+	flagSiblings(l)
+	if createdAtSince == nil && createdAtUntil == nil {
+		return l, nil
 	}
 
 	// extract only versions fitting the created timestamp filtering specified
@@ -192,13 +256,23 @@ func (s *service) FileNew(ctx context.Context, bucketID string, r io.Reader, con
 		return nil, err
 	}
 
-	// calculate the checksum
-	var buf bytes.Buffer
-	tee := io.TeeReader(r, &buf)
-
-	checksum, err := s.Checksum(tee)
+	// spool the contents calculating the checksum
+	f, contents, err := s.spool(r)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Failed to calculate checksum")
+		s.logger.Error().Err(err).Str("method", "FileNew").Msg("Failed to spool file contents")
+		return nil, err
+	}
+	defer f.Close()
+
+	return s.writeNew(ctx, bucketID, f, contents, contentType, archetype, labels)
+}
+
+// writeNew writes spooled contents as a new file
+func (s *service) writeNew(ctx context.Context, bucketID string, f *spool.File, contents io.Reader, contentType string, archetype string, labels []string) (*models.FileDescriptor, error) {
+	if err := s.validate(f, contentType, archetype); err != nil {
+		return nil, err
+	}
+	if err := s.checkQuota(ctx, bucketID, f.Size()); err != nil {
 		return nil, err
 	}
 
@@ -206,8 +280,8 @@ func (s *service) FileNew(ctx context.Context, bucketID string, r io.Reader, con
 	version := getUUID()
 	no := &object.NewObjectInfo{
 		Archetype:   archetype,
-		Size:        int64(buf.Len()),
-		Checksum:    checksum,
+		Size:        f.Size(),
+		Checksum:    f.Checksum(),
 		Created:     getTime(),
 		ContentType: contentType,
 		Version:     version,
@@ -216,16 +290,18 @@ func (s *service) FileNew(ctx context.Context, bucketID string, r io.Reader, con
 		Labels:      labels,
 	}
 
+	published, err := s.record(ctx, "FileNew", storageSync.FileNew, &storageSync.FileInfo{BucketID: bucketID, FileID: fileID, Version: version, Created: no.Created})
+	if err != nil {
+		return nil, err
+	}
+
 	start := time.Now()
-	fd, err := s.s3.Write(ctx, bucketID, no, &buf)
+	fd, err := s.s3.Write(ctx, bucketID, no, contents)
 	s.logger.Info().Str("method", "FileNew").Msgf("s3 write time %s", time.Since(start))
+	published(err)
 
 	if err == nil {
-		errorChecker.LogError(s.publisher.PublishAsyncWithRetries(
-			context.TODO(),
-			storageSync.FileNew,
-			&storageSync.FileInfo{BucketID: bucketID, FileID: fileID, Version: version, Created: fd.Created},
-		))
+		s.index.update(bucketID, fd)
 
 		for _, label := range labels {
 			err := s.updateFilesCollection(ctx, s3.Write, bucketID, label, fd)
@@ -247,39 +323,58 @@ func (s *service) FileUpdate(ctx context.Context, bucketID, fileID string, r io.
 	if err != nil {
 		return nil, err
 	}
+	if old.LegalHold {
+		return nil, ErrLegalHold
+	}
 
-	// calculate the checksum
-	var buf bytes.Buffer
-	tee := io.TeeReader(r, &buf)
-	checksum, err := s.Checksum(tee)
+	// spool the contents calculating the checksum
+	f, contents, err := s.spool(r)
 	if err != nil {
-		s.logger.Error().Err(err).Str("method", "FileUpdate").Msg("Failed to calculate checksum")
+		s.logger.Error().Err(err).Str("method", "FileUpdate").Msg("Failed to spool file contents")
+		return nil, err
+	}
+	defer f.Close()
+
+	return s.writeUpdate(ctx, bucketID, fileID, old, []string{old.Version}, f, contents, contentType, archetype, labels)
+}
+
+// writeUpdate writes spooled contents as a new version of the file derived from parent versions replacing
+// the old version
+func (s *service) writeUpdate(ctx context.Context, bucketID, fileID string, old *models.FileDescriptor, parents []string, f *spool.File, contents io.Reader, contentType string, archetype string, labels []string) (*models.FileDescriptor, error) {
+	if err := s.validate(f, contentType, archetype); err != nil {
+		return nil, err
+	}
+	if err := s.checkQuota(ctx, bucketID, f.Size()); err != nil {
 		return nil, err
 	}
 
 	version := getUUID()
 	no := &object.NewObjectInfo{
 		Archetype:   archetype,
-		Checksum:    checksum,
-		Size:        int64(buf.Len()),
+		Checksum:    f.Checksum(),
+		Size:        f.Size(),
 		Created:     getTime(),
 		ContentType: contentType,
 		Version:     version,
 		Name:        fileID,
 		Operation:   string(s3.Write),
 		Labels:      labels,
+		Parents:     parents,
 	}
 
-	start = time.Now()
-	fd, err := s.s3.Write(ctx, bucketID, no, &buf)
+	published, err := s.record(ctx, "FileUpdate", storageSync.FileUpdate, &storageSync.FileInfo{BucketID: bucketID, FileID: fileID, Version: version, Created: no.Created})
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	fd, err := s.s3.Write(ctx, bucketID, no, contents)
 	s.logger.Info().Str("method", "FileUpdate").Msgf("s3 write time %s", time.Since(start))
+	published(err)
 
 	if err == nil {
-		errorChecker.LogError(s.publisher.PublishAsyncWithRetries(
-			context.TODO(),
-			storageSync.FileUpdate,
-			&storageSync.FileInfo{BucketID: bucketID, FileID: fileID, Version: version, Created: fd.Created},
-		))
+		s.index.update(bucketID, fd)
+		s.previews.invalidate(bucketID, fileID)
 
 		for _, label := range labels {
 			err := s.updateFilesCollection(ctx, s3.Write, bucketID, label, fd)
@@ -308,30 +403,43 @@ func (s *service) FileDelete(ctx context.Context, bucketID, fileID string) error
 	if err != nil {
 		return err
 	}
+	if fd.LegalHold {
+		return ErrLegalHold
+	}
+
+	_, err = s.writeDelete(ctx, bucketID, fileID, fd, []string{fd.Version})
+	return err
+}
 
+// writeDelete marks the file as deleted writing new version derived from parent versions
+func (s *service) writeDelete(ctx context.Context, bucketID, fileID string, old *models.FileDescriptor, parents []string) (*models.FileDescriptor, error) {
 	version := getUUID()
 	no := &object.NewObjectInfo{
-		Archetype:   fd.Archetype,
+		Archetype:   old.Archetype,
 		Checksum:    "",
 		Size:        0,
 		Created:     getTime(),
-		ContentType: fd.ContentType,
+		ContentType: old.ContentType,
 		Version:     version,
 		Name:        fileID,
 		Operation:   string(s3.Delete),
-		Labels:      fd.Labels,
+		Labels:      old.Labels,
+		Parents:     parents,
 	}
 
-	start = time.Now()
-	fd, err = s.s3.Write(ctx, bucketID, no, &bytes.Buffer{})
+	published, err := s.record(ctx, "FileDelete", storageSync.FileDelete, &storageSync.FileInfo{BucketID: bucketID, FileID: fileID, Version: version, Created: no.Created})
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	fd, err := s.s3.Write(ctx, bucketID, no, &bytes.Buffer{})
 	s.logger.Info().Str("method", "FileDelete").Msgf("s3 write time %s", time.Since(start))
+	published(err)
 
 	if err == nil {
-		errorChecker.LogError(s.publisher.PublishAsyncWithRetries(
-			context.TODO(),
-			storageSync.FileDelete,
-			&storageSync.FileInfo{BucketID: bucketID, FileID: fileID, Version: version, Created: fd.Created},
-		))
+		s.index.update(bucketID, fd)
+		s.previews.invalidate(bucketID, fileID)
 		for _, label := range fd.Labels {
 			err := s.updateFilesCollection(ctx, s3.Delete, bucketID, label, fd)
 			if err != nil {
@@ -339,61 +447,66 @@ func (s *service) FileDelete(ctx context.Context, bucketID, fileID string) error
 			}
 		}
 	}
-	return err
+	return fd, err
 }
 
-func (s *service) SyncFileList(ctx context.Context, bucketID string, createdAtSince, createdAtUntil *strfmt.DateTime) ([]*models.FileDescriptor, error) {
-	// init list to return
-	list := []*models.FileDescriptor{}
+func (s *service) SyncFileList(ctx context.Context, bucketID string, query *Query) ([]*models.FileDescriptor, int64, error) {
+	return s.list(ctx, bucketID, query, true)
+}
 
+// list queries the index of latest versions of files in the bucket, files marked as deleted are
+// included only if deleted is set
+func (s *service) list(ctx context.Context, bucketID string, query *Query, deleted bool) ([]*models.FileDescriptor, int64, error) {
 	// check if bucket exists
 	exists, err := s.s3.BucketExists(ctx, bucketID)
 	if err != nil {
-		s.logger.Info().Err(err).Str("method", "SyncFileList").Str("bucket", bucketID).Msg("Failed to check if bucket exists")
-		return nil, err
+		s.logger.Info().Err(err).Str("method", "list").Str("bucket", bucketID).Msg("Failed to check if bucket exists")
+		return nil, 0, err
 	}
 	if !exists {
-		return list, nil
+		return []*models.FileDescriptor{}, 0, nil
 	}
 
-	// collect the list
-	l, err := s.s3.List(ctx, bucketID, "")
-	if err != nil {
-		return nil, err
+	if query == nil {
+		query = &Query{}
 	}
 
-	// extract only latest versions of files; latest version is already sorted
-	// omit files that don't fit specified created timestamp filtering
-	// on top, add to return list
-	m := map[string]bool{}
-	for _, f := range l {
-		if _, ok := m[f.Name]; !ok {
-			m[f.Name] = true
-			if (createdAtSince == nil || (createdAtSince != nil && time.Time(*createdAtSince).Before(time.Time(f.Created)))) &&
-				(createdAtUntil == nil || (createdAtUntil != nil && time.Time(*createdAtUntil).After(time.Time(f.Created)))) {
-				list = append(list, f)
-			}
-		}
-	}
+	return s.index.query(bucketID, query, deleted, s.loadVersions(ctx, bucketID))
+}
 
-	return list, nil
+// loadVersions returns function listing all the versions of files in the bucket to be indexed
+func (s *service) loadVersions(ctx context.Context, bucketID string) func() ([]*models.FileDescriptor, error) {
+	return func() ([]*models.FileDescriptor, error) {
+		start := time.Now()
+		l, err := s.s3.List(ctx, bucketID, "")
+		s.logger.Info().Str("method", "loadVersions").Str("bucket", bucketID).Msgf("s3 list time %s", time.Since(start))
+		return l, err
+	}
 }
 
-func (s *service) SyncFile(ctx context.Context, bucketID, fileID, version string, r io.Reader, contentType string, created strfmt.DateTime, archetype string, labels []string) (*models.FileDescriptor, error) {
+func (s *service) SyncFile(ctx context.Context, bucketID, fileID, version string, r io.Reader, checksum, contentType string, created strfmt.DateTime, archetype string, labels, parents []string, source string) (*models.FileDescriptor, error) {
 	err := s.EnsureBucket(ctx, bucketID)
 	if err != nil {
 		return nil, err
 	}
 
-	// calculate the checksum
-	var buf bytes.Buffer
-
-	tee := io.TeeReader(r, &buf)
-	checksum, err := s.Checksum(tee)
+	// spool the contents calculating the checksum
+	f, contents, err := s.spool(r)
 	if err != nil {
-		s.logger.Error().Err(err).Str("method", "SyncFile").Msg("Failed to calculate checksum")
+		s.logger.Error().Err(err).Str("method", "SyncFile").Msg("Failed to spool file contents")
 		return nil, err
 	}
+	defer f.Close()
+	// contents are checked here so that every synced file version is covered regardless of the caller
+	if err := f.Verify(checksum); err != nil {
+		s.logger.Error().Err(err).Str("method", "SyncFile").Msg("File contents don't match the checksum")
+		return nil, ErrChecksumMismatch
+	}
+	if s.validator == nil || !s.validator.SyncBypassed(bucketID) {
+		if err := s.validate(f, contentType, archetype); err != nil {
+			return nil, err
+		}
+	}
 
 	// try to fetch
 	start := time.Now()
@@ -420,6 +533,8 @@ func (s *service) SyncFile(ctx context.Context, bucketID, fileID, version string
 				Msg("Error while trying to delete file")
 			return nil, err
 		}
+		s.index.remove(bucketID, fd)
+		s.previews.invalidate(bucketID, fileID)
 	// Storage returned error and it is not "not found"
 	case err != nil && err != s3.ErrNotFound:
 		s.logger.Error().Err(err).Str("method", "SyncFile").
@@ -430,23 +545,43 @@ func (s *service) SyncFile(ctx context.Context, bucketID, fileID, version string
 	no := &object.NewObjectInfo{
 		Archetype:   archetype,
 		Checksum:    checksum,
-		Size:        int64(buf.Len()),
+		Size:        f.Size(),
 		Created:     created,
 		ContentType: contentType,
 		Version:     version,
 		Name:        fileID,
 		Operation:   string(s3.Write),
 		Labels:      labels,
+		Parents:     parents,
+		Source:      source,
 	}
 
 	start = time.Now()
-	fd, err = s.s3.Write(ctx, bucketID, no, &buf)
+	fd, err = s.s3.Write(ctx, bucketID, no, contents)
 	s.logger.Info().Str("method", "SyncFile").Msgf("s3 write time %s", time.Since(start))
 
-	return fd, err
+	if err != nil {
+		return nil, err
+	}
+	s.index.update(bucketID, fd)
+	s.previews.invalidate(bucketID, fileID)
+
+	// versions written concurrently are kept as siblings until the conflict is resolved
+	if err := s.index.flag(bucketID, s.loadVersions(ctx, bucketID), fd); err != nil {
+		s.logger.Error().Err(err).Str("method", "SyncFile").Msg("Failed to look for conflicting versions")
+	}
+	if fd.Conflict {
+		s.logger.Warn().Str("method", "SyncFile").
+			Str("bucket", bucketID).
+			Str("file", fileID).
+			Strs("siblings", fd.Siblings).
+			Msg("File version conflicts with concurrently written versions")
+	}
+
+	return fd, nil
 }
 
-func (s *service) SyncFileDelete(ctx context.Context, bucketID, fileID, version string, created strfmt.DateTime) error {
+func (s *service) SyncFileDelete(ctx context.Context, bucketID, fileID, version string, created strfmt.DateTime, parents []string, source string) error {
 	// get the previous file
 	start := time.Now()
 	_, fd, err := s.s3.Read(ctx, bucketID, fileID, "")
@@ -457,16 +592,22 @@ func (s *service) SyncFileDelete(ctx context.Context, bucketID, fileID, version
 	}
 
 	// File was already deleted
-	if fd.Operation == string(s3.Delete) {
-		if fd.Version == version {
-			s.logger.Debug().Str("method", "SyncFileDelete").
-				Msg("File delete already synced")
-			return nil
-		}
+	if fd.Operation == string(s3.Delete) && fd.Version == version {
+		s.logger.Debug().Str("method", "SyncFileDelete").
+			Msg("File delete already synced")
+		return nil
+	}
+	// concurrent deletes with known lineage don't conflict, without it the delete can't be placed
+	if fd.Operation == string(s3.Delete) && len(parents) == 0 {
 		s.logger.Error().Str("method", "SyncFileDelete").
 			Msg("File already deleted and delete has conflicting version")
 		return ErrDeleted
 	}
+	if fd.LegalHold {
+		s.logger.Error().Str("method", "SyncFileDelete").
+			Msg("File is under legal hold")
+		return ErrLegalHold
+	}
 
 	// Write delete object
 	no := &object.NewObjectInfo{
@@ -479,12 +620,119 @@ func (s *service) SyncFileDelete(ctx context.Context, bucketID, fileID, version
 		Name:        fileID,
 		Operation:   string(s3.Delete),
 		Labels:      fd.Labels,
+		Parents:     parents,
+		Source:      source,
 	}
 
 	start = time.Now()
-	_, err = s.s3.Write(ctx, bucketID, no, &bytes.Buffer{})
+	fd, err = s.s3.Write(ctx, bucketID, no, &bytes.Buffer{})
 	s.logger.Info().Str("method", "SyncFileDelete").Msgf("s3 write time %s", time.Since(start))
 
+	if err != nil {
+		return err
+	}
+	s.index.update(bucketID, fd)
+	s.previews.invalidate(bucketID, fileID)
+
+	// delete concurrent with an update is kept as a sibling until the conflict is resolved
+	if err := s.index.flag(bucketID, s.loadVersions(ctx, bucketID), fd); err != nil {
+		s.logger.Error().Err(err).Str("method", "SyncFileDelete").Msg("Failed to look for conflicting versions")
+	}
+	if fd.Conflict {
+		s.logger.Warn().Str("method", "SyncFileDelete").
+			Str("bucket", bucketID).
+			Str("file", fileID).
+			Strs("siblings", fd.Siblings).
+			Msg("File deletion conflicts with concurrently written versions")
+	}
+
+	return nil
+}
+
+func (s *service) BucketEvict(ctx context.Context, bucketID string) error {
+	exists, err := s.s3.BucketExists(ctx, bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("method", "BucketEvict").Str("bucket", bucketID).Msg("Failed to check if bucket exists")
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	versions, err := s.s3.List(ctx, bucketID, "")
+	if err != nil {
+		s.logger.Error().Err(err).Str("method", "BucketEvict").Str("bucket", bucketID).Msg("Failed to list files")
+		return err
+	}
+
+	files := []string{}
+	seen := make(map[string]bool)
+	for _, fd := range versions {
+		if !seen[fd.Name] {
+			seen[fd.Name] = true
+			files = append(files, fd.Name)
+		}
+	}
+
+	// removed files are indexed again on the next query
+	defer s.index.drop(bucketID)
+
+	var held int
+	for _, fileID := range files {
+		start := time.Now()
+		err := s.s3.Delete(ctx, bucketID, fileID, "")
+		s.logger.Info().Str("method", "BucketEvict").Msgf("s3 delete time %s", time.Since(start))
+
+		switch {
+		case err == ErrLegalHold:
+			held++
+		case err != nil:
+			s.logger.Error().Err(err).Str("method", "BucketEvict").Str("bucket", bucketID).Str("file", fileID).Msg("Failed to remove file")
+			return err
+		default:
+			s.previews.invalidate(bucketID, fileID)
+		}
+	}
+
+	s.logger.Info().Str("method", "BucketEvict").Str("bucket", bucketID).
+		Msgf("Evicted %d file(s), kept %d file(s) under legal hold", len(files)-held, held)
+
+	return nil
+}
+
+// spool streams contents of the reader into a temporary spool file (in $TMPDIR) calculating
+// their checksum and size on the way. Caller is responsible for closing the returned spool file.
+func (s *service) spool(r io.Reader) (*spool.File, io.Reader, error) {
+	f, err := spool.Copy("", r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contents, err := f.Reader()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, contents, nil
+}
+
+// validate validates spooled contents and rewinds them to be written
+func (s *service) validate(f *spool.File, contentType, archetype string) error {
+	if s.validator == nil {
+		return nil
+	}
+
+	r, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	if err := s.validator.Validate(contentType, archetype, r); err != nil {
+		s.logger.Info().Err(err).Str("method", "validate").Str("archetype", archetype).Msg("File validation failed")
+		return err
+	}
+	_, err = f.Reader()
+
 	return err
 }
 
@@ -553,30 +801,60 @@ func (s *service) updateFilesCollection(ctx context.Context, operation s3.Operat
 		Labels:      []string{labelFilesCollection},
 	}
 
+	published, err := s.record(ctx, "updateFilesCollection", storageSync.FileUpdate, &storageSync.FileInfo{BucketID: bucketID, FileID: fileID, Version: version, Created: no.Created})
+	if err != nil {
+		return err
+	}
+
 	start = time.Now()
 	fd, err = s.s3.Write(ctx, bucketID, no, &buf)
 	s.logger.Info().Str("method", "updateFilesCollection").Msgf("s3 write time %s", time.Since(start))
+	published(err)
 
 	if err != nil {
 		s.logger.Error().Err(err).Msg("failed to write file collection file")
 		return err
 	}
-
-	errorChecker.LogError(s.publisher.PublishAsyncWithRetries(
-		context.TODO(),
-		storageSync.FileUpdate,
-		&storageSync.FileInfo{BucketID: bucketID, FileID: fileID, Version: fd.Version, Created: fd.Created},
-	))
+	s.index.update(bucketID, fd)
 
 	return nil
 }
 
-// New returns a new instance of storage service
-func New(s3 s3.Storage, keyProvider s3.KeyProvider, publisher storageSync.Publisher, logger zerolog.Logger) Service {
+// record records the event before the change it describes is made if the publisher is a storageSync.Recorder.
+// Returned function has to be called with the result of the change, it publishes the event if the change was
+// made and discards it otherwise.
+func (s *service) record(ctx context.Context, method string, typ storageSync.EventType, f *storageSync.FileInfo) (func(error), error) {
+	recorder, ok := s.publisher.(storageSync.Recorder)
+	if !ok {
+		return func(err error) {
+			if err == nil {
+				errorChecker.LogError(s.publisher.PublishAsyncWithRetries(context.TODO(), typ, f))
+			}
+		}, nil
+	}
+
+	key, err := recorder.Record(ctx, typ, f)
+	if err != nil {
+		s.logger.Error().Err(err).Str("method", method).Msg("Failed to record sync event")
+		return nil, err
+	}
+
+	return func(err error) {
+		if err != nil {
+			errorChecker.LogError(recorder.Discard(key))
+			return
+		}
+		errorChecker.LogError(recorder.Commit(key))
+	}, nil
+}
+
+// New returns a new instance of storage service; uploads expire after uploadTTL, quotas limit usage of every bucket
+// and validator, if not nil, validates files before they are written
+func New(s3 s3.Storage, keyProvider s3.KeyProvider, publisher storageSync.Publisher, uploadTTL time.Duration, quotas Quotas, validator Validator, logger zerolog.Logger) Service {
 	logger.Error().Msg("test")
 	logger = logger.With().Str("component", "service/storage").Logger()
 	logger.Error().Msg("test")
-	return &service{s3: s3, keyProvider: keyProvider, publisher: publisher, logger: logger}
+	return &service{s3: s3, keyProvider: keyProvider, publisher: publisher, uploadTTL: uploadTTL, quotas: quotas, validator: validator, logger: logger}
 }
 
 var getUUID = func() string {
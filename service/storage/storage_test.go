@@ -50,6 +50,19 @@ var (
 		Operation:   "w",
 		Labels:      []string{"vitalSign"},
 	}
+	file1V2Held = &models.FileDescriptor{
+		Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
+		Checksum:    "CHS",
+		ContentType: "text/openEhrXml",
+		Created:     time2,
+		Name:        "File1",
+		Path:        "BUCKET/File1/V2",
+		Version:     "V2",
+		Size:        8,
+		Operation:   "w",
+		Labels:      []string{"vitalSign"},
+		LegalHold:   true,
+	}
 	file2V1 = &models.FileDescriptor{
 		Archetype:   "",
 		Checksum:    "CHS",
@@ -240,9 +253,14 @@ func TestBucketList(t *testing.T) {
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1, bucket2}, nil),
+					s.EXPECT().Usage(gomock.Any(), "BUCKET1").Return(int64(15706), int64(3), nil),
+					s.EXPECT().Usage(gomock.Any(), "BUCKET2").Return(int64(0), int64(0), nil),
 				}
 			},
-			[]*models.BucketDescriptor{bucket1, bucket2},
+			[]*models.BucketDescriptor{
+				{Name: "BUCKET1", Created: time1, Usage: &models.BucketUsage{Size: 15706, Objects: 3}},
+				{Name: "BUCKET2", Created: time2, Usage: &models.BucketUsage{}},
+			},
 			noErrors,
 			nil,
 		},
@@ -287,24 +305,29 @@ func TestBucketList(t *testing.T) {
 func TestFileList(t *testing.T) {
 	testCases := []struct {
 		description   string
+		query         *Query
 		calls         func(*mock.MockStorage) []*gomock.Call
 		expected      []*models.FileDescriptor
+		total         int64
 		errorExpected bool
 		exactError    error
 	}{
 		{
 			"BucketExists fails",
+			nil,
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, fmt.Errorf("Error")),
 				}
 			},
 			nil,
+			0,
 			withErrors,
 			nil,
 		},
 		{
 			"List fails",
+			nil,
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
@@ -312,22 +335,26 @@ func TestFileList(t *testing.T) {
 				}
 			},
 			nil,
+			0,
 			withErrors,
 			nil,
 		},
 		{
 			"Bucket does not exist",
+			nil,
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, nil),
 				}
 			},
 			[]*models.FileDescriptor{},
+			0,
 			noErrors,
 			nil,
 		},
 		{
 			"Successful call",
+			nil,
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
@@ -335,6 +362,35 @@ func TestFileList(t *testing.T) {
 				}
 			},
 			[]*models.FileDescriptor{file1V2},
+			1,
+			noErrors,
+			nil,
+		},
+		{
+			"Successful call with labels filtering",
+			&Query{Labels: []string{"vitalSign"}},
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file1V2, file2V2, file1V1, file2V1}, nil),
+				}
+			},
+			[]*models.FileDescriptor{file1V2},
+			1,
+			noErrors,
+			nil,
+		},
+		{
+			"Successful call with pagination",
+			&Query{ContentType: "text/openEhrXml", Offset: 1, Limit: 1},
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file1V2, file3V1ALT, file1V1}, nil),
+				}
+			},
+			[]*models.FileDescriptor{file1V2},
+			2,
 			noErrors,
 			nil,
 		},
@@ -350,7 +406,7 @@ func TestFileList(t *testing.T) {
 			test.calls(s)
 
 			// call the MakeBucket
-			out, err := svc.FileList(context.TODO(), "BUCKET")
+			out, total, err := svc.FileList(context.TODO(), "BUCKET", test.query)
 
 			// check expected results
 			if !reflect.DeepEqual(out, test.expected) {
@@ -360,6 +416,9 @@ func TestFileList(t *testing.T) {
 				printJson(out)
 				t.Errorf("Expected list to equal\n%+v\ngot\n%+v", test.expected, out)
 			}
+			if total != test.total {
+				t.Errorf("Expected total to equal %d, got %d", test.total, total)
+			}
 
 			// assert error
 			if test.errorExpected && err == nil {
@@ -571,6 +630,17 @@ func TestFileUpdate(t *testing.T) {
 			withErrors,
 			nil,
 		},
+		{
+			"File under legal hold",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, file1V2Held, nil),
+				}
+			},
+			nil,
+			withErrors,
+			ErrLegalHold,
+		},
 		{
 			"Write fails",
 			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
@@ -596,6 +666,7 @@ func TestFileUpdate(t *testing.T) {
 					Name:        "FILE",
 					Operation:   "w",
 					Labels:      []string{"vitalSign"},
+					Parents:     []string{"V1"},
 				}
 				// prepare the reader for existing collection file
 				r1 := ioutil.NopCloser(bytes.NewReader([]byte(collectionFileV1)))
@@ -698,6 +769,16 @@ func TestFileDelete(t *testing.T) {
 			withErrors,
 			nil,
 		},
+		{
+			"File under legal hold",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, file1V2Held, nil),
+				}
+			},
+			withErrors,
+			ErrLegalHold,
+		},
 		{
 			"Write fails",
 			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
@@ -721,6 +802,7 @@ func TestFileDelete(t *testing.T) {
 					Name:        "FILE",
 					Operation:   "d",
 					Labels:      []string{"basicPatientInfo"},
+					Parents:     []string{"V1"},
 				}
 				r := ioutil.NopCloser(bytes.NewReader([]byte(collectionFileV2)))
 				basicNo := &object.NewObjectInfo{
@@ -929,18 +1011,16 @@ func TestFileListVersions(t *testing.T) {
 
 func TestSyncFileList(t *testing.T) {
 	testCases := []struct {
-		description    string
-		createdAtSince *strfmt.DateTime
-		createdAtUntil *strfmt.DateTime
-		calls          func(*mock.MockStorage) []*gomock.Call
-		expected       []*models.FileDescriptor
-		errorExpected  bool
-		exactError     error
+		description   string
+		query         *Query
+		calls         func(*mock.MockStorage) []*gomock.Call
+		expected      []*models.FileDescriptor
+		errorExpected bool
+		exactError    error
 	}{
 		{
 			"BucketExsits fails",
 			nil,
-			nil,
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, fmt.Errorf("Error")),
@@ -953,7 +1033,6 @@ func TestSyncFileList(t *testing.T) {
 		{
 			"List fails",
 			nil,
-			nil,
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
@@ -967,7 +1046,6 @@ func TestSyncFileList(t *testing.T) {
 		{
 			"Bucket does not exist",
 			nil,
-			nil,
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, nil),
@@ -980,7 +1058,6 @@ func TestSyncFileList(t *testing.T) {
 		{
 			"Successful call",
 			nil,
-			nil,
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
@@ -993,8 +1070,7 @@ func TestSyncFileList(t *testing.T) {
 		},
 		{
 			"Successful call with createdAtSince filtering",
-			&time2,
-			nil,
+			&Query{CreatedAtSince: &time2},
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
@@ -1007,8 +1083,7 @@ func TestSyncFileList(t *testing.T) {
 		},
 		{
 			"Successful call with createdAtUntil filtering",
-			nil,
-			&time3,
+			&Query{CreatedAtUntil: &time3},
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
@@ -1021,8 +1096,7 @@ func TestSyncFileList(t *testing.T) {
 		},
 		{
 			"Successful call with createdAtSince and createdAtUntil filtering",
-			&time2,
-			&time3,
+			&Query{CreatedAtSince: &time2, CreatedAtUntil: &time3},
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
@@ -1045,7 +1119,7 @@ func TestSyncFileList(t *testing.T) {
 			test.calls(s)
 
 			// call SyncFileList
-			out, err := svc.SyncFileList(context.TODO(), "BUCKET", test.createdAtSince, test.createdAtUntil)
+			out, _, err := svc.SyncFileList(context.TODO(), "BUCKET", test.query)
 
 			// check expected results
 			if !reflect.DeepEqual(out, test.expected) {
@@ -1139,12 +1213,14 @@ func TestSyncFile(t *testing.T) {
 					Version:     "V1",
 					Name:        "FILE3",
 					Operation:   "w",
+					Source:      "SOURCE",
 				}
 
 				return []*gomock.Call{
 					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
 					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE3", "V1").Return(nil, nil, s3.ErrNotFound),
 					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file3V1, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file3V1}, nil),
 				}
 			},
 			file3V1,
@@ -1176,6 +1252,7 @@ func TestSyncFile(t *testing.T) {
 					Version:     "V1",
 					Name:        "FILE3",
 					Operation:   "w",
+					Source:      "SOURCE",
 				}
 				return []*gomock.Call{
 					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
@@ -1200,12 +1277,14 @@ func TestSyncFile(t *testing.T) {
 					Version:     "V1",
 					Name:        "FILE3",
 					Operation:   "w",
+					Source:      "SOURCE",
 				}
 				return []*gomock.Call{
 					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
 					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE3", "V1").Return(nil, file3V1ALT, nil),
 					s.EXPECT().Delete(gomock.Any(), "BUCKET", "FILE3", "V1").Return(nil),
 					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file3V1, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file3V1}, nil),
 				}
 			},
 			file3V1,
@@ -1231,7 +1310,7 @@ func TestSyncFile(t *testing.T) {
 			r := bytes.NewReader([]byte("contents"))
 
 			// call the SyncFile
-			out, err := svc.SyncFile(context.TODO(), "BUCKET", "FILE3", "V1", r, "text/openEhrXml", time2, "ARCH", nil)
+			out, err := svc.SyncFile(context.TODO(), "BUCKET", "FILE3", "V1", r, "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug=", "text/openEhrXml", time2, "ARCH", nil, nil, "SOURCE")
 
 			// check expected results
 			if !reflect.DeepEqual(out, test.expected) {
@@ -1257,54 +1336,221 @@ func TestSyncFile(t *testing.T) {
 	}
 }
 
+func TestSyncFileChecksumMismatch(t *testing.T) {
+	svc, s, _, _, c := getTestService(t)
+	defer c()
+
+	// contents not matching the checksum are never written
+	s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil)
+
+	_, err := svc.SyncFile(context.TODO(), "BUCKET", "FILE", "V1", bytes.NewReader([]byte("corrupted")), "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug=", "text/plain", time3, "", nil, nil, "")
+	if err != ErrChecksumMismatch {
+		t.Errorf("Expected error to equal '%v', got %v", ErrChecksumMismatch, err)
+	}
+}
+
+func TestFileNewRecordsEvent(t *testing.T) {
+	getUUID = func() string { return "UUID" }
+	getTime = func() strfmt.DateTime { return strfmt.DateTime(time1) }
+	info := &storageSync.FileInfo{BucketID: "BUCKET", FileID: "UUID", Version: "UUID", Created: time1}
+
+	testCases := []struct {
+		description   string
+		calls         func(*mock.MockStorage, *mockStorageSync.MockRecorder) []*gomock.Call
+		errorExpected bool
+	}{
+		{
+			"Event is committed once file is written",
+			func(s *mock.MockStorage, r *mockStorageSync.MockRecorder) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
+					r.EXPECT().Record(gomock.Any(), storageSync.FileNew, info).Return("KEY", nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(file1V1, nil),
+					r.EXPECT().Commit("KEY").Return(nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"Event is discarded if file is not written",
+			func(s *mock.MockStorage, r *mockStorageSync.MockRecorder) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
+					r.EXPECT().Record(gomock.Any(), storageSync.FileNew, info).Return("KEY", nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
+					r.EXPECT().Discard("KEY").Return(nil),
+				}
+			},
+			withErrors,
+		},
+		{
+			"File is not written if event is not recorded",
+			func(s *mock.MockStorage, r *mockStorageSync.MockRecorder) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
+					r.EXPECT().Record(gomock.Any(), storageSync.FileNew, info).Return("", fmt.Errorf("Error")),
+				}
+			},
+			withErrors,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			svc, s, _, p, c := getTestService(t)
+			defer c()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			r := mockStorageSync.NewMockRecorder(ctrl)
+			svc.publisher = &recordingPublisher{p, r}
+
+			gomock.InOrder(test.calls(s, r)...)
+
+			_, err := svc.FileNew(context.TODO(), "BUCKET", bytes.NewReader([]byte("contents")), "text/plain", "", nil)
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			}
+			if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+		})
+	}
+}
+
+// recordingPublisher is publisher recording events like the outbox
+type recordingPublisher struct {
+	*mockStorageSync.MockPublisher
+	*mockStorageSync.MockRecorder
+}
+
 func TestSyncFileDelete(t *testing.T) {
+	deleteNo := &object.NewObjectInfo{
+		Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
+		Size:        int64(0),
+		Checksum:    "",
+		Created:     strfmt.DateTime(time2),
+		ContentType: "text/openEhrXml",
+		Version:     "DEL_VERSION",
+		Name:        "FILE",
+		Operation:   "d",
+		Labels:      []string{"vitalSign", "basicPatientInfo"},
+		Parents:     []string{"V1"},
+		Source:      "SOURCE",
+	}
+	// versions of FILE: V2 updated V1 while V1 was deleted in the source storage
+	v1 := &models.FileDescriptor{Name: "FILE", Version: "V1", Operation: "w", Checksum: "CHS1", Created: time1}
+	v2 := &models.FileDescriptor{Name: "FILE", Version: "V2", Operation: "w", Checksum: "CHS2", Created: time2, Parents: []string{"V1"}, Labels: []string{"vitalSign", "basicPatientInfo"}, Archetype: "openEHR-EHR-OBSERVATION.blood_pressure.v1", ContentType: "text/openEhrXml"}
+	deleted := &models.FileDescriptor{Name: "FILE", Version: "DEL_VERSION", Operation: "d", Created: time2, Parents: []string{"V1"}, Source: "SOURCE"}
+	otherDelete := &models.FileDescriptor{Name: "FILE", Version: "OTHER_DEL", Operation: "d", Created: time2, Parents: []string{"V1"}, Labels: []string{"vitalSign", "basicPatientInfo"}, Archetype: "openEHR-EHR-OBSERVATION.blood_pressure.v1", ContentType: "text/openEhrXml"}
+
 	testCases := []struct {
 		description   string
+		parents       []string
 		calls         func(*mock.MockStorage) []*gomock.Call
+		siblings      []string
 		errorExpected bool
 		exactError    error
 	}{
 		{
 			"Read fails",
+			[]string{"V1"},
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, nil, fmt.Errorf("Error")),
 				}
 			},
+			nil,
 			withErrors,
 			nil,
 		},
+		{
+			"File under legal hold",
+			[]string{"V1"},
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, file1V2Held, nil),
+				}
+			},
+			nil,
+			withErrors,
+			ErrLegalHold,
+		},
+		{
+			"Delete already synced",
+			[]string{"V1"},
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, deleted, nil),
+				}
+			},
+			nil,
+			noErrors,
+			nil,
+		},
+		{
+			"File deleted by other delete and lineage is unknown",
+			nil,
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, otherDelete, nil),
+				}
+			},
+			nil,
+			withErrors,
+			ErrDeleted,
+		},
+		{
+			"Concurrent deletes don't conflict",
+			[]string{"V1"},
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, otherDelete, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", deleteNo, gomock.Any()).Return(deleted, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{v1, otherDelete, deleted}, nil),
+				}
+			},
+			[]string{},
+			noErrors,
+			nil,
+		},
 		{
 			"Write fails",
+			[]string{"V1"},
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, file1V1, nil),
 					s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
 				}
 			},
+			nil,
 			withErrors,
 			nil,
 		},
 		{
 			"Write successfull",
+			[]string{"V1"},
 			func(s *mock.MockStorage) []*gomock.Call {
-				no := &object.NewObjectInfo{
-					Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
-					Size:        int64(0),
-					Checksum:    "",
-					Created:     strfmt.DateTime(time2),
-					ContentType: "text/openEhrXml",
-					Version:     "DEL_VERSION",
-					Name:        "FILE",
-					Operation:   "d",
-					Labels:      []string{"vitalSign", "basicPatientInfo"},
-				}
-
 				return []*gomock.Call{
 					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, file1V1, nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file1V2, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", deleteNo, gomock.Any()).Return(deleted, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{v1, deleted}, nil),
+				}
+			},
+			[]string{},
+			noErrors,
+			nil,
+		},
+		{
+			"Delete concurrent with update is kept as sibling",
+			[]string{"V1"},
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, v2, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", deleteNo, gomock.Any()).Return(deleted, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{v1, v2, deleted}, nil),
 				}
 			},
+			[]string{"DEL_VERSION", "V2"},
 			noErrors,
 			nil,
 		},
@@ -1322,8 +1568,8 @@ func TestSyncFileDelete(t *testing.T) {
 			// setup calls
 			test.calls(s)
 
-			// call the MakeBucket
-			err := svc.SyncFileDelete(context.TODO(), "BUCKET", "FILE", "DEL_VERSION", strfmt.DateTime(time2))
+			// call the SyncFileDelete
+			err := svc.SyncFileDelete(context.TODO(), "BUCKET", "FILE", "DEL_VERSION", strfmt.DateTime(time2), test.parents, "SOURCE")
 
 			// assert error
 			if test.errorExpected && err == nil {
@@ -1336,6 +1582,99 @@ func TestSyncFileDelete(t *testing.T) {
 			if test.exactError != nil && test.exactError != err {
 				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
 			}
+
+			// assert siblings
+			if test.siblings != nil {
+				siblings, err := svc.index.siblings("BUCKET", "FILE", nil)
+				if err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if !reflect.DeepEqual(siblings, test.siblings) {
+					t.Errorf("Expected siblings to equal %v, got %v", test.siblings, siblings)
+				}
+			}
+		})
+	}
+}
+
+func TestBucketEvict(t *testing.T) {
+	testCases := []struct {
+		description   string
+		calls         func(*mock.MockStorage) []*gomock.Call
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"Bucket does not exist",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, nil),
+				}
+			},
+			noErrors,
+			nil,
+		},
+		{
+			"List fails",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(nil, fmt.Errorf("Error")),
+				}
+			},
+			withErrors,
+			nil,
+		},
+		{
+			"Delete fails",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file1V1, file2V1}, nil),
+					s.EXPECT().Delete(gomock.Any(), "BUCKET", "File1", "").Return(fmt.Errorf("Error")),
+				}
+			},
+			withErrors,
+			nil,
+		},
+		{
+			"All versions removed, held files kept",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file1V1, file1V2, file2V1, file2V2, file3V1}, nil),
+					s.EXPECT().Delete(gomock.Any(), "BUCKET", "File1", "").Return(nil),
+					s.EXPECT().Delete(gomock.Any(), "BUCKET", "Image", "").Return(ErrLegalHold),
+					s.EXPECT().Delete(gomock.Any(), "BUCKET", "FILE3", "").Return(nil),
+				}
+			},
+			noErrors,
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, _, c := getTestService(t)
+			defer c()
+
+			// setup calls
+			gomock.InOrder(test.calls(s)...)
+
+			// call BucketEvict
+			err := svc.BucketEvict(context.TODO(), "BUCKET")
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
 		})
 	}
 }
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/utils/spool"
+)
+
+// Upload has not received all the contents yet
+var ErrUploadIncomplete = s3.ErrUploadIncomplete
+
+// Contents don't match the checksum
+var ErrChecksumMismatch = s3.ErrChecksumMismatch
+
+// Chunk does not fit into the size of the upload
+var ErrChunkOutOfRange = errors.New("Chunk exceeds size of the upload")
+
+func (s *service) UploadNew(ctx context.Context, bucketID, fileID string, size int64, checksum, contentType, archetype string, labels []string) (*models.UploadDescriptor, error) {
+	// make sure the file to update exists
+	if fileID != "" {
+		_, fd, err := s.s3.Read(ctx, bucketID, fileID, "")
+		if err != nil {
+			return nil, err
+		}
+		if fd.Operation == string(s3.Delete) {
+			return nil, ErrDeleted
+		}
+		if fd.LegalHold {
+			return nil, ErrLegalHold
+		}
+	}
+
+	err := s.EnsureBucket(ctx, bucketID)
+	if err != nil {
+		return nil, err
+	}
+
+	// refuse uploads that could not be finalized
+	if err := s.checkQuota(ctx, bucketID, size); err != nil {
+		return nil, err
+	}
+
+	created := getTime()
+	upload := &models.UploadDescriptor{
+		ID:          getUUID(),
+		FileID:      fileID,
+		Size:        size,
+		Checksum:    checksum,
+		ContentType: contentType,
+		Archetype:   archetype,
+		Labels:      labels,
+		Created:     created,
+		Expires:     strfmt.DateTime(time.Time(created).Add(s.uploadTTL)),
+		Received:    []*models.ByteRange{},
+	}
+
+	if err := s.s3.UploadNew(ctx, bucketID, upload); err != nil {
+		s.logger.Error().Err(err).Str("method", "UploadNew").Msg("Failed to create upload")
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (s *service) UploadGet(ctx context.Context, bucketID, uploadID string) (*models.UploadDescriptor, error) {
+	upload, err := s.s3.UploadGet(ctx, bucketID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	// expired uploads are treated as removed even before they are garbage collected
+	if isExpired(upload) {
+		return nil, ErrNotFound
+	}
+
+	return upload, nil
+}
+
+func (s *service) UploadChunk(ctx context.Context, bucketID, uploadID string, offset int64, r io.Reader) (*models.UploadDescriptor, error) {
+	upload, err := s.UploadGet(ctx, bucketID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > upload.Size {
+		return nil, ErrChunkOutOfRange
+	}
+
+	// spool the chunk to find out its size; read at most one byte more than fits into the upload
+	f, err := spool.Copy("", io.LimitReader(r, upload.Size-offset+1))
+	if err != nil {
+		s.logger.Error().Err(err).Str("method", "UploadChunk").Msg("Failed to spool chunk")
+		return nil, err
+	}
+	defer f.Close()
+	if f.Size() > upload.Size-offset {
+		return nil, ErrChunkOutOfRange
+	}
+	contents, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	err = s.s3.UploadWriteChunk(ctx, bucketID, uploadID, offset, contents, f.Size())
+	s.logger.Info().Str("method", "UploadChunk").Msgf("s3 write time %s", time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.s3.UploadGet(ctx, bucketID, uploadID)
+}
+
+func (s *service) UploadFinalize(ctx context.Context, bucketID, uploadID string) (*models.FileDescriptor, error) {
+	upload, err := s.UploadGet(ctx, bucketID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	// get the previous file before spooling the contents
+	var old *models.FileDescriptor
+	if upload.FileID != "" {
+		_, old, err = s.s3.Read(ctx, bucketID, upload.FileID, "")
+		if err != nil {
+			return nil, err
+		}
+		if old.LegalHold {
+			return nil, ErrLegalHold
+		}
+	}
+
+	// assemble the contents from received chunks
+	r, err := s.s3.UploadRead(ctx, bucketID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	f, contents, err := s.spool(r)
+	r.Close()
+	if err != nil {
+		s.logger.Error().Err(err).Str("method", "UploadFinalize").Msg("Failed to spool upload contents")
+		return nil, err
+	}
+	defer f.Close()
+
+	if upload.Checksum != "" {
+		if err := f.Verify(upload.Checksum); err != nil {
+			s.logger.Error().Str("method", "UploadFinalize").Str("upload", uploadID).Msg("Upload contents don't match the checksum")
+			return nil, ErrChecksumMismatch
+		}
+	}
+
+	var fd *models.FileDescriptor
+	if old == nil {
+		fd, err = s.writeNew(ctx, bucketID, f, contents, upload.ContentType, upload.Archetype, upload.Labels)
+	} else {
+		fd, err = s.writeUpdate(ctx, bucketID, upload.FileID, old, []string{old.Version}, f, contents, upload.ContentType, upload.Archetype, upload.Labels)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// file is already written; upload left behind is removed once expired
+	if err := s.s3.UploadDelete(ctx, bucketID, uploadID); err != nil {
+		s.logger.Error().Err(err).Str("method", "UploadFinalize").Str("upload", uploadID).Msg("Failed to remove finalized upload")
+	}
+
+	return fd, nil
+}
+
+func (s *service) UploadDelete(ctx context.Context, bucketID, uploadID string) error {
+	if _, err := s.s3.UploadGet(ctx, bucketID, uploadID); err != nil {
+		return err
+	}
+
+	return s.s3.UploadDelete(ctx, bucketID, uploadID)
+}
+
+func (s *service) UploadCollectGarbage(ctx context.Context) error {
+	buckets, err := s.s3.ListBuckets(ctx)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	removed := 0
+	for _, bucket := range buckets {
+		uploads, err := s.s3.UploadList(ctx, bucket.Name)
+		if err != nil {
+			s.logger.Error().Err(err).Str("method", "UploadCollectGarbage").Str("bucket", bucket.Name).Msg("Failed to list uploads")
+			lastErr = err
+			continue
+		}
+
+		for _, upload := range uploads {
+			if !isExpired(upload) {
+				continue
+			}
+			if err := s.s3.UploadDelete(ctx, bucket.Name, upload.ID); err != nil {
+				s.logger.Error().Err(err).Str("method", "UploadCollectGarbage").Str("bucket", bucket.Name).Str("upload", upload.ID).Msg("Failed to remove expired upload")
+				lastErr = err
+				continue
+			}
+			removed++
+		}
+	}
+	s.logger.Info().Str("method", "UploadCollectGarbage").Msgf("removed %d expired uploads", removed)
+
+	return lastErr
+}
+
+// isExpired checks if the upload expired; uploads without expiry are leftovers of removed uploads
+func isExpired(upload *models.UploadDescriptor) bool {
+	return !time.Time(getTime()).Before(time.Time(upload.Expires))
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/golang/mock/gomock"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/storage/s3/mock"
+	"github.com/iryonetwork/wwm/storage/s3/object"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	mockStorageSync "github.com/iryonetwork/wwm/sync/storage/mock"
+)
+
+var (
+	upload1 = &models.UploadDescriptor{
+		ID:          "UPLOAD",
+		Size:        8,
+		ContentType: "CONT/TYPE",
+		Archetype:   "ARCH",
+		Created:     time1,
+		Expires:     strfmt.DateTime(time.Time(time1).Add(time.Hour)),
+		Received:    []*models.ByteRange{},
+	}
+	upload1Received = &models.UploadDescriptor{
+		ID:          "UPLOAD",
+		Size:        8,
+		ContentType: "CONT/TYPE",
+		Archetype:   "ARCH",
+		Created:     time1,
+		Expires:     strfmt.DateTime(time.Time(time1).Add(time.Hour)),
+		Received:    []*models.ByteRange{{Offset: 0, Length: 8}},
+	}
+	upload1Expired = &models.UploadDescriptor{
+		ID:      "UPLOAD",
+		Size:    8,
+		Created: time1,
+		Expires: time1,
+	}
+	upload1WithChecksum = &models.UploadDescriptor{
+		ID:          "UPLOAD",
+		Size:        8,
+		Checksum:    "CHS",
+		ContentType: "CONT/TYPE",
+		Created:     time1,
+		Expires:     strfmt.DateTime(time.Time(time1).Add(time.Hour)),
+		Received:    []*models.ByteRange{{Offset: 0, Length: 8}},
+	}
+)
+
+func TestUploadChunk(t *testing.T) {
+	testCases := []struct {
+		description   string
+		offset        int64
+		contents      string
+		calls         func(*mock.MockStorage) []*gomock.Call
+		expected      *models.UploadDescriptor
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"Upload not found",
+			0,
+			"contents",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().UploadGet(gomock.Any(), "BUCKET", "UPLOAD").Return(nil, s3.ErrNotFound),
+				}
+			},
+			nil,
+			withErrors,
+			ErrNotFound,
+		},
+		{
+			"Upload expired",
+			0,
+			"contents",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().UploadGet(gomock.Any(), "BUCKET", "UPLOAD").Return(upload1Expired, nil),
+				}
+			},
+			nil,
+			withErrors,
+			ErrNotFound,
+		},
+		{
+			"Chunk exceeds size of the upload",
+			4,
+			"contents",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().UploadGet(gomock.Any(), "BUCKET", "UPLOAD").Return(upload1, nil),
+				}
+			},
+			nil,
+			withErrors,
+			ErrChunkOutOfRange,
+		},
+		{
+			"Chunk written",
+			0,
+			"contents",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().UploadGet(gomock.Any(), "BUCKET", "UPLOAD").Return(upload1, nil),
+					s.EXPECT().UploadWriteChunk(gomock.Any(), "BUCKET", "UPLOAD", int64(0), gomock.Any(), int64(8)).Return(nil),
+					s.EXPECT().UploadGet(gomock.Any(), "BUCKET", "UPLOAD").Return(upload1Received, nil),
+				}
+			},
+			upload1Received,
+			noErrors,
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, _, c := getTestService(t)
+			defer c()
+
+			// mock getTime
+			getTime = func() strfmt.DateTime { return strfmt.DateTime(time1) }
+
+			// setup calls
+			gomock.InOrder(test.calls(s)...)
+
+			out, err := svc.UploadChunk(context.TODO(), "BUCKET", "UPLOAD", test.offset, bytes.NewBufferString(test.contents))
+
+			// check expected results
+			if !reflect.DeepEqual(out, test.expected) {
+				t.Errorf("Expected upload descriptor to equal\n%+v\ngot\n%+v", test.expected, out)
+			}
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
+
+func TestUploadFinalize(t *testing.T) {
+	testCases := []struct {
+		description   string
+		calls         func(*mock.MockStorage, *mockStorageSync.MockPublisher) []*gomock.Call
+		expected      *models.FileDescriptor
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"Upload incomplete",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().UploadGet(gomock.Any(), "BUCKET", "UPLOAD").Return(upload1, nil),
+					s.EXPECT().UploadRead(gomock.Any(), "BUCKET", "UPLOAD").Return(nil, s3.ErrUploadIncomplete),
+				}
+			},
+			nil,
+			withErrors,
+			ErrUploadIncomplete,
+		},
+		{
+			"Checksum mismatch",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().UploadGet(gomock.Any(), "BUCKET", "UPLOAD").Return(upload1WithChecksum, nil),
+					s.EXPECT().UploadRead(gomock.Any(), "BUCKET", "UPLOAD").Return(ioutil.NopCloser(bytes.NewBufferString("contents")), nil),
+				}
+			},
+			nil,
+			withErrors,
+			ErrChecksumMismatch,
+		},
+		{
+			"Write fails",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().UploadGet(gomock.Any(), "BUCKET", "UPLOAD").Return(upload1Received, nil),
+					s.EXPECT().UploadRead(gomock.Any(), "BUCKET", "UPLOAD").Return(ioutil.NopCloser(bytes.NewBufferString("contents")), nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
+				}
+			},
+			nil,
+			withErrors,
+			nil,
+		},
+		{
+			"New file written",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				no := &object.NewObjectInfo{
+					Archetype:   "ARCH",
+					Size:        int64(8),
+					Checksum:    "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug=",
+					Created:     strfmt.DateTime(time1),
+					ContentType: "CONT/TYPE",
+					Version:     "UUID",
+					Name:        "UUID",
+					Operation:   "w",
+				}
+
+				return []*gomock.Call{
+					s.EXPECT().UploadGet(gomock.Any(), "BUCKET", "UPLOAD").Return(upload1Received, nil),
+					s.EXPECT().UploadRead(gomock.Any(), "BUCKET", "UPLOAD").Return(ioutil.NopCloser(bytes.NewBufferString("contents")), nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file3V1, nil),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileNew, gomock.Eq(&storageSync.FileInfo{BucketID: "BUCKET", FileID: "UUID", Version: "UUID", Created: time1})),
+					s.EXPECT().UploadDelete(gomock.Any(), "BUCKET", "UPLOAD").Return(nil),
+				}
+			},
+			file3V1,
+			noErrors,
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, p, c := getTestService(t)
+			defer c()
+
+			// mock getUUID and getTime
+			getUUID = func() string { return "UUID" }
+			getTime = func() strfmt.DateTime { return strfmt.DateTime(time1) }
+
+			// setup calls
+			gomock.InOrder(test.calls(s, p)...)
+
+			out, err := svc.UploadFinalize(context.TODO(), "BUCKET", "UPLOAD")
+
+			// check expected results
+			if !reflect.DeepEqual(out, test.expected) {
+				t.Errorf("Expected file descriptor to equal\n%+v\ngot\n%+v", test.expected, out)
+			}
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	openapiErrors "github.com/go-openapi/errors"
+	"github.com/go-openapi/spec"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/validate"
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/utils"
+)
+
+// Validator validates contents of files before they are written
+type Validator interface {
+	// Validate returns *ValidationError if contents of the file with the content type and archetype are not valid.
+	Validate(contentType, archetype string, r io.Reader) error
+	// SyncBypassed returns true if files synced to the bucket are written without validation.
+	SyncBypassed(bucketID string) bool
+}
+
+// ValidationRules configure the validator
+type ValidationRules struct {
+	// Archetypes maps archetypes to rules for their files, files with other archetypes are not validated
+	Archetypes map[string]*ArchetypeRules `json:"archetypes"`
+	// SyncBypassBuckets lists buckets files synced to which are not validated, "*" matches all the buckets
+	SyncBypassBuckets []string `json:"syncBypassBuckets"`
+}
+
+// ArchetypeRules describe valid files of the archetype
+type ArchetypeRules struct {
+	// ContentTypes lists allowed content types, any content type is allowed if empty
+	ContentTypes []string `json:"contentTypes"`
+	// Schema is JSON schema of the contents; openEHR templates are described by schemas of the documents
+	// with EHR paths as properties
+	Schema *spec.Schema `json:"schema"`
+	// SchemaFilepath is path to JSON schema of the contents relative to the rules file, used if Schema is not set
+	SchemaFilepath string `json:"schemaFilepath"`
+}
+
+// ValidationError is returned when file contents are not valid
+type ValidationError struct {
+	Reasons []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("File validation failed: %s", strings.Join(e.Reasons, "; "))
+}
+
+type validator struct {
+	rules *ValidationRules
+}
+
+// Validate returns *ValidationError if contents of the file with the content type and archetype are not valid.
+func (v *validator) Validate(contentType, archetype string, r io.Reader) error {
+	rules, ok := v.rules.Archetypes[archetype]
+	if !ok {
+		return nil
+	}
+
+	if len(rules.ContentTypes) != 0 && !utils.SliceContains(rules.ContentTypes, contentType) {
+		return &ValidationError{Reasons: []string{
+			fmt.Sprintf("content type %s is not allowed for archetype %s", contentType, archetype),
+		}}
+	}
+
+	if rules.Schema == nil {
+		return nil
+	}
+
+	var data interface{}
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return &ValidationError{Reasons: []string{fmt.Sprintf("contents are not valid JSON: %s", err)}}
+	}
+
+	err := validate.AgainstSchema(rules.Schema, data, strfmt.Default)
+	if err == nil {
+		return nil
+	}
+	verr := &ValidationError{}
+	if composite, ok := err.(*openapiErrors.CompositeError); ok {
+		for _, e := range composite.Errors {
+			verr.Reasons = append(verr.Reasons, e.Error())
+		}
+	} else {
+		verr.Reasons = append(verr.Reasons, err.Error())
+	}
+
+	return verr
+}
+
+// SyncBypassed returns true if files synced to the bucket are written without validation.
+func (v *validator) SyncBypassed(bucketID string) bool {
+	return utils.SliceContains(v.rules.SyncBypassBuckets, "*") || utils.SliceContains(v.rules.SyncBypassBuckets, bucketID)
+}
+
+// NewValidator returns a new instance of validator with the rules
+func NewValidator(rules *ValidationRules) Validator {
+	if rules.Archetypes == nil {
+		rules.Archetypes = make(map[string]*ArchetypeRules)
+	}
+
+	return &validator{rules: rules}
+}
+
+// LoadValidationRules reads validation rules from JSON file together with schemas they refer to
+func LoadValidationRules(path string) (*ValidationRules, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read validation rules")
+	}
+
+	rules := &ValidationRules{}
+	if err := json.Unmarshal(b, rules); err != nil {
+		return nil, errors.Wrap(err, "failed to parse validation rules")
+	}
+
+	for archetype, r := range rules.Archetypes {
+		if r.Schema != nil || r.SchemaFilepath == "" {
+			continue
+		}
+
+		schemaPath := r.SchemaFilepath
+		if !filepath.IsAbs(schemaPath) {
+			schemaPath = filepath.Join(filepath.Dir(path), schemaPath)
+		}
+		b, err := ioutil.ReadFile(schemaPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read schema of archetype %s", archetype)
+		}
+		r.Schema = &spec.Schema{}
+		if err := json.Unmarshal(b, r.Schema); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse schema of archetype %s", archetype)
+		}
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-openapi/spec"
+	"github.com/golang/mock/gomock"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3/object"
+)
+
+const (
+	encounterArchetype = "openEHR-EHR-COMPOSITION.encounter.v1"
+	encounterSchema    = `{
+		"type": "object",
+		"required": ["/content[openEHR-EHR-COMPOSITION.encounter.v1]/category"],
+		"properties": {
+			"/content[openEHR-EHR-COMPOSITION.encounter.v1]/category": {"type": "string"}
+		}
+	}`
+	validEncounter = `{"/content[openEHR-EHR-COMPOSITION.encounter.v1]/category": "openehr::433|event|"}`
+)
+
+func TestValidate(t *testing.T) {
+	validator := NewValidator(&ValidationRules{
+		Archetypes: map[string]*ArchetypeRules{
+			encounterArchetype: {ContentTypes: []string{"application/json"}, Schema: schema(t, encounterSchema)},
+			"ARCH":             {ContentTypes: []string{"CONT/TYPE"}},
+		},
+	})
+
+	testCases := []struct {
+		description   string
+		contentType   string
+		archetype     string
+		contents      string
+		errorExpected bool
+	}{
+		{"Archetype without rules", "text/plain", "UNKNOWN", "contents", noErrors},
+		{"Allowed content type without schema", "CONT/TYPE", "ARCH", "contents", noErrors},
+		{"Content type not allowed", "text/plain", "ARCH", "contents", withErrors},
+		{"Valid document", "application/json", encounterArchetype, validEncounter, noErrors},
+		{"Contents are not JSON", "application/json", encounterArchetype, "contents", withErrors},
+		{"Required path is missing", "application/json", encounterArchetype, `{}`, withErrors},
+		{"Value of wrong type", "application/json", encounterArchetype, `{"/content[openEHR-EHR-COMPOSITION.encounter.v1]/category": 433}`, withErrors},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			err := validator.Validate(test.contentType, test.archetype, strings.NewReader(test.contents))
+
+			if test.errorExpected {
+				if verr, ok := err.(*ValidationError); !ok || len(verr.Reasons) == 0 {
+					t.Errorf("Expected validation error with reasons, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadValidationRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"encounter.json": encounterSchema,
+		"rules.json":     `{"archetypes": {"openEHR-EHR-COMPOSITION.encounter.v1": {"schemaFilepath": "encounter.json"}}, "syncBypassBuckets": ["BUCKET"]}`,
+		"missing.json":   `{"archetypes": {"openEHR-EHR-COMPOSITION.encounter.v1": {"schemaFilepath": "missing.json.schema"}}}`,
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatalf("Failed to write %s, %v", name, err)
+		}
+	}
+
+	rules, err := LoadValidationRules(filepath.Join(dir, "rules.json"))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	validator := NewValidator(rules)
+	if err := validator.Validate("application/json", encounterArchetype, strings.NewReader(`{}`)); err == nil {
+		t.Error("Expected schema loaded from file to be used")
+	}
+	if !validator.SyncBypassed("BUCKET") || validator.SyncBypassed("OTHER") {
+		t.Error("Expected validation of synced files to be bypassed only for BUCKET")
+	}
+
+	if _, err := LoadValidationRules(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected error for missing schema file, got nil")
+	}
+}
+
+func TestValidatedWrites(t *testing.T) {
+	rules := &ValidationRules{
+		Archetypes:        map[string]*ArchetypeRules{encounterArchetype: {Schema: schema(t, encounterSchema)}},
+		SyncBypassBuckets: []string{"BYPASSED"},
+	}
+
+	t.Run("Invalid file is not written", func(t *testing.T) {
+		svc, s, _, _, c := getTestService(t)
+		defer c()
+		svc.validator = NewValidator(rules)
+
+		s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil)
+
+		_, err := svc.FileNew(context.TODO(), "BUCKET", strings.NewReader("{}"), "application/json", encounterArchetype, nil)
+		if _, ok := err.(*ValidationError); !ok {
+			t.Errorf("Expected validation error, got %v", err)
+		}
+	})
+
+	t.Run("Valid file is written from the beginning", func(t *testing.T) {
+		svc, s, _, p, c := getTestService(t)
+		defer c()
+		svc.validator = NewValidator(rules)
+
+		gomock.InOrder(
+			s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
+			s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).DoAndReturn(
+				func(_ context.Context, _ string, _ *object.NewObjectInfo, r io.Reader) (*models.FileDescriptor, error) {
+					if b, _ := ioutil.ReadAll(r); string(b) != validEncounter {
+						t.Errorf("Expected written contents to equal '%s', got '%s'", validEncounter, b)
+					}
+					return file1V1, nil
+				}),
+			p.EXPECT().PublishAsyncWithRetries(gomock.Any(), gomock.Any(), gomock.Any()),
+		)
+
+		if _, err := svc.FileNew(context.TODO(), "BUCKET", strings.NewReader(validEncounter), "application/json", encounterArchetype, nil); err != nil {
+			t.Errorf("Expected error to be nil, got %v", err)
+		}
+	})
+
+	t.Run("Invalid synced file is refused", func(t *testing.T) {
+		svc, s, _, _, c := getTestService(t)
+		defer c()
+		svc.validator = NewValidator(rules)
+
+		s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil)
+
+		_, err := svc.SyncFile(context.TODO(), "BUCKET", "FILE", "V1", strings.NewReader("{}"), "RBNvo1WzZ4oRRq0W9-hknpT7T8If536DEMBg9hyq_4o=", "application/json", time1, encounterArchetype, nil, nil, "")
+		if _, ok := err.(*ValidationError); !ok {
+			t.Errorf("Expected validation error, got %v", err)
+		}
+	})
+
+	t.Run("Validation of synced file is bypassed", func(t *testing.T) {
+		svc, s, _, _, c := getTestService(t)
+		defer c()
+		svc.validator = NewValidator(rules)
+
+		gomock.InOrder(
+			s.EXPECT().MakeBucket(gomock.Any(), "BYPASSED").Return(nil),
+			s.EXPECT().Read(gomock.Any(), "BYPASSED", "FILE", "V1").Return(nil, nil, fmt.Errorf("Error")),
+		)
+
+		_, err := svc.SyncFile(context.TODO(), "BYPASSED", "FILE", "V1", strings.NewReader("{}"), "RBNvo1WzZ4oRRq0W9-hknpT7T8If536DEMBg9hyq_4o=", "application/json", time1, encounterArchetype, nil, nil, "")
+		if err == nil || err.Error() != "Error" {
+			t.Errorf("Expected read error, got %v", err)
+		}
+	})
+}
+
+func schema(t *testing.T, s string) *spec.Schema {
+	schema := &spec.Schema{}
+	if err := json.Unmarshal([]byte(s), schema); err != nil {
+		t.Fatalf("Failed to parse schema, %v", err)
+	}
+
+	return schema
+}
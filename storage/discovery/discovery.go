@@ -44,6 +44,9 @@ type (
 		// Unlink removes a connection between a patient and a location
 		Unlink(patientID, locationID strfmt.UUID) error
 
+		// LocationPatients returns IDs of patients linked to a location
+		LocationPatients(locationID strfmt.UUID) (models.PatientIDs, error)
+
 		// CodesGet fetches matching codes
 		CodesGet(category, query, parentID, locale string) (models.Codes, error)
 
@@ -342,6 +345,25 @@ func (s *storage) Unlink(patientID, locationID strfmt.UUID) error {
 	return ErrNotFound
 }
 
+func (s *storage) LocationPatients(locationID strfmt.UUID) (models.PatientIDs, error) {
+	rows, err := s.db.Model(&location{}).
+		Where("location_id = ?", locationID.String()).
+		Select("patient_id").Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to look up linked patients")
+	}
+	defer rows.Close()
+
+	patientIDs := models.PatientIDs{}
+	for rows.Next() {
+		var patientID string
+		errorChecker.LogError(rows.Scan(&patientID))
+		patientIDs = append(patientIDs, strfmt.UUID(patientID))
+	}
+
+	return patientIDs, nil
+}
+
 func (s *storage) CodesGet(category, query, parentID, locale string) (models.Codes, error) {
 	if locale == "" {
 		locale = "en"
@@ -1033,6 +1033,72 @@ func TestUnlink(t *testing.T) {
 	}
 }
 
+func TestLocationPatients(t *testing.T) {
+	testCases := []struct {
+		title         string
+		calls         func(sqlmock.Sqlmock)
+		expected      models.PatientIDs
+		errorExpected bool
+	}{
+		{
+			"Linked patients",
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT patient_id FROM \"locations\" WHERE \\(location_id = \\$1\\)").
+					WithArgs(uuid2.String()).
+					WillReturnRows(sqlmock.NewRows([]string{"patient_id"}).
+						AddRow(uuid1.String()).
+						AddRow(uuid2.String()))
+			},
+			models.PatientIDs{uuid1, uuid2},
+			noErrors,
+		},
+		{
+			"No linked patients",
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT patient_id .+").
+					WillReturnRows(sqlmock.NewRows([]string{"patient_id"}))
+			},
+			models.PatientIDs{},
+			noErrors,
+		},
+		{
+			"Select fails",
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT patient_id .+").
+					WillReturnError(fmt.Errorf("Failed"))
+			},
+			nil,
+			withErrors,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.title, func(t *testing.T) {
+			// init storage
+			s, db, c := getTestDB(t)
+			defer c()
+
+			// collect mocked calls
+			tc.calls(db)
+
+			// call the method
+			out, err := s.LocationPatients(uuid2)
+
+			// check expected results
+			if !reflect.DeepEqual(out, tc.expected) {
+				t.Errorf("Expected\n\t%s\nto equal\n\t%s", toJSON(out), toJSON(tc.expected))
+			}
+
+			// assert error
+			if tc.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !tc.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+		})
+	}
+}
+
 func TestGetCodes(t *testing.T) {
 	cat := "CAT"
 	id := "ID"
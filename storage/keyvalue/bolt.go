@@ -1,5 +1,7 @@
 package keyvalue
 
+//go:generate ../../bin/mockgen.sh storage/keyvalue Storage $GOFILE
+
 import (
 	"context"
 	"fmt"
@@ -18,6 +20,7 @@ const (
 	operationSeconds metrics.ID = "operationSeconds"
 	operationAdd     string     = "add"
 	operationGet     string     = "get"
+	operationForEach string     = "forEach"
 )
 
 // Storage interface
@@ -26,6 +29,7 @@ type Storage interface {
 	Update(bucket string, key string, value []byte) error
 	Get(bucket string, key string) []byte
 	Delete(bucket string, key string) error
+	ForEach(bucket string, fn func(key string, value []byte) error) error
 	GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector
 }
 
@@ -123,7 +127,8 @@ func (s *boltKeyValue) Get(bucket string, key string) []byte {
 			return nil
 		}
 
-		val = b.Get([]byte(key))
+		// value is valid only during the transaction
+		val = append([]byte(nil), b.Get([]byte(key))...)
 		return nil
 	}))
 
@@ -161,6 +166,38 @@ func (s *boltKeyValue) Delete(bucket string, key string) error {
 	return nil
 }
 
+// ForEach calls the function for every item of the bucket in order of keys, iteration stops on first error
+func (s *boltKeyValue) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	// Make sure we record duration metrics even if processing fails
+	start := time.Now()
+	success := false
+	defer func() {
+		duration := time.Since(start)
+		s.metricsCollection[operationSeconds].(*prometheus.HistogramVec).
+			With(prometheus.Labels{"operation": operationForEach, "success": fmt.Sprintf("%t", success)}).
+			Observe(duration.Seconds())
+	}()
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+
+	if err != nil {
+		s.logger.Error().Err(err).Str("bucket", bucket).Msg("failed to iterate over bucket")
+		return errors.Wrapf(err, "failed to iterate over bucket %s", bucket)
+	}
+
+	success = true
+	return nil
+}
+
 // Close releases DB.
 func (s *boltKeyValue) Close() error {
 	err := s.db.Close()
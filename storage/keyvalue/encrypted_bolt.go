@@ -146,6 +146,38 @@ func (s *encryptedBoltKeyValue) Delete(bucket string, key string) error {
 	return nil
 }
 
+// ForEach calls the function for every item of the bucket in order of keys, iteration stops on first error
+func (s *encryptedBoltKeyValue) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	// Make sure we record duration metrics even if processing fails
+	start := time.Now()
+	success := false
+	defer func() {
+		duration := time.Since(start)
+		s.metricsCollection[operationSeconds].(*prometheus.HistogramVec).
+			With(prometheus.Labels{"operation": operationForEach, "success": fmt.Sprintf("%t", success)}).
+			Observe(duration.Seconds())
+	}()
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+
+	if err != nil {
+		s.logger.Error().Err(err).Str("bucket", bucket).Msg("failed to iterate over bucket")
+		return errors.Wrapf(err, "failed to iterate over bucket %s", bucket)
+	}
+
+	success = true
+	return nil
+}
+
 // Close releases DB.
 func (s *encryptedBoltKeyValue) Close() error {
 	err := s.db.Close()
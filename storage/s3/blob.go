@@ -0,0 +1,247 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	minio "github.com/minio/minio-go"
+
+	"github.com/iryonetwork/wwm/utils/spool"
+)
+
+// blobsPrefix is the prefix of all objects holding deduplicated file contents
+const blobsPrefix = "blobs/"
+
+// blobRemovalTimeout is the time after which tombstone of the blob removal is considered abandoned
+const blobRemovalTimeout = time.Minute
+
+// blobRemovalPollInterval is the interval in which tombstone of the blob removal is checked
+const blobRemovalPollInterval = 100 * time.Millisecond
+
+// blobKey returns the key of the object holding contents with the checksum
+func blobKey(checksum string) string {
+	return blobsPrefix + checksum + "/data"
+}
+
+// blobRefsPrefix returns the prefix of references to contents with the checksum
+func blobRefsPrefix(checksum string) string {
+	return blobsPrefix + checksum + "/refs/"
+}
+
+// blobTombstoneKey returns the key of the object marking removal of contents with the checksum in progress
+func blobTombstoneKey(checksum string) string {
+	return blobsPrefix + checksum + "/tombstone"
+}
+
+// blobRefKey returns the key of the reference from the file version to contents with the checksum
+func blobRefKey(checksum, fileID, version string) string {
+	return blobRefsPrefix(checksum) + fileID + "." + version
+}
+
+// putBlob stores contents of the file version as a content addressed blob referenced by the file version.
+// Contents are uploaded only if blob with the same checksum does not exist in the bucket yet.
+func (s *s3storage) putBlob(ctx context.Context, bucketID string, md *metadata, keyVersion string, r io.Reader) error {
+	// blob is shared by other file versions so make sure contents match the checksum before they are
+	// deduplicated or uploaded; contents spooled by the caller are not spooled again
+	contents, ok := r.(*spool.Contents)
+	if !ok {
+		f, err := spool.Copy("", r)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read contents")
+		}
+		defer f.Close()
+		if contents, err = f.Reader(); err != nil {
+			return err
+		}
+	}
+	if contents.Checksum() != md.checksum {
+		return ErrChecksumMismatch
+	}
+
+	// reference the blob before checking if it exists so that it's not removed by Delete of its last reference
+	refKey := blobRefKey(md.checksum, md.filename, md.version)
+	_, err := s.client.PutObjectWithContext(ctx, bucketID, refKey, &bytes.Buffer{}, 0, minio.PutObjectOptions{})
+	if err != nil {
+		return errors.Wrap(err, "Failed to put blob reference")
+	}
+	// removal that started before the reference was written might not have seen it
+	if err := s.waitForBlobRemoval(ctx, bucketID, md.checksum); err != nil {
+		return err
+	}
+
+	key := blobKey(md.checksum)
+	_, err = s.client.StatObject(bucketID, key, minio.StatObjectOptions{})
+	switch {
+	case err == nil:
+		// contents are already stored
+		return nil
+	case !isNotFound(err):
+		return errors.Wrap(err, "Failed to stat blob")
+	}
+
+	em, err := getCBCKey(bucketID, keyVersion, s.keys)
+	if err != nil {
+		return errors.Wrap(err, "Failed to set the CBC key")
+	}
+	opts := minio.PutObjectOptions{EncryptMaterials: em}
+	if keyVersion != "" {
+		opts.UserMetadata = map[string]string{keyVersionMetadata: keyVersion}
+	}
+
+	_, err = s.client.PutObjectWithContext(ctx, bucketID, key, contents, -1, opts)
+	if err != nil {
+		return errors.Wrap(err, "Failed to put blob")
+	}
+
+	return nil
+}
+
+// waitForBlobRemoval waits until removal of the blob marked by its tombstone finishes. Tombstones older than
+// blobRemovalTimeout were left by removals that never finished and are ignored.
+func (s *s3storage) waitForBlobRemoval(ctx context.Context, bucketID, checksum string) error {
+	for {
+		info, err := s.client.StatObject(bucketID, blobTombstoneKey(checksum), minio.StatObjectOptions{})
+		switch {
+		case isNotFound(err):
+			return nil
+		case err != nil:
+			return errors.Wrap(err, "Failed to stat blob tombstone")
+		case time.Since(info.LastModified) > blobRemovalTimeout:
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(blobRemovalPollInterval):
+		}
+	}
+}
+
+// blobKeyVersion returns version of the key used to encrypt the blob
+func (s *s3storage) blobKeyVersion(bucketID, checksum string) (string, error) {
+	info, err := s.client.StatObject(bucketID, blobKey(checksum), minio.StatObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	return info.Metadata.Get(keyVersionHeader), nil
+}
+
+// reencryptBlob rewrites the blob encrypted with the current key of the bucket. Returns false if blob is
+// already encrypted with the current key.
+func (s *s3storage) reencryptBlob(ctx context.Context, bucketID, checksum, currentVersion string) (bool, error) {
+	oldVersion, err := s.blobKeyVersion(bucketID, checksum)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to stat blob")
+	}
+	if oldVersion == currentVersion {
+		return false, nil
+	}
+
+	// spool the whole blob; it is overwritten under the same name so it can't be streamed
+	em, err := getCBCKey(bucketID, oldVersion, s.keys)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to set CBC key")
+	}
+	r, err := s.client.GetObjectWithContext(ctx, bucketID, blobKey(checksum), minio.GetObjectOptions{Materials: em})
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to fetch enc. blob")
+	}
+	f, err := spool.Copy("", r)
+	r.Close()
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to read enc. blob")
+	}
+	defer f.Close()
+
+	// make sure the blob was decrypted correctly before overwriting it
+	if f.Verify(checksum) != nil {
+		return false, ErrChecksumMismatch
+	}
+	contents, err := f.Reader()
+	if err != nil {
+		return false, err
+	}
+
+	em, err = getCBCKey(bucketID, currentVersion, s.keys)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to set the CBC key")
+	}
+	opts := minio.PutObjectOptions{EncryptMaterials: em}
+	if currentVersion != "" {
+		opts.UserMetadata = map[string]string{keyVersionMetadata: currentVersion}
+	}
+	_, err = s.client.PutObjectWithContext(ctx, bucketID, blobKey(checksum), contents, -1, opts)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to put blob")
+	}
+
+	return true, nil
+}
+
+// removeUnreferencedBlob removes the blob if no file version references it anymore. Removal is marked with
+// a tombstone and references are checked again once it's written; references written later wait for the
+// removal to finish and upload the contents again.
+func (s *s3storage) removeUnreferencedBlob(ctx context.Context, bucketID, checksum string) error {
+	referenced, err := s.blobReferenced(bucketID, checksum)
+	if err != nil || referenced {
+		return err
+	}
+
+	tombstone := blobTombstoneKey(checksum)
+	if _, err := s.client.PutObjectWithContext(ctx, bucketID, tombstone, &bytes.Buffer{}, 0, minio.PutObjectOptions{}); err != nil {
+		return errors.Wrap(err, "Failed to put blob tombstone")
+	}
+	defer func() {
+		if err := s.removeObjects(bucketID, []string{tombstone}); err != nil {
+			s.logger.Error().Err(err).Str("cmd", "s3::removeUnreferencedBlob").Msg("Failed to remove blob tombstone")
+		}
+	}()
+
+	referenced, err = s.blobReferenced(bucketID, checksum)
+	if err != nil || referenced {
+		return err
+	}
+
+	return s.removeObjects(bucketID, []string{blobKey(checksum)})
+}
+
+// blobReferenced returns true if any file version references the blob
+func (s *s3storage) blobReferenced(bucketID, checksum string) (bool, error) {
+	ch := make(chan struct{})
+	defer close(ch)
+	for info := range s.client.ListObjectsV2(bucketID, blobRefsPrefix(checksum), false, ch) {
+		if info.Err != nil {
+			return false, errors.Wrap(info.Err, "Failed to list blob references")
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// removeObjects removes all the objects, returns the last error encountered
+func (s *s3storage) removeObjects(bucketID string, keys []string) error {
+	ch := make(chan string, len(keys))
+	for _, key := range keys {
+		ch <- key
+	}
+	close(ch)
+
+	for _, key := range keys {
+		s.headers.invalidate(bucketID, key)
+	}
+
+	var err error
+	for removeObjErr := range s.client.RemoveObjects(bucketID, ch) {
+		err = removeObjErr.Err
+		s.logger.Error().Err(err).Str("object", removeObjErr.ObjectName).Msg("Failed to delete the object")
+	}
+
+	return err
+}
@@ -0,0 +1,576 @@
+package s3
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/pkg/encrypt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	minio "github.com/minio/minio-go"
+)
+
+// fsTmpDir is the directory under the root holding objects being written
+const fsTmpDir = ".tmp"
+
+// fsObjectsDir is the directory of the bucket holding its objects
+const fsObjectsDir = "objects"
+
+// fsBucketFile is the file of the bucket holding its details
+const fsBucketFile = "bucket.json"
+
+// fsFooterLength is the length of the footer of the object file holding the length of object info
+const fsFooterLength = 8
+
+// headers under which encryption materials are stored, same as used by minio client
+const (
+	amzHeaderIV      = "X-Amz-Meta-X-Amz-Iv"
+	amzHeaderKey     = "X-Amz-Meta-X-Amz-Key"
+	amzHeaderMatDesc = "X-Amz-Meta-X-Amz-Matdesc"
+)
+
+// fsClient implements Minio interface on the local filesystem. Buckets are directories under the root
+// and objects are files under the objects directory of the bucket with keys as their paths. Object file
+// holds contents of the object followed by JSON encoded object info and its length.
+type fsClient struct {
+	root string
+}
+
+// fsBucketInfo describes the bucket
+type fsBucketInfo struct {
+	Created time.Time `json:"created"`
+}
+
+// fsObjectInfo holds object info stored after contents of the object
+type fsObjectInfo struct {
+	LastModified time.Time   `json:"lastModified"`
+	Metadata     http.Header `json:"metadata"`
+}
+
+// NewFilesystem creates a new instance of storage keeping buckets in directories under the root instead
+// of S3 storage. Objects are written atomically and synced to the disk; encryption, metadata and
+// versioning are the same as in S3 storage.
+func NewFilesystem(root string, keys KeyProvider, logger zerolog.Logger) (Storage, error) {
+	logger = logger.With().Str("component", "storage/s3").Logger()
+
+	c, err := newFsClient(root)
+	if err != nil {
+		logger.Info().Err(err).Str("cmd", "s3::NewFilesystem").Msg("Failed to initialize filesystem storage")
+		return nil, errors.Wrap(err, "Failed to initialize filesystem storage")
+	}
+
+	obj := &s3storage{
+		cfg:    &Config{},
+		client: c,
+		keys:   keys,
+		logger: logger,
+	}
+
+	return obj, nil
+}
+
+// newFsClient returns filesystem client with the root directory, objects left behind by interrupted
+// writes are removed
+func newFsClient(root string) (*fsClient, error) {
+	c := &fsClient{root: root}
+
+	if err := os.RemoveAll(c.tmpDir()); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(c.tmpDir(), 0700); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *fsClient) MakeBucket(bucketName, _ string) error {
+	if err := validBucketName(bucketName); err != nil {
+		return err
+	}
+
+	// bucket is prepared in temporary directory so that it's created atomically
+	dir, err := ioutil.TempDir(c.tmpDir(), "bucket")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, fsObjectsDir), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(fsBucketInfo{Created: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(dir, fsBucketFile), b); err != nil {
+		return err
+	}
+
+	if exists, err := c.BucketExists(bucketName); err != nil {
+		return err
+	} else if exists {
+		return minio.ErrorResponse{Code: "BucketAlreadyOwnedByYou", Message: bucketExistsErrMsg, StatusCode: http.StatusConflict}
+	}
+	if err := os.Rename(dir, c.bucketDir(bucketName)); err != nil {
+		if os.IsExist(err) {
+			return minio.ErrorResponse{Code: "BucketAlreadyOwnedByYou", Message: bucketExistsErrMsg, StatusCode: http.StatusConflict}
+		}
+		return err
+	}
+
+	return syncDir(c.root)
+}
+
+func (c *fsClient) BucketExists(bucketName string) (bool, error) {
+	if err := validBucketName(bucketName); err != nil {
+		return false, err
+	}
+
+	_, err := os.Stat(filepath.Join(c.bucketDir(bucketName), fsBucketFile))
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsNotExist(err):
+		return false, nil
+	}
+
+	return false, err
+}
+
+func (c *fsClient) ListBuckets() ([]minio.BucketInfo, error) {
+	dirs, err := ioutil.ReadDir(c.root)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := []minio.BucketInfo{}
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(c.root, d.Name(), fsBucketFile))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var info fsBucketInfo
+		if err := json.Unmarshal(b, &info); err != nil {
+			return nil, errors.Wrapf(err, "Invalid bucket %s", d.Name())
+		}
+		buckets = append(buckets, minio.BucketInfo{Name: d.Name(), CreationDate: info.Created})
+	}
+
+	return buckets, nil
+}
+
+// ListObjectsV2 lists objects with keys starting with the prefix sorted by key. Unless recursive, only
+// objects up to the next slash after the prefix are listed and deeper objects are listed by their common prefix.
+func (c *fsClient) ListObjectsV2(bucketName, prefix string, recursive bool, doneCh <-chan struct{}) <-chan minio.ObjectInfo {
+	ch := make(chan minio.ObjectInfo)
+
+	go func() {
+		defer close(ch)
+
+		infos, err := c.listObjects(bucketName, prefix, recursive)
+		if err != nil {
+			infos = []minio.ObjectInfo{{Err: err}}
+		}
+		for _, info := range infos {
+			select {
+			case ch <- info:
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+func (c *fsClient) listObjects(bucketName, prefix string, recursive bool) ([]minio.ObjectInfo, error) {
+	if exists, err := c.BucketExists(bucketName); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, minio.ErrorResponse{Code: "NoSuchBucket", Message: "The specified bucket does not exist", StatusCode: http.StatusNotFound}
+	}
+
+	infos := []minio.ObjectInfo{}
+	var walk func(dir, keyPrefix string) error
+	walk = func(dir, keyPrefix string) error {
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			key := keyPrefix + f.Name()
+			if f.IsDir() {
+				key += "/"
+			}
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				continue
+			}
+
+			switch {
+			case f.IsDir() && (recursive || !strings.HasPrefix(key, prefix)):
+				if err := walk(filepath.Join(dir, f.Name()), key); err != nil {
+					return err
+				}
+			case f.IsDir():
+				infos = append(infos, minio.ObjectInfo{Key: key})
+			case strings.HasPrefix(key, prefix):
+				size, info, err := statObjectFile(filepath.Join(dir, f.Name()))
+				if os.IsNotExist(err) {
+					// removed in the meantime
+					continue
+				} else if err != nil {
+					return errors.Wrapf(err, "Failed to read object %s", key)
+				}
+				infos = append(infos, minio.ObjectInfo{Key: key, Size: size, LastModified: info.LastModified})
+			}
+		}
+
+		return nil
+	}
+
+	// start at the deepest directory covered by the prefix
+	keyPrefix := prefix[:strings.LastIndex(prefix, "/")+1]
+	if err := validObjectName(strings.TrimSuffix(keyPrefix, "/"), true); err != nil {
+		return nil, err
+	}
+	if err := walk(filepath.Join(c.objectsDir(bucketName), filepath.FromSlash(keyPrefix)), keyPrefix); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// GetObjectWithContext returns contents of the object decrypted with materials if set. Like with minio client,
+// missing object is reported only when contents are read.
+func (c *fsClient) GetObjectWithContext(_ context.Context, bucketName, objectName string, opts minio.GetObjectOptions) (io.ReadCloser, error) {
+	path, err := c.objectPath(bucketName, objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ioutil.NopCloser(errReader{noSuchKey(objectName)}), nil
+	} else if err != nil {
+		return nil, err
+	}
+	size, info, err := readObjectInfo(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var r io.ReadCloser = limitReadCloser{io.LimitReader(f, size), f}
+
+	if opts.Materials != nil {
+		if err := opts.Materials.SetupDecryptMode(r, info.Metadata.Get(amzHeaderIV), info.Metadata.Get(amzHeaderKey)); err != nil {
+			r.Close()
+			return nil, err
+		}
+		r = opts.Materials
+	}
+
+	return r, nil
+}
+
+func (c *fsClient) GetEncryptedObject(bucketName, objectName string, encryptMaterials encrypt.Materials) (io.ReadCloser, error) {
+	return c.GetObjectWithContext(context.Background(), bucketName, objectName, minio.GetObjectOptions{Materials: encryptMaterials})
+}
+
+func (c *fsClient) StatObject(bucketName, objectName string, _ minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	path, err := c.objectPath(bucketName, objectName)
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+
+	size, info, err := statObjectFile(path)
+	if os.IsNotExist(err) {
+		return minio.ObjectInfo{}, noSuchKey(objectName)
+	} else if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+
+	return minio.ObjectInfo{Key: objectName, Size: size, LastModified: info.LastModified, Metadata: info.Metadata}, nil
+}
+
+// PutObjectWithContext writes the object atomically replacing the existing object with the same key. Contents
+// are encrypted with materials if set. Returns the size of stored contents.
+func (c *fsClient) PutObjectWithContext(ctx context.Context, bucketName, objectName string, reader io.Reader, _ int64, opts minio.PutObjectOptions) (int64, error) {
+	path, err := c.objectPath(bucketName, objectName)
+	if err != nil {
+		return 0, err
+	}
+	if exists, err := c.BucketExists(bucketName); err != nil {
+		return 0, err
+	} else if !exists {
+		return 0, minio.ErrorResponse{Code: "NoSuchBucket", Message: "The specified bucket does not exist", StatusCode: http.StatusNotFound}
+	}
+
+	info := fsObjectInfo{LastModified: time.Now().UTC(), Metadata: http.Header{}}
+	for k, v := range opts.UserMetadata {
+		info.Metadata.Set("X-Amz-Meta-"+k, v)
+	}
+	if opts.EncryptMaterials != nil {
+		if err := opts.EncryptMaterials.SetupEncryptMode(reader); err != nil {
+			return 0, err
+		}
+		reader = opts.EncryptMaterials
+		info.Metadata.Set(amzHeaderIV, opts.EncryptMaterials.GetIV())
+		info.Metadata.Set(amzHeaderKey, opts.EncryptMaterials.GetKey())
+		info.Metadata.Set(amzHeaderMatDesc, opts.EncryptMaterials.GetDesc())
+	}
+
+	f, err := ioutil.TempFile(c.tmpDir(), "object")
+	if err != nil {
+		return 0, err
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	n, err := io.Copy(f, reader)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeObjectInfo(f, info); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// directory might be removed by concurrent removal of the last object in it
+	for attempt := 0; ; attempt++ {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return 0, err
+		}
+		err := os.Rename(f.Name(), path)
+		if err == nil {
+			renamed = true
+			break
+		}
+		if !os.IsNotExist(err) || attempt > 0 {
+			return 0, err
+		}
+	}
+
+	return n, syncDir(filepath.Dir(path))
+}
+
+func (c *fsClient) PutEncryptedObject(bucketName, objectName string, reader io.Reader, encryptMaterials encrypt.Materials) (int64, error) {
+	return c.PutObjectWithContext(context.Background(), bucketName, objectName, reader, -1, minio.PutObjectOptions{EncryptMaterials: encryptMaterials})
+}
+
+// RemoveObjects removes the objects, removing objects that don't exist is not an error
+func (c *fsClient) RemoveObjects(bucketName string, objectsCh <-chan string) <-chan minio.RemoveObjectError {
+	errCh := make(chan minio.RemoveObjectError)
+
+	go func() {
+		defer close(errCh)
+
+		for objectName := range objectsCh {
+			if err := c.removeObject(bucketName, objectName); err != nil {
+				errCh <- minio.RemoveObjectError{ObjectName: objectName, Err: err}
+			}
+		}
+	}()
+
+	return errCh
+}
+
+func (c *fsClient) removeObject(bucketName, objectName string) error {
+	path, err := c.objectPath(bucketName, objectName)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// remove directories left empty so that they are not listed as common prefixes
+	dir := filepath.Dir(path)
+	for dir != c.objectsDir(bucketName) && os.Remove(dir) == nil {
+		dir = filepath.Dir(dir)
+	}
+
+	return syncDir(dir)
+}
+
+func (c *fsClient) tmpDir() string {
+	return filepath.Join(c.root, fsTmpDir)
+}
+
+func (c *fsClient) bucketDir(bucketName string) string {
+	return filepath.Join(c.root, bucketName)
+}
+
+func (c *fsClient) objectsDir(bucketName string) string {
+	return filepath.Join(c.bucketDir(bucketName), fsObjectsDir)
+}
+
+// objectPath returns path of the object file, object names can't point outside of the bucket
+func (c *fsClient) objectPath(bucketName, objectName string) (string, error) {
+	if err := validBucketName(bucketName); err != nil {
+		return "", err
+	}
+	if err := validObjectName(objectName, false); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(c.objectsDir(bucketName), filepath.FromSlash(objectName)), nil
+}
+
+func validBucketName(bucketName string) error {
+	if bucketName == "" || strings.HasPrefix(bucketName, ".") || strings.ContainsAny(bucketName, `/\`) {
+		return minio.ErrorResponse{Code: "InvalidBucketName", Message: fmt.Sprintf("Invalid bucket name %s", bucketName), StatusCode: http.StatusBadRequest}
+	}
+
+	return nil
+}
+
+// validObjectName checks that every element of the object name is a valid file name, empty name is
+// valid only if allowEmpty is set
+func validObjectName(objectName string, allowEmpty bool) error {
+	if objectName == "" && allowEmpty {
+		return nil
+	}
+
+	for _, element := range strings.Split(objectName, "/") {
+		if element == "" || element == "." || element == ".." || strings.Contains(element, `\`) {
+			return minio.ErrorResponse{Code: "XMinioInvalidObjectName", Message: fmt.Sprintf("Invalid object name %s", objectName), StatusCode: http.StatusBadRequest}
+		}
+	}
+
+	return nil
+}
+
+func noSuchKey(objectName string) error {
+	return minio.ErrorResponse{Code: "NoSuchKey", Message: fmt.Sprintf("The specified key %s does not exist", objectName), StatusCode: http.StatusNotFound}
+}
+
+// statObjectFile returns the size of contents and object info of the object file
+func statObjectFile(path string) (int64, *fsObjectInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	return readObjectInfo(f)
+}
+
+// readObjectInfo returns the size of contents and object info of the opened object file
+func readObjectInfo(f *os.File) (int64, *fsObjectInfo, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if stat.Size() < fsFooterLength {
+		return 0, nil, errors.New("Object file is too short")
+	}
+	footer := make([]byte, fsFooterLength)
+	if _, err := f.ReadAt(footer, stat.Size()-fsFooterLength); err != nil {
+		return 0, nil, errors.Wrap(err, "Failed to read object footer")
+	}
+	// length is validated as unsigned so that corrupted footers can't overflow the size
+	length := binary.BigEndian.Uint64(footer)
+	if length > uint64(stat.Size()-fsFooterLength) {
+		return 0, nil, errors.New("Invalid object footer")
+	}
+	size := stat.Size() - fsFooterLength - int64(length)
+
+	b := make([]byte, length)
+	if _, err := f.ReadAt(b, size); err != nil {
+		return 0, nil, errors.Wrap(err, "Failed to read object info")
+	}
+	info := &fsObjectInfo{}
+	if err := json.Unmarshal(b, info); err != nil {
+		return 0, nil, errors.Wrap(err, "Failed to parse object info")
+	}
+
+	return size, info, nil
+}
+
+// writeObjectInfo writes object info and its length after contents of the object
+func writeObjectInfo(w io.Writer, info fsObjectInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	footer := make([]byte, fsFooterLength)
+	binary.BigEndian.PutUint64(footer, uint64(len(b)))
+	_, err = w.Write(append(b, footer...))
+	return err
+}
+
+// writeFileSync writes the file and syncs it to the disk
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// syncDir syncs the directory so that changes of its entries are persisted
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// errReader returns the error on every read
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
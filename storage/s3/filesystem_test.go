@@ -0,0 +1,698 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3/object"
+	minio "github.com/minio/minio-go"
+)
+
+// testKeys provides keys of all the buckets, current version of the key can be changed
+type testKeys struct {
+	current string
+}
+
+func (k *testKeys) Get(bucketID string) (string, error) {
+	return k.GetVersion(bucketID, k.current)
+}
+
+func (k *testKeys) GetVersion(_, version string) (string, error) {
+	return fmt.Sprintf("%-32s", "key"+version), nil
+}
+
+func (k *testKeys) CurrentVersion(string) (string, error) {
+	return k.current, nil
+}
+
+// backends returns constructors of storages to run scenarios against; filesystem storages are created
+// in the directory and S3 storage is tested only if S3_TEST_ENDPOINT is set
+func backends(t *testing.T, root string) map[string]func(*testKeys) Storage {
+	b := map[string]func(*testKeys) Storage{
+		"filesystem": func(keys *testKeys) Storage {
+			dir, err := ioutil.TempDir(root, "storage")
+			if err != nil {
+				t.Fatalf("Failed to create temporary directory, %v", err)
+			}
+			s, err := NewFilesystem(dir, keys, zerolog.New(ioutil.Discard))
+			if err != nil {
+				t.Fatalf("Failed to initialize filesystem storage, %v", err)
+			}
+			return s
+		},
+	}
+
+	if endpoint := os.Getenv("S3_TEST_ENDPOINT"); endpoint != "" {
+		b["s3"] = func(keys *testKeys) Storage {
+			cfg := &Config{
+				Endpoint:     endpoint,
+				AccessKey:    os.Getenv("S3_TEST_ACCESS_KEY"),
+				AccessSecret: os.Getenv("S3_TEST_SECRET"),
+				Region:       "us-east-1",
+			}
+			s, err := New(cfg, keys, zerolog.New(ioutil.Discard))
+			if err != nil {
+				t.Fatalf("Failed to initialize S3 storage, %v", err)
+			}
+			return s
+		}
+	}
+
+	return b
+}
+
+func newTestFile(name, version string, op Operation, created time.Time, contents string) *object.NewObjectInfo {
+	no := &object.NewObjectInfo{
+		Name:        name,
+		Version:     version,
+		Operation:   string(op),
+		Created:     strfmt.DateTime(created),
+		ContentType: "text/plain",
+		Archetype:   "ARCH",
+		Labels:      []string{"label"},
+	}
+	if op == Write {
+		no.Checksum = checksumOf([]byte(contents))
+		no.Size = int64(len(contents))
+	}
+
+	return no
+}
+
+func TestBackends(t *testing.T) {
+	created := time.Date(2018, 1, 18, 15, 22, 46, 123000000, time.UTC)
+
+	scenarios := []struct {
+		description string
+		run         func(*testing.T, Storage, *testKeys, string)
+	}{
+		{
+			"buckets",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				if exists, err := s.BucketExists(ctx, bucket); err != nil || !exists {
+					t.Errorf("Expected bucket to exist, got %v, %v", exists, err)
+				}
+				if exists, err := s.BucketExists(ctx, bucket+"-missing"); err != nil || exists {
+					t.Errorf("Expected bucket not to exist, got %v, %v", exists, err)
+				}
+				if err := s.MakeBucket(ctx, bucket); err != ErrAlreadyExists {
+					t.Errorf("Expected error to equal %v, got %v", ErrAlreadyExists, err)
+				}
+
+				buckets, err := s.ListBuckets(ctx)
+				if err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				found := false
+				for _, b := range buckets {
+					found = found || b.Name == bucket
+				}
+				if !found {
+					t.Errorf("Expected bucket %s to be listed", bucket)
+				}
+			},
+		},
+		{
+			"list",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				mustWrite(t, s, bucket, newTestFile("File1", "V1", Write, created, "contents"), "contents")
+				mustWrite(t, s, bucket, newTestFile("File1", "V2", Write, created.Add(2*time.Minute), "new contents"), "new contents")
+				mustWrite(t, s, bucket, newTestFile("Image", "V1", Write, created.Add(time.Minute), "image"), "image")
+				mustWrite(t, s, bucket, newTestFile("Image", "V2", Delete, created.Add(3*time.Minute), ""), "")
+				// objects other than file versions are not listed
+				if err := s.HoldSet(ctx, bucket, "Image"); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if err := s.UploadNew(ctx, bucket, &models.UploadDescriptor{ID: "UPLOAD", Size: 8}); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+
+				image := testDescriptor(bucket, "Image", "V2", Delete, created.Add(3*time.Minute), "")
+				image.LegalHold = true
+				expected := []*models.FileDescriptor{
+					image,
+					testDescriptor(bucket, "File1", "V2", Write, created.Add(2*time.Minute), "new contents"),
+					testDescriptor(bucket, "Image", "V1", Write, created.Add(time.Minute), "image"),
+					testDescriptor(bucket, "File1", "V1", Write, created, "contents"),
+				}
+				expected[2].LegalHold = true
+				assertList(t, s, bucket, "", expected)
+				// listed again from cached headers
+				assertList(t, s, bucket, "", expected)
+				assertList(t, s, bucket, "File1.", []*models.FileDescriptor{expected[1], expected[3]})
+				assertList(t, s, bucket+"-missing", "", []*models.FileDescriptor{})
+			},
+		},
+		{
+			"read",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				mustWrite(t, s, bucket, newTestFile("File1", "V1", Write, created, "contents"), "contents")
+				mustWrite(t, s, bucket, newTestFile("File1", "V2", Write, created.Add(time.Minute), "new contents"), "new contents")
+
+				_, fd, err := s.Read(ctx, bucket, "File1", "")
+				if err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				fd.Received = nil
+				if expected := testDescriptor(bucket, "File1", "V2", Write, created.Add(time.Minute), "new contents"); !reflect.DeepEqual(fd, expected) {
+					t.Errorf("Expected descriptor to equal\n%+v\ngot\n%+v", expected, fd)
+				}
+				assertContents(t, s, bucket, "File1", "", "new contents")
+				assertContents(t, s, bucket, "File1", "V1", "contents")
+
+				if _, _, err := s.Read(ctx, bucket, "File1", "V3"); err != ErrNotFound {
+					t.Errorf("Expected error to equal %v, got %v", ErrNotFound, err)
+				}
+				if _, _, err := s.Read(ctx, bucket+"-missing", "File1", ""); err != ErrNotFound {
+					t.Errorf("Expected error to equal %v, got %v", ErrNotFound, err)
+				}
+			},
+		},
+		{
+			"write",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				written, err := s.Write(ctx, bucket, newTestFile("File1", "V1", Write, created, "contents"), strings.NewReader("contents"))
+				if err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				written.Received = nil
+				if expected := testDescriptor(bucket, "File1", "V1", Write, created, "contents"); !reflect.DeepEqual(written, expected) {
+					t.Errorf("Expected descriptor to equal\n%+v\ngot\n%+v", expected, written)
+				}
+
+				// delete is written without contents
+				written, err = s.Write(ctx, bucket, newTestFile("File1", "V2", Delete, created.Add(time.Minute), ""), strings.NewReader(""))
+				if err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if written.Operation != string(Delete) || written.Size != 0 {
+					t.Errorf("Expected empty delete marker, got %+v", written)
+				}
+
+				large := newTestFile("File2", "V1", Write, created, "contents")
+				large.Labels = []string{strings.Repeat("label", 400)}
+				if _, err := s.Write(ctx, bucket, large, strings.NewReader("contents")); err != ErrMetadataTooLarge {
+					t.Errorf("Expected error to equal %v, got %v", ErrMetadataTooLarge, err)
+				}
+				assertUsage(t, s, bucket, 8, 2)
+			},
+		},
+		{
+			"delete",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				mustWrite(t, s, bucket, newTestFile("File1", "V1", Write, created, "contents"), "contents")
+				mustWrite(t, s, bucket, newTestFile("File1", "V2", Write, created.Add(time.Minute), "new contents"), "new contents")
+				mustWrite(t, s, bucket, newTestFile("File2", "V1", Write, created, "contents"), "contents")
+
+				// only the version is removed
+				if err := s.Delete(ctx, bucket, "File1", "V1"); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				assertList(t, s, bucket, "File1.", []*models.FileDescriptor{
+					testDescriptor(bucket, "File1", "V2", Write, created.Add(time.Minute), "new contents"),
+				})
+				// all versions are removed
+				if err := s.Delete(ctx, bucket, "File1", ""); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				assertList(t, s, bucket, "File1.", []*models.FileDescriptor{})
+
+				// removing missing files succeeds
+				if err := s.Delete(ctx, bucket, "File1", "V3"); err != nil {
+					t.Errorf("Expected error to be nil, got %v", err)
+				}
+				if err := s.Delete(ctx, bucket+"-missing", "File1", ""); err != nil {
+					t.Errorf("Expected error to be nil, got %v", err)
+				}
+
+				// nothing is removed from the bucket under legal hold
+				if err := s.HoldSet(ctx, bucket, ""); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if err := s.Delete(ctx, bucket, "File2", ""); err != ErrLegalHold {
+					t.Errorf("Expected error to equal %v, got %v", ErrLegalHold, err)
+				}
+				assertContents(t, s, bucket, "File2", "V1", "contents")
+			},
+		},
+		{
+			"time of receipt",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				// S3 keeps the time of the last modification in seconds
+				before := time.Now().Truncate(time.Second)
+				written, err := s.Write(ctx, bucket, newTestFile("File1", "V1", Write, created, "contents"), strings.NewReader("contents"))
+				if err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if written.Received == nil || time.Time(*written.Received).Before(before) {
+					t.Errorf("Expected written version to be received after %s, got %v", before, written.Received)
+				}
+
+				// version created long ago is received now
+				_, fd, err := s.Read(ctx, bucket, "File1", "V1")
+				if err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if fd.Received == nil || time.Time(*fd.Received).Before(before) || !time.Time(fd.Created).Equal(created) {
+					t.Errorf("Expected version created at %s to be received after %s, got %+v", created, before, fd)
+				}
+			},
+		},
+		{
+			"versions and delete marker",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				mustWrite(t, s, bucket, newTestFile("File1", "V1", Write, created, "contents"), "contents")
+				mustWrite(t, s, bucket, newTestFile("File1", "V2", Write, created.Add(time.Minute), "new contents"), "new contents")
+				mustWrite(t, s, bucket, newTestFile("File1", "V3", Delete, created.Add(2*time.Minute), ""), "")
+
+				list, err := s.List(ctx, bucket, "File1.")
+				if err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				versions := []string{}
+				for _, fd := range list {
+					versions = append(versions, fd.Version+"."+fd.Operation)
+				}
+				if expected := []string{"V3.d", "V2.w", "V1.w"}; !reflect.DeepEqual(versions, expected) {
+					t.Errorf("Expected versions to equal %v, got %v", expected, versions)
+				}
+
+				_, fd, err := s.Read(ctx, bucket, "File1", "")
+				if err != nil || fd.Operation != string(Delete) {
+					t.Errorf("Expected the latest version to be the delete marker, got %+v, %v", fd, err)
+				}
+				assertContents(t, s, bucket, "File1", "V1", "contents")
+				assertContents(t, s, bucket, "File1", "V2", "new contents")
+
+				if _, _, err := s.Read(ctx, bucket, "File2", ""); err != ErrNotFound {
+					t.Errorf("Expected error to equal %v, got %v", ErrNotFound, err)
+				}
+			},
+		},
+		{
+			"deduplicated contents",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				mustWrite(t, s, bucket, newTestFile("File1", "V1", Write, created, "contents"), "contents")
+				mustWrite(t, s, bucket, newTestFile("File2", "V1", Write, created, "contents"), "contents")
+
+				if err := s.Delete(ctx, bucket, "File1", "V1"); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if _, _, err := s.Read(ctx, bucket, "File1", "V1"); err != ErrNotFound {
+					t.Errorf("Expected error to equal %v, got %v", ErrNotFound, err)
+				}
+				assertContents(t, s, bucket, "File2", "V1", "contents")
+
+				// contents of new blobs have to match the checksum
+				bad := newTestFile("File3", "V1", Write, created, "new contents")
+				if _, err := s.Write(ctx, bucket, bad, strings.NewReader("other")); err != ErrChecksumMismatch {
+					t.Errorf("Expected error to equal %v, got %v", ErrChecksumMismatch, err)
+				}
+			},
+		},
+		{
+			"read range",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				mustWrite(t, s, bucket, newTestFile("File1", "V1", Write, created, "contents"), "contents")
+
+				r, _, err := s.ReadRange(ctx, bucket, "File1", "V1", 2, 3)
+				if err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				defer r.Close()
+				if b, _ := ioutil.ReadAll(r); string(b) != "nte" {
+					t.Errorf("Expected contents to equal 'nte', got '%s'", b)
+				}
+				if _, _, err := s.ReadRange(ctx, bucket, "File1", "V1", 9, -1); err != ErrInvalidRange {
+					t.Errorf("Expected error to equal %v, got %v", ErrInvalidRange, err)
+				}
+			},
+		},
+		{
+			"legal hold",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				mustWrite(t, s, bucket, newTestFile("File1", "V1", Write, created, "contents"), "contents")
+
+				if err := s.HoldSet(ctx, bucket, "File1"); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if err := s.Delete(ctx, bucket, "File1", "V1"); err != ErrLegalHold {
+					t.Errorf("Expected error to equal %v, got %v", ErrLegalHold, err)
+				}
+				list, err := s.List(ctx, bucket, "")
+				if err != nil || len(list) != 1 || !list[0].LegalHold {
+					t.Errorf("Expected single file under legal hold, got %+v, %v", list, err)
+				}
+
+				if err := s.HoldRelease(ctx, bucket, "File1"); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if err := s.Delete(ctx, bucket, "File1", "V1"); err != nil {
+					t.Errorf("Expected error to be nil, got %v", err)
+				}
+			},
+		},
+		{
+			"usage",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				assertUsage(t, s, bucket, 0, 0)
+				mustWrite(t, s, bucket, newTestFile("File1", "V1", Write, created, "contents"), "contents")
+				mustWrite(t, s, bucket, newTestFile("File1", "V2", Write, created.Add(time.Minute), "new contents"), "new contents")
+				mustWrite(t, s, bucket, newTestFile("File1", "V3", Delete, created.Add(2*time.Minute), ""), "")
+				mustWrite(t, s, bucket, newTestFile("File2", "V1", Write, created, "contents"), "contents")
+				assertUsage(t, s, bucket, 28, 4)
+
+				if err := s.Delete(ctx, bucket, "File1", "V2"); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				assertUsage(t, s, bucket, 16, 3)
+				if err := s.Delete(ctx, bucket, "File1", ""); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				assertUsage(t, s, bucket, 8, 1)
+			},
+		},
+		{
+			"uploads",
+			func(t *testing.T, s Storage, _ *testKeys, bucket string) {
+				ctx := context.Background()
+				upload := &models.UploadDescriptor{ID: "UPLOAD", Size: 8, ContentType: "text/plain"}
+				if err := s.UploadNew(ctx, bucket, upload); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if _, err := s.UploadRead(ctx, bucket, "UPLOAD"); err != ErrUploadIncomplete {
+					t.Errorf("Expected error to equal %v, got %v", ErrUploadIncomplete, err)
+				}
+				if err := s.UploadWriteChunk(ctx, bucket, "UPLOAD", 3, strings.NewReader("tents"), 5); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if err := s.UploadWriteChunk(ctx, bucket, "UPLOAD", 0, strings.NewReader("cont"), 4); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+
+				uploads, err := s.UploadList(ctx, bucket)
+				if err != nil || len(uploads) != 1 || uploads[0].ID != "UPLOAD" {
+					t.Errorf("Expected single upload, got %+v, %v", uploads, err)
+				}
+				r, err := s.UploadRead(ctx, bucket, "UPLOAD")
+				if err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				b, _ := ioutil.ReadAll(r)
+				r.Close()
+				if string(b) != "contents" {
+					t.Errorf("Expected contents to equal 'contents', got '%s'", b)
+				}
+
+				if err := s.UploadDelete(ctx, bucket, "UPLOAD"); err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if _, err := s.UploadGet(ctx, bucket, "UPLOAD"); err != ErrNotFound {
+					t.Errorf("Expected error to equal %v, got %v", ErrNotFound, err)
+				}
+				if list, err := s.List(ctx, bucket, ""); err != nil || len(list) != 0 {
+					t.Errorf("Expected no files, got %+v, %v", list, err)
+				}
+			},
+		},
+		{
+			"reencrypt",
+			func(t *testing.T, s Storage, keys *testKeys, bucket string) {
+				ctx := context.Background()
+				mustWrite(t, s, bucket, newTestFile("File1", "V1", Write, created, "contents"), "contents")
+
+				if reencrypted, err := s.Reencrypt(ctx, bucket, "File1", "V1"); err != nil || reencrypted {
+					t.Errorf("Expected file not to be reencrypted, got %v, %v", reencrypted, err)
+				}
+				keys.current = "2"
+				if reencrypted, err := s.Reencrypt(ctx, bucket, "File1", "V1"); err != nil || !reencrypted {
+					t.Errorf("Expected file to be reencrypted, got %v, %v", reencrypted, err)
+				}
+				assertContents(t, s, bucket, "File1", "V1", "contents")
+
+				if _, err := s.Reencrypt(ctx, bucket, "File2", "V1"); err != ErrNotFound {
+					t.Errorf("Expected error to equal %v, got %v", ErrNotFound, err)
+				}
+			},
+		},
+		{
+			"reencrypt deduplicated contents",
+			func(t *testing.T, s Storage, keys *testKeys, bucket string) {
+				ctx := context.Background()
+				mustWrite(t, s, bucket, newTestFile("File1", "V1", Write, created, "contents"), "contents")
+				mustWrite(t, s, bucket, newTestFile("File2", "V1", Write, created, "contents"), "contents")
+
+				// shared contents are reencrypted once
+				keys.current = "2"
+				if reencrypted, err := s.Reencrypt(ctx, bucket, "File1", "V1"); err != nil || !reencrypted {
+					t.Errorf("Expected file to be reencrypted, got %v, %v", reencrypted, err)
+				}
+				if reencrypted, err := s.Reencrypt(ctx, bucket, "File2", "V1"); err != nil || reencrypted {
+					t.Errorf("Expected file not to be reencrypted, got %v, %v", reencrypted, err)
+				}
+				assertContents(t, s, bucket, "File1", "V1", "contents")
+				assertContents(t, s, bucket, "File2", "V1", "contents")
+			},
+		},
+		{
+			"repair",
+			func(t *testing.T, s Storage, keys *testKeys, bucket string) {
+				ctx := context.Background()
+				mustWrite(t, s, bucket, newTestFile("File1", "V1", Write, created, "contents"), "contents")
+				mustWrite(t, s, bucket, newTestFile("File1", "V2", Delete, created.Add(time.Second), ""), "")
+
+				if err := s.Repair(ctx, bucket, "File1", "V1", strings.NewReader("other contents")); err != ErrChecksumMismatch {
+					t.Errorf("Expected error %v, got %v", ErrChecksumMismatch, err)
+				}
+				if err := s.Repair(ctx, bucket, "File1", "V2", strings.NewReader("")); err != ErrDeleted {
+					t.Errorf("Expected error %v, got %v", ErrDeleted, err)
+				}
+				if err := s.Repair(ctx, bucket, "File1", "V3", strings.NewReader("contents")); err != ErrNotFound {
+					t.Errorf("Expected error %v, got %v", ErrNotFound, err)
+				}
+				keys.current = "2"
+				if err := s.Repair(ctx, bucket, "File1", "V1", strings.NewReader("contents")); err != nil {
+					t.Errorf("Expected error to be nil, got %v", err)
+				}
+				assertContents(t, s, bucket, "File1", "V1", "contents")
+				if reencrypted, err := s.Reencrypt(ctx, bucket, "File1", "V1"); err != nil || reencrypted {
+					t.Errorf("Expected repaired file to be encrypted with the current key, got %v, %v", reencrypted, err)
+				}
+			},
+		},
+	}
+
+	root, err := ioutil.TempDir("", "backends")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	for name, newStorage := range backends(t, root) {
+		for i, scenario := range scenarios {
+			t.Run(fmt.Sprintf("%s/%s", name, scenario.description), func(t *testing.T) {
+				keys := &testKeys{current: "1"}
+				s := newStorage(keys)
+				bucket := fmt.Sprintf("test-%d-%d", time.Now().UnixNano(), i)
+				if err := s.MakeBucket(context.Background(), bucket); err != nil {
+					t.Fatalf("Failed to make bucket, %v", err)
+				}
+
+				scenario.run(t, s, keys, bucket)
+			})
+		}
+	}
+}
+
+func TestFsClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newFsClient(dir)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if err := c.MakeBucket("BUCKET", ""); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	for _, key := range []string{"File1.V1.w.1516288966123.3", "blobs/CHS/data", "blobs/CHS/refs/File1.V1", "holds/bucket"} {
+		opts := minio.PutObjectOptions{UserMetadata: map[string]string{"Key-Version": "1"}}
+		if _, err := c.PutObjectWithContext(context.Background(), "BUCKET", key, bytes.NewBufferString("contents"), -1, opts); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+
+	testCases := []struct {
+		description string
+		prefix      string
+		recursive   bool
+		expected    []string
+	}{
+		{"common prefixes", "", false, []string{"File1.V1.w.1516288966123.3", "blobs/", "holds/"}},
+		{"file prefix", "File1.", false, []string{"File1.V1.w.1516288966123.3"}},
+		{"nested prefix", "blobs/CHS/", false, []string{"blobs/CHS/data", "blobs/CHS/refs/"}},
+		{"recursive", "blobs/", true, []string{"blobs/CHS/data", "blobs/CHS/refs/File1.V1"}},
+		{"missing prefix", "uploads/", false, []string{}},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			keys := []string{}
+			for info := range c.ListObjectsV2("BUCKET", test.prefix, test.recursive, nil) {
+				if info.Err != nil {
+					t.Fatalf("Expected error to be nil, got %v", info.Err)
+				}
+				keys = append(keys, info.Key)
+			}
+
+			if !reflect.DeepEqual(keys, test.expected) {
+				t.Errorf("Expected keys to equal %v, got %v", test.expected, keys)
+			}
+		})
+	}
+
+	t.Run("stat", func(t *testing.T) {
+		info, err := c.StatObject("BUCKET", "blobs/CHS/data", minio.StatObjectOptions{})
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		if info.Size != 8 || info.Metadata.Get(keyVersionHeader) != "1" {
+			t.Errorf("Expected size 8 and key version 1, got %+v", info)
+		}
+		if _, err := c.StatObject("BUCKET", "blobs/OTHER/data", minio.StatObjectOptions{}); !isNotFound(err) {
+			t.Errorf("Expected not found error, got %v", err)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		ch := make(chan string, 2)
+		ch <- "blobs/CHS/data"
+		ch <- "blobs/CHS/refs/File1.V1"
+		close(ch)
+		for err := range c.RemoveObjects("BUCKET", ch) {
+			t.Errorf("Expected no error, got %v", err.Err)
+		}
+
+		// empty directories are removed with the last object
+		if _, err := os.Stat(filepath.Join(dir, "BUCKET", fsObjectsDir, "blobs")); !os.IsNotExist(err) {
+			t.Errorf("Expected blobs directory to be removed, got %v", err)
+		}
+	})
+
+	t.Run("corrupted footer", func(t *testing.T) {
+		path, err := c.objectPath("BUCKET", "File1.V1.w.1516288966123.3")
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		for _, footer := range [][]byte{
+			{0, 0, 0, 0, 0, 0, 1, 0},
+			{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			{0},
+		} {
+			if err := ioutil.WriteFile(path, append([]byte("contents"), footer...), 0600); err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+			if _, err := c.StatObject("BUCKET", "File1.V1.w.1516288966123.3", minio.StatObjectOptions{}); err == nil {
+				t.Errorf("Expected error for footer %v, got nil", footer)
+			}
+		}
+	})
+
+	t.Run("invalid object name", func(t *testing.T) {
+		if _, err := c.PutObjectWithContext(context.Background(), "BUCKET", "../BUCKET2/File", bytes.NewBufferString("contents"), -1, minio.PutObjectOptions{}); err == nil {
+			t.Error("Expected error, got nil")
+		}
+	})
+}
+
+func mustWrite(t *testing.T, s Storage, bucket string, no *object.NewObjectInfo, contents string) {
+	if _, err := s.Write(context.Background(), bucket, no, strings.NewReader(contents)); err != nil {
+		t.Fatalf("Failed to write %s.%s, %v", no.Name, no.Version, err)
+	}
+}
+
+func assertContents(t *testing.T, s Storage, bucket, fileID, version, expected string) {
+	r, _, err := s.Read(context.Background(), bucket, fileID, version)
+	if err != nil {
+		t.Fatalf("Failed to read %s.%s, %v", fileID, version, err)
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != expected {
+		t.Errorf("Expected contents of %s.%s to equal '%s', got '%s', %v", fileID, version, expected, b, err)
+	}
+}
+
+// testDescriptor returns descriptor of the file version written from newTestFile
+func testDescriptor(bucket, name, version string, op Operation, created time.Time, contents string) *models.FileDescriptor {
+	no := newTestFile(name, version, op, created, contents)
+	return &models.FileDescriptor{
+		Name:        name,
+		Version:     version,
+		Path:        fmt.Sprintf("%s/%s/%s", bucket, name, version),
+		Operation:   no.Operation,
+		Created:     no.Created,
+		Checksum:    no.Checksum,
+		Size:        no.Size,
+		ContentType: no.ContentType,
+		Archetype:   no.Archetype,
+		Labels:      no.Labels,
+	}
+}
+
+// assertList compares listed file versions with expected ones ignoring the time of their receipt
+func assertList(t *testing.T, s Storage, bucket, prefix string, expected []*models.FileDescriptor) {
+	list, err := s.List(context.Background(), bucket, prefix)
+	if err != nil {
+		t.Fatalf("Failed to list files, %v", err)
+	}
+	for _, fd := range list {
+		fd.Received = nil
+	}
+	if !reflect.DeepEqual(list, expected) {
+		t.Errorf("Expected list to equal\n%s\ngot\n%s", printableList(expected), printableList(list))
+	}
+}
+
+func printableList(list []*models.FileDescriptor) string {
+	b, _ := json.MarshalIndent(list, "", "  ")
+	return string(b)
+}
+
+func assertUsage(t *testing.T, s Storage, bucket string, size, objects int64) {
+	sz, o, err := s.Usage(context.Background(), bucket)
+	if err != nil {
+		t.Fatalf("Failed to get usage, %v", err)
+	}
+	if sz != size || o != objects {
+		t.Errorf("Expected usage to equal %d bytes in %d objects, got %d bytes in %d objects", size, objects, sz, o)
+	}
+}
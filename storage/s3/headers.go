@@ -0,0 +1,89 @@
+package s3
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+// headerCacheSize is the maximum number of objects user metadata of which is cached
+const headerCacheSize = 10000
+
+// headerCache holds user metadata of least recently used objects. Entries are keyed by object and
+// valid only for the ETag they were read with, so objects rewritten under the same key by other
+// processes are read again.
+type headerCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+type headerEntry struct {
+	key     string
+	etag    string
+	headers http.Header
+}
+
+func (c *headerCache) get(bucketID, objectName, etag string) (http.Header, bool) {
+	if etag == "" {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[headerKey(bucketID, objectName)]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*headerEntry)
+	if entry.etag != etag {
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+
+	return entry.headers, true
+}
+
+func (c *headerCache) add(bucketID, objectName, etag string, headers http.Header) {
+	if etag == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	key := headerKey(bucketID, objectName)
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&headerEntry{key: key, etag: etag, headers: headers})
+
+	for c.lru.Len() > headerCacheSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate removes user metadata of the object
+func (c *headerCache) invalidate(bucketID, objectName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[headerKey(bucketID, objectName)]; ok {
+		c.remove(e)
+	}
+}
+
+// remove removes the entry, caller has to hold the lock
+func (c *headerCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*headerEntry)
+	delete(c.entries, entry.key)
+}
+
+func headerKey(bucketID, objectName string) string {
+	return bucketID + "/" + objectName
+}
@@ -0,0 +1,100 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	minio "github.com/minio/minio-go"
+)
+
+// holdsPrefix is the prefix of all objects marking legal holds
+const holdsPrefix = "holds/"
+
+// bucketHoldKey is the key of the object marking legal hold of the whole bucket
+const bucketHoldKey = holdsPrefix + "bucket"
+
+// fileHoldsPrefix is the prefix of objects marking legal holds of files
+const fileHoldsPrefix = holdsPrefix + "files/"
+
+// ErrLegalHold indicates file or bucket is under legal hold and can't be changed or removed
+var ErrLegalHold = errors.New("File is under legal hold")
+
+// holdKey returns the key of the object marking legal hold of the file, empty fileID refers to the whole bucket
+func holdKey(fileID string) string {
+	if fileID == "" {
+		return bucketHoldKey
+	}
+	return fileHoldsPrefix + fileID
+}
+
+// holds describes legal holds in the bucket
+type holds struct {
+	bucket bool
+	files  map[string]bool
+}
+
+// held checks if the file is under legal hold
+func (h *holds) held(fileID string) bool {
+	return h.bucket || h.files[fileID]
+}
+
+// HoldSet puts the file under legal hold, empty fileID puts the whole bucket under legal hold
+func (s *s3storage) HoldSet(ctx context.Context, bucketID, fileID string) error {
+	s.logger.Debug().Str("cmd", "s3::HoldSet").Msgf("('%s', '%s')", bucketID, fileID)
+
+	_, err := s.client.PutObjectWithContext(ctx, bucketID, holdKey(fileID), &bytes.Buffer{}, 0, minio.PutObjectOptions{})
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::HoldSet").Msg("Failed to put the hold")
+		return errors.Wrap(err, "Failed to put the hold")
+	}
+
+	return nil
+}
+
+// HoldRelease releases legal hold of the file, empty fileID releases legal hold of the whole bucket
+func (s *s3storage) HoldRelease(_ context.Context, bucketID, fileID string) error {
+	s.logger.Debug().Str("cmd", "s3::HoldRelease").Msgf("('%s', '%s')", bucketID, fileID)
+
+	if err := s.removeObjects(bucketID, []string{holdKey(fileID)}); err != nil {
+		return errors.Wrap(err, "Failed to remove the hold")
+	}
+
+	return nil
+}
+
+// Held checks if the file or the whole bucket is under legal hold
+func (s *s3storage) Held(_ context.Context, bucketID, fileID string) (bool, error) {
+	s.logger.Debug().Str("cmd", "s3::Held").Msgf("('%s', '%s')", bucketID, fileID)
+
+	h, err := s.holds(bucketID)
+	if err != nil {
+		return false, err
+	}
+
+	return h.held(fileID), nil
+}
+
+// holds lists legal holds in the bucket
+func (s *s3storage) holds(bucketID string) (*holds, error) {
+	ch := make(chan struct{})
+	defer close(ch)
+
+	h := &holds{files: make(map[string]bool)}
+	for info := range s.client.ListObjectsV2(bucketID, holdsPrefix, true, ch) {
+		if info.Err != nil {
+			s.logger.Info().Err(info.Err).Str("cmd", "s3::holds").Msg("Failed to list holds")
+			return nil, errors.Wrap(info.Err, "Failed to list holds")
+		}
+
+		if info.Key == bucketHoldKey {
+			h.bucket = true
+		} else if strings.HasPrefix(info.Key, fileHoldsPrefix) {
+			h.files[strings.TrimPrefix(info.Key, fileHoldsPrefix)] = true
+		}
+	}
+
+	return h, nil
+}
@@ -0,0 +1,214 @@
+/*
+Package keyRotation re-encrypts files stored in S3 storage with the current
+key of their bucket. It is meant to be run after a new key version was added to
+the keyring and made current.
+
+Rotation is performed online - storage service can keep serving requests as
+files are re-encrypted one by one. Buckets that
+were completely re-encrypted are recorded in the key-value storage with the key
+version they were rotated to, so an interrupted rotation can be resumed without
+processing them again. Files already encrypted with the current key are skipped.
+
+Files stored in an older metadata format are migrated to the current format
+while being re-encrypted.
+*/
+package keyRotation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/metrics"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	"github.com/iryonetwork/wwm/storage/s3"
+)
+
+// Rotator describes public methods of key rotation
+type Rotator interface {
+	// Rotate re-encrypts all the files in all the buckets with current keys.
+	Rotate(ctx context.Context) error
+	// GetPrometheusMetricsCollection returns metrics to be registered for the component.
+	GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector
+}
+
+type rotator struct {
+	storage           s3.Storage
+	keys              s3.KeyProvider
+	checkpoints       keyvalue.Storage
+	logger            zerolog.Logger
+	metricsCollection map[metrics.ID]prometheus.Collector
+}
+
+const (
+	checkpointsBucket string     = "keyRotation"
+	objectSeconds     metrics.ID = "objectSeconds"
+	bucketsRotated    metrics.ID = "bucketsRotated"
+
+	resultReencrypted string = "reencrypted"
+	resultSkipped     string = "skipped"
+	resultFailed      string = "failed"
+)
+
+// Rotate re-encrypts all the files in all the buckets with current keys.
+func (r *rotator) Rotate(ctx context.Context) error {
+	buckets, err := r.storage.ListBuckets(ctx)
+	if err != nil {
+		r.logger.Error().Err(err).Msg("failed to list buckets")
+		return errors.Wrap(err, "failed to list buckets")
+	}
+
+	var errCount int
+	for _, b := range buckets {
+		select {
+		case <-ctx.Done():
+			r.logger.Error().Msg("aborting key rotation due to context cancellation")
+			return errors.Wrap(ctx.Err(), "aborting key rotation due to context cancellation")
+		default:
+			err := r.rotateBucket(ctx, b.Name)
+			if err != nil {
+				r.logger.Error().Err(err).Str("bucket", b.Name).Msg("failed to rotate key")
+				errCount++
+			}
+		}
+	}
+
+	if errCount > 0 {
+		r.logger.Error().Msgf("%d failure(s) out of %d bucket(s) to rotate", errCount, len(buckets))
+		return errors.Errorf("%d failure(s) out of %d bucket(s) to rotate", errCount, len(buckets))
+	}
+
+	return nil
+}
+
+// GetPrometheusMetricsCollection returns all prometheus metrics collectors to be registered
+func (r *rotator) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
+	return r.metricsCollection
+}
+
+// New returns a new instance of key rotation using checkpoints storage to allow resuming interrupted rotation
+func New(storage s3.Storage, keys s3.KeyProvider, checkpoints keyvalue.Storage, logger zerolog.Logger) Rotator {
+	logger = logger.With().Str("component", "storage/s3/keyRotation").Logger()
+
+	metricsCollection := make(map[metrics.ID]prometheus.Collector)
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "key_rotation",
+		Name:      "file_version_seconds",
+		Help:      "Time taken to re-encrypt file version",
+	}, []string{"result"})
+	metricsCollection[objectSeconds] = h
+
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "key_rotation",
+		Name:      "buckets",
+		Help:      "Number of processed buckets",
+	}, []string{"result"})
+	metricsCollection[bucketsRotated] = c
+
+	return &rotator{
+		storage:           storage,
+		keys:              keys,
+		checkpoints:       checkpoints,
+		logger:            logger,
+		metricsCollection: metricsCollection,
+	}
+}
+
+func (r *rotator) rotateBucket(ctx context.Context, bucketID string) error {
+	result := resultFailed
+	defer func() {
+		r.metricsCollection[bucketsRotated].(*prometheus.CounterVec).
+			With(prometheus.Labels{"result": result}).
+			Inc()
+	}()
+
+	keyVersion, err := r.keys.CurrentVersion(bucketID)
+	if err != nil {
+		return errors.Wrap(err, "failed to get current key version")
+	}
+
+	// skip buckets that were already rotated to the current key version and metadata format
+	checkpoint := r.checkpoints.Get(checkpointsBucket, bucketID)
+	if checkpoint != nil && string(checkpoint) == checkpointValue(keyVersion) {
+		r.logger.Debug().Str("bucket", bucketID).Msgf("bucket already rotated to key version %s", keyVersion)
+		result = resultSkipped
+		return nil
+	}
+
+	files, err := r.storage.List(ctx, bucketID, "")
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to list files in bucket %s", bucketID))
+	}
+
+	var errCount int
+	for _, f := range files {
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "aborting bucket key rotation due to context cancellation")
+		default:
+			if err := r.reencryptFileVersion(ctx, bucketID, f); err != nil {
+				errCount++
+			}
+		}
+	}
+
+	if errCount > 0 {
+		return errors.Errorf("%d failure(s) out of %d version(s) to re-encrypt in bucket %s", errCount, len(files), bucketID)
+	}
+
+	// save the checkpoint
+	err = r.checkpoints.Update(checkpointsBucket, bucketID, []byte(checkpointValue(keyVersion)))
+	if err != nil {
+		return errors.Wrap(err, "failed to save checkpoint")
+	}
+
+	r.logger.Info().Str("bucket", bucketID).Msgf("bucket rotated to key version %s", keyVersion)
+	result = resultReencrypted
+	return nil
+}
+
+func (r *rotator) reencryptFileVersion(ctx context.Context, bucketID string, f *models.FileDescriptor) error {
+	// Make sure we record duration metrics even if processing fails, set default values for labels
+	start := time.Now()
+	result := resultFailed
+	defer func() {
+		duration := time.Since(start)
+		r.metricsCollection[objectSeconds].(*prometheus.HistogramVec).
+			With(prometheus.Labels{"result": result}).
+			Observe(duration.Seconds())
+	}()
+
+	reencrypted, err := r.storage.Reencrypt(ctx, bucketID, f.Name, f.Version)
+	if err != nil {
+		r.logger.Error().Err(err).
+			Str("bucket", bucketID).
+			Str("file", f.Name).
+			Str("version", f.Version).
+			Msg("failed to re-encrypt")
+		return err
+	}
+
+	if reencrypted {
+		result = resultReencrypted
+	} else {
+		result = resultSkipped
+	}
+	r.logger.Debug().
+		Str("bucket", bucketID).
+		Str("file", f.Name).
+		Str("version", f.Version).
+		Str("result", result).
+		Msg("file version processed")
+
+	return nil
+}
+
+// checkpointValue returns checkpoint saved for the bucket rotated to the key version
+func checkpointValue(keyVersion string) string {
+	return fmt.Sprintf("%s/%d", keyVersion, s3.MetadataFormat)
+}
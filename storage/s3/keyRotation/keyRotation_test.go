@@ -0,0 +1,149 @@
+package keyRotation
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	keyvalueMock "github.com/iryonetwork/wwm/storage/keyvalue/mock"
+	"github.com/iryonetwork/wwm/storage/s3/mock"
+)
+
+var (
+	time1, _ = strfmt.ParseDateTime("2018-01-18T15:22:46.123Z")
+	bucket1  = &models.BucketDescriptor{Name: "Bucket1", Created: time1}
+	bucket2  = &models.BucketDescriptor{Name: "Bucket2", Created: time1}
+	file1V1  = &models.FileDescriptor{Name: "File1", Version: "V1", Operation: "w", Created: time1}
+	file1V2  = &models.FileDescriptor{Name: "File1", Version: "V2", Operation: "d", Created: time1}
+	file2V1  = &models.FileDescriptor{Name: "File2", Version: "V1", Operation: "w", Created: time1}
+
+	noErrors   = false
+	withErrors = true
+)
+
+func TestRotate(t *testing.T) {
+	testCases := []struct {
+		description   string
+		calls         func(*mock.MockStorage, *mock.MockKeyProvider, *keyvalueMock.MockStorage) []*gomock.Call
+		errorExpected bool
+	}{
+		{
+			"all buckets rotated",
+			func(s *mock.MockStorage, k *mock.MockKeyProvider, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1, bucket2}, nil),
+					k.EXPECT().CurrentVersion("Bucket1").Return("2", nil),
+					kv.EXPECT().Get(checkpointsBucket, "Bucket1").Return([]byte("1")),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V2, file1V1}, nil),
+					s.EXPECT().Reencrypt(gomock.Any(), "Bucket1", "File1", "V2").Return(true, nil),
+					s.EXPECT().Reencrypt(gomock.Any(), "Bucket1", "File1", "V1").Return(false, nil),
+					kv.EXPECT().Update(checkpointsBucket, "Bucket1", []byte("2/3")).Return(nil),
+					k.EXPECT().CurrentVersion("Bucket2").Return("2", nil),
+					kv.EXPECT().Get(checkpointsBucket, "Bucket2").Return(nil),
+					s.EXPECT().List(gomock.Any(), "Bucket2", "").Return([]*models.FileDescriptor{file2V1}, nil),
+					s.EXPECT().Reencrypt(gomock.Any(), "Bucket2", "File2", "V1").Return(true, nil),
+					kv.EXPECT().Update(checkpointsBucket, "Bucket2", []byte("2/3")).Return(nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"bucket already rotated is skipped",
+			func(s *mock.MockStorage, k *mock.MockKeyProvider, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1, bucket2}, nil),
+					k.EXPECT().CurrentVersion("Bucket1").Return("2", nil),
+					kv.EXPECT().Get(checkpointsBucket, "Bucket1").Return([]byte("2/3")),
+					k.EXPECT().CurrentVersion("Bucket2").Return("2", nil),
+					kv.EXPECT().Get(checkpointsBucket, "Bucket2").Return(nil),
+					s.EXPECT().List(gomock.Any(), "Bucket2", "").Return([]*models.FileDescriptor{file2V1}, nil),
+					s.EXPECT().Reencrypt(gomock.Any(), "Bucket2", "File2", "V1").Return(true, nil),
+					kv.EXPECT().Update(checkpointsBucket, "Bucket2", []byte("2/3")).Return(nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"bucket rotated in older metadata format is processed",
+			func(s *mock.MockStorage, k *mock.MockKeyProvider, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					k.EXPECT().CurrentVersion("Bucket1").Return("2", nil),
+					kv.EXPECT().Get(checkpointsBucket, "Bucket1").Return([]byte("2")),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V1}, nil),
+					s.EXPECT().Reencrypt(gomock.Any(), "Bucket1", "File1", "V1").Return(true, nil),
+					kv.EXPECT().Update(checkpointsBucket, "Bucket1", []byte("2/3")).Return(nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"failed file version does not save checkpoint",
+			func(s *mock.MockStorage, k *mock.MockKeyProvider, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1, bucket2}, nil),
+					k.EXPECT().CurrentVersion("Bucket1").Return("2", nil),
+					kv.EXPECT().Get(checkpointsBucket, "Bucket1").Return(nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V2, file1V1}, nil),
+					s.EXPECT().Reencrypt(gomock.Any(), "Bucket1", "File1", "V2").Return(false, errors.New("error")),
+					s.EXPECT().Reencrypt(gomock.Any(), "Bucket1", "File1", "V1").Return(true, nil),
+					k.EXPECT().CurrentVersion("Bucket2").Return("2", nil),
+					kv.EXPECT().Get(checkpointsBucket, "Bucket2").Return(nil),
+					s.EXPECT().List(gomock.Any(), "Bucket2", "").Return([]*models.FileDescriptor{file2V1}, nil),
+					s.EXPECT().Reencrypt(gomock.Any(), "Bucket2", "File2", "V1").Return(true, nil),
+					kv.EXPECT().Update(checkpointsBucket, "Bucket2", []byte("2/3")).Return(nil),
+				}
+			},
+			withErrors,
+		},
+		{
+			"failed to list buckets",
+			func(s *mock.MockStorage, k *mock.MockKeyProvider, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return(nil, errors.New("error")),
+				}
+			},
+			withErrors,
+		},
+		{
+			"failed to list files",
+			func(s *mock.MockStorage, k *mock.MockKeyProvider, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					k.EXPECT().CurrentVersion("Bucket1").Return("2", nil),
+					kv.EXPECT().Get(checkpointsBucket, "Bucket1").Return(nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return(nil, errors.New("error")),
+				}
+			},
+			withErrors,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			s := mock.NewMockStorage(ctrl)
+			k := mock.NewMockKeyProvider(ctrl)
+			kv := keyvalueMock.NewMockStorage(ctrl)
+
+			gomock.InOrder(test.calls(s, k, kv)...)
+
+			r := New(s, k, kv, zerolog.New(os.Stdout))
+			err := r.Rotate(context.Background())
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	minio "github.com/minio/minio-go"
+)
+
+// manifestPrefix is the prefix of all objects holding manifests of file versions
+const manifestPrefix = "manifest/"
+
+// manifestKey is the key of the object holding the manifest of file versions in the whole bucket
+const manifestKey = manifestPrefix + "bucket"
+
+// manifest holds user metadata of file versions in the bucket keyed by object name so that listing the bucket
+// with a cold header cache doesn't have to stat every object. Entries are valid only for the ETag they were
+// read with. Manifest is only a cache, versions missing from it are stat-ed and added to it.
+type manifest map[string]manifestEntry
+
+type manifestEntry struct {
+	ETag    string      `json:"etag"`
+	Headers http.Header `json:"headers"`
+}
+
+// manifest reads the manifest of the bucket. Manifest that is missing or can't be read is empty.
+func (s *s3storage) manifest(ctx context.Context, bucketID string) manifest {
+	r, err := s.client.GetObjectWithContext(ctx, bucketID, manifestKey, minio.GetObjectOptions{})
+	if err == nil {
+		defer r.Close()
+		m := manifest{}
+		if err = json.NewDecoder(r).Decode(&m); err == nil {
+			return m
+		}
+	}
+	if !isNotFound(err) {
+		s.logger.Error().Err(err).Str("cmd", "s3::manifest").Str("bucket", bucketID).Msg("Failed to read manifest")
+	}
+
+	return manifest{}
+}
+
+// putManifest stores the manifest of the bucket
+func (s *s3storage) putManifest(ctx context.Context, bucketID string, m manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal manifest")
+	}
+
+	_, err = s.client.PutObjectWithContext(ctx, bucketID, manifestKey, bytes.NewReader(b), int64(len(b)), minio.PutObjectOptions{})
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::putManifest").Msg("Failed to put manifest")
+		return errors.Wrap(err, "Failed to put manifest")
+	}
+
+	return nil
+}
+
+// loadListHeaders reads user metadata of listed file versions in the current metadata format. Headers missing
+// from the header cache are read from the manifest of the bucket, only versions missing from the manifest are
+// stat-ed and the manifest is updated with them.
+func (s *s3storage) loadListHeaders(ctx context.Context, bucketID, prefix string, list []*metadata) error {
+	var m manifest
+	changed := false
+	for _, md := range list {
+		if md.format < 2 {
+			continue
+		}
+		objectName := md.String()
+		if headers, ok := s.headers.get(bucketID, objectName, md.etag); ok {
+			if err := md.setFromHeaders(headers); err != nil {
+				return err
+			}
+			continue
+		}
+		// headers of versions listed without ETag can't be validated against the manifest
+		if md.etag == "" {
+			if err := s.loadHeaders(bucketID, md); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if m == nil {
+			m = s.manifest(ctx, bucketID)
+		}
+		if e, ok := m[objectName]; ok && e.ETag == md.etag {
+			if err := md.setFromHeaders(e.Headers); err != nil {
+				return err
+			}
+			s.headers.add(bucketID, objectName, e.ETag, e.Headers)
+			continue
+		}
+
+		info, err := s.client.StatObject(bucketID, objectName, minio.StatObjectOptions{})
+		if err != nil {
+			return err
+		}
+		if err := md.setFromHeaders(info.Metadata); err != nil {
+			return err
+		}
+		s.headers.add(bucketID, objectName, info.ETag, info.Metadata)
+		m[objectName] = manifestEntry{ETag: info.ETag, Headers: info.Metadata}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	// versions removed from the bucket are dropped from the manifest when the whole bucket is listed
+	if prefix == "" {
+		listed := make(map[string]bool, len(list))
+		for _, md := range list {
+			listed[md.String()] = true
+		}
+		for objectName := range m {
+			if !listed[objectName] {
+				delete(m, objectName)
+			}
+		}
+	}
+	if err := s.putManifest(ctx, bucketID, m); err != nil {
+		s.logger.Error().Err(err).Str("cmd", "s3::loadListHeaders").Str("bucket", bucketID).Msg("Failed to update manifest")
+	}
+
+	return nil
+}
@@ -2,7 +2,9 @@ package s3
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -14,7 +16,20 @@ import (
 	"github.com/iryonetwork/wwm/storage/s3/object"
 )
 
+// MetadataFormat is the version of metadata format used for newly written objects
+const MetadataFormat = 3
+
+// metadataKey is the user metadata key holding encoded metadataHeader
+const metadataKey = "Metadata"
+
+// metadataHeaderName is the header under which S3 returns metadataKey
+const metadataHeaderName = "X-Amz-Meta-" + metadataKey
+
+// maxUserMetadataSize is the size limit of object's user metadata imposed by S3
+const maxUserMetadataSize = 2 * 1024
+
 type metadata struct {
+	format      int
 	filename    string
 	version     string
 	operation   Operation
@@ -23,13 +38,55 @@ type metadata struct {
 	contentType string
 	archetype   string
 	labels      []string
+	size        int64
+	keyVersion  string
+	author      string
+	source      string
+	parents     []string
+	blob        string
+	// etag identifies contents and user metadata of the listed object
+	etag string
+	// received is the time the object was written to the storage, it's not part of the object's metadata
+	received time.Time
+}
+
+// metadataHeader holds metadata stored in object's user metadata since format 2. New
+// optional fields can be added freely as long as older readers can ignore them; fields must
+// never be removed or renamed. Blob was added in format 3, Parents are optional within it.
+type metadataHeader struct {
+	Checksum    string   `json:"checksum,omitempty"`
+	ContentType string   `json:"contentType,omitempty"`
+	Archetype   string   `json:"archetype,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+	Size        int64    `json:"size"`
+	KeyVersion  string   `json:"keyVersion,omitempty"`
+	Author      string   `json:"author,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Blob        string   `json:"blob,omitempty"`
+	Parents     []string `json:"parents,omitempty"`
 }
 
 var utc, _ = time.LoadLocation("UTC")
 
+// metadataFromKey parses metadata from the object key. Objects written in format 1 hold all
+// metadata in the key; objects written in later formats hold only the identifying part of it
+// and the rest has to be read with setFromHeaders.
 func metadataFromKey(key string) (*metadata, error) {
-	items := strings.SplitN(key, ".", 8)
+	items := strings.Split(key, ".")
+
+	switch len(items) {
+	case 8:
+		return metadataFromKeyV1(items)
+	case 5:
+		return metadataFromKeyV2(items)
+	}
 
+	return nil, fmt.Errorf("Invalid number of key items (%d)", len(items))
+}
+
+// metadataFromKeyV1 parses key in format
+// FILENAME.VERSION.OPERATION.TIMESTAMP.CHECKSUM.CONTENTTYPE.ARCHETYPE.LABELS
+func metadataFromKeyV1(items []string) (*metadata, error) {
 	// decode contentType
 	ct, err := decode(items[5])
 	if err != nil {
@@ -47,6 +104,7 @@ func metadataFromKey(key string) (*metadata, error) {
 	labels := labelsStringToSlice(labelsString)
 
 	md := &metadata{
+		format:      1,
 		filename:    items[0],
 		version:     items[1],
 		operation:   Operation(items[2]),
@@ -61,22 +119,44 @@ func metadataFromKey(key string) (*metadata, error) {
 		return nil, fmt.Errorf("Invalid operation %s", md.operation)
 	}
 
-	// convert timestamp
-	if len(items[3]) < 13 {
-		return nil, fmt.Errorf("Invalid timestamp length (%s, %d)", items[3], len(items[3]))
-	}
-	s, err := strconv.ParseInt(items[3], 10, 64)
+	md.created, err = parseTimestamp(items[3])
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse timestamp (%s)", items[3])
+		return nil, err
+	}
+
+	return md, nil
+}
+
+// metadataFromKeyV2 parses key in format FILENAME.VERSION.OPERATION.TIMESTAMP.FORMAT
+func metadataFromKeyV2(items []string) (*metadata, error) {
+	format, err := strconv.Atoi(items[4])
+	if err != nil || format < 2 || format > MetadataFormat {
+		return nil, fmt.Errorf("Unsupported metadata format %s", items[4])
+	}
+
+	md := &metadata{
+		format:    format,
+		filename:  items[0],
+		version:   items[1],
+		operation: Operation(items[2]),
+	}
+
+	// validate operation
+	if md.operation != Write && md.operation != Delete {
+		return nil, fmt.Errorf("Invalid operation %s", md.operation)
 	}
 
-	md.created = time.Unix(s/1000, s%1000*1000000).In(utc)
+	md.created, err = parseTimestamp(items[3])
+	if err != nil {
+		return nil, err
+	}
 
 	return md, nil
 }
 
 func metadataFromNewFile(newFile *object.NewObjectInfo) (*metadata, error) {
 	md := &metadata{
+		format:      MetadataFormat,
 		filename:    newFile.Name,
 		version:     newFile.Version,
 		operation:   Operation(newFile.Operation),
@@ -85,6 +165,10 @@ func metadataFromNewFile(newFile *object.NewObjectInfo) (*metadata, error) {
 		contentType: newFile.ContentType,
 		archetype:   newFile.Archetype,
 		labels:      newFile.Labels,
+		size:        newFile.Size,
+		author:      newFile.Author,
+		source:      newFile.Source,
+		parents:     newFile.Parents,
 	}
 
 	// validate operation
@@ -95,40 +179,153 @@ func metadataFromNewFile(newFile *object.NewObjectInfo) (*metadata, error) {
 	return md, nil
 }
 
-func metadataFromFileDescriptor(fd *models.FileDescriptor) (*metadata, error) {
-	md := &metadata{
-		filename:    fd.Name,
-		version:     fd.Version,
-		operation:   Operation(fd.Operation),
-		checksum:    fd.Checksum,
-		contentType: fd.ContentType,
-		archetype:   fd.Archetype,
-		labels:      fd.Labels,
+// setFromHeaders reads the part of metadata stored in object's user metadata
+func (m *metadata) setFromHeaders(h http.Header) error {
+	if m.format < 2 {
+		// only key version is stored in user metadata
+		m.keyVersion = h.Get(keyVersionHeader)
+		return nil
 	}
 
-	// parse created
-	c, err := time.Parse(strfmt.RFC3339Millis, fd.Created.String())
+	encoded := h.Get(metadataHeaderName)
+	if encoded == "" {
+		return fmt.Errorf("Missing metadata header")
+	}
+	b, err := base64.URLEncoding.DecodeString(encoded)
 	if err != nil {
-		return nil, err
+		return errors.Wrap(err, "failed to decode metadata header")
+	}
+	var mh metadataHeader
+	if err := json.Unmarshal(b, &mh); err != nil {
+		return errors.Wrap(err, "failed to unmarshal metadata header")
 	}
-	md.created = c
 
-	return md, nil
+	m.checksum = mh.Checksum
+	m.contentType = mh.ContentType
+	m.archetype = mh.Archetype
+	m.labels = mh.Labels
+	m.size = mh.Size
+	m.keyVersion = mh.KeyVersion
+	m.author = mh.Author
+	m.source = mh.Source
+	m.parents = mh.Parents
+	m.blob = mh.Blob
+
+	return nil
+}
+
+// checkSize returns ErrMetadataTooLarge if metadata of the new file version does not fit into object's user
+// metadata once it references its blob
+func (m *metadata) checkSize() error {
+	stored := *m
+	if stored.operation == Write && stored.checksum != "" {
+		stored.blob = stored.checksum
+		stored.keyVersion = ""
+	}
+	userMetadata, err := stored.userMetadata()
+	if err != nil {
+		return err
+	}
+
+	var size int
+	for k, v := range userMetadata {
+		size += len(k) + len(v)
+	}
+	if size > maxUserMetadataSize {
+		return ErrMetadataTooLarge
+	}
+
+	return nil
+}
+
+// userMetadata returns the part of metadata to be stored in object's user metadata
+func (m *metadata) userMetadata() (map[string]string, error) {
+	if m.format < 2 {
+		if m.keyVersion == "" {
+			return nil, nil
+		}
+		return map[string]string{keyVersionMetadata: m.keyVersion}, nil
+	}
+
+	b, err := json.Marshal(metadataHeader{
+		Checksum:    m.checksum,
+		ContentType: m.contentType,
+		Archetype:   m.archetype,
+		Labels:      m.labels,
+		Size:        m.size,
+		KeyVersion:  m.keyVersion,
+		Author:      m.author,
+		Source:      m.source,
+		Blob:        m.blob,
+		Parents:     m.parents,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal metadata header")
+	}
+
+	return map[string]string{metadataKey: base64.URLEncoding.EncodeToString(b)}, nil
+}
+
+func (m *metadata) fileDescriptor(bucketID string) *models.FileDescriptor {
+	fd := &models.FileDescriptor{
+		Size:        m.size,
+		ContentType: m.contentType,
+		Path:        fmt.Sprintf("%s/%s/%s", bucketID, m.filename, m.version),
+		Name:        m.filename,
+		Version:     m.version,
+		Checksum:    m.checksum,
+		Created:     strfmt.DateTime(m.created),
+		Archetype:   m.archetype,
+		Operation:   string(m.operation),
+		Labels:      m.labels,
+		Author:      m.author,
+		Source:      m.source,
+		Parents:     m.parents,
+	}
+	if !m.received.IsZero() {
+		received := strfmt.DateTime(m.received)
+		fd.Received = &received
+	}
+
+	return fd
 }
 
+// String returns object key in the metadata's format
 func (m *metadata) String() string {
-	return fmt.Sprintf("%s.%s.%s.%d.%s.%s.%s.%s",
+	if m.format < 2 {
+		return fmt.Sprintf("%s.%s.%s.%d.%s.%s.%s.%s",
+			m.filename,
+			m.version,
+			m.operation,
+			m.created.UnixNano()/1000000,
+			m.checksum,
+			encode(m.contentType),
+			encode(m.archetype),
+			encode(sliceToLabelsString(m.labels)),
+		)
+	}
+
+	return fmt.Sprintf("%s.%s.%s.%d.%d",
 		m.filename,
 		m.version,
 		m.operation,
 		m.created.UnixNano()/1000000,
-		m.checksum,
-		encode(m.contentType),
-		encode(m.archetype),
-		encode(sliceToLabelsString(m.labels)),
+		m.format,
 	)
 }
 
+func parseTimestamp(timestamp string) (time.Time, error) {
+	if len(timestamp) < 13 {
+		return time.Time{}, fmt.Errorf("Invalid timestamp length (%s, %d)", timestamp, len(timestamp))
+	}
+	s, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to parse timestamp (%s)", timestamp)
+	}
+
+	return time.Unix(s/1000, s%1000*1000000).In(utc), nil
+}
+
 func encode(src string) string {
 	return base64.URLEncoding.EncodeToString([]byte(src))
 }
@@ -0,0 +1,140 @@
+package s3
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetadataFromKey(t *testing.T) {
+	created := time.Date(2018, 1, 18, 15, 22, 46, 123000000, utc)
+
+	testCases := []struct {
+		description   string
+		key           string
+		expected      *metadata
+		errorExpected bool
+	}{
+		{
+			"format 1",
+			"File1.V1.w.1516288966123.CHS.dGV4dC9vcGVuRWhyWG1s.b3BlbkVIUi1FSFItT0JTRVJWQVRJT04uYmxvb2RfcHJlc3N1cmUudjE=.dml0YWxTaWdu",
+			&metadata{
+				format:      1,
+				filename:    "File1",
+				version:     "V1",
+				operation:   Write,
+				created:     created,
+				checksum:    "CHS",
+				contentType: "text/openEhrXml",
+				archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
+				labels:      []string{"vitalSign"},
+			},
+			noErrors,
+		},
+		{
+			"format 2",
+			"File1.V1.d.1516288966123.2",
+			&metadata{
+				format:    2,
+				filename:  "File1",
+				version:   "V1",
+				operation: Delete,
+				created:   created,
+			},
+			noErrors,
+		},
+		{
+			"format 3",
+			"File1.V1.w.1516288966123.3",
+			&metadata{
+				format:    3,
+				filename:  "File1",
+				version:   "V1",
+				operation: Write,
+				created:   created,
+			},
+			noErrors,
+		},
+		{
+			"unsupported format",
+			"File1.V1.w.1516288966123.4",
+			nil,
+			withErrors,
+		},
+		{
+			"invalid operation",
+			"File1.V1.x.1516288966123.2",
+			nil,
+			withErrors,
+		},
+		{
+			"invalid timestamp",
+			"File1.V1.w.invalid.2",
+			nil,
+			withErrors,
+		},
+		{
+			"invalid number of items",
+			"File1.V1.w.1516288966123",
+			nil,
+			withErrors,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			md, err := metadataFromKey(test.key)
+
+			if !reflect.DeepEqual(md, test.expected) {
+				t.Errorf("Expected metadata to equal\n%+v\ngot\n%+v", test.expected, md)
+			}
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMetadataHeadersRoundtrip(t *testing.T) {
+	md := &metadata{
+		format:      MetadataFormat,
+		filename:    "File1",
+		version:     "V1",
+		operation:   Write,
+		created:     time.Date(2018, 1, 18, 15, 22, 46, 123000000, utc),
+		checksum:    "CHS",
+		contentType: "text/openEhrXml",
+		archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
+		labels:      []string{"vitalSign", "basicPatientInfo"},
+		size:        8,
+		keyVersion:  "KEYV1",
+		author:      "AUTHOR",
+		source:      "SOURCE",
+		parents:     []string{"V0"},
+		blob:        "CHS",
+	}
+
+	userMetadata, err := md.userMetadata()
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// parse the key and headers as they would be returned by S3
+	parsed, err := metadataFromKey(md.String())
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	headers := metadataHeaders(metadataHeader{})
+	headers.Set(metadataHeaderName, userMetadata[metadataKey])
+	if err := parsed.setFromHeaders(headers); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	if !reflect.DeepEqual(parsed, md) {
+		t.Errorf("Expected metadata to equal\n%+v\ngot\n%+v", md, parsed)
+	}
+}
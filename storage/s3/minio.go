@@ -24,3 +24,8 @@ func (m iminio) BucketExists(bucketName string) (bool, error) {
 	}
 	return exists, err
 }
+
+// isNotFound checks if the error returned by minio means that the object does not exist
+func isNotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
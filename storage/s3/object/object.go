@@ -31,4 +31,8 @@ type NewObjectInfo struct {
 	Version     string
 	Operation   string
 	Labels      []string
+	Author      string
+	Source      string
+	// Parents are versions of the file the new version was derived from
+	Parents []string
 }
@@ -0,0 +1,385 @@
+/*
+Package retention purges file versions that are no longer to be retained from
+S3 storage according to configured retention policies.
+
+Policies apply per bucket, per label or to both. A file is governed by the
+most specific matching policy: bucket and label, then bucket, then label and
+finally the default policy matching every file. Policy can limit
+
+    - number of versions of the file to keep
+    - number of days to keep versions of the file for
+    - number of days after which deleted files are purged completely
+
+Older versions of the file are purged only when all configured limits are
+exceeded and the current version is never purged unless the file was deleted.
+Nothing younger than the minimum retention period is ever purged, regardless of
+policies, so that medical record retention requirements are respected.
+
+Files under legal hold are never purged.
+
+Every purged file version is recorded in the key-value storage as an audit
+record. In dry-run mode purge candidates are only recorded.
+*/
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/metrics"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	"github.com/iryonetwork/wwm/storage/s3"
+)
+
+// Policy describes how long versions of files are retained. Zero values are not limiting.
+type Policy struct {
+	// Bucket the policy applies to, empty matches all buckets
+	Bucket string `json:"bucket,omitempty"`
+	// Label the policy applies to, empty matches all files
+	Label string `json:"label,omitempty"`
+	// KeepVersions is the number of the newest versions of the file to keep
+	KeepVersions int `json:"keepVersions,omitempty"`
+	// KeepDays is the number of days to keep versions of the file for
+	KeepDays int `json:"keepDays,omitempty"`
+	// PurgeDeletedAfterDays is the number of days after which deleted files are purged with all their versions
+	PurgeDeletedAfterDays int `json:"purgeDeletedAfterDays,omitempty"`
+}
+
+// Record is the audit record of the purged file version
+type Record struct {
+	Bucket    string          `json:"bucket"`
+	File      string          `json:"file"`
+	Version   string          `json:"version"`
+	Operation string          `json:"operation"`
+	Checksum  string          `json:"checksum,omitempty"`
+	Created   strfmt.DateTime `json:"created"`
+	Reason    string          `json:"reason"`
+	Policy    Policy          `json:"policy"`
+	Purged    strfmt.DateTime `json:"purged"`
+	DryRun    bool            `json:"dryRun,omitempty"`
+}
+
+// Cfg holds configuration of the purge
+type Cfg struct {
+	Policies         []Policy
+	MinimumRetention time.Duration
+	DryRun           bool
+}
+
+// Purger describes public methods of retention policies enforcement
+type Purger interface {
+	// Purge removes file versions that are not to be retained from all the buckets.
+	Purge(ctx context.Context) error
+	// GetPrometheusMetricsCollection returns metrics to be registered for the component.
+	GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector
+}
+
+type purger struct {
+	storage           s3.Storage
+	audit             keyvalue.Storage
+	policies          []Policy
+	minimumRetention  time.Duration
+	dryRun            bool
+	logger            zerolog.Logger
+	metricsCollection map[metrics.ID]prometheus.Collector
+}
+
+type candidate struct {
+	file   *models.FileDescriptor
+	reason string
+	policy Policy
+}
+
+const (
+	// AuditBucket is the key-value storage bucket holding audit records
+	AuditBucket string = "retentionAudit"
+
+	fileVersions metrics.ID = "fileVersions"
+
+	reasonDeleted    string = "deleted"
+	reasonSuperseded string = "superseded"
+
+	resultPurged string = "purged"
+	resultDryRun string = "dryRun"
+	resultFailed string = "failed"
+)
+
+// day is the unit of retention periods in policies
+const day = 24 * time.Hour
+
+// now is used to get current time, can be mocked in tests
+var now = time.Now
+
+// LoadPolicies reads retention policies from JSON file
+func LoadPolicies(path string) ([]Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read policies file")
+	}
+
+	policies := []Policy{}
+	if err := json.Unmarshal(b, &policies); err != nil {
+		return nil, errors.Wrap(err, "failed to parse policies file")
+	}
+
+	for _, p := range policies {
+		if p.KeepVersions < 0 || p.KeepDays < 0 || p.PurgeDeletedAfterDays < 0 {
+			return nil, errors.Errorf("invalid policy for bucket '%s' and label '%s', limits can't be negative", p.Bucket, p.Label)
+		}
+	}
+
+	return policies, nil
+}
+
+// Purge removes file versions that are not to be retained from all the buckets.
+func (p *purger) Purge(ctx context.Context) error {
+	buckets, err := p.storage.ListBuckets(ctx)
+	if err != nil {
+		p.logger.Error().Err(err).Msg("failed to list buckets")
+		return errors.Wrap(err, "failed to list buckets")
+	}
+
+	var errCount int
+	for _, b := range buckets {
+		select {
+		case <-ctx.Done():
+			p.logger.Error().Msg("aborting purge due to context cancellation")
+			return errors.Wrap(ctx.Err(), "aborting purge due to context cancellation")
+		default:
+			err := p.purgeBucket(ctx, b.Name)
+			if err != nil {
+				p.logger.Error().Err(err).Str("bucket", b.Name).Msg("failed to purge")
+				errCount++
+			}
+		}
+	}
+
+	if errCount > 0 {
+		p.logger.Error().Msgf("%d failure(s) out of %d bucket(s) to purge", errCount, len(buckets))
+		return errors.Errorf("%d failure(s) out of %d bucket(s) to purge", errCount, len(buckets))
+	}
+
+	return nil
+}
+
+// GetPrometheusMetricsCollection returns all prometheus metrics collectors to be registered
+func (p *purger) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
+	return p.metricsCollection
+}
+
+// New returns a new instance of retention policies enforcement recording purged file versions in audit storage
+func New(storage s3.Storage, audit keyvalue.Storage, cfg Cfg, logger zerolog.Logger) Purger {
+	logger = logger.With().Str("component", "storage/s3/retention").Logger()
+
+	metricsCollection := make(map[metrics.ID]prometheus.Collector)
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "retention",
+		Name:      "file_versions",
+		Help:      "Number of file versions purged",
+	}, []string{"result", "reason"})
+	metricsCollection[fileVersions] = c
+
+	return &purger{
+		storage:           storage,
+		audit:             audit,
+		policies:          cfg.Policies,
+		minimumRetention:  cfg.MinimumRetention,
+		dryRun:            cfg.DryRun,
+		logger:            logger,
+		metricsCollection: metricsCollection,
+	}
+}
+
+func (p *purger) purgeBucket(ctx context.Context, bucketID string) error {
+	files, err := p.storage.List(ctx, bucketID, "")
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to list files in bucket %s", bucketID))
+	}
+
+	// group versions by file keeping them sorted from the newest
+	names := []string{}
+	versions := make(map[string][]*models.FileDescriptor)
+	for _, f := range files {
+		if _, ok := versions[f.Name]; !ok {
+			names = append(names, f.Name)
+		}
+		versions[f.Name] = append(versions[f.Name], f)
+	}
+
+	var errCount, count int
+	for _, name := range names {
+		// files under legal hold are never purged
+		if versions[name][0].LegalHold {
+			p.logger.Debug().Str("bucket", bucketID).Str("file", name).Msg("file under legal hold skipped")
+			continue
+		}
+
+		policy := p.policy(bucketID, versions[name])
+		if policy == nil {
+			continue
+		}
+
+		for _, c := range p.candidates(*policy, versions[name]) {
+			select {
+			case <-ctx.Done():
+				return errors.Wrap(ctx.Err(), "aborting bucket purge due to context cancellation")
+			default:
+				count++
+				if err := p.purgeFileVersion(ctx, bucketID, c); err != nil {
+					errCount++
+				}
+			}
+		}
+	}
+
+	if errCount > 0 {
+		return errors.Errorf("%d failure(s) out of %d version(s) to purge in bucket %s", errCount, count, bucketID)
+	}
+
+	p.logger.Info().Str("bucket", bucketID).Bool("dryRun", p.dryRun).Msgf("%d version(s) purged", count)
+	return nil
+}
+
+// policy returns the most specific policy matching the file in the bucket
+func (p *purger) policy(bucketID string, versions []*models.FileDescriptor) *Policy {
+	labels := make(map[string]bool)
+	for _, v := range versions {
+		for _, l := range v.Labels {
+			labels[l] = true
+		}
+	}
+
+	var match *Policy
+	best := -1
+	for i, policy := range p.policies {
+		if policy.Bucket != "" && policy.Bucket != bucketID {
+			continue
+		}
+		if policy.Label != "" && !labels[policy.Label] {
+			continue
+		}
+
+		specificity := 0
+		if policy.Bucket != "" {
+			specificity += 2
+		}
+		if policy.Label != "" {
+			specificity++
+		}
+		if specificity > best {
+			match = &p.policies[i]
+			best = specificity
+		}
+	}
+
+	return match
+}
+
+// candidates returns versions of the file to purge according to the policy, oldest first
+func (p *purger) candidates(policy Policy, versions []*models.FileDescriptor) []candidate {
+	t := now()
+	candidates := []candidate{}
+
+	// versions are sorted from the newest, purge the oldest ones first so that the file
+	// can't reappear if the purge is interrupted
+	latest := versions[0]
+	if latest.Operation == string(s3.Delete) && policy.PurgeDeletedAfterDays > 0 &&
+		p.expired(latest, t, time.Duration(policy.PurgeDeletedAfterDays)*day) {
+		for i := len(versions) - 1; i >= 0; i-- {
+			candidates = append(candidates, candidate{file: versions[i], reason: reasonDeleted, policy: policy})
+		}
+		return candidates
+	}
+
+	if policy.KeepVersions == 0 && policy.KeepDays == 0 {
+		return candidates
+	}
+	for i := len(versions) - 1; i > 0; i-- {
+		if policy.KeepVersions > 0 && i < policy.KeepVersions {
+			continue
+		}
+		if !p.expired(versions[i], t, time.Duration(policy.KeepDays)*day) {
+			continue
+		}
+		candidates = append(candidates, candidate{file: versions[i], reason: reasonSuperseded, policy: policy})
+	}
+
+	return candidates
+}
+
+// expired checks if the file version is older than the retention period and the minimum retention period at time t
+func (p *purger) expired(f *models.FileDescriptor, t time.Time, retention time.Duration) bool {
+	if p.minimumRetention > retention {
+		retention = p.minimumRetention
+	}
+
+	return time.Time(f.Created).Add(retention).Before(t)
+}
+
+func (p *purger) purgeFileVersion(ctx context.Context, bucketID string, c candidate) error {
+	result := resultFailed
+	defer func() {
+		p.metricsCollection[fileVersions].(*prometheus.CounterVec).
+			With(prometheus.Labels{"result": result, "reason": c.reason}).
+			Inc()
+	}()
+
+	logger := p.logger.With().
+		Str("bucket", bucketID).
+		Str("file", c.file.Name).
+		Str("version", c.file.Version).
+		Str("reason", c.reason).
+		Logger()
+
+	if !p.dryRun {
+		if err := p.storage.Delete(ctx, bucketID, c.file.Name, c.file.Version); err != nil {
+			logger.Error().Err(err).Msg("failed to purge")
+			return err
+		}
+	}
+
+	record := Record{
+		Bucket:    bucketID,
+		File:      c.file.Name,
+		Version:   c.file.Version,
+		Operation: c.file.Operation,
+		Checksum:  c.file.Checksum,
+		Created:   c.file.Created,
+		Reason:    c.reason,
+		Policy:    c.policy,
+		Purged:    strfmt.DateTime(now()),
+		DryRun:    p.dryRun,
+	}
+	b, err := json.Marshal(record)
+	if err == nil {
+		err = p.audit.Add(AuditBucket, auditKey(record), b)
+	}
+	if err != nil {
+		// the version is already gone, make sure the record ends up at least in the log
+		logger.Error().Err(err).Str("record", string(b)).Msg("failed to save audit record")
+		return err
+	}
+
+	if p.dryRun {
+		result = resultDryRun
+	} else {
+		result = resultPurged
+	}
+	logger.Info().Bool("dryRun", p.dryRun).Msg("file version purged")
+
+	return nil
+}
+
+// auditKey returns key of the audit record, records are sorted by the time of purge
+func auditKey(r Record) string {
+	return fmt.Sprintf("%s/%s/%s/%s", r.Purged, r.Bucket, r.File, r.Version)
+}
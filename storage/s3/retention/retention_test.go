@@ -0,0 +1,222 @@
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	keyvalueMock "github.com/iryonetwork/wwm/storage/keyvalue/mock"
+	"github.com/iryonetwork/wwm/storage/s3/mock"
+)
+
+var (
+	time1, _ = strfmt.ParseDateTime("2018-01-18T15:22:46.123Z")
+	time2, _ = strfmt.ParseDateTime("2018-03-18T15:22:46.123Z")
+	time3, _ = strfmt.ParseDateTime("2018-05-18T15:22:46.123Z")
+	purged   = strfmt.DateTime(time.Time(time3).Add(20 * day))
+	bucket1  = &models.BucketDescriptor{Name: "Bucket1", Created: time1}
+	file1V1  = &models.FileDescriptor{Name: "File1", Version: "V1", Operation: "w", Created: time1}
+	file1V2  = &models.FileDescriptor{Name: "File1", Version: "V2", Operation: "w", Created: time2}
+	file1V3  = &models.FileDescriptor{Name: "File1", Version: "V3", Operation: "w", Created: time3}
+	file2V1  = &models.FileDescriptor{Name: "File2", Version: "V1", Operation: "w", Created: time1, Labels: []string{"draft"}}
+	file2V2  = &models.FileDescriptor{Name: "File2", Version: "V2", Operation: "d", Created: time2, Labels: []string{"draft"}}
+	file3V1  = &models.FileDescriptor{Name: "File3", Version: "V1", Operation: "w", Created: time1, LegalHold: true}
+	file3V2  = &models.FileDescriptor{Name: "File3", Version: "V2", Operation: "d", Created: time2, LegalHold: true}
+
+	noErrors   = false
+	withErrors = true
+)
+
+func TestPurge(t *testing.T) {
+	testCases := []struct {
+		description      string
+		policies         []Policy
+		minimumRetention time.Duration
+		dryRun           bool
+		calls            func(*mock.MockStorage, *keyvalueMock.MockStorage) []*gomock.Call
+		errorExpected    bool
+	}{
+		{
+			"no matching policy",
+			[]Policy{{Bucket: "Bucket2", KeepVersions: 1}},
+			0,
+			false,
+			func(s *mock.MockStorage, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V3, file2V2, file1V2, file1V1, file2V1}, nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"versions exceeding the limit are purged oldest first",
+			[]Policy{{KeepVersions: 1}},
+			0,
+			false,
+			func(s *mock.MockStorage, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V3, file2V2, file1V2, file1V1, file2V1}, nil),
+					s.EXPECT().Delete(gomock.Any(), "Bucket1", "File1", "V1").Return(nil),
+					kv.EXPECT().Add(AuditBucket, auditKey(Record{Bucket: "Bucket1", File: "File1", Version: "V1", Purged: purged}), auditRecord(file1V1, reasonSuperseded, Policy{KeepVersions: 1}, false)).Return(nil),
+					s.EXPECT().Delete(gomock.Any(), "Bucket1", "File1", "V2").Return(nil),
+					kv.EXPECT().Add(AuditBucket, auditKey(Record{Bucket: "Bucket1", File: "File1", Version: "V2", Purged: purged}), auditRecord(file1V2, reasonSuperseded, Policy{KeepVersions: 1}, false)).Return(nil),
+					s.EXPECT().Delete(gomock.Any(), "Bucket1", "File2", "V1").Return(nil),
+					kv.EXPECT().Add(AuditBucket, gomock.Any(), auditRecord(file2V1, reasonSuperseded, Policy{KeepVersions: 1}, false)).Return(nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"all limits have to be exceeded",
+			[]Policy{{KeepVersions: 1, KeepDays: 100}},
+			0,
+			false,
+			func(s *mock.MockStorage, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V3, file1V2, file1V1}, nil),
+					s.EXPECT().Delete(gomock.Any(), "Bucket1", "File1", "V1").Return(nil),
+					kv.EXPECT().Add(AuditBucket, gomock.Any(), auditRecord(file1V1, reasonSuperseded, Policy{KeepVersions: 1, KeepDays: 100}, false)).Return(nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"minimum retention is respected",
+			[]Policy{{KeepVersions: 1}},
+			100 * day,
+			false,
+			func(s *mock.MockStorage, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V3, file1V2, file1V1}, nil),
+					s.EXPECT().Delete(gomock.Any(), "Bucket1", "File1", "V1").Return(nil),
+					kv.EXPECT().Add(AuditBucket, gomock.Any(), auditRecord(file1V1, reasonSuperseded, Policy{KeepVersions: 1}, false)).Return(nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"deleted file is purged completely by the most specific policy",
+			[]Policy{{KeepVersions: 5}, {Label: "draft", PurgeDeletedAfterDays: 30}},
+			0,
+			false,
+			func(s *mock.MockStorage, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				policy := Policy{Label: "draft", PurgeDeletedAfterDays: 30}
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V3, file2V2, file1V2, file1V1, file2V1}, nil),
+					s.EXPECT().Delete(gomock.Any(), "Bucket1", "File2", "V1").Return(nil),
+					kv.EXPECT().Add(AuditBucket, gomock.Any(), auditRecord(file2V1, reasonDeleted, policy, false)).Return(nil),
+					s.EXPECT().Delete(gomock.Any(), "Bucket1", "File2", "V2").Return(nil),
+					kv.EXPECT().Add(AuditBucket, gomock.Any(), auditRecord(file2V2, reasonDeleted, policy, false)).Return(nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"dry run only records candidates",
+			[]Policy{{Bucket: "Bucket1", PurgeDeletedAfterDays: 30}},
+			0,
+			true,
+			func(s *mock.MockStorage, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				policy := Policy{Bucket: "Bucket1", PurgeDeletedAfterDays: 30}
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file2V2, file2V1}, nil),
+					kv.EXPECT().Add(AuditBucket, gomock.Any(), auditRecord(file2V1, reasonDeleted, policy, true)).Return(nil),
+					kv.EXPECT().Add(AuditBucket, gomock.Any(), auditRecord(file2V2, reasonDeleted, policy, true)).Return(nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"file under legal hold is skipped",
+			[]Policy{{KeepVersions: 1, PurgeDeletedAfterDays: 30}},
+			0,
+			false,
+			func(s *mock.MockStorage, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file3V2, file3V1}, nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"failed delete is not recorded",
+			[]Policy{{KeepVersions: 2}},
+			0,
+			false,
+			func(s *mock.MockStorage, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V3, file1V2, file1V1}, nil),
+					s.EXPECT().Delete(gomock.Any(), "Bucket1", "File1", "V1").Return(errors.New("error")),
+				}
+			},
+			withErrors,
+		},
+		{
+			"failed to list buckets",
+			[]Policy{{KeepVersions: 1}},
+			0,
+			false,
+			func(s *mock.MockStorage, kv *keyvalueMock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return(nil, errors.New("error")),
+				}
+			},
+			withErrors,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			s := mock.NewMockStorage(ctrl)
+			kv := keyvalueMock.NewMockStorage(ctrl)
+
+			// mock current time
+			now = func() time.Time { return time.Time(purged) }
+
+			gomock.InOrder(test.calls(s, kv)...)
+
+			cfg := Cfg{Policies: test.policies, MinimumRetention: test.minimumRetention, DryRun: test.dryRun}
+			err := New(s, kv, cfg, zerolog.New(os.Stdout)).Purge(context.Background())
+
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+		})
+	}
+}
+
+func auditRecord(f *models.FileDescriptor, reason string, policy Policy, dryRun bool) []byte {
+	b, _ := json.Marshal(Record{
+		Bucket:    "Bucket1",
+		File:      f.Name,
+		Version:   f.Version,
+		Operation: f.Operation,
+		Checksum:  f.Checksum,
+		Created:   f.Created,
+		Reason:    reason,
+		Policy:    policy,
+		Purged:    purged,
+		DryRun:    dryRun,
+	})
+	return b
+}
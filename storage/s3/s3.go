@@ -10,35 +10,123 @@ S3 supports following features:
     - creating new files
     - reading files
     - encrypting all files using an external key provider
+    - re-encrypting files with the current key after key rotation
+    - repairing corrupted file contents
+    - storing identical file contents only once per bucket
+    - receiving file contents in chunks for resumable uploads
+    - legal holds preventing files from being changed or removed
+    - usage counters of buckets updated by every write and delete
+    - storing files on the local filesystem instead of S3 storage
 
 Encryption
 
 To support encryption s3 requires an external key provider that can provide the
-storage correct key for the current bucket / user ID.
+storage correct key for the current bucket / user ID. Keys are versioned; the
+version of the key used to encrypt an object is stored in the object's user
+metadata so that objects written under older key versions stay readable.
+Objects without the key version metadata are read with the legacy key (empty
+version).
 
 Storing metadata
 
-Metadata is stored inside the file name. The end file name on S3 storage will
-look like this
+Metadata is stored partially inside the file name and partially in the object's
+user metadata. The end file name on S3 storage will look like this
 
-	FILENAME.VERSION.OPERATION.TIMESTAMP.CHECKSUM.ARCHETYPE
-	-- 40 --.- 1-40-.--- 1 ---.-- 13 ---.-- 44 --.--- * ---
+	FILENAME.VERSION.OPERATION.TIMESTAMP.FORMAT
+	-- 40 --.- 1-40-.--- 1 ---.-- 13 ---.- 1 -
 
-Filenames on S3 are limited to around 1024 bytes meaning that the last archetype
-value can be up to 886 characters long.
+The remaining values (checksum, content type, archetype, labels, size, key
+version, author, source and parent versions) are stored as base64 URL encoded JSON in the
+"Metadata" user metadata value. New values can be added to the JSON without
+changing the format. User metadata is limited to 2KB in total, and listing
+requires a StatObject call for every object. Time the object was last modified
+is returned as the time the version was received by the storage.
 
-@TODO How to add new values to file name?
+Files written before the format was versioned (format 1) store all metadata in
+the file name
+
+	FILENAME.VERSION.OPERATION.TIMESTAMP.CHECKSUM.CONTENTTYPE.ARCHETYPE.LABELS
+
+and are still readable. Reencrypt migrates them to the current format.
+
+Deduplication
+
+Contents of written files are stored once per bucket as content addressed blobs
+
+	blobs/CHECKSUM/data
+
+encrypted with the key of the bucket. File versions with the same contents hold
+only metadata pointing at the blob. Every file version referencing the blob
+holds an empty reference object
+
+	blobs/CHECKSUM/refs/FILENAME.VERSION
+
+and the blob is removed on Delete only after its last reference is removed.
+Contents are checked against their checksum before they are deduplicated. Removal
+of the blob is marked with
+
+	blobs/CHECKSUM/tombstone
+
+while it's in progress; versions referencing the blob in the meantime wait for
+the removal to finish and upload the contents again.
+Repair of a deduplicated file version rewrites the blob and so repairs all the
+file versions referencing it.
+
+Uploads
+
+Contents of resumable uploads are received in chunks stored next to the upload
+session until the upload is finalized
+
+	uploads/UPLOADID/upload
+	uploads/UPLOADID/chunks/OFFSET
+
+Chunks are encrypted with the key of the bucket. Chunks may overlap, contents
+are assembled by UploadRead in the order of their offsets.
+
+Legal holds
+
+Files and whole buckets under legal hold are marked with empty objects
+
+	holds/bucket
+	holds/files/FILENAME
+
+Delete refuses to remove versions of held files and file descriptors returned
+by List and Read report the hold.
+
+Manifest
+
+Metadata of files in the current format is held in object headers. List reads
+headers of versions missing from the header cache from the manifest of the
+bucket and stats only versions the manifest doesn't know yet
+
+	manifest/bucket
+
+Manifest is only a cache, its entries are valid for the ETag of the object.
+
+Filesystem
+
+Storage created with NewFilesystem keeps buckets in directories on the local
+filesystem instead of S3 storage. Objects are stored as files with the same
+keys, contents encrypted the same way and user metadata appended after the
+contents, so all the features above behave the same on both backends. Objects
+are written to a temporary file, synced to the disk and renamed into place so
+that a crash never leaves a partially written object behind.
 */
 package s3
 
 //go:generate ../../bin/mockgen.sh storage/s3 Storage,KeyProvider,Minio $GOFILE
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/go-openapi/strfmt"
 	"github.com/minio/minio-go/pkg/encrypt"
@@ -47,6 +135,7 @@ import (
 
 	"github.com/iryonetwork/wwm/gen/storage/models"
 	"github.com/iryonetwork/wwm/storage/s3/object"
+	"github.com/iryonetwork/wwm/utils/spool"
 	"github.com/minio/minio-go"
 )
 
@@ -57,13 +146,32 @@ type Storage interface {
 	ListBuckets(ctx context.Context) ([]*models.BucketDescriptor, error)
 	List(ctx context.Context, bucketID, prefix string) ([]*models.FileDescriptor, error)
 	Read(ctx context.Context, bucketID, fileID, version string) (io.ReadCloser, *models.FileDescriptor, error)
+	ReadRange(ctx context.Context, bucketID, fileID, version string, offset, length int64) (io.ReadCloser, *models.FileDescriptor, error)
 	Write(ctx context.Context, bucketID string, newFile *object.NewObjectInfo, r io.Reader) (*models.FileDescriptor, error)
 	Delete(ctx context.Context, bucketID, fileID, version string) error
+	Reencrypt(ctx context.Context, bucketID, fileID, version string) (bool, error)
+	Repair(ctx context.Context, bucketID, fileID, version string, r io.Reader) error
+	UploadNew(ctx context.Context, bucketID string, upload *models.UploadDescriptor) error
+	UploadGet(ctx context.Context, bucketID, uploadID string) (*models.UploadDescriptor, error)
+	UploadList(ctx context.Context, bucketID string) ([]*models.UploadDescriptor, error)
+	UploadWriteChunk(ctx context.Context, bucketID, uploadID string, offset int64, r io.Reader, size int64) error
+	UploadRead(ctx context.Context, bucketID, uploadID string) (io.ReadCloser, error)
+	UploadDelete(ctx context.Context, bucketID, uploadID string) error
+	HoldSet(ctx context.Context, bucketID, fileID string) error
+	HoldRelease(ctx context.Context, bucketID, fileID string) error
+	Held(ctx context.Context, bucketID, fileID string) (bool, error)
+	Usage(ctx context.Context, bucketID string) (size, objects int64, err error)
 }
 
 // KeyProvider lists methods required for reading encryption keys
 type KeyProvider interface {
+	// Get returns the current key of the bucket.
 	Get(string) (string, error)
+	// GetVersion returns the key of the bucket with the given version. Empty
+	// version refers to the legacy key used before keys were versioned.
+	GetVersion(string, string) (string, error)
+	// CurrentVersion returns the version of the current key of the bucket.
+	CurrentVersion(string) (string, error)
 }
 
 // Minio interface describes functions used in minio-go package for mocking
@@ -75,6 +183,7 @@ type Minio interface {
 	ListObjectsV2(bucketName, prefix string, recursive bool, doneCh <-chan struct{}) <-chan minio.ObjectInfo
 	GetObjectWithContext(ctx context.Context, bucketName, objectName string, opts minio.GetObjectOptions) (io.ReadCloser, error)
 	GetEncryptedObject(bucketName, objectName string, encryptMaterials encrypt.Materials) (io.ReadCloser, error)
+	StatObject(bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
 	PutObjectWithContext(ctx context.Context, bucketName, objectName string, reader io.Reader, objectSize int64,
 		opts minio.PutObjectOptions) (n int64, err error)
 	PutEncryptedObject(bucketName, objectName string, reader io.Reader, encryptMaterials encrypt.Materials) (n int64, err error)
@@ -91,10 +200,12 @@ type Config struct {
 }
 
 type s3storage struct {
-	cfg    *Config
-	client Minio
-	keys   KeyProvider
-	logger zerolog.Logger
+	cfg        *Config
+	client     Minio
+	keys       KeyProvider
+	headers    headerCache
+	usageLocks usageLocks
+	logger     zerolog.Logger
 }
 
 // Operation represents a single character operation
@@ -108,6 +219,12 @@ const Delete Operation = Operation(models.FileDescriptorOperationD)
 
 const bucketExistsErrMsg = "Your previous request to create the named bucket succeeded and you already own it."
 
+// keyVersionMetadata is the user metadata key holding version of the key used to encrypt the object
+const keyVersionMetadata = "Key-Version"
+
+// keyVersionHeader is the header under which S3 returns keyVersionMetadata
+const keyVersionHeader = "X-Amz-Meta-" + keyVersionMetadata
+
 // ErrAlreadyExists indicates bucket or file already exists
 var ErrAlreadyExists = errors.New("Item already exists")
 
@@ -117,6 +234,15 @@ var ErrNotFound = errors.New("File not found")
 // ErrDeleted indicates file or bucket were already deleted
 var ErrDeleted = errors.New("File was deleted")
 
+// ErrChecksumMismatch indicates contents of the file do not match the stored checksum
+var ErrChecksumMismatch = errors.New("Checksum mismatch")
+
+// ErrInvalidRange indicates requested range starts after the end of the file
+var ErrInvalidRange = errors.New("Invalid range")
+
+// ErrMetadataTooLarge is returned when metadata of the file does not fit into object's user metadata
+var ErrMetadataTooLarge = errors.New("File metadata exceeds the size limit of object user metadata")
+
 // New creates a new instance of s3 storage
 func New(cfg *Config, keys KeyProvider, logger zerolog.Logger) (Storage, error) {
 	logger = logger.With().Str("component", "storage/s3").Logger()
@@ -151,7 +277,7 @@ func (s *s3storage) BucketExists(_ context.Context, bucketID string) (bool, erro
 }
 
 // MakeBucket creates a bucket, return ErrAlreadyExists if bucket already exists
-func (s *s3storage) MakeBucket(_ context.Context, bucketID string) error {
+func (s *s3storage) MakeBucket(ctx context.Context, bucketID string) error {
 	s.logger.Debug().Str("cmd", "s3::MakeBucket").Msgf("('%s')", bucketID)
 
 	exists, err := s.client.BucketExists(bucketID)
@@ -172,7 +298,8 @@ func (s *s3storage) MakeBucket(_ context.Context, bucketID string) error {
 		}
 	}
 
-	return nil
+	// new buckets start with empty usage so that it never has to be counted
+	return s.putUsage(ctx, bucketID, &usage{})
 
 }
 
@@ -201,41 +328,35 @@ func (s *s3storage) ListBuckets(_ context.Context) ([]*models.BucketDescriptor,
 }
 
 // List returns a list of files stored inside a bucket
-func (s *s3storage) List(_ context.Context, bucketID, prefix string) ([]*models.FileDescriptor, error) {
+func (s *s3storage) List(ctx context.Context, bucketID, prefix string) ([]*models.FileDescriptor, error) {
 	s.logger.Debug().Str("cmd", "s3::List").Msgf("('%s', '%s')", bucketID, prefix)
 
-	// Check if bucket exists first
-	exists, err := s.client.BucketExists(bucketID)
+	list, err := s.list(ctx, bucketID, prefix)
 	if err != nil {
-		s.logger.Info().Err(err).Str("cmd", "s3::List").Msg("Failed to check if bucket exists")
-		return nil, errors.Wrap(err, "Failed to check if bucket exists")
-	}
-	if !exists {
-		// Nothing to list
-		return []*models.FileDescriptor{}, nil
+		return nil, err
 	}
 
-	ch := make(chan struct{})
-	defer close(ch)
-	infos := s.client.ListObjectsV2(bucketID, prefix, false, ch)
+	files := make([]*models.FileDescriptor, len(list))
+	if len(list) == 0 {
+		return files, nil
+	}
 
-	files := []*models.FileDescriptor{}
-	for info := range infos {
-		if info.Err != nil {
-			s.logger.Info().Err(info.Err).Str("cmd", "s3::List").Msg("Failed to read object from a list")
-			return nil, errors.Wrap(info.Err, "Failed to read object from a list")
-		}
+	if err := s.loadListHeaders(ctx, bucketID, prefix, list); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::List").Msg("Failed to load metadata from object headers")
+		return nil, errors.Wrap(err, "Failed to load metadata from object headers")
+	}
 
-		fd, err := objectInfoToFileDescriptor(info, bucketID)
-		if err != nil {
-			s.logger.Info().Err(err).Str("cmd", "s3::List").Msg("Failed to convert object to fileDescriptor")
-			return nil, errors.Wrap(err, "Failed to convert object to fileDescriptor")
-		}
+	// mark files under legal hold
+	h, err := s.holds(bucketID)
+	if err != nil {
+		return nil, err
+	}
 
-		files = append(files, fd)
+	for i, md := range list {
+		files[i] = md.fileDescriptor(bucketID)
+		files[i].LegalHold = h.held(md.filename)
 	}
 
-	sort.Sort(byCreated(files))
 	return files, nil
 }
 
@@ -243,12 +364,21 @@ func (s *s3storage) List(_ context.Context, bucketID, prefix string) ([]*models.
 func (s *s3storage) Read(ctx context.Context, bucketID, fileID, version string) (io.ReadCloser, *models.FileDescriptor, error) {
 	s.logger.Debug().Str("cmd", "s3::Read").Msgf("('%s', '%s', '%s')", bucketID, fileID, version)
 
+	return s.ReadRange(ctx, bucketID, fileID, version, 0, -1)
+}
+
+// ReadRange fetches length bytes of contents starting at the offset from the storage, negative length reads
+// until the end of the file. Returned file descriptor describes the whole file. Encrypted contents can't be
+// fetched partially from S3, the part before the offset is decrypted and discarded.
+func (s *s3storage) ReadRange(ctx context.Context, bucketID, fileID, version string, offset, length int64) (io.ReadCloser, *models.FileDescriptor, error) {
+	s.logger.Debug().Str("cmd", "s3::ReadRange").Msgf("('%s', '%s', '%s', %d, %d)", bucketID, fileID, version, offset, length)
+
 	// find the file
 	prefix := fmt.Sprintf("%s.", fileID)
 	if version != "" {
 		prefix += fmt.Sprintf("%s.", version)
 	}
-	list, err := s.List(ctx, bucketID, prefix)
+	list, err := s.list(ctx, bucketID, prefix)
 	if err != nil {
 		s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to list files")
 		return nil, nil, errors.Wrap(err, "Failed to list files")
@@ -256,28 +386,69 @@ func (s *s3storage) Read(ctx context.Context, bucketID, fileID, version string)
 	if len(list) == 0 {
 		return nil, nil, ErrNotFound
 	}
-	md, err := metadataFromFileDescriptor(list[0])
+	md := list[0]
+	h, err := s.holds(bucketID)
 	if err != nil {
-		s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to parse metadata from fileDescriptor")
-		return nil, nil, errors.Wrap(err, "Failed to parse metadata from fileDescriptor")
+		return nil, nil, err
+	}
+	if err := s.loadHeaders(bucketID, md); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to stat object")
+		return nil, nil, errors.Wrap(err, "Failed to stat object")
+	}
+	fd := md.fileDescriptor(bucketID)
+	fd.LegalHold = h.held(md.filename)
+
+	// contents of deduplicated file versions are stored in the blob
+	objectName, keyVersion := md.String(), md.keyVersion
+	if md.blob != "" {
+		objectName = blobKey(md.blob)
+		keyVersion, err = s.blobKeyVersion(bucketID, md.blob)
+		if err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to stat blob")
+			return nil, nil, errors.Wrap(err, "Failed to stat blob")
+		}
 	}
 
 	// read the key
-	em, err := getCBCKey(bucketID, s.keys)
+	em, err := getCBCKey(bucketID, keyVersion, s.keys)
 	if err != nil {
 		s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to set CBC key")
 		return nil, nil, errors.Wrap(err, "Failed to set CBC key")
 	}
 
 	// fetch the file
-	reader, err := s.client.GetObjectWithContext(ctx, bucketID, md.String(), minio.GetObjectOptions{Materials: em})
+	reader, err := s.client.GetObjectWithContext(ctx, bucketID, objectName, minio.GetObjectOptions{Materials: em})
 
 	if err != nil {
 		s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to fetch enc. object")
 		return nil, nil, errors.Wrap(err, "Failed to fetch enc. object")
 	}
+	if offset == 0 && length < 0 {
+		return reader, fd, nil
+	}
+
+	// skip contents before the offset
+	if offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil {
+			reader.Close()
+			if err == io.EOF {
+				return nil, nil, ErrInvalidRange
+			}
+			s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to skip to the offset")
+			return nil, nil, errors.Wrap(err, "Failed to skip to the offset")
+		}
+	}
+	if length >= 0 {
+		reader = limitReadCloser{io.LimitReader(reader, length), reader}
+	}
+
+	return reader, fd, nil
+}
 
-	return reader, list[0], nil
+// limitReadCloser closes the underlying reader of the limited reader
+type limitReadCloser struct {
+	io.Reader
+	io.Closer
 }
 
 // Write creates a new file in the storage
@@ -291,13 +462,6 @@ func (s *s3storage) Write(ctx context.Context, bucketID string, newFile *object.
 		return nil, fmt.Errorf("Received an invalid operation '%s'", op)
 	}
 
-	// get the key
-	em, err := getCBCKey(bucketID, s.keys)
-	if err != nil {
-		s.logger.Info().Err(err).Str("cmd", "s3::Write").Msg("Failed to set the CBC key")
-		return nil, errors.Wrap(err, "Failed to set the CBC key")
-	}
-
 	// collect meta data
 	meta, err := metadataFromNewFile(newFile)
 	if err != nil {
@@ -305,32 +469,215 @@ func (s *s3storage) Write(ctx context.Context, bucketID string, newFile *object.
 		return nil, errors.Wrap(err, "Failed to collect metadata from new file")
 	}
 
+	// get the current key
+	meta.keyVersion, err = s.keys.CurrentVersion(bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Write").Msg("Failed to get the current key version")
+		return nil, errors.Wrap(err, "Failed to get the current key version")
+	}
+
+	// make sure metadata fits into user metadata before anything is uploaded
+	if err := meta.checkSize(); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Write").Msg("Metadata of the file is too large")
+		return nil, err
+	}
+
 	// upload the file
-	_, err = s.client.PutObjectWithContext(ctx, bucketID, meta.String(), r, -1, minio.PutObjectOptions{EncryptMaterials: em})
+	if err := s.put(ctx, bucketID, meta, r); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Write").Msg("Failed to put the file")
+		if err == ErrChecksumMismatch {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "Failed to put the file")
+	}
+	meta.received = time.Now().UTC()
+
+	// the version is written already, failing to account for it is only reported
+	if err := s.addUsage(ctx, bucketID, meta.size, 1); err != nil {
+		s.logger.Error().Err(err).Str("cmd", "s3::Write").Str("bucket", bucketID).Msg("Failed to update usage of the bucket")
+	}
+
+	return meta.fileDescriptor(bucketID), nil
+}
+
+// Reencrypt rewrites the file version encrypted with the current key of the bucket and migrates its metadata
+// to the current metadata format. Metadata of the file is preserved. Deduplicated contents are re-encrypted once
+// for all file versions referencing them. Returns false if file version is already encrypted with the current
+// key and stored in the current metadata format.
+func (s *s3storage) Reencrypt(ctx context.Context, bucketID, fileID, version string) (bool, error) {
+	s.logger.Debug().Str("cmd", "s3::Reencrypt").Msgf("('%s', '%s', '%s')", bucketID, fileID, version)
+
+	// find the file
+	list, err := s.list(ctx, bucketID, fmt.Sprintf("%s.%s.", fileID, version))
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Reencrypt").Msg("Failed to list files")
+		return false, errors.Wrap(err, "Failed to list files")
+	}
+	if len(list) == 0 {
+		return false, ErrNotFound
+	}
+	md := list[0]
+	objectName := md.String()
+
+	// compare key versions and formats
+	if err := s.loadHeaders(bucketID, md); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Reencrypt").Msg("Failed to stat object")
+		return false, errors.Wrap(err, "Failed to stat object")
+	}
+	currentVersion, err := s.keys.CurrentVersion(bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Reencrypt").Msg("Failed to get the current key version")
+		return false, errors.Wrap(err, "Failed to get the current key version")
+	}
+	if md.blob != "" {
+		reencrypted, err := s.reencryptBlob(ctx, bucketID, md.blob, currentVersion)
+		if err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::Reencrypt").Msg("Failed to re-encrypt blob")
+		}
+		return reencrypted, err
+	}
+	if md.keyVersion == currentVersion && md.format == MetadataFormat {
+		return false, nil
+	}
+
+	// spool the whole file; object might be overwritten under the same name so it can't be streamed
+	em, err := getCBCKey(bucketID, md.keyVersion, s.keys)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Reencrypt").Msg("Failed to set CBC key")
+		return false, errors.Wrap(err, "Failed to set CBC key")
+	}
+	r, err := s.client.GetObjectWithContext(ctx, bucketID, objectName, minio.GetObjectOptions{Materials: em})
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Reencrypt").Msg("Failed to fetch enc. object")
+		return false, errors.Wrap(err, "Failed to fetch enc. object")
+	}
+	f, err := spool.Copy("", r)
+	r.Close()
 	if err != nil {
-		s.logger.Info().Err(err).Str("cmd", "s3::Write").Msg("Failed to call PutObject")
-		return nil, errors.Wrap(err, "Failed to call PutObjectWithContext")
+		s.logger.Info().Err(err).Str("cmd", "s3::Reencrypt").Msg("Failed to read enc. object")
+		return false, errors.Wrap(err, "Failed to read enc. object")
 	}
+	defer f.Close()
 
-	// generate the file descriptor
-	fd := &models.FileDescriptor{
-		Name:        newFile.Name,
-		Version:     newFile.Version,
-		Archetype:   newFile.Archetype,
-		ContentType: newFile.ContentType,
-		Checksum:    newFile.Checksum,
-		Created:     newFile.Created,
-		Labels:      newFile.Labels,
-		Path:        fmt.Sprintf("%s/%s/%s", bucketID, meta.filename, meta.version),
-		Size:        newFile.Size,
-		Operation:   string(op),
+	// make sure the file was decrypted correctly before overwriting it
+	if md.operation == Write && f.Verify(md.checksum) != nil {
+		s.logger.Info().Str("cmd", "s3::Reencrypt").Msg("Checksum of decrypted object does not match")
+		return false, ErrChecksumMismatch
+	}
+	contents, err := f.Reader()
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Reencrypt").Msg("Failed to read spooled object")
+		return false, err
+	}
+
+	// upload the file encrypted with the current key in the current format
+	newMd := *md
+	newMd.format = MetadataFormat
+	newMd.keyVersion = currentVersion
+	newMd.size = f.Size()
+	if err := s.put(ctx, bucketID, &newMd, contents); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Reencrypt").Msg("Failed to put the file")
+		return false, errors.Wrap(err, "Failed to put the file")
+	}
+
+	// remove the object stored in the old format
+	if newMd.String() != objectName {
+		if err := s.removeObjects(bucketID, []string{objectName}); err != nil {
+			s.logger.Error().Err(err).Str("cmd", "s3::Reencrypt").Msg("Failed to delete the old object")
+			return false, errors.Wrap(err, "Failed to delete the old object")
+		}
+	}
+
+	return true, nil
+}
+
+// Repair overwrites stored contents of the file version with contents read from the reader, used to replace
+// contents that got corrupted in the storage. Contents are rewritten encrypted with the current key of the bucket
+// only if they match the checksum of the file version. Metadata of the file is preserved.
+func (s *s3storage) Repair(ctx context.Context, bucketID, fileID, version string, r io.Reader) error {
+	s.logger.Debug().Str("cmd", "s3::Repair").Msgf("('%s', '%s', '%s', reader)", bucketID, fileID, version)
+
+	// find the file
+	list, err := s.list(ctx, bucketID, fmt.Sprintf("%s.%s.", fileID, version))
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Repair").Msg("Failed to list files")
+		return errors.Wrap(err, "Failed to list files")
+	}
+	if len(list) == 0 {
+		return ErrNotFound
+	}
+	md := list[0]
+	objectName := md.String()
+	if md.operation != Write {
+		return ErrDeleted
+	}
+	if err := s.loadHeaders(bucketID, md); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Repair").Msg("Failed to stat object")
+		return errors.Wrap(err, "Failed to stat object")
+	}
+
+	// make sure the contents are the right ones before overwriting anything
+	f, err := spool.Copy("", r)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Repair").Msg("Failed to read contents")
+		return errors.Wrap(err, "Failed to read contents")
+	}
+	defer f.Close()
+	if f.Verify(md.checksum) != nil {
+		s.logger.Info().Str("cmd", "s3::Repair").Msg("Checksum of contents does not match")
+		return ErrChecksumMismatch
+	}
+	contents, err := f.Reader()
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Repair").Msg("Failed to read spooled contents")
+		return err
+	}
+
+	currentVersion, err := s.keys.CurrentVersion(bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Repair").Msg("Failed to get the current key version")
+		return errors.Wrap(err, "Failed to get the current key version")
 	}
 
-	return fd, nil
+	if md.blob != "" {
+		em, err := getCBCKey(bucketID, currentVersion, s.keys)
+		if err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::Repair").Msg("Failed to set the CBC key")
+			return errors.Wrap(err, "Failed to set the CBC key")
+		}
+		opts := minio.PutObjectOptions{EncryptMaterials: em}
+		if currentVersion != "" {
+			opts.UserMetadata = map[string]string{keyVersionMetadata: currentVersion}
+		}
+		if _, err := s.client.PutObjectWithContext(ctx, bucketID, blobKey(md.blob), contents, -1, opts); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::Repair").Msg("Failed to put blob")
+			return errors.Wrap(err, "Failed to put blob")
+		}
+		return nil
+	}
+
+	// contents stored with the file version are migrated to the current format
+	newMd := *md
+	newMd.format = MetadataFormat
+	newMd.keyVersion = currentVersion
+	newMd.size = f.Size()
+	if err := s.put(ctx, bucketID, &newMd, contents); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Repair").Msg("Failed to put the file")
+		return errors.Wrap(err, "Failed to put the file")
+	}
+	if newMd.String() != objectName {
+		if err := s.removeObjects(bucketID, []string{objectName}); err != nil {
+			s.logger.Error().Err(err).Str("cmd", "s3::Repair").Msg("Failed to delete the old object")
+			return errors.Wrap(err, "Failed to delete the old object")
+		}
+	}
+
+	return nil
 }
 
 // Delete removes files completely from storage, used only in case of conflicting files with the same ID and version
-func (s *s3storage) Delete(_ context.Context, bucketID, fileID, version string) error {
+// and to purge versions that are no longer retained. Files under legal hold are never removed.
+func (s *s3storage) Delete(ctx context.Context, bucketID, fileID, version string) error {
 	s.logger.Debug().Str("cmd", "s3::Delete").Msgf("('%s', '%s', '%s')", bucketID, fileID, version)
 
 	// Check if bucket exists first
@@ -344,6 +691,12 @@ func (s *s3storage) Delete(_ context.Context, bucketID, fileID, version string)
 		return nil
 	}
 
+	if held, err := s.Held(ctx, bucketID, fileID); err != nil {
+		return err
+	} else if held {
+		return ErrLegalHold
+	}
+
 	// Set object prefix
 	prefix := fmt.Sprintf("%s.", fileID)
 	if version != "" {
@@ -352,54 +705,149 @@ func (s *s3storage) Delete(_ context.Context, bucketID, fileID, version string)
 
 	// first objects keys will be saved to array to prevent deleting any if listing fails
 	objKeys := []string{}
+	blobs := []string{}
+	var size, versions int64
 	for info := range s.client.ListObjectsV2(bucketID, prefix, false, nil) {
 		if info.Err != nil {
 			s.logger.Error().Err(info.Err).Str("cmd", "s3::Delete").Msg("Failed to list all objects")
 			return errors.Wrap(info.Err, "Failed to list all objects")
 		}
 		objKeys = append(objKeys, info.Key)
+
+		// references to deduplicated contents are removed together with the file version
+		md, err := metadataFromKey(info.Key)
+		if err != nil {
+			continue
+		}
+		versions++
+		if md.format < 2 {
+			size += info.Size
+			continue
+		}
+		md.etag = info.ETag
+		if err := s.loadHeaders(bucketID, md); err != nil {
+			s.logger.Error().Err(err).Str("cmd", "s3::Delete").Msg("Failed to load metadata from object headers")
+			return errors.Wrap(err, "Failed to load metadata from object headers")
+		}
+		size += md.size
+		if md.blob != "" {
+			objKeys = append(objKeys, blobRefKey(md.blob, md.filename, md.version))
+			blobs = append(blobs, md.blob)
+		}
+	}
+
+	if err := s.removeObjects(bucketID, objKeys); err != nil {
+		return errors.New("Failed to delete all matching objects")
+	}
+
+	if versions > 0 {
+		if err := s.addUsage(ctx, bucketID, -size, -versions); err != nil {
+			s.logger.Error().Err(err).Str("cmd", "s3::Delete").Str("bucket", bucketID).Msg("Failed to update usage of the bucket")
+		}
 	}
 
-	// make objects channel
-	ch := make(chan string, len(objKeys))
-	for _, objKey := range objKeys {
-		ch <- objKey
+	// blobs are removed only when no other file version references them
+	for _, blob := range blobs {
+		if err := s.removeUnreferencedBlob(ctx, bucketID, blob); err != nil {
+			s.logger.Error().Err(err).Str("cmd", "s3::Delete").Msg("Failed to remove unreferenced blob")
+			return errors.Wrap(err, "Failed to remove unreferenced blob")
+		}
 	}
-	close(ch)
 
-	for removeObjErr := range s.client.RemoveObjects(bucketID, ch) {
-		err = removeObjErr.Err
-		s.logger.Error().Err(err).Str("cmd", "s3::Delete").Msg("Failed to delete the object")
+	return nil
+}
+
+// put uploads the file version. Contents of written files are stored as content addressed blobs referenced
+// by the file version so that identical contents are stored only once in the bucket.
+func (s *s3storage) put(ctx context.Context, bucketID string, md *metadata, r io.Reader) error {
+	if md.operation == Write && md.checksum != "" {
+		if err := s.putBlob(ctx, bucketID, md, md.keyVersion, r); err != nil {
+			return err
+		}
+
+		// file version holds only the metadata
+		md.blob = md.checksum
+		md.keyVersion = ""
+		r = &bytes.Buffer{}
 	}
 
+	opts, err := putObjectOptions(bucketID, md, s.keys)
 	if err != nil {
-		return errors.New("Failed to delete all matching objects")
+		return errors.Wrap(err, "Failed to set put options")
+	}
+	_, err = s.client.PutObjectWithContext(ctx, bucketID, md.String(), r, -1, opts)
+	s.headers.invalidate(bucketID, md.String())
+	if err != nil {
+		return errors.Wrap(err, "Failed to call PutObjectWithContext")
 	}
 
 	return nil
 }
 
-func objectInfoToFileDescriptor(info minio.ObjectInfo, bucketID string) (*models.FileDescriptor, error) {
-	meta, err := metadataFromKey(info.Key)
+// list returns metadata of files stored inside a bucket sorted by creation time, newest first. Only metadata
+// held in object keys is returned, the rest has to be read with loadHeaders for the versions that need it.
+func (s *s3storage) list(_ context.Context, bucketID, prefix string) ([]*metadata, error) {
+	// Check if bucket exists first
+	exists, err := s.client.BucketExists(bucketID)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to extract metadata from key")
+		s.logger.Info().Err(err).Str("cmd", "s3::List").Msg("Failed to check if bucket exists")
+		return nil, errors.Wrap(err, "Failed to check if bucket exists")
+	}
+	if !exists {
+		// Nothing to list
+		return []*metadata{}, nil
+	}
+
+	ch := make(chan struct{})
+	defer close(ch)
+	infos := s.client.ListObjectsV2(bucketID, prefix, false, ch)
+
+	list := []*metadata{}
+	for info := range infos {
+		if info.Err != nil {
+			s.logger.Info().Err(info.Err).Str("cmd", "s3::List").Msg("Failed to read object from a list")
+			return nil, errors.Wrap(info.Err, "Failed to read object from a list")
+		}
+		if strings.HasPrefix(info.Key, blobsPrefix) || strings.HasPrefix(info.Key, uploadsPrefix) || strings.HasPrefix(info.Key, holdsPrefix) || strings.HasPrefix(info.Key, usagePrefix) || strings.HasPrefix(info.Key, manifestPrefix) {
+			continue
+		}
+
+		md, err := metadataFromKey(info.Key)
+		if err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::List").Msg("Failed to extract metadata from key")
+			return nil, errors.Wrap(err, "Failed to extract metadata from key")
+		}
+
+		// size of the object in format 1 is not stored anywhere else
+		md.size = info.Size
+		md.etag = info.ETag
+		md.received = info.LastModified.UTC()
+
+		list = append(list, md)
+	}
+
+	sort.Sort(byCreated(list))
+	return list, nil
+}
+
+// loadHeaders reads the part of metadata stored in object's user metadata. User metadata of listed objects
+// is cached until the object changes.
+func (s *s3storage) loadHeaders(bucketID string, md *metadata) error {
+	objectName := md.String()
+	if headers, ok := s.headers.get(bucketID, objectName, md.etag); ok {
+		return md.setFromHeaders(headers)
 	}
 
-	// copy basic data
-	fd := &models.FileDescriptor{
-		Size:        info.Size,
-		ContentType: meta.contentType,
-		Path:        fmt.Sprintf("%s/%s/%s", bucketID, meta.filename, meta.version),
-		Name:        meta.filename,
-		Version:     meta.version,
-		Checksum:    meta.checksum,
-		Created:     strfmt.DateTime(meta.created),
-		Archetype:   meta.archetype,
-		Operation:   string(meta.operation),
-		Labels:      meta.labels,
+	info, err := s.client.StatObject(bucketID, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return err
 	}
+	if err := md.setFromHeaders(info.Metadata); err != nil {
+		return err
+	}
+	s.headers.add(bucketID, objectName, info.ETag, info.Metadata)
 
-	return fd, nil
+	return nil
 }
 
 func bucketInfoToBucketDescriptor(info minio.BucketInfo) (*models.BucketDescriptor, error) {
@@ -412,9 +860,9 @@ func bucketInfoToBucketDescriptor(info minio.BucketInfo) (*models.BucketDescript
 	return bd, nil
 }
 
-func getCBCKey(bucketID string, keys KeyProvider) (encrypt.Materials, error) {
+func getCBCKey(bucketID, keyVersion string, keys KeyProvider) (encrypt.Materials, error) {
 	// read the key
-	secret, err := keys.Get(bucketID)
+	secret, err := keys.GetVersion(bucketID, keyVersion)
 	if err != nil {
 		return nil, err
 	}
@@ -422,3 +870,27 @@ func getCBCKey(bucketID string, keys KeyProvider) (encrypt.Materials, error) {
 	// create the materials
 	return encrypt.NewCBCSecureMaterials(encrypt.NewSymmetricKey([]byte(secret)))
 }
+
+func putObjectOptions(bucketID string, md *metadata, keys KeyProvider) (minio.PutObjectOptions, error) {
+	userMetadata, err := md.userMetadata()
+	if err != nil {
+		return minio.PutObjectOptions{}, err
+	}
+	opts := minio.PutObjectOptions{UserMetadata: userMetadata}
+
+	// file versions referencing a blob have no contents to encrypt
+	if md.blob == "" {
+		opts.EncryptMaterials, err = getCBCKey(bucketID, md.keyVersion, keys)
+		if err != nil {
+			return minio.PutObjectOptions{}, err
+		}
+	}
+
+	return opts, nil
+}
+
+// checksumOf returns base64 URL encoded sha256 sum of the contents, same as used by storage service
+func checksumOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return base64.URLEncoding.EncodeToString(sum[:])
+}
@@ -3,13 +3,17 @@ package s3
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/iryonetwork/wwm/storage/s3/object"
 	"github.com/pkg/errors"
@@ -36,6 +40,7 @@ func (n noopCloser) Close() error {
 var (
 	time1, _ = strfmt.ParseDateTime("2018-01-18T15:22:46.123Z")
 	time2, _ = strfmt.ParseDateTime("2018-01-26T15:16:15.123Z")
+	time3, _ = strfmt.ParseDateTime("2018-01-20T10:00:00.123Z")
 	file1V1  = &models.FileDescriptor{
 		Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
 		Checksum:    "CHS",
@@ -98,6 +103,58 @@ var (
 		Key:  "Image.V2.d.1516979775123.CHS.aW1hZ2UvanBlZw==..",
 		Size: 0,
 	} //Fri Jan 26 16:16:26
+	file3V1 = &models.FileDescriptor{
+		Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
+		Checksum:    "CHS",
+		ContentType: "text/openEhrXml",
+		Created:     time3,
+		Name:        "File3",
+		Path:        "BUCKET/File3/V1",
+		Version:     "V1",
+		Size:        8,
+		Operation:   "w",
+		Labels:      []string{"vitalSign"},
+		Author:      "AUTHOR",
+		Source:      "SOURCE",
+	}
+	info3V1 = minio.ObjectInfo{
+		Key:  "File3.V1.w.1516442400123.2",
+		Size: 32,
+	}
+	stat3V1 = minio.ObjectInfo{
+		Metadata: metadataHeaders(metadataHeader{
+			Checksum:    "CHS",
+			ContentType: "text/openEhrXml",
+			Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
+			Labels:      []string{"vitalSign"},
+			Size:        8,
+			KeyVersion:  "KEYV1",
+			Author:      "AUTHOR",
+			Source:      "SOURCE",
+		}),
+	}
+	file3V2 = &models.FileDescriptor{
+		Checksum:    "CHS",
+		ContentType: "text/openEhrXml",
+		Created:     time2,
+		Name:        "File3",
+		Path:        "BUCKET/File3/V2",
+		Version:     "V2",
+		Size:        8,
+		Operation:   "w",
+	}
+	info3V2 = minio.ObjectInfo{
+		Key:  "File3.V2.w.1516979775123.3",
+		Size: 0,
+	}
+	stat3V2 = minio.ObjectInfo{
+		Metadata: metadataHeaders(metadataHeader{
+			Checksum:    "CHS",
+			ContentType: "text/openEhrXml",
+			Size:        8,
+			Blob:        "CHS",
+		}),
+	}
 	infoErr = minio.ObjectInfo{
 		Err: errors.New("error occurred"),
 	}
@@ -112,8 +169,21 @@ var (
 	}
 	noErrors   = false
 	withErrors = true
+
+	// checksum of "contents"
+	contentsChecksum = "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug="
 )
 
+// holdsList returns channel listing objects marking legal holds with the keys
+func holdsList(keys ...string) <-chan minio.ObjectInfo {
+	ch := make(chan minio.ObjectInfo, len(keys))
+	for _, key := range keys {
+		ch <- minio.ObjectInfo{Key: key}
+	}
+	close(ch)
+	return ch
+}
+
 func getTestStorage(t *testing.T) (*s3storage, *mock.MockMinio, *mock.MockKeyProvider, func()) {
 	// setup minio mock
 	minioCtrl := gomock.NewController(t)
@@ -138,6 +208,41 @@ func getTestStorage(t *testing.T) (*s3storage, *mock.MockMinio, *mock.MockKeyPro
 	return s, minio, keyProvider, cleanup
 }
 
+// usageCalls returns calls updating usage counters of the bucket from before to after
+func usageCalls(t *testing.T, m *mock.MockMinio, before, after usage) []*gomock.Call {
+	b, _ := json.Marshal(before)
+	return []*gomock.Call{
+		m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", usageKey, gomock.Any()).Return(ioutil.NopCloser(bytes.NewReader(b)), nil),
+		m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", usageKey, gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_ context.Context, _, _ string, r io.Reader, _ int64, _ minio.PutObjectOptions) {
+			u := usage{}
+			if err := json.NewDecoder(r).Decode(&u); err != nil || u != after {
+				t.Errorf("Expected usage to be updated to %+v, got %+v", after, u)
+			}
+		}).Return(int64(0), nil),
+	}
+}
+
+// manifestCall returns call storing the manifest of the bucket
+func manifestCall(t *testing.T, m *mock.MockMinio, expected manifest) *gomock.Call {
+	return m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", manifestKey, gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_ context.Context, _, _ string, r io.Reader, _ int64, _ minio.PutObjectOptions) {
+		stored := manifest{}
+		if err := json.NewDecoder(r).Decode(&stored); err != nil || !reflect.DeepEqual(stored, expected) {
+			t.Errorf("Expected manifest to be updated to %+v, got %+v", expected, stored)
+		}
+	}).Return(int64(0), nil)
+}
+
+// readAll consumes the reader passed to PutObjectWithContext
+func readAll(_ context.Context, _, _ string, r io.Reader, _ int64, _ minio.PutObjectOptions) {
+	_, _ = ioutil.ReadAll(r)
+}
+
+// metadataHeaders returns object headers holding metadata in the current format
+func metadataHeaders(mh metadataHeader) http.Header {
+	b, _ := json.Marshal(mh)
+	return http.Header{metadataHeaderName: []string{base64.URLEncoding.EncodeToString(b)}}
+}
+
 func TestBucketExists(t *testing.T) {
 	testCases := []struct {
 		description   string
@@ -236,6 +341,7 @@ func TestMakeBucket(t *testing.T) {
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(false, nil),
 					m.EXPECT().MakeBucket("BUCKET", "REGION").Return(nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", usageKey, gomock.Any(), gomock.Any(), gomock.Any()).Return(int64(0), nil),
 				}
 			},
 			noErrors,
@@ -301,25 +407,28 @@ func TestS3List(t *testing.T) {
 		exactError    error
 	}{
 		{
-			"valid call",
-			[]minio.ObjectInfo{info1V1, info1V2, info2V2, info2V1},
+			"valid call with file in current metadata format",
+			[]minio.ObjectInfo{info1V1, info3V1, {Key: "blobs/"}, info1V2},
 			func(i chan minio.ObjectInfo, m *mock.MockMinio) []*gomock.Call {
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
 					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX", false, gomock.Any()).Return(i),
+					m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+					m.EXPECT().StatObject("BUCKET", info3V1.Key, gomock.Any()).Return(stat3V1, nil),
 				}
 			},
-			[]*models.FileDescriptor{file1V2, file2V2, file1V1, file2V1},
+			[]*models.FileDescriptor{file1V2, file3V1, file1V1},
 			noErrors,
 			nil,
 		},
 		{
-			"file contains error",
-			[]minio.ObjectInfo{infoErr},
+			"StatObject fails for file in current metadata format",
+			[]minio.ObjectInfo{info3V1},
 			func(i chan minio.ObjectInfo, m *mock.MockMinio) []*gomock.Call {
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
 					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX", false, gomock.Any()).Return(i),
+					m.EXPECT().StatObject("BUCKET", info3V1.Key, gomock.Any()).Return(minio.ObjectInfo{}, errors.New("Error")),
 				}
 			},
 			nil,
@@ -327,8 +436,8 @@ func TestS3List(t *testing.T) {
 			nil,
 		},
 		{
-			"file has broken filename",
-			[]minio.ObjectInfo{infoBrokenFD},
+			"file contains error",
+			[]minio.ObjectInfo{infoErr},
 			func(i chan minio.ObjectInfo, m *mock.MockMinio) []*gomock.Call {
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
@@ -340,15 +449,16 @@ func TestS3List(t *testing.T) {
 			nil,
 		},
 		{
-			"bucket does not exist",
+			"file has broken filename",
 			[]minio.ObjectInfo{infoBrokenFD},
 			func(i chan minio.ObjectInfo, m *mock.MockMinio) []*gomock.Call {
 				return []*gomock.Call{
-					m.EXPECT().BucketExists("BUCKET").Return(false, nil),
+					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX", false, gomock.Any()).Return(i),
 				}
 			},
-			[]*models.FileDescriptor{},
-			noErrors,
+			nil,
+			withErrors,
 			nil,
 		},
 		{
@@ -410,6 +520,7 @@ func TestS3List(t *testing.T) {
 
 func TestS3Read(t *testing.T) {
 	expectedFileName := "File1.V2.w.1516979775123.CHS.dGV4dC9vcGVuRWhyWG1s.b3BlbkVIUi1FSFItT0JTRVJWQVRJT04uYmxvb2RfcHJlc3N1cmUudjE=.dml0YWxTaWduLGJhc2ljUGF0aWVudEluZm8="
+	statInfo := minio.ObjectInfo{Metadata: http.Header{keyVersionHeader: []string{"KEYV1"}}}
 
 	testCases := []struct {
 		description   string
@@ -422,15 +533,17 @@ func TestS3Read(t *testing.T) {
 		exactError    error
 	}{
 		{
-			"valid call without a version",
-			"",
+			"valid call for file written with legacy key",
+			"VERSION",
 			[]minio.ObjectInfo{info1V2},
 			func(i chan minio.ObjectInfo, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
 				rc := noopCloser{bytes.NewBuffer([]byte("contents"))}
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
-					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.", false, gomock.Any()).Return(i),
-					k.EXPECT().Get("BUCKET").Return("SECRET-KEY", nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.VERSION.", false, gomock.Any()).Return(i),
+					m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+					m.EXPECT().StatObject("BUCKET", expectedFileName, gomock.Any()).Return(minio.ObjectInfo{}, nil),
+					k.EXPECT().GetVersion("BUCKET", "").Return("SECRET-KEY", nil),
 					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", expectedFileName, gomock.Any()).Return(rc, nil),
 				}
 			},
@@ -440,20 +553,22 @@ func TestS3Read(t *testing.T) {
 			nil,
 		},
 		{
-			"valid call with a version",
+			"valid call for file in current metadata format",
 			"VERSION",
-			[]minio.ObjectInfo{info1V2},
+			[]minio.ObjectInfo{info3V1},
 			func(i chan minio.ObjectInfo, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
 				rc := noopCloser{bytes.NewBuffer([]byte("contents"))}
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
 					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.VERSION.", false, gomock.Any()).Return(i),
-					k.EXPECT().Get("BUCKET").Return("SECRET-KEY", nil),
-					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", expectedFileName, gomock.Any()).Return(rc, nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+					m.EXPECT().StatObject("BUCKET", info3V1.Key, gomock.Any()).Return(stat3V1, nil),
+					k.EXPECT().GetVersion("BUCKET", "KEYV1").Return("SECRET-KEY", nil),
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", info3V1.Key, gomock.Any()).Return(rc, nil),
 				}
 			},
 			[]byte("contents"),
-			file1V2,
+			file3V1,
 			noErrors,
 			nil,
 		},
@@ -473,43 +588,33 @@ func TestS3Read(t *testing.T) {
 			nil,
 		},
 		{
-			"list is empty",
-			"",
-			[]minio.ObjectInfo{},
+			"key server fails",
+			"VERSION",
+			[]minio.ObjectInfo{info1V2},
 			func(i chan minio.ObjectInfo, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
-					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.", false, gomock.Any()).Return(i),
+					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.VERSION.", false, gomock.Any()).Return(i),
+					m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+					m.EXPECT().StatObject("BUCKET", expectedFileName, gomock.Any()).Return(statInfo, nil),
+					k.EXPECT().GetVersion("BUCKET", "KEYV1").Return("", errors.New("Error")),
 				}
 			},
 			nil,
 			nil,
 			withErrors,
-			ErrNotFound,
-		},
-		{
-			"list is empty (bucket does not exist)",
-			"",
-			[]minio.ObjectInfo{},
-			func(i chan minio.ObjectInfo, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
-				return []*gomock.Call{
-					m.EXPECT().BucketExists("BUCKET").Return(false, nil),
-				}
-			},
-			nil,
 			nil,
-			withErrors,
-			ErrNotFound,
 		},
 		{
-			"key server fails",
+			"StatObject fails",
 			"VERSION",
 			[]minio.ObjectInfo{info1V2},
 			func(i chan minio.ObjectInfo, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
 					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.VERSION.", false, gomock.Any()).Return(i),
-					k.EXPECT().Get("BUCKET").Return("", errors.New("Error")),
+					m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+					m.EXPECT().StatObject("BUCKET", expectedFileName, gomock.Any()).Return(minio.ObjectInfo{}, errors.New("Error")),
 				}
 			},
 			nil,
@@ -525,7 +630,9 @@ func TestS3Read(t *testing.T) {
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
 					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.VERSION.", false, gomock.Any()).Return(i),
-					k.EXPECT().Get("BUCKET").Return("SECRET-KEY", nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+					m.EXPECT().StatObject("BUCKET", expectedFileName, gomock.Any()).Return(statInfo, nil),
+					k.EXPECT().GetVersion("BUCKET", "KEYV1").Return("SECRET-KEY", nil),
 					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", expectedFileName, gomock.Any()).Return(nil, errors.New("Error")),
 				}
 			},
@@ -586,7 +693,182 @@ func TestS3Read(t *testing.T) {
 	}
 }
 
+func TestS3ReadRange(t *testing.T) {
+	expectedFileName := "File1.V2.w.1516979775123.CHS.dGV4dC9vcGVuRWhyWG1s.b3BlbkVIUi1FSFItT0JTRVJWQVRJT04uYmxvb2RfcHJlc3N1cmUudjE=.dml0YWxTaWduLGJhc2ljUGF0aWVudEluZm8="
+	statInfo := minio.ObjectInfo{Metadata: http.Header{keyVersionHeader: []string{"KEYV1"}}}
+
+	testCases := []struct {
+		description   string
+		offset        int64
+		length        int64
+		reader        []byte
+		errorExpected bool
+		exactError    error
+	}{
+		{"range in the middle", 2, 3, []byte("nte"), noErrors, nil},
+		{"range until the end", 5, -1, []byte("nts"), noErrors, nil},
+		{"range after the end", 9, -1, nil, withErrors, ErrInvalidRange},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init storage
+			s, m, k, c := getTestStorage(t)
+			defer c()
+
+			// prepare ObjectInfos channel
+			infos := make(chan minio.ObjectInfo, 1)
+			infos <- info1V2
+			close(infos)
+
+			// setup calls
+			rc := noopCloser{bytes.NewBuffer([]byte("contents"))}
+			m.EXPECT().BucketExists("BUCKET").Return(true, nil)
+			m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.V2.", false, gomock.Any()).Return(infos)
+			m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList())
+			m.EXPECT().StatObject("BUCKET", expectedFileName, gomock.Any()).Return(statInfo, nil)
+			k.EXPECT().GetVersion("BUCKET", "KEYV1").Return("SECRET-KEY", nil)
+			m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", expectedFileName, gomock.Any()).Return(rc, nil)
+
+			// call ReadRange method
+			reader, fd, err := s.ReadRange(context.TODO(), "BUCKET", "PREFIX", "V2", test.offset, test.length)
+
+			// check expected results
+			if test.reader == nil && reader != nil {
+				t.Errorf("Expected reader to be nil")
+			} else if test.reader != nil {
+				if !reflect.DeepEqual(fd, file1V2) {
+					t.Errorf("Expected FileDescriptor to equal\n%+v\ngot\n%+v", file1V2, fd)
+				}
+				if b, err := ioutil.ReadAll(reader); !bytes.Equal(test.reader, b) {
+					t.Errorf("Expected '%s' to equal '%s'", b, test.reader)
+				} else if err != nil {
+					t.Errorf("Expected err from ioutil.ReadAll to be nil; got %v", err)
+				}
+			}
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
+
+func TestS3ListCachesHeaders(t *testing.T) {
+	s, m, _, c := getTestStorage(t)
+	defer c()
+
+	listed := func(etag string) <-chan minio.ObjectInfo {
+		info := info3V1
+		info.ETag = etag
+		ch := make(chan minio.ObjectInfo, 1)
+		ch <- info
+		close(ch)
+		return ch
+	}
+	stat := stat3V1
+	stat.ETag = "ETAG1"
+	changed := stat3V1
+	changed.ETag = "ETAG2"
+	notFound := minio.ErrorResponse{Code: "NoSuchKey"}
+
+	// headers are read again only once the object changes
+	gomock.InOrder(
+		m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+		m.EXPECT().ListObjectsV2("BUCKET", "PREFIX", false, gomock.Any()).Return(listed("ETAG1")),
+		m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", manifestKey, gomock.Any()).Return(nil, notFound),
+		m.EXPECT().StatObject("BUCKET", info3V1.Key, gomock.Any()).Return(stat, nil),
+		manifestCall(t, m, manifest{info3V1.Key: {ETag: "ETAG1", Headers: stat3V1.Metadata}}),
+		m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+		m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+		m.EXPECT().ListObjectsV2("BUCKET", "PREFIX", false, gomock.Any()).Return(listed("ETAG1")),
+		m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+		m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+		m.EXPECT().ListObjectsV2("BUCKET", "PREFIX", false, gomock.Any()).Return(listed("ETAG2")),
+		m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", manifestKey, gomock.Any()).Return(nil, notFound),
+		m.EXPECT().StatObject("BUCKET", info3V1.Key, gomock.Any()).Return(changed, nil),
+		manifestCall(t, m, manifest{info3V1.Key: {ETag: "ETAG2", Headers: stat3V1.Metadata}}),
+		m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+	)
+
+	for i := 0; i < 3; i++ {
+		list, err := s.List(context.TODO(), "BUCKET", "PREFIX")
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		if !reflect.DeepEqual(list, []*models.FileDescriptor{file3V1}) {
+			t.Errorf("Expected list to equal\n%+v\ngot\n%+v", []*models.FileDescriptor{file3V1}, list)
+		}
+	}
+}
+
+func TestS3ListReadsManifest(t *testing.T) {
+	s, m, _, c := getTestStorage(t)
+	defer c()
+
+	listed := func() <-chan minio.ObjectInfo {
+		ch := make(chan minio.ObjectInfo, 2)
+		for _, info := range []minio.ObjectInfo{info3V1, info3V2} {
+			info.ETag = "ETAG"
+			ch <- info
+		}
+		close(ch)
+		return ch
+	}
+	stat := stat3V2
+	stat.ETag = "ETAG"
+	b, _ := json.Marshal(manifest{
+		info3V1.Key:                  {ETag: "ETAG", Headers: stat3V1.Metadata},
+		"File3.V0.w.1516442400000.2": {ETag: "ETAG", Headers: stat3V1.Metadata},
+	})
+
+	// only the version missing from the manifest is stat-ed, removed versions are dropped from the manifest
+	gomock.InOrder(
+		m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+		m.EXPECT().ListObjectsV2("BUCKET", "", false, gomock.Any()).Return(listed()),
+		m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", manifestKey, gomock.Any()).Return(ioutil.NopCloser(bytes.NewReader(b)), nil),
+		m.EXPECT().StatObject("BUCKET", info3V2.Key, gomock.Any()).Return(stat, nil),
+		manifestCall(t, m, manifest{
+			info3V1.Key: {ETag: "ETAG", Headers: stat3V1.Metadata},
+			info3V2.Key: {ETag: "ETAG", Headers: stat3V2.Metadata},
+		}),
+		m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+	)
+
+	list, err := s.List(context.TODO(), "BUCKET", "")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if !reflect.DeepEqual(list, []*models.FileDescriptor{file3V2, file3V1}) {
+		t.Errorf("Expected list to equal\n%+v\ngot\n%+v", []*models.FileDescriptor{file3V2, file3V1}, list)
+	}
+}
+
 func TestS3Write(t *testing.T) {
+	newObject := &object.NewObjectInfo{
+		Name:        "File1",
+		Version:     "V1",
+		Operation:   "w",
+		Created:     time1,
+		ContentType: "text/openEhrXml",
+		Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
+		Checksum:    contentsChecksum,
+		Labels:      []string{"vitalSign", "basicPatientInfo"},
+	}
+	recordName := "File1.V1.w.1516288966123.3"
+	refName := "blobs/" + contentsChecksum + "/refs/File1.V1"
+	blobName := "blobs/" + contentsChecksum + "/data"
+	tombstoneName := "blobs/" + contentsChecksum + "/tombstone"
+	notFound := minio.ErrorResponse{Code: "NoSuchKey"}
+
 	testCases := []struct {
 		description   string
 		newObject     *object.NewObjectInfo
@@ -595,56 +877,73 @@ func TestS3Write(t *testing.T) {
 		exactError    error
 	}{
 		{
-			"valid call",
-			&object.NewObjectInfo{
-				Name:        "File1",
-				Version:     "V1",
-				Operation:   "w",
-				Created:     time1,
-				ContentType: "text/openEhrXml",
-				Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
-				Checksum:    "CHS",
-				Labels:      []string{"vitalSign", "basicPatientInfo"},
+			"contents are uploaded again once concurrent removal finishes",
+			newObject,
+			func(r io.Reader, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				return append([]*gomock.Call{
+					k.EXPECT().CurrentVersion("BUCKET").Return("KEYV1", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", refName, gomock.Any(), int64(0), gomock.Any()).Return(int64(0), nil),
+					m.EXPECT().StatObject("BUCKET", tombstoneName, gomock.Any()).Return(minio.ObjectInfo{LastModified: time.Now()}, nil),
+					m.EXPECT().StatObject("BUCKET", tombstoneName, gomock.Any()).Return(minio.ObjectInfo{}, notFound),
+					m.EXPECT().StatObject("BUCKET", blobName, gomock.Any()).Return(minio.ObjectInfo{}, notFound),
+					k.EXPECT().GetVersion("BUCKET", "KEYV1").Return("SECRET", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", blobName, gomock.Any(), int64(-1), gomock.Any()).Do(readAll).Return(int64(8), nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", recordName, gomock.Any(), int64(-1), gomock.Any()).Return(int64(0), nil),
+				}, usageCalls(t, m, usage{16, 2}, usage{16, 3})...)
+			},
+			noErrors,
+			nil,
+		},
+		{
+			"abandoned removal is ignored",
+			newObject,
+			func(r io.Reader, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				return append([]*gomock.Call{
+					k.EXPECT().CurrentVersion("BUCKET").Return("KEYV1", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", refName, gomock.Any(), int64(0), gomock.Any()).Return(int64(0), nil),
+					m.EXPECT().StatObject("BUCKET", tombstoneName, gomock.Any()).Return(minio.ObjectInfo{LastModified: time.Now().Add(-2 * blobRemovalTimeout)}, nil),
+					m.EXPECT().StatObject("BUCKET", blobName, gomock.Any()).Return(minio.ObjectInfo{}, nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", recordName, gomock.Any(), int64(-1), gomock.Any()).Return(int64(0), nil),
+				}, usageCalls(t, m, usage{16, 2}, usage{16, 3})...)
 			},
+			noErrors,
+			nil,
+		},
+		{
+			"StatObject fails",
+			newObject,
 			func(r io.Reader, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
 				return []*gomock.Call{
-					k.EXPECT().Get("BUCKET").Return("SECRET", nil),
-					m.EXPECT().PutObjectWithContext(
-						gomock.Any(),
-						"BUCKET",
-						"File1.V1.w.1516288966123.CHS.dGV4dC9vcGVuRWhyWG1s.b3BlbkVIUi1FSFItT0JTRVJWQVRJT04uYmxvb2RfcHJlc3N1cmUudjE=.dml0YWxTaWduLGJhc2ljUGF0aWVudEluZm8=",
-						r,
-						int64(-1),
-						gomock.Any(),
-					).Return(int64(8), nil),
+					k.EXPECT().CurrentVersion("BUCKET").Return("KEYV1", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", refName, gomock.Any(), int64(0), gomock.Any()).Return(int64(0), nil),
+					m.EXPECT().StatObject("BUCKET", tombstoneName, gomock.Any()).Return(minio.ObjectInfo{}, notFound),
+					m.EXPECT().StatObject("BUCKET", blobName, gomock.Any()).Return(minio.ObjectInfo{}, errors.New("Error")),
 				}
 			},
-			noErrors,
+			withErrors,
 			nil,
 		},
 		{
 			"PutObjectWithContext returns error",
-			&object.NewObjectInfo{
-				Name:        "File1",
-				Version:     "V1",
-				Operation:   "w",
-				Created:     time1,
-				ContentType: "text/openEhrXml",
-				Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
-				Checksum:    "CHS",
-				Labels:      []string{"vitalSign", "basicPatientInfo"},
+			newObject,
+			func(r io.Reader, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				return []*gomock.Call{
+					k.EXPECT().CurrentVersion("BUCKET").Return("KEYV1", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", refName, gomock.Any(), int64(0), gomock.Any()).Return(int64(0), nil),
+					m.EXPECT().StatObject("BUCKET", tombstoneName, gomock.Any()).Return(minio.ObjectInfo{}, notFound),
+					m.EXPECT().StatObject("BUCKET", blobName, gomock.Any()).Return(minio.ObjectInfo{}, nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", recordName, gomock.Any(), int64(-1), gomock.Any()).Return(int64(0), errors.New("Error")),
+				}
 			},
+			withErrors,
+			nil,
+		},
+		{
+			"key provider fails",
+			newObject,
 			func(r io.Reader, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
 				return []*gomock.Call{
-					k.EXPECT().Get("BUCKET").Return("SECRET", nil),
-					m.EXPECT().PutObjectWithContext(
-						gomock.Any(),
-						"BUCKET",
-						"File1.V1.w.1516288966123.CHS.dGV4dC9vcGVuRWhyWG1s.b3BlbkVIUi1FSFItT0JTRVJWQVRJT04uYmxvb2RfcHJlc3N1cmUudjE=.dml0YWxTaWduLGJhc2ljUGF0aWVudEluZm8=",
-						r,
-						int64(-1),
-						gomock.Any(),
-					).Return(int64(0), errors.New("Error")),
+					k.EXPECT().CurrentVersion("BUCKET").Return("", errors.New("Error")),
 				}
 			},
 			withErrors,
@@ -682,86 +981,219 @@ func TestS3Write(t *testing.T) {
 	}
 }
 
-func TestS3Delete(t *testing.T) {
+func TestS3Reencrypt(t *testing.T) {
+	fileName := "File3.V1.w.1516979775123." + contentsChecksum + ".dGV4dC9vcGVuRWhyWG1s.."
+	v2FileName := "File3.V1.w.1516979775123.2"
+	newFileName := "File3.V1.w.1516979775123.3"
+	refName := "blobs/" + contentsChecksum + "/refs/File3.V1"
+	blobName := "blobs/" + contentsChecksum + "/data"
+	tombstoneName := "blobs/" + contentsChecksum + "/tombstone"
+	info := minio.ObjectInfo{Key: fileName, Size: 32}
+	v2Info := minio.ObjectInfo{Key: v2FileName, Size: 32}
+	brokenInfo := minio.ObjectInfo{Key: "File3.V1.w.1516979775123.CHS.dGV4dC9vcGVuRWhyWG1s..", Size: 32}
+	statInfo := minio.ObjectInfo{Metadata: http.Header{keyVersionHeader: []string{"KEYV1"}}}
+	v2StatInfo := minio.ObjectInfo{
+		Metadata: metadataHeaders(metadataHeader{
+			Checksum:    contentsChecksum,
+			ContentType: "text/openEhrXml",
+			Size:        8,
+			KeyVersion:  "KEYV1",
+		}),
+	}
+	notFound := minio.ErrorResponse{Code: "NoSuchKey"}
+
 	testCases := []struct {
-		description            string
-		version                string
-		listInfos              []minio.ObjectInfo
-		listRemoveObjectErrors []minio.RemoveObjectError
-		calls                  func(chan minio.ObjectInfo, chan minio.RemoveObjectError, *mock.MockMinio) []*gomock.Call
-		errorExpected          bool
-		exactError             error
+		description   string
+		listInfos     []minio.ObjectInfo
+		calls         func(chan minio.ObjectInfo, *mock.MockMinio, *mock.MockKeyProvider) []*gomock.Call
+		reencrypted   bool
+		errorExpected bool
+		exactError    error
 	}{
 		{
-			"valid call without a version",
-			"",
-			[]minio.ObjectInfo{info1V2},
-			[]minio.RemoveObjectError{},
-			func(i chan minio.ObjectInfo, errCh chan minio.RemoveObjectError, m *mock.MockMinio) []*gomock.Call {
+			"file is reencrypted and migrated to current metadata format",
+			[]minio.ObjectInfo{info},
+			func(i chan minio.ObjectInfo, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				rc := noopCloser{bytes.NewBuffer([]byte("contents"))}
+				errCh := make(chan minio.RemoveObjectError)
+				close(errCh)
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
-					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.", false, gomock.Any()).Return(i),
+					m.EXPECT().ListObjectsV2("BUCKET", "File3.V1.", false, gomock.Any()).Return(i),
+					m.EXPECT().StatObject("BUCKET", fileName, gomock.Any()).Return(statInfo, nil),
+					k.EXPECT().CurrentVersion("BUCKET").Return("KEYV2", nil),
+					k.EXPECT().GetVersion("BUCKET", "KEYV1").Return("SECRET-KEY", nil),
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", fileName, gomock.Any()).Return(rc, nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", refName, gomock.Any(), int64(0), gomock.Any()).Return(int64(0), nil),
+					m.EXPECT().StatObject("BUCKET", tombstoneName, gomock.Any()).Return(minio.ObjectInfo{}, notFound),
+					m.EXPECT().StatObject("BUCKET", blobName, gomock.Any()).Return(minio.ObjectInfo{}, notFound),
+					k.EXPECT().GetVersion("BUCKET", "KEYV2").Return("SECRET-KEY-2", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", blobName, gomock.Any(), int64(-1), gomock.Any()).Do(readAll).Return(int64(8), nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", newFileName, gomock.Any(), int64(-1), gomock.Any()).Return(int64(0), nil),
 					m.EXPECT().RemoveObjects("BUCKET", gomock.Any()).Return(errCh),
 				}
 			},
+			true,
 			noErrors,
 			nil,
 		},
 		{
-			"valid call with a version",
-			"VERSION",
-			[]minio.ObjectInfo{info1V2},
-			[]minio.RemoveObjectError{},
-			func(i chan minio.ObjectInfo, errCh chan minio.RemoveObjectError, m *mock.MockMinio) []*gomock.Call {
+			"file in metadata format 2 is migrated",
+			[]minio.ObjectInfo{v2Info},
+			func(i chan minio.ObjectInfo, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				rc := noopCloser{bytes.NewBuffer([]byte("contents"))}
+				errCh := make(chan minio.RemoveObjectError)
+				close(errCh)
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
-					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.VERSION.", false, gomock.Any()).Return(i),
+					m.EXPECT().ListObjectsV2("BUCKET", "File3.V1.", false, gomock.Any()).Return(i),
+					m.EXPECT().StatObject("BUCKET", v2FileName, gomock.Any()).Return(v2StatInfo, nil),
+					k.EXPECT().CurrentVersion("BUCKET").Return("KEYV1", nil),
+					k.EXPECT().GetVersion("BUCKET", "KEYV1").Return("SECRET-KEY", nil),
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", v2FileName, gomock.Any()).Return(rc, nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", refName, gomock.Any(), int64(0), gomock.Any()).Return(int64(0), nil),
+					m.EXPECT().StatObject("BUCKET", tombstoneName, gomock.Any()).Return(minio.ObjectInfo{}, notFound),
+					m.EXPECT().StatObject("BUCKET", blobName, gomock.Any()).Return(minio.ObjectInfo{}, nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", newFileName, gomock.Any(), int64(-1), gomock.Any()).Return(int64(0), nil),
 					m.EXPECT().RemoveObjects("BUCKET", gomock.Any()).Return(errCh),
 				}
 			},
+			true,
 			noErrors,
 			nil,
 		},
 		{
-			"list fails",
-			"VERSION",
-			[]minio.ObjectInfo{infoErr},
-			[]minio.RemoveObjectError{},
-			func(i chan minio.ObjectInfo, errCh chan minio.RemoveObjectError, m *mock.MockMinio) []*gomock.Call {
+			"checksum mismatch",
+			[]minio.ObjectInfo{brokenInfo},
+			func(i chan minio.ObjectInfo, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				rc := noopCloser{bytes.NewBuffer([]byte("contents"))}
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
-					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.VERSION.", false, gomock.Any()).Return(i),
+					m.EXPECT().ListObjectsV2("BUCKET", "File3.V1.", false, gomock.Any()).Return(i),
+					m.EXPECT().StatObject("BUCKET", brokenInfo.Key, gomock.Any()).Return(minio.ObjectInfo{}, nil),
+					k.EXPECT().CurrentVersion("BUCKET").Return("KEYV2", nil),
+					k.EXPECT().GetVersion("BUCKET", "").Return("SECRET-KEY", nil),
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", brokenInfo.Key, gomock.Any()).Return(rc, nil),
 				}
 			},
+			false,
+			withErrors,
+			ErrChecksumMismatch,
+		},
+		{
+			"PutObjectWithContext fails",
+			[]minio.ObjectInfo{info},
+			func(i chan minio.ObjectInfo, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				rc := noopCloser{bytes.NewBuffer([]byte("contents"))}
+				return []*gomock.Call{
+					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "File3.V1.", false, gomock.Any()).Return(i),
+					m.EXPECT().StatObject("BUCKET", fileName, gomock.Any()).Return(statInfo, nil),
+					k.EXPECT().CurrentVersion("BUCKET").Return("KEYV2", nil),
+					k.EXPECT().GetVersion("BUCKET", "KEYV1").Return("SECRET-KEY", nil),
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", fileName, gomock.Any()).Return(rc, nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", refName, gomock.Any(), int64(0), gomock.Any()).Return(int64(0), errors.New("Error")),
+				}
+			},
+			false,
 			withErrors,
 			nil,
 		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init storage
+			s, m, k, c := getTestStorage(t)
+			defer c()
+
+			// prepare ObjectInfos channel
+			infos := make(chan minio.ObjectInfo, len(test.listInfos))
+			for _, info := range test.listInfos {
+				infos <- info
+			}
+			close(infos)
+
+			// setup calls
+			test.calls(infos, m, k)
+
+			// call Reencrypt method
+			reencrypted, err := s.Reencrypt(context.TODO(), "BUCKET", "File3", "V1")
+
+			if reencrypted != test.reencrypted {
+				t.Errorf("Expected reencrypted to equal %t; got %t", test.reencrypted, reencrypted)
+			}
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
+
+func TestS3Delete(t *testing.T) {
+	testCases := []struct {
+		description            string
+		version                string
+		listInfos              []minio.ObjectInfo
+		listRemoveObjectErrors []minio.RemoveObjectError
+		calls                  func(chan minio.ObjectInfo, chan minio.RemoveObjectError, *mock.MockMinio) []*gomock.Call
+		errorExpected          bool
+		exactError             error
+	}{
 		{
-			"list is empty",
+			"deduplicated file keeps contents referenced while they are removed",
 			"VERSION",
-			[]minio.ObjectInfo{},
+			[]minio.ObjectInfo{info3V2},
 			[]minio.RemoveObjectError{},
 			func(i chan minio.ObjectInfo, errCh chan minio.RemoveObjectError, m *mock.MockMinio) []*gomock.Call {
-				return []*gomock.Call{
+				noRefs := make(chan minio.ObjectInfo)
+				close(noRefs)
+				refs := make(chan minio.ObjectInfo, 1)
+				refs <- minio.ObjectInfo{Key: "blobs/CHS/refs/File1.V1"}
+				close(refs)
+				tombstoneErrCh := make(chan minio.RemoveObjectError)
+				close(tombstoneErrCh)
+				return append([]*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
 					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.VERSION.", false, gomock.Any()).Return(i),
+					m.EXPECT().StatObject("BUCKET", info3V2.Key, gomock.Any()).Return(stat3V2, nil),
 					m.EXPECT().RemoveObjects("BUCKET", gomock.Any()).Return(errCh),
-				}
+					m.EXPECT().ListObjectsV2("BUCKET", "blobs/CHS/refs/", false, gomock.Any()).Return(noRefs),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", "blobs/CHS/tombstone", gomock.Any(), int64(0), gomock.Any()).Return(int64(0), nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "blobs/CHS/refs/", false, gomock.Any()).Return(refs),
+					m.EXPECT().RemoveObjects("BUCKET", gomock.Any()).Do(func(_ string, keys <-chan string) {
+						if key := <-keys; key != "blobs/CHS/tombstone" {
+							t.Errorf("Expected only the tombstone to be removed, got %s", key)
+						}
+					}).Return(tombstoneErrCh),
+				}, usageCalls(t, m, usage{16, 2}, usage{8, 1})...)
 			},
 			noErrors,
 			nil,
 		},
 		{
-			"list is empty (bucket does not exist)",
+			"list fails",
 			"VERSION",
-			[]minio.ObjectInfo{},
+			[]minio.ObjectInfo{infoErr},
 			[]minio.RemoveObjectError{},
 			func(i chan minio.ObjectInfo, errCh chan minio.RemoveObjectError, m *mock.MockMinio) []*gomock.Call {
 				return []*gomock.Call{
-					m.EXPECT().BucketExists("BUCKET").Return(false, nil),
+					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.VERSION.", false, gomock.Any()).Return(i),
 				}
 			},
-			noErrors,
+			withErrors,
 			nil,
 		},
 		{
@@ -772,6 +1204,7 @@ func TestS3Delete(t *testing.T) {
 			func(i chan minio.ObjectInfo, errCh chan minio.RemoveObjectError, m *mock.MockMinio) []*gomock.Call {
 				return []*gomock.Call{
 					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
 					m.EXPECT().ListObjectsV2("BUCKET", "PREFIX.VERSION.", false, gomock.Any()).Return(i),
 					m.EXPECT().RemoveObjects("BUCKET", gomock.Any()).Return(errCh),
 				}
@@ -822,6 +1255,97 @@ func TestS3Delete(t *testing.T) {
 	}
 }
 
+func TestS3Usage(t *testing.T) {
+	testCases := []struct {
+		description     string
+		calls           func(*mock.MockMinio) []*gomock.Call
+		expectedSize    int64
+		expectedObjects int64
+		errorExpected   bool
+	}{
+		{
+			"usage is read from counters",
+			func(m *mock.MockMinio) []*gomock.Call {
+				return []*gomock.Call{
+					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", usageKey, gomock.Any()).Return(ioutil.NopCloser(strings.NewReader(`{"size":16,"objects":2}`)), nil),
+				}
+			},
+			16,
+			2,
+			noErrors,
+		},
+		{
+			"usage of bucket without counters is counted once",
+			func(m *mock.MockMinio) []*gomock.Call {
+				infos := make(chan minio.ObjectInfo, 3)
+				infos <- info1V1
+				infos <- minio.ObjectInfo{Key: usageKey}
+				infos <- info2V1
+				close(infos)
+				return append([]*gomock.Call{
+					m.EXPECT().BucketExists("BUCKET").Return(true, nil).Times(2),
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", usageKey, gomock.Any()).Return(ioutil.NopCloser(errReader{minio.ErrorResponse{Code: "NoSuchKey"}}), nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "", false, gomock.Any()).Return(infos),
+					m.EXPECT().ListObjectsV2("BUCKET", "holds/", true, gomock.Any()).Return(holdsList()),
+				}, m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", usageKey, gomock.Any(), gomock.Any(), gomock.Any()).Return(int64(0), nil))
+			},
+			15706,
+			2,
+			noErrors,
+		},
+		{
+			"bucket does not exist",
+			func(m *mock.MockMinio) []*gomock.Call {
+				return []*gomock.Call{
+					m.EXPECT().BucketExists("BUCKET").Return(false, nil),
+				}
+			},
+			0,
+			0,
+			noErrors,
+		},
+		{
+			"counters can't be read",
+			func(m *mock.MockMinio) []*gomock.Call {
+				return []*gomock.Call{
+					m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", usageKey, gomock.Any()).Return(nil, fmt.Errorf("Error")),
+				}
+			},
+			0,
+			0,
+			withErrors,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init storage
+			s, m, _, c := getTestStorage(t)
+			defer c()
+
+			// setup calls
+			test.calls(m)
+
+			// call Usage
+			size, objects, err := s.Usage(context.TODO(), "BUCKET")
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert usage
+			if size != test.expectedSize || objects != test.expectedObjects {
+				t.Errorf("Expected usage to equal %d bytes in %d objects, got %d bytes in %d objects", test.expectedSize, test.expectedObjects, size, objects)
+			}
+		})
+	}
+}
+
 func printJson(item interface{}) {
 	enc := json.NewEncoder(os.Stdout)
 	_ = enc.Encode(item)
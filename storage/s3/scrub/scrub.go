@@ -0,0 +1,277 @@
+/*
+Package scrub verifies integrity of files stored in S3 storage. Every stored
+version of every file is read and its checksum is recomputed and compared to
+the checksum stored in its metadata, so that contents corrupted at rest are
+found before they are needed.
+
+Versions with mismatching checksum and versions that can't be read or
+decrypted are counted in metrics and listed in the report. If repair is
+enabled, their contents are fetched again from the source storage (cloud
+storage for local deployments), verified against the checksum and written
+over the corrupted contents.
+*/
+package scrub
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/metrics"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/utils/spool"
+)
+
+// Scrubber describes public methods of the integrity scrub
+type Scrubber interface {
+	// Scrub verifies checksums of all the versions of all the files in all the buckets.
+	Scrub(ctx context.Context) (*Report, error)
+	// GetPrometheusMetricsCollection returns metrics to be registered for the component.
+	GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector
+}
+
+// Checksummer calculates checksums the same way the storage service does
+type Checksummer interface {
+	Checksum(r io.Reader) (string, error)
+}
+
+// Fetcher downloads file versions from the source storage to repair corrupted contents
+type Fetcher interface {
+	FetchSourceFile(ctx context.Context, bucketID, fileID, version string, f *spool.File) error
+}
+
+// Cfg holds configuration of the scrub
+type Cfg struct {
+	// BucketsToSkip lists IDs of buckets that are not verified
+	BucketsToSkip []string
+	// Repair enables repairing of corrupted contents from the source storage
+	Repair bool
+}
+
+// Report summarizes results of the scrub
+type Report struct {
+	Started  strfmt.DateTime `json:"started"`
+	Finished strfmt.DateTime `json:"finished"`
+	// Verified is the number of file versions that were read and checked
+	Verified int `json:"verified"`
+	// Failures lists all the file versions that failed the verification
+	Failures []*Failure `json:"failures"`
+}
+
+// Failure describes the file version that failed the verification
+type Failure struct {
+	Bucket   string `json:"bucket"`
+	File     string `json:"file"`
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"`
+	// Result is either checksum mismatch or unreadable
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+	// Repaired is set if the contents were successfully repaired
+	Repaired    bool   `json:"repaired"`
+	RepairError string `json:"repairError,omitempty"`
+}
+
+type scrubber struct {
+	storage           s3.Storage
+	checksummer       Checksummer
+	fetcher           Fetcher
+	bucketsToSkip     map[string]bool
+	repair            bool
+	logger            zerolog.Logger
+	metricsCollection map[metrics.ID]prometheus.Collector
+}
+
+const (
+	versionsScrubbed metrics.ID = "versionsScrubbed"
+	versionsRepaired metrics.ID = "versionsRepaired"
+
+	resultOK       string = "ok"
+	resultMismatch string = "mismatch"
+	resultUnread   string = "unreadable"
+	resultRepaired string = "repaired"
+	resultFailed   string = "failed"
+)
+
+// now is used to mock current time in tests
+var now = time.Now
+
+// Scrub verifies checksums of all the versions of all the files in all the buckets.
+func (s *scrubber) Scrub(ctx context.Context) (*Report, error) {
+	report := &Report{Started: strfmt.DateTime(now()), Failures: []*Failure{}}
+
+	buckets, err := s.storage.ListBuckets(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to list buckets")
+		return nil, errors.Wrap(err, "failed to list buckets")
+	}
+
+	var errCount int
+	for _, b := range buckets {
+		if s.bucketsToSkip[b.Name] {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			s.logger.Error().Msg("aborting scrub due to context cancellation")
+			return nil, errors.Wrap(ctx.Err(), "aborting scrub due to context cancellation")
+		default:
+			err := s.scrubBucket(ctx, b.Name, report)
+			if err != nil {
+				s.logger.Error().Err(err).Str("bucket", b.Name).Msg("failed to scrub")
+				errCount++
+			}
+		}
+	}
+	report.Finished = strfmt.DateTime(now())
+
+	if errCount > 0 {
+		s.logger.Error().Msgf("%d failure(s) out of %d bucket(s) to scrub", errCount, len(buckets))
+		return report, errors.Errorf("%d failure(s) out of %d bucket(s) to scrub", errCount, len(buckets))
+	}
+
+	return report, nil
+}
+
+func (s *scrubber) scrubBucket(ctx context.Context, bucketID string, report *Report) error {
+	versions, err := s.storage.List(ctx, bucketID, "")
+	if err != nil {
+		return errors.Wrap(err, "failed to list files")
+	}
+
+	for _, fd := range versions {
+		// delete markers have no contents
+		if s3.Operation(fd.Operation) != s3.Write {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		result, err := s.verify(ctx, bucketID, fd)
+		s.metricsCollection[versionsScrubbed].(*prometheus.CounterVec).WithLabelValues(result).Inc()
+		report.Verified++
+		if result == resultOK {
+			continue
+		}
+
+		logger := s.logger.With().Str("bucket", bucketID).Str("file", fd.Name).Str("version", fd.Version).Logger()
+		logger.Error().Err(err).Str("result", result).Msg("file version failed verification")
+		f := &Failure{Bucket: bucketID, File: fd.Name, Version: fd.Version, Checksum: fd.Checksum, Result: result}
+		if err != nil {
+			f.Error = err.Error()
+		}
+		if s.repair {
+			if err := s.repairVersion(ctx, bucketID, fd); err != nil {
+				logger.Error().Err(err).Msg("failed to repair file version")
+				f.RepairError = err.Error()
+				s.metricsCollection[versionsRepaired].(*prometheus.CounterVec).WithLabelValues(resultFailed).Inc()
+			} else {
+				logger.Info().Msg("file version repaired")
+				f.Repaired = true
+				s.metricsCollection[versionsRepaired].(*prometheus.CounterVec).WithLabelValues(resultRepaired).Inc()
+			}
+		}
+		report.Failures = append(report.Failures, f)
+	}
+
+	return nil
+}
+
+// verify reads the file version and compares checksum of its contents to the stored one
+func (s *scrubber) verify(ctx context.Context, bucketID string, fd *models.FileDescriptor) (string, error) {
+	r, _, err := s.storage.Read(ctx, bucketID, fd.Name, fd.Version)
+	if err != nil {
+		return resultUnread, err
+	}
+	defer r.Close()
+
+	checksum, err := s.checksummer.Checksum(r)
+	if err != nil {
+		return resultUnread, err
+	}
+	if checksum != fd.Checksum {
+		return resultMismatch, s3.ErrChecksumMismatch
+	}
+
+	return resultOK, nil
+}
+
+// repairVersion fetches contents of the file version from the source storage and writes them over the stored ones
+func (s *scrubber) repairVersion(ctx context.Context, bucketID string, fd *models.FileDescriptor) error {
+	f, err := spool.New("")
+	if err != nil {
+		return errors.Wrap(err, "failed to create spool file")
+	}
+	defer f.Close()
+
+	if err := s.fetcher.FetchSourceFile(ctx, bucketID, fd.Name, fd.Version, f); err != nil {
+		return errors.Wrap(err, "failed to fetch file from source storage")
+	}
+	// source storage might hold conflicting contents under the same version
+	if err := f.Verify(fd.Checksum); err != nil {
+		return err
+	}
+
+	contents, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	if err := s.storage.Repair(ctx, bucketID, fd.Name, fd.Version, contents); err != nil {
+		return errors.Wrap(err, "failed to write repaired contents")
+	}
+
+	// make sure the repair helped
+	if result, err := s.verify(ctx, bucketID, fd); result != resultOK {
+		return errors.Wrap(err, "repaired contents failed verification")
+	}
+
+	return nil
+}
+
+// GetPrometheusMetricsCollection returns all prometheus metrics collectors to be registered
+func (s *scrubber) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
+	return s.metricsCollection
+}
+
+// New returns a new instance of the scrub; fetcher is used only if repair is enabled
+func New(storage s3.Storage, checksummer Checksummer, fetcher Fetcher, cfg Cfg, logger zerolog.Logger) Scrubber {
+	logger = logger.With().Str("component", "storage/s3/scrub").Logger()
+
+	bucketsToSkip := make(map[string]bool)
+	for _, b := range cfg.BucketsToSkip {
+		bucketsToSkip[b] = true
+	}
+
+	metricsCollection := make(map[metrics.ID]prometheus.Collector)
+	metricsCollection[versionsScrubbed] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "storage_scrub",
+		Name:      "file_versions",
+		Help:      "Number of verified file versions by result",
+	}, []string{"result"})
+	metricsCollection[versionsRepaired] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "storage_scrub",
+		Name:      "repairs",
+		Help:      "Number of attempted repairs of file versions by result",
+	}, []string{"result"})
+
+	return &scrubber{
+		storage:           storage,
+		checksummer:       checksummer,
+		fetcher:           fetcher,
+		bucketsToSkip:     bucketsToSkip,
+		repair:            cfg.Repair && fetcher != nil,
+		logger:            logger,
+		metricsCollection: metricsCollection,
+	}
+}
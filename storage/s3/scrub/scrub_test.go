@@ -0,0 +1,199 @@
+package scrub
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/service/storage"
+	"github.com/iryonetwork/wwm/storage/s3/mock"
+	syncMock "github.com/iryonetwork/wwm/sync/storage/mock"
+	"github.com/iryonetwork/wwm/utils/spool"
+)
+
+var (
+	time1, _ = strfmt.ParseDateTime("2018-01-18T15:22:46.123Z")
+	time2, _ = strfmt.ParseDateTime("2018-03-18T15:22:46.123Z")
+	bucket1  = &models.BucketDescriptor{Name: "Bucket1", Created: time1}
+	bucket2  = &models.BucketDescriptor{Name: "Bucket2", Created: time1}
+	// checksum of "contents"
+	checksum = "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug="
+	file1V1  = &models.FileDescriptor{Name: "File1", Version: "V1", Operation: "w", Created: time1, Checksum: checksum}
+	file1V2  = &models.FileDescriptor{Name: "File1", Version: "V2", Operation: "d", Created: time2}
+	file2V1  = &models.FileDescriptor{Name: "File2", Version: "V1", Operation: "w", Created: time1, Checksum: checksum}
+
+	noErrors   = false
+	withErrors = true
+)
+
+func TestScrub(t *testing.T) {
+	testCases := []struct {
+		description      string
+		cfg              Cfg
+		calls            func(*mock.MockStorage, *syncMock.MockHandlers) []*gomock.Call
+		expectedVerified int
+		expectedFailures []*Failure
+		errorExpected    bool
+	}{
+		{
+			"all versions are valid",
+			Cfg{},
+			func(s *mock.MockStorage, h *syncMock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V2, file1V1, file2V1}, nil),
+					s.EXPECT().Read(gomock.Any(), "Bucket1", "File1", "V1").Return(contents("contents"), file1V1, nil),
+					s.EXPECT().Read(gomock.Any(), "Bucket1", "File2", "V1").Return(contents("contents"), file2V1, nil),
+				}
+			},
+			2,
+			[]*Failure{},
+			noErrors,
+		},
+		{
+			"corrupted and unreadable versions are reported",
+			Cfg{},
+			func(s *mock.MockStorage, h *syncMock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V1, file2V1}, nil),
+					s.EXPECT().Read(gomock.Any(), "Bucket1", "File1", "V1").Return(contents("corrupted"), file1V1, nil),
+					s.EXPECT().Read(gomock.Any(), "Bucket1", "File2", "V1").Return(nil, nil, errors.New("error")),
+				}
+			},
+			2,
+			[]*Failure{
+				{Bucket: "Bucket1", File: "File1", Version: "V1", Checksum: checksum, Result: resultMismatch},
+				{Bucket: "Bucket1", File: "File2", Version: "V1", Checksum: checksum, Result: resultUnread},
+			},
+			noErrors,
+		},
+		{
+			"corrupted version is repaired",
+			Cfg{Repair: true},
+			func(s *mock.MockStorage, h *syncMock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V1}, nil),
+					s.EXPECT().Read(gomock.Any(), "Bucket1", "File1", "V1").Return(contents("corrupted"), file1V1, nil),
+					h.EXPECT().FetchSourceFile(gomock.Any(), "Bucket1", "File1", "V1", gomock.Any()).DoAndReturn(fetch("contents")),
+					s.EXPECT().Repair(gomock.Any(), "Bucket1", "File1", "V1", gomock.Any()).DoAndReturn(
+						func(_ context.Context, _, _, _ string, r io.Reader) error {
+							if b, _ := ioutil.ReadAll(r); string(b) != "contents" {
+								t.Errorf("Expected repair with 'contents', got '%s'", b)
+							}
+							return nil
+						}),
+					s.EXPECT().Read(gomock.Any(), "Bucket1", "File1", "V1").Return(contents("contents"), file1V1, nil),
+				}
+			},
+			1,
+			[]*Failure{
+				{Bucket: "Bucket1", File: "File1", Version: "V1", Checksum: checksum, Result: resultMismatch, Repaired: true},
+			},
+			noErrors,
+		},
+		{
+			"conflicting contents in source storage are not used for repair",
+			Cfg{Repair: true},
+			func(s *mock.MockStorage, h *syncMock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return([]*models.FileDescriptor{file1V1}, nil),
+					s.EXPECT().Read(gomock.Any(), "Bucket1", "File1", "V1").Return(nil, nil, errors.New("error")),
+					h.EXPECT().FetchSourceFile(gomock.Any(), "Bucket1", "File1", "V1", gomock.Any()).DoAndReturn(fetch("other contents")),
+				}
+			},
+			1,
+			[]*Failure{
+				{Bucket: "Bucket1", File: "File1", Version: "V1", Checksum: checksum, Result: resultUnread, RepairError: "Checksum mismatch"},
+			},
+			noErrors,
+		},
+		{
+			"skipped bucket and failed bucket",
+			Cfg{BucketsToSkip: []string{"Bucket2"}},
+			func(s *mock.MockStorage, h *syncMock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1, bucket2}, nil),
+					s.EXPECT().List(gomock.Any(), "Bucket1", "").Return(nil, errors.New("error")),
+				}
+			},
+			0,
+			[]*Failure{},
+			withErrors,
+		},
+		{
+			"failed to list buckets",
+			Cfg{},
+			func(s *mock.MockStorage, h *syncMock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().ListBuckets(gomock.Any()).Return(nil, errors.New("error")),
+				}
+			},
+			0,
+			nil,
+			withErrors,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			s := mock.NewMockStorage(ctrl)
+			h := syncMock.NewMockHandlers(ctrl)
+			logger := zerolog.New(os.Stdout)
+
+			gomock.InOrder(test.calls(s, h)...)
+
+			report, err := New(s, storage.New(nil, nil, nil, 0, storage.Quotas{}, nil, logger), h, test.cfg, logger).Scrub(context.Background())
+
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+			if report == nil {
+				if test.expectedFailures != nil {
+					t.Error("Expected report, got nil")
+				}
+				return
+			}
+			if report.Verified != test.expectedVerified {
+				t.Errorf("Expected %d verified versions, got %d", test.expectedVerified, report.Verified)
+			}
+			for _, f := range report.Failures {
+				f.Error = ""
+				if i := strings.Index(f.RepairError, ":"); i >= 0 {
+					f.RepairError = f.RepairError[:i]
+				}
+			}
+			if !reflect.DeepEqual(report.Failures, test.expectedFailures) {
+				t.Errorf("Expected failures %+v, got %+v", test.expectedFailures, report.Failures)
+			}
+		})
+	}
+}
+
+func contents(s string) io.ReadCloser {
+	return ioutil.NopCloser(strings.NewReader(s))
+}
+
+// fetch returns implementation of FetchSourceFile fetching the contents
+func fetch(s string) func(context.Context, string, string, string, *spool.File) error {
+	return func(_ context.Context, _, _, _ string, f *spool.File) error {
+		_, err := io.Copy(f, strings.NewReader(s))
+		return err
+	}
+}
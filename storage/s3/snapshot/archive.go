@@ -0,0 +1,158 @@
+package snapshot
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"hash"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/utils/spool"
+)
+
+// magic identifies the archive format and its version
+const magic = "WWMSNAP1"
+
+const (
+	ivSize  = aes.BlockSize
+	macSize = sha256.Size
+)
+
+// ErrInvalidSignature is returned when the archive was not signed with the snapshot key or was altered
+var ErrInvalidSignature = errors.New("Invalid snapshot archive signature")
+
+// ErrInvalidKey is returned when the snapshot key is too short
+var ErrInvalidKey = errors.New("Snapshot key has to be at least 32 bytes long")
+
+// deriveKeys derives separate encryption and signing keys from the snapshot key
+func deriveKeys(key []byte) (encryption, signing []byte) {
+	derive := func(purpose string) []byte {
+		m := hmac.New(sha256.New, key)
+		m.Write([]byte(purpose))
+		return m.Sum(nil)
+	}
+
+	return derive("encryption"), derive("signing")
+}
+
+// sealer encrypts everything written with AES-256 in CTR mode and signs the encrypted
+// stream with HMAC-SHA256; the signature is appended on Close
+type sealer struct {
+	w      io.Writer
+	stream cipher.StreamWriter
+	mac    hash.Hash
+}
+
+func newSealer(w io.Writer, key []byte) (*sealer, error) {
+	encryption, signing := deriveKeys(key)
+	block, err := aes.NewCipher(encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, ivSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, errors.Wrap(err, "failed to generate IV")
+	}
+
+	mac := hmac.New(sha256.New, signing)
+	header := append([]byte(magic), iv...)
+	mac.Write(header)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &sealer{
+		w:      w,
+		stream: cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: io.MultiWriter(w, mac)},
+		mac:    mac,
+	}, nil
+}
+
+func (s *sealer) Write(p []byte) (int, error) {
+	return s.stream.Write(p)
+}
+
+// Close writes the signature; it does not close the underlying writer
+func (s *sealer) Close() error {
+	_, err := s.w.Write(s.mac.Sum(nil))
+	return err
+}
+
+// open verifies the signature of the whole archive and returns reader of decrypted contents which has to be
+// closed. Archive is read only once into a spool file which is then verified and decrypted, so that the archive
+// can't be changed after it was verified.
+func open(r io.Reader, key []byte) (_ io.ReadCloser, err error) {
+	encryption, signing := deriveKeys(key)
+	block, err := aes.NewCipher(encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := spool.Copy("", r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read archive")
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	size := f.Size()
+	if size < int64(len(magic)+ivSize+macSize) {
+		return nil, ErrInvalidSignature
+	}
+
+	// verify the signature before anything is decrypted
+	spooled, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, signing)
+	if _, err := io.CopyN(mac, spooled, size-macSize); err != nil {
+		return nil, errors.Wrap(err, "failed to read archive")
+	}
+	signature := make([]byte, macSize)
+	if _, err := io.ReadFull(spooled, signature); err != nil {
+		return nil, errors.Wrap(err, "failed to read archive signature")
+	}
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidSignature
+	}
+
+	// read header
+	spooled, err = f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(magic)+ivSize)
+	if _, err := io.ReadFull(spooled, header); err != nil {
+		return nil, errors.Wrap(err, "failed to read archive header")
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, errors.New("Unsupported snapshot archive format")
+	}
+	iv := header[len(magic):]
+
+	return &opened{
+		Reader: cipher.StreamReader{
+			S: cipher.NewCTR(block, iv),
+			R: io.LimitReader(spooled, size-macSize-int64(len(header))),
+		},
+		spool: f,
+	}, nil
+}
+
+// opened reads decrypted contents of the spooled archive, Close removes the spool file
+type opened struct {
+	io.Reader
+	spool *spool.File
+}
+
+func (o *opened) Close() error {
+	return o.spool.Close()
+}
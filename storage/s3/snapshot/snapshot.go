@@ -0,0 +1,272 @@
+/*
+Package snapshot exports buckets from S3 storage into archives and imports them
+back, so that a bucket can be moved between deployments without live sync, e.g.
+on a USB drive to a clinic with no connectivity.
+
+Archive is a tar stream encrypted with AES-256 in CTR mode and signed with
+HMAC-SHA256, both with keys derived from the snapshot key shared between the
+deployments. It starts with the manifest listing descriptors of all versions
+of all files of the bucket including delete markers ordered by the time of
+their creation, followed by contents of the written versions in the same order.
+
+Import reads the archive once into a temporary spool file and verifies the
+signature of the whole archive before anything is decrypted. Versions are then
+replayed in order with sync semantics of the storage service, so versions,
+checksums and creation times are preserved. Versions already present in the
+target storage are skipped, import of the same archive can therefore be safely
+repeated. Storage sync event is published for every imported or skipped version
+so that the versions are synced further. Legal holds are not carried over.
+*/
+package snapshot
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// Snapshots describes public methods of snapshot export and import
+type Snapshots interface {
+	// Export writes archive of the bucket into the writer.
+	Export(ctx context.Context, bucketID string, w io.Writer) (*Manifest, error)
+	// Import replays the archive read from the reader into the target storage publishing storage sync events
+	// of the imported versions.
+	Import(ctx context.Context, r io.Reader, target Syncer, publisher storageSync.Publisher) (*Manifest, error)
+}
+
+// Syncer lists methods of the storage service used to replay the archive
+type Syncer interface {
+	SyncFile(ctx context.Context, bucketID, fileID, version string, r io.Reader, checksum, contentType string, created strfmt.DateTime, archetype string, labels, parents []string, source string) (*models.FileDescriptor, error)
+	SyncFileDelete(ctx context.Context, bucketID, fileID, version string, created strfmt.DateTime, parents []string, source string) error
+}
+
+// Manifest describes contents of the archive
+type Manifest struct {
+	// Bucket is the exported bucket
+	Bucket *models.BucketDescriptor `json:"bucket"`
+	// Exported is the time of the export
+	Exported strfmt.DateTime `json:"exported"`
+	// Files lists all the versions of all the files in the bucket ordered by the time of creation
+	Files []*models.FileDescriptor `json:"files"`
+}
+
+type snapshots struct {
+	storage s3.Storage
+	key     []byte
+	logger  zerolog.Logger
+}
+
+const manifestName = "manifest.json"
+
+// now is used to mock current time in tests
+var now = time.Now
+
+// Export writes archive of the bucket into the writer.
+func (s *snapshots) Export(ctx context.Context, bucketID string, w io.Writer) (*Manifest, error) {
+	logger := s.logger.With().Str("method", "Export").Str("bucket", bucketID).Logger()
+
+	buckets, err := s.storage.ListBuckets(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to list buckets")
+		return nil, errors.Wrap(err, "failed to list buckets")
+	}
+	m := &Manifest{Exported: strfmt.DateTime(now().UTC())}
+	for _, b := range buckets {
+		if b.Name == bucketID {
+			m.Bucket = b
+		}
+	}
+	if m.Bucket == nil {
+		return nil, s3.ErrNotFound
+	}
+
+	m.Files, err = s.storage.List(ctx, bucketID, "")
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to list files")
+		return nil, errors.Wrap(err, "failed to list files")
+	}
+	sort.SliceStable(m.Files, func(i, j int) bool {
+		ti, tj := time.Time(m.Files[i].Created), time.Time(m.Files[j].Created)
+		if ti.Equal(tj) {
+			return m.Files[i].Name < m.Files[j].Name
+		}
+		return ti.Before(tj)
+	})
+
+	sw, err := newSealer(w, s.key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize archive encryption")
+	}
+	tw := tar.NewWriter(sw)
+
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal manifest")
+	}
+	err = tw.WriteHeader(&tar.Header{Name: manifestName, Mode: 0600, Size: int64(len(manifest)), ModTime: time.Time(m.Exported)})
+	if err == nil {
+		_, err = tw.Write(manifest)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write manifest")
+	}
+
+	for _, fd := range m.Files {
+		if s3.Operation(fd.Operation) != s3.Write {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Error().Msg("aborting export due to context cancellation")
+			return nil, errors.Wrap(ctx.Err(), "aborting export due to context cancellation")
+		default:
+		}
+
+		if err := s.exportFile(ctx, tw, bucketID, fd); err != nil {
+			logger.Error().Err(err).Str("file", fd.Name).Str("version", fd.Version).Msg("failed to export file")
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to finish archive")
+	}
+	if err := sw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to sign archive")
+	}
+
+	logger.Info().Int("versions", len(m.Files)).Msg("bucket exported")
+	return m, nil
+}
+
+func (s *snapshots) exportFile(ctx context.Context, tw *tar.Writer, bucketID string, fd *models.FileDescriptor) error {
+	r, _, err := s.storage.Read(ctx, bucketID, fd.Name, fd.Version)
+	if err != nil {
+		return errors.Wrap(err, "failed to read file")
+	}
+	defer r.Close()
+
+	err = tw.WriteHeader(&tar.Header{Name: contentsName(fd), Mode: 0600, Size: fd.Size, ModTime: time.Time(fd.Created)})
+	if err != nil {
+		return errors.Wrap(err, "failed to write header")
+	}
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return errors.Wrap(err, "failed to write contents")
+	}
+	if n != fd.Size {
+		return errors.Errorf("contents are %d bytes long, expected %d", n, fd.Size)
+	}
+
+	return nil
+}
+
+// Import replays the archive read from the reader into the target storage publishing storage sync events
+// of the imported versions.
+func (s *snapshots) Import(ctx context.Context, r io.Reader, target Syncer, publisher storageSync.Publisher) (*Manifest, error) {
+	logger := s.logger.With().Str("method", "Import").Logger()
+
+	contents, err := open(r, s.key)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to open archive")
+		return nil, err
+	}
+	defer contents.Close()
+	tr := tar.NewReader(contents)
+
+	h, err := tr.Next()
+	if err != nil || h.Name != manifestName {
+		return nil, errors.New("Archive does not start with manifest")
+	}
+	m := &Manifest{}
+	if err := json.NewDecoder(tr).Decode(m); err != nil {
+		return nil, errors.Wrap(err, "failed to decode manifest")
+	}
+	if m.Bucket == nil || m.Bucket.Name == "" {
+		return nil, errors.New("Manifest does not name the bucket")
+	}
+	logger = logger.With().Str("bucket", m.Bucket.Name).Logger()
+
+	var imported, skipped int
+	for _, fd := range m.Files {
+		select {
+		case <-ctx.Done():
+			logger.Error().Msg("aborting import due to context cancellation")
+			return nil, errors.Wrap(ctx.Err(), "aborting import due to context cancellation")
+		default:
+		}
+
+		switch s3.Operation(fd.Operation) {
+		case s3.Write:
+			h, err := tr.Next()
+			if err != nil || h.Name != contentsName(fd) {
+				return nil, errors.Errorf("Archive is missing contents of %s", contentsName(fd))
+			}
+			_, err = target.SyncFile(ctx, m.Bucket.Name, fd.Name, fd.Version, tr, fd.Checksum, fd.ContentType, fd.Created, fd.Archetype, fd.Labels, fd.Parents, fd.Source)
+			switch {
+			case err == s3.ErrAlreadyExists:
+				skipped++
+			case err != nil:
+				logger.Error().Err(err).Str("file", fd.Name).Str("version", fd.Version).Msg("failed to import file")
+				return nil, errors.Wrapf(err, "failed to import %s", contentsName(fd))
+			default:
+				imported++
+			}
+		case s3.Delete:
+			err := target.SyncFileDelete(ctx, m.Bucket.Name, fd.Name, fd.Version, fd.Created, fd.Parents, fd.Source)
+			if err != nil {
+				logger.Error().Err(err).Str("file", fd.Name).Str("version", fd.Version).Msg("failed to import file delete")
+				return nil, errors.Wrapf(err, "failed to import delete of %s", contentsName(fd))
+			}
+			imported++
+		default:
+			return nil, errors.Errorf("Unknown operation %s of %s", fd.Operation, contentsName(fd))
+		}
+
+		// events are published for skipped versions as well so that repeated import publishes events lost
+		// by the previous one
+		typ := storageSync.FileNew
+		if s3.Operation(fd.Operation) == s3.Delete {
+			typ = storageSync.FileDelete
+		}
+		info := &storageSync.FileInfo{BucketID: m.Bucket.Name, FileID: fd.Name, Version: fd.Version, Created: fd.Created}
+		if err := publisher.Publish(ctx, typ, info); err != nil {
+			logger.Error().Err(err).Str("file", fd.Name).Str("version", fd.Version).Msg("failed to publish storage sync event")
+			return nil, errors.Wrapf(err, "failed to publish storage sync event of %s", contentsName(fd))
+		}
+	}
+
+	logger.Info().Int("imported", imported).Int("skipped", skipped).Msg("bucket imported")
+	return m, nil
+}
+
+// contentsName returns the name of the archive entry holding the contents of the file version
+func contentsName(fd *models.FileDescriptor) string {
+	return fmt.Sprintf("files/%s/%s", fd.Name, fd.Version)
+}
+
+// New returns a new instance of snapshots exporting buckets from the storage; key is used to derive keys encrypting and signing the archives
+func New(storage s3.Storage, key []byte, logger zerolog.Logger) (Snapshots, error) {
+	if len(key) < 32 {
+		return nil, ErrInvalidKey
+	}
+
+	return &snapshots{
+		storage: storage,
+		key:     key,
+		logger:  logger.With().Str("component", "storage/s3/snapshot").Logger(),
+	}, nil
+}
@@ -0,0 +1,179 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/golang/mock/gomock"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/service/storage"
+	"github.com/iryonetwork/wwm/storage/s3"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	syncMock "github.com/iryonetwork/wwm/sync/storage/mock"
+	"github.com/iryonetwork/wwm/utils/keyProvider"
+)
+
+var (
+	time1, _ = strfmt.ParseDateTime("2018-01-18T15:22:46.123Z")
+	time2, _ = strfmt.ParseDateTime("2018-03-18T15:22:46.123Z")
+	time3, _ = strfmt.ParseDateTime("2018-05-18T15:22:46.123Z")
+	key      = []byte("snapshotKeySnapshotKeySnapshotKe")
+	logger   = zerolog.New(ioutil.Discard)
+)
+
+func TestSnapshot(t *testing.T) {
+	root, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %v", err)
+	}
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+
+	// mock current time
+	now = func() time.Time { return time.Time(time3) }
+
+	// populate source storage
+	src, srcService := newStorage(t, root, "src")
+	calls := []func() error{
+		func() error { return syncFile(srcService, "File1", "V1", "contents 1", time1) },
+		func() error { return syncFile(srcService, "File2", "V1", "contents 2", time1) },
+		func() error { return syncFile(srcService, "File1", "V2", "", time2) },
+		func() error { return srcService.SyncFileDelete(ctx, "Bucket1", "File2", "V2", time3, nil, "") },
+	}
+	for _, call := range calls {
+		if err := call(); err != nil {
+			t.Fatalf("Failed to populate storage, %v", err)
+		}
+	}
+
+	snapshots, err := New(src, key, logger)
+	if err != nil {
+		t.Fatalf("Failed to initialize snapshots, %v", err)
+	}
+	archive := &bytes.Buffer{}
+	m, err := snapshots.Export(ctx, "Bucket1", archive)
+	if err != nil {
+		t.Fatalf("Failed to export bucket, %v", err)
+	}
+	if len(m.Files) != 4 || m.Bucket.Name != "Bucket1" {
+		t.Fatalf("Expected manifest of Bucket1 with 4 versions, got %+v", m)
+	}
+	if bytes.Contains(archive.Bytes(), []byte("contents 1")) {
+		t.Error("Expected archive to be encrypted")
+	}
+
+	t.Run("import replays all versions", func(t *testing.T) {
+		dst, dstService := newStorage(t, root, "dst")
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		publisher := syncMock.NewMockPublisher(ctrl)
+
+		// importing twice is harmless and publishes events again
+		for i := 0; i < 2; i++ {
+			gomock.InOrder(
+				publisher.EXPECT().Publish(gomock.Any(), storageSync.FileNew, &storageSync.FileInfo{BucketID: "Bucket1", FileID: "File1", Version: "V1", Created: time1}).Return(nil),
+				publisher.EXPECT().Publish(gomock.Any(), storageSync.FileNew, &storageSync.FileInfo{BucketID: "Bucket1", FileID: "File2", Version: "V1", Created: time1}).Return(nil),
+				publisher.EXPECT().Publish(gomock.Any(), storageSync.FileNew, &storageSync.FileInfo{BucketID: "Bucket1", FileID: "File1", Version: "V2", Created: time2}).Return(nil),
+				publisher.EXPECT().Publish(gomock.Any(), storageSync.FileDelete, &storageSync.FileInfo{BucketID: "Bucket1", FileID: "File2", Version: "V2", Created: time3}).Return(nil),
+			)
+			if _, err := snapshots.Import(ctx, bytes.NewReader(archive.Bytes()), dstService, publisher); err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+		}
+
+		expected := list(t, src)
+		if got := list(t, dst); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected imported versions\n%+v\ngot\n%+v", expected, got)
+		}
+		r, _, err := dst.Read(ctx, "Bucket1", "File1", "V1")
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		defer r.Close()
+		if b, _ := ioutil.ReadAll(r); string(b) != "contents 1" {
+			t.Errorf("Expected contents 'contents 1', got '%s'", b)
+		}
+	})
+
+	t.Run("archive signed with another key", func(t *testing.T) {
+		_, dstService := newStorage(t, root, "other")
+		other, _ := New(src, bytes.ToUpper(key), logger)
+		if _, err := other.Import(ctx, bytes.NewReader(archive.Bytes()), dstService, nil); err != ErrInvalidSignature {
+			t.Errorf("Expected error %v, got %v", ErrInvalidSignature, err)
+		}
+	})
+
+	t.Run("altered archive", func(t *testing.T) {
+		_, dstService := newStorage(t, root, "altered")
+		b := append([]byte{}, archive.Bytes()...)
+		b[len(b)/2] ^= 1
+		if _, err := snapshots.Import(ctx, bytes.NewReader(b), dstService, nil); err != ErrInvalidSignature {
+			t.Errorf("Expected error %v, got %v", ErrInvalidSignature, err)
+		}
+		if _, err := snapshots.Import(ctx, bytes.NewReader(b[:10]), dstService, nil); err != ErrInvalidSignature {
+			t.Errorf("Expected error %v, got %v", ErrInvalidSignature, err)
+		}
+	})
+
+	t.Run("missing bucket", func(t *testing.T) {
+		if _, err := snapshots.Export(ctx, "Bucket2", ioutil.Discard); err != s3.ErrNotFound {
+			t.Errorf("Expected error %v, got %v", s3.ErrNotFound, err)
+		}
+	})
+
+	t.Run("short key", func(t *testing.T) {
+		if _, err := New(src, key[:31], logger); err != ErrInvalidKey {
+			t.Errorf("Expected error %v, got %v", ErrInvalidKey, err)
+		}
+	})
+}
+
+func newStorage(t *testing.T, root, name string) (s3.Storage, storage.Service) {
+	dir, err := ioutil.TempDir(root, name)
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %v", err)
+	}
+	keys := keyProvider.New(strings.Repeat("k", 32))
+	s, err := s3.NewFilesystem(dir, keys, logger)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage, %v", err)
+	}
+
+	return s, storage.New(s, keys, nil, 0, storage.Quotas{}, nil, logger)
+}
+
+func syncFile(s storage.Service, name, version, contents string, created strfmt.DateTime) error {
+	checksum, err := s.Checksum(strings.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	_, err = s.SyncFile(context.Background(), "Bucket1", name, version, strings.NewReader(contents), checksum, "text/plain", created, "archetype", []string{"label"}, nil, "")
+	return err
+}
+
+// list returns all the versions in Bucket1 in a stable order
+func list(t *testing.T, s s3.Storage) []*models.FileDescriptor {
+	l, err := s.List(context.Background(), "Bucket1", "")
+	if err != nil {
+		t.Fatalf("Failed to list files, %v", err)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Name+l[i].Version < l[j].Name+l[j].Version
+	})
+	// imported versions are received by the storage later
+	for _, fd := range l {
+		fd.Path, fd.Received = "", nil
+	}
+
+	return l
+}
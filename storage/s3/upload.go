@@ -0,0 +1,354 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	minio "github.com/minio/minio-go"
+)
+
+// uploadsPrefix is the prefix of all objects belonging to upload sessions
+const uploadsPrefix = "uploads/"
+
+// ErrUploadIncomplete indicates not all the contents of the upload were received yet
+var ErrUploadIncomplete = errors.New("Upload is incomplete")
+
+// uploadKey returns the key of the object holding the upload session
+func uploadKey(uploadID string) string {
+	return uploadsPrefix + uploadID + "/upload"
+}
+
+// uploadChunksPrefix returns the prefix of chunks of the upload
+func uploadChunksPrefix(uploadID string) string {
+	return uploadsPrefix + uploadID + "/chunks/"
+}
+
+// uploadChunkKey returns the key of the chunk starting at the offset; offset is zero padded so that
+// chunks are listed in order
+func uploadChunkKey(uploadID string, offset int64) string {
+	return fmt.Sprintf("%s%020d", uploadChunksPrefix(uploadID), offset)
+}
+
+// chunkSizeMetadata is the user metadata key holding size of the unencrypted chunk
+const chunkSizeMetadata = "Chunk-Size"
+
+// chunkSizeHeader is the header under which S3 returns chunkSizeMetadata
+const chunkSizeHeader = "X-Amz-Meta-" + chunkSizeMetadata
+
+// chunk describes a stored chunk of the upload
+type chunk struct {
+	key        string
+	offset     int64
+	size       int64
+	keyVersion string
+}
+
+// UploadNew stores a new upload session
+func (s *s3storage) UploadNew(ctx context.Context, bucketID string, upload *models.UploadDescriptor) error {
+	s.logger.Debug().Str("cmd", "s3::UploadNew").Msgf("('%s', '%+v')", bucketID, upload)
+
+	// received ranges are always collected from stored chunks
+	u := *upload
+	u.Received = nil
+	b, err := json.Marshal(u)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal upload")
+	}
+
+	_, err = s.client.PutObjectWithContext(ctx, bucketID, uploadKey(upload.ID), bytes.NewReader(b), int64(len(b)), minio.PutObjectOptions{})
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::UploadNew").Msg("Failed to put the upload")
+		return errors.Wrap(err, "Failed to put the upload")
+	}
+
+	return nil
+}
+
+// UploadGet returns the upload session with ranges of contents received so far
+func (s *s3storage) UploadGet(ctx context.Context, bucketID, uploadID string) (*models.UploadDescriptor, error) {
+	s.logger.Debug().Str("cmd", "s3::UploadGet").Msgf("('%s', '%s')", bucketID, uploadID)
+
+	upload, _, err := s.uploadGet(ctx, bucketID, uploadID)
+	return upload, err
+}
+
+// UploadList returns all the upload sessions in the bucket
+func (s *s3storage) UploadList(ctx context.Context, bucketID string) ([]*models.UploadDescriptor, error) {
+	s.logger.Debug().Str("cmd", "s3::UploadList").Msgf("('%s')", bucketID)
+
+	ch := make(chan struct{})
+	defer close(ch)
+
+	ids := []string{}
+	for info := range s.client.ListObjectsV2(bucketID, uploadsPrefix, false, ch) {
+		if info.Err != nil {
+			s.logger.Info().Err(info.Err).Str("cmd", "s3::UploadList").Msg("Failed to list uploads")
+			return nil, errors.Wrap(info.Err, "Failed to list uploads")
+		}
+		ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(info.Key, uploadsPrefix), "/"))
+	}
+
+	uploads := []*models.UploadDescriptor{}
+	for _, id := range ids {
+		upload, err := s.UploadGet(ctx, bucketID, id)
+		if err == ErrNotFound {
+			// chunks left behind by upload that was not fully removed
+			upload = &models.UploadDescriptor{ID: id}
+		} else if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, nil
+}
+
+// UploadWriteChunk stores the chunk of contents of the upload starting at the offset. Chunk
+// written again at the same offset replaces the previous one.
+func (s *s3storage) UploadWriteChunk(ctx context.Context, bucketID, uploadID string, offset int64, r io.Reader, size int64) error {
+	s.logger.Debug().Str("cmd", "s3::UploadWriteChunk").Msgf("('%s', '%s', %d, reader, %d)", bucketID, uploadID, offset, size)
+
+	keyVersion, err := s.keys.CurrentVersion(bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::UploadWriteChunk").Msg("Failed to get the current key version")
+		return errors.Wrap(err, "Failed to get the current key version")
+	}
+	em, err := getCBCKey(bucketID, keyVersion, s.keys)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::UploadWriteChunk").Msg("Failed to set the CBC key")
+		return errors.Wrap(err, "Failed to set the CBC key")
+	}
+
+	// size of the chunk can't be read from the encrypted object
+	opts := minio.PutObjectOptions{
+		EncryptMaterials: em,
+		UserMetadata:     map[string]string{chunkSizeMetadata: strconv.FormatInt(size, 10)},
+	}
+	if keyVersion != "" {
+		opts.UserMetadata[keyVersionMetadata] = keyVersion
+	}
+
+	_, err = s.client.PutObjectWithContext(ctx, bucketID, uploadChunkKey(uploadID, offset), r, -1, opts)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::UploadWriteChunk").Msg("Failed to put the chunk")
+		return errors.Wrap(err, "Failed to put the chunk")
+	}
+
+	return nil
+}
+
+// UploadRead returns contents of the upload assembled from its chunks. Returns ErrUploadIncomplete
+// if contents were not fully received.
+func (s *s3storage) UploadRead(ctx context.Context, bucketID, uploadID string) (io.ReadCloser, error) {
+	s.logger.Debug().Str("cmd", "s3::UploadRead").Msgf("('%s', '%s')", bucketID, uploadID)
+
+	upload, chunks, err := s.uploadGet(ctx, bucketID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if !isComplete(upload.Size, upload.Received) {
+		return nil, ErrUploadIncomplete
+	}
+
+	return &chunkReader{ctx: ctx, s: s, bucketID: bucketID, chunks: chunks, size: upload.Size}, nil
+}
+
+// UploadDelete removes the upload session and all its chunks
+func (s *s3storage) UploadDelete(_ context.Context, bucketID, uploadID string) error {
+	s.logger.Debug().Str("cmd", "s3::UploadDelete").Msgf("('%s', '%s')", bucketID, uploadID)
+
+	chunks, err := s.uploadChunks(bucketID, uploadID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::UploadDelete").Msg("Failed to list chunks")
+		return errors.Wrap(err, "Failed to list chunks")
+	}
+
+	keys := []string{uploadKey(uploadID)}
+	for _, c := range chunks {
+		keys = append(keys, c.key)
+	}
+	if err := s.removeObjects(bucketID, keys); err != nil {
+		return errors.New("Failed to delete the upload")
+	}
+
+	return nil
+}
+
+// uploadGet reads the upload session and lists its chunks
+func (s *s3storage) uploadGet(ctx context.Context, bucketID, uploadID string) (*models.UploadDescriptor, []chunk, error) {
+	r, err := s.client.GetObjectWithContext(ctx, bucketID, uploadKey(uploadID), minio.GetObjectOptions{})
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::uploadGet").Msg("Failed to fetch the upload")
+		return nil, nil, errors.Wrap(err, "Failed to fetch the upload")
+	}
+	defer r.Close()
+
+	upload := &models.UploadDescriptor{}
+	if err := json.NewDecoder(r).Decode(upload); err != nil {
+		if isNotFound(err) {
+			return nil, nil, ErrNotFound
+		}
+		s.logger.Info().Err(err).Str("cmd", "s3::uploadGet").Msg("Failed to read the upload")
+		return nil, nil, errors.Wrap(err, "Failed to read the upload")
+	}
+
+	chunks, err := s.uploadChunks(bucketID, uploadID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::uploadGet").Msg("Failed to list chunks")
+		return nil, nil, errors.Wrap(err, "Failed to list chunks")
+	}
+	upload.Received = receivedRanges(chunks)
+
+	return upload, chunks, nil
+}
+
+// uploadChunks lists chunks of the upload ordered by offset
+func (s *s3storage) uploadChunks(bucketID, uploadID string) ([]chunk, error) {
+	ch := make(chan struct{})
+	defer close(ch)
+
+	chunks := []chunk{}
+	for info := range s.client.ListObjectsV2(bucketID, uploadChunksPrefix(uploadID), false, ch) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		offset, err := strconv.ParseInt(strings.TrimPrefix(info.Key, uploadChunksPrefix(uploadID)), 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid chunk key %s", info.Key)
+		}
+		stat, err := s.client.StatObject(bucketID, info.Key, minio.StatObjectOptions{})
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(stat.Metadata.Get(chunkSizeHeader), 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid size of chunk %s", info.Key)
+		}
+		chunks = append(chunks, chunk{key: info.Key, offset: offset, size: size, keyVersion: stat.Metadata.Get(keyVersionHeader)})
+	}
+
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].offset < chunks[j].offset })
+	return chunks, nil
+}
+
+// receivedRanges merges chunks ordered by offset into continuous ranges
+func receivedRanges(chunks []chunk) []*models.ByteRange {
+	ranges := []*models.ByteRange{}
+	for _, c := range chunks {
+		if c.size == 0 {
+			continue
+		}
+		if len(ranges) > 0 {
+			last := ranges[len(ranges)-1]
+			if c.offset <= last.Offset+last.Length {
+				if end := c.offset + c.size; end > last.Offset+last.Length {
+					last.Length = end - last.Offset
+				}
+				continue
+			}
+		}
+		ranges = append(ranges, &models.ByteRange{Offset: c.offset, Length: c.size})
+	}
+
+	return ranges
+}
+
+// isComplete checks if received ranges cover the whole contents of the size
+func isComplete(size int64, ranges []*models.ByteRange) bool {
+	if size == 0 {
+		return true
+	}
+
+	return len(ranges) == 1 && ranges[0].Offset == 0 && ranges[0].Length >= size
+}
+
+// chunkReader reads contents of chunks ordered by offset one after another skipping overlapping parts
+type chunkReader struct {
+	ctx      context.Context
+	s        *s3storage
+	bucketID string
+	chunks   []chunk
+	size     int64
+	pos      int64
+	current  io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.pos >= c.size {
+			return 0, io.EOF
+		}
+
+		if c.current == nil {
+			if err := c.next(); err != nil {
+				return 0, err
+			}
+		}
+
+		// don't read past the declared size of the upload
+		if remaining := c.size - c.pos; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+		n, err := c.current.Read(p)
+		c.pos += int64(n)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// next opens the chunk containing the current position
+func (c *chunkReader) next() error {
+	for len(c.chunks) > 0 {
+		ch := c.chunks[0]
+		c.chunks = c.chunks[1:]
+		if ch.offset+ch.size <= c.pos {
+			// already read from previous chunks
+			continue
+		}
+		if ch.offset > c.pos {
+			return ErrUploadIncomplete
+		}
+
+		em, err := getCBCKey(c.bucketID, ch.keyVersion, c.s.keys)
+		if err != nil {
+			return errors.Wrap(err, "Failed to set CBC key")
+		}
+		r, err := c.s.client.GetObjectWithContext(c.ctx, c.bucketID, ch.key, minio.GetObjectOptions{Materials: em})
+		if err != nil {
+			return errors.Wrap(err, "Failed to fetch enc. chunk")
+		}
+
+		// skip the part already read from previous chunks
+		if _, err := io.CopyN(ioutil.Discard, r, c.pos-ch.offset); err != nil {
+			r.Close()
+			return errors.Wrap(err, "Failed to read enc. chunk")
+		}
+		c.current = r
+		return nil
+	}
+
+	return ErrUploadIncomplete
+}
+
+func (c *chunkReader) Close() error {
+	if c.current != nil {
+		return c.current.Close()
+	}
+	return nil
+}
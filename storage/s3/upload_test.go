@@ -0,0 +1,151 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/minio/minio-go"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3/mock"
+)
+
+func TestReceivedRanges(t *testing.T) {
+	testCases := []struct {
+		description string
+		chunks      []chunk
+		expected    []*models.ByteRange
+	}{
+		{
+			"no chunks",
+			[]chunk{},
+			[]*models.ByteRange{},
+		},
+		{
+			"continuous chunks",
+			[]chunk{{offset: 0, size: 4}, {offset: 4, size: 4}},
+			[]*models.ByteRange{{Offset: 0, Length: 8}},
+		},
+		{
+			"overlapping chunks",
+			[]chunk{{offset: 0, size: 4}, {offset: 2, size: 4}, {offset: 3, size: 1}},
+			[]*models.ByteRange{{Offset: 0, Length: 6}},
+		},
+		{
+			"chunks with gaps",
+			[]chunk{{offset: 2, size: 2}, {offset: 6, size: 2}, {offset: 8, size: 0}},
+			[]*models.ByteRange{{Offset: 2, Length: 2}, {Offset: 6, Length: 2}},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			ranges := receivedRanges(test.chunks)
+
+			if !reflect.DeepEqual(ranges, test.expected) {
+				t.Errorf("Expected ranges to equal\n%+v\ngot\n%+v", test.expected, ranges)
+			}
+		})
+	}
+}
+
+func TestS3UploadRead(t *testing.T) {
+	chunkInfo := func(key string, size string) minio.ObjectInfo {
+		return minio.ObjectInfo{Key: key, Metadata: http.Header{chunkSizeHeader: []string{size}, keyVersionHeader: []string{"KEYV1"}}}
+	}
+	chunk0 := chunkInfo("uploads/UPLOAD/chunks/00000000000000000000", "4")
+	chunk2 := chunkInfo("uploads/UPLOAD/chunks/00000000000000000002", "6")
+	chunk5 := chunkInfo("uploads/UPLOAD/chunks/00000000000000000005", "3")
+
+	testCases := []struct {
+		description   string
+		listInfos     []minio.ObjectInfo
+		calls         func(chan minio.ObjectInfo, *mock.MockMinio, *mock.MockKeyProvider) []*gomock.Call
+		reader        []byte
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"overlapping chunks are assembled",
+			[]minio.ObjectInfo{chunk0, chunk2},
+			func(i chan minio.ObjectInfo, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				return []*gomock.Call{
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", "uploads/UPLOAD/upload", gomock.Any()).Return(noopCloser{bytes.NewBufferString(`{"id":"UPLOAD","size":8}`)}, nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "uploads/UPLOAD/chunks/", false, gomock.Any()).Return(i),
+					m.EXPECT().StatObject("BUCKET", chunk0.Key, gomock.Any()).Return(chunk0, nil),
+					m.EXPECT().StatObject("BUCKET", chunk2.Key, gomock.Any()).Return(chunk2, nil),
+					k.EXPECT().GetVersion("BUCKET", "KEYV1").Return("SECRET-KEY", nil),
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", chunk0.Key, gomock.Any()).Return(noopCloser{bytes.NewBufferString("cont")}, nil),
+					k.EXPECT().GetVersion("BUCKET", "KEYV1").Return("SECRET-KEY", nil),
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", chunk2.Key, gomock.Any()).Return(noopCloser{bytes.NewBufferString("ntents")}, nil),
+				}
+			},
+			[]byte("contents"),
+			noErrors,
+			nil,
+		},
+		{
+			"missing chunk",
+			[]minio.ObjectInfo{chunk0, chunk5},
+			func(i chan minio.ObjectInfo, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				return []*gomock.Call{
+					m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", "uploads/UPLOAD/upload", gomock.Any()).Return(noopCloser{bytes.NewBufferString(`{"id":"UPLOAD","size":8}`)}, nil),
+					m.EXPECT().ListObjectsV2("BUCKET", "uploads/UPLOAD/chunks/", false, gomock.Any()).Return(i),
+					m.EXPECT().StatObject("BUCKET", chunk0.Key, gomock.Any()).Return(chunk0, nil),
+					m.EXPECT().StatObject("BUCKET", chunk5.Key, gomock.Any()).Return(chunk5, nil),
+				}
+			},
+			nil,
+			withErrors,
+			ErrUploadIncomplete,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init storage
+			s, m, k, c := getTestStorage(t)
+			defer c()
+
+			// prepare ObjectInfos channel
+			infos := make(chan minio.ObjectInfo, len(test.listInfos))
+			for _, info := range test.listInfos {
+				infos <- info
+			}
+			close(infos)
+
+			// setup calls
+			gomock.InOrder(test.calls(infos, m, k)...)
+
+			// call UploadRead method
+			reader, err := s.UploadRead(context.TODO(), "BUCKET", "UPLOAD")
+
+			if test.reader == nil && reader != nil {
+				t.Errorf("Expected reader to be nil")
+			} else if test.reader != nil {
+				if b, err := ioutil.ReadAll(reader); !bytes.Equal(test.reader, b) {
+					t.Errorf("Expected '%s' to equal '%s'", b, test.reader)
+				} else if err != nil {
+					t.Errorf("Expected err from ioutil.ReadAll to be nil; got %v", err)
+				}
+			}
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
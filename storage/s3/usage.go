@@ -0,0 +1,136 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	minio "github.com/minio/minio-go"
+)
+
+// usagePrefix is the prefix of all objects holding usage counters
+const usagePrefix = "usage/"
+
+// usageKey is the key of the object holding usage counters of the whole bucket
+const usageKey = usagePrefix + "bucket"
+
+// usage holds total size and number of all the versions of files in the bucket, including replaced versions
+// and delete markers
+type usage struct {
+	Size    int64 `json:"size"`
+	Objects int64 `json:"objects"`
+}
+
+// usageLocks serializes updates of usage counters of every bucket
+type usageLocks struct {
+	mu      sync.Mutex
+	buckets map[string]*sync.Mutex
+}
+
+func (l *usageLocks) lock(bucketID string) func() {
+	l.mu.Lock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*sync.Mutex)
+	}
+	m, ok := l.buckets[bucketID]
+	if !ok {
+		m = &sync.Mutex{}
+		l.buckets[bucketID] = m
+	}
+	l.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
+
+// Usage returns total size and number of all the versions of files in the bucket. Usage is kept in counters
+// stored in the bucket and updated by every write and delete.
+func (s *s3storage) Usage(ctx context.Context, bucketID string) (int64, int64, error) {
+	s.logger.Debug().Str("cmd", "s3::Usage").Msgf("('%s')", bucketID)
+
+	exists, err := s.client.BucketExists(bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Usage").Msg("Failed to check if bucket exists")
+		return 0, 0, errors.Wrap(err, "Failed to check if bucket exists")
+	}
+	if !exists {
+		return 0, 0, nil
+	}
+
+	unlock := s.usageLocks.lock(bucketID)
+	defer unlock()
+
+	u, err := s.usage(ctx, bucketID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return u.Size, u.Objects, nil
+}
+
+// addUsage adds size and number of objects to usage counters of the bucket
+func (s *s3storage) addUsage(ctx context.Context, bucketID string, size, objects int64) error {
+	unlock := s.usageLocks.lock(bucketID)
+	defer unlock()
+
+	u, err := s.usage(ctx, bucketID)
+	if err != nil {
+		return err
+	}
+	u.Size += size
+	u.Objects += objects
+
+	return s.putUsage(ctx, bucketID, u)
+}
+
+// usage reads usage counters of the bucket. Buckets created before usage counters were kept are counted from
+// the list of all the versions once, caller has to hold the lock of the bucket.
+func (s *s3storage) usage(ctx context.Context, bucketID string) (*usage, error) {
+	r, err := s.client.GetObjectWithContext(ctx, bucketID, usageKey, minio.GetObjectOptions{})
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::usage").Msg("Failed to fetch usage")
+		return nil, errors.Wrap(err, "Failed to fetch usage")
+	}
+	defer r.Close()
+
+	u := &usage{}
+	err = json.NewDecoder(r).Decode(u)
+	switch {
+	case err == nil:
+		return u, nil
+	case !isNotFound(err):
+		s.logger.Info().Err(err).Str("cmd", "s3::usage").Msg("Failed to read usage")
+		return nil, errors.Wrap(err, "Failed to read usage")
+	}
+
+	files, err := s.List(ctx, bucketID, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range files {
+		u.Size += fd.Size
+		u.Objects++
+	}
+	s.logger.Info().Str("cmd", "s3::usage").Str("bucket", bucketID).Msgf("Counted usage of %d object(s)", u.Objects)
+
+	return u, s.putUsage(ctx, bucketID, u)
+}
+
+// putUsage stores usage counters of the bucket, caller has to hold the lock of the bucket
+func (s *s3storage) putUsage(ctx context.Context, bucketID string, u *usage) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal usage")
+	}
+
+	_, err = s.client.PutObjectWithContext(ctx, bucketID, usageKey, bytes.NewReader(b), int64(len(b)), minio.PutObjectOptions{})
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::putUsage").Msg("Failed to put usage")
+		return errors.Wrap(err, "Failed to put usage")
+	}
+
+	return nil
+}
@@ -3,6 +3,8 @@ package batch
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/go-openapi/strfmt"
@@ -13,6 +15,8 @@ import (
 	"github.com/iryonetwork/wwm/gen/storage/models"
 	"github.com/iryonetwork/wwm/metrics"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/scheduler"
+	"github.com/iryonetwork/wwm/sync/storage/selective"
 	"github.com/iryonetwork/wwm/utils"
 )
 
@@ -20,18 +24,60 @@ type Cfg struct {
 	BucketsRateLimit        int
 	FilesPerBucketRateLimit int
 	BucketsToSkip           []string
+	// Selector limits sync to buckets of patients linked to the location, all the buckets are synced if nil
+	Selector selective.Selector
+	// EvictOnUnlink enables removal of buckets of patients unlinked from the location from destination storage
+	EvictOnUnlink bool
+	// Direction labels metrics of the sync, defaults to local to cloud sync
+	Direction storageSync.Direction
+	// SkipSyncedVersions skips versions synced to source storage from other storage so that they are not synced back
+	SkipSyncedVersions bool
+	// SkipSource skips versions created in the storage with the ID, set to the ID of destination storage so that
+	// versions synced from it to source storage are not synced back
+	SkipSource string
+	// SinceReceived syncs versions received by source storage since the bucket is synced instead of versions created
+	// since then; versions synced to source storage from other storages keep their time of creation but are
+	// received later
+	SinceReceived bool
+	// Checkpoints keep start time of the last run in which each bucket was synced successfully, buckets are synced
+	// since their checkpoint instead of the last successful run of the whole sync if set
+	Checkpoints Checkpoints
+	// Scheduler orders files of all the buckets by priority and limits bandwidth and time in which they are synced if set
+	Scheduler scheduler.Scheduler
 }
 
+// errDeferred is reported for files and buckets with versions deferred to the time window of their priority class
+var errDeferred = errors.New("deferred to the time window of its priority class")
+
+// receivedOverlap is the time before the checkpoint since which versions received by source storage are listed
+// again as its clock differs from the clock of the sync; versions synced already are not fetched again
+const receivedOverlap = time.Minute
+
 type syncError struct {
 	id  string // identifier of resource that failed to sync
 	err error
 }
 
+// bucketRun holds files of the bucket to sync and collects results of their syncs
+type bucketRun struct {
+	bucketID string
+	since    time.Time
+	files    []*models.FileDescriptor
+	results  chan *syncError
+}
+
 type batchStorageSync struct {
 	handlers                storageSync.Handlers
 	bucketsRateLimit        int
 	filesPerBucketRateLimit int
 	bucketsToSkip           map[string]bool
+	selector                selective.Selector
+	evictOnUnlink           bool
+	skipSyncedVersions      bool
+	skipSource              string
+	sinceReceived           bool
+	checkpoints             Checkpoints
+	scheduler               scheduler.Scheduler
 	logger                  zerolog.Logger
 	metricsCollection       map[metrics.ID]prometheus.Collector
 }
@@ -39,8 +85,21 @@ type batchStorageSync struct {
 const syncSeconds metrics.ID = "syncSeconds"
 
 func (s *batchStorageSync) Sync(ctx context.Context, lastSuccessfulRun time.Time) error {
+	// start time is saved as checkpoint of synced buckets to account for anything that happens during sync
+	start := time.Now()
 	bucketRateLimit := make(chan bool, s.bucketsRateLimit)
 
+	linked := make(map[string]bool)
+	unlinked := []string{}
+	if s.selector != nil {
+		l, u, err := s.selector.Refresh(ctx)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("failed to refresh linked patients")
+			return errors.Wrap(err, "failed to refresh linked patients")
+		}
+		linked, unlinked = utils.SliceToMap(l), u
+	}
+
 	buckets, err := s.handlers.ListSourceBuckets(ctx)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("failed to list source buckets")
@@ -50,27 +109,74 @@ func (s *batchStorageSync) Sync(ctx context.Context, lastSuccessfulRun time.Time
 	numberOfBuckets := len(buckets)
 
 	ch := make(chan *syncError)
+	pulling := []string{}
+	runs := []*bucketRun{}
 	for _, b := range buckets {
-		if _, ok := s.bucketsToSkip[b.Name]; !ok {
-			go s.syncBucket(ctx, lastSuccessfulRun, b.Name, ch, bucketRateLimit)
-		} else {
+		switch {
+		case s.bucketsToSkip[b.Name], s.selector != nil && !s.selector.Selected(b.Name):
 			numberOfBuckets--
+		case linked[b.Name]:
+			// whole history of the bucket of newly linked patient is pulled
+			pulling = append(pulling, b.Name)
+			runs = append(runs, &bucketRun{bucketID: b.Name, since: time.Unix(0, 0)})
+		default:
+			runs = append(runs, &bucketRun{bucketID: b.Name, since: s.since(b.Name, lastSuccessfulRun)})
+		}
+	}
+	if s.scheduler != nil {
+		go s.syncScheduled(ctx, start, runs, ch, bucketRateLimit)
+	} else {
+		for _, run := range runs {
+			go s.syncBucket(ctx, start, run, ch, bucketRateLimit)
 		}
 	}
 
 	var errCount int
+	var deferredCount int
+	failed := make(map[string]bool)
 	for i := 0; i < numberOfBuckets; i++ {
 		syncErr := <-ch
-		if syncErr != nil {
+		switch {
+		case syncErr == nil:
+		case syncErr.err == errDeferred:
+			failed[syncErr.id] = true
+			deferredCount++
+		default:
 			s.logger.Error().Err(syncErr.err).Str("bucket", syncErr.id).Msg("failed to sync")
+			failed[syncErr.id] = true
 			errCount++
 		}
 	}
 
+	// history of failed buckets is pulled again on the next run
+	for _, bucketID := range pulling {
+		if failed[bucketID] {
+			continue
+		}
+		if err := s.selector.Pulled(bucketID); err != nil {
+			s.logger.Error().Err(err).Str("bucket", bucketID).Msg("failed to record pulled bucket")
+		}
+	}
+
+	for _, bucketID := range unlinked {
+		if err := s.unlinkBucket(ctx, bucketID); err != nil {
+			s.logger.Error().Err(err).Str("bucket", bucketID).Msg("failed to unlink")
+			errCount++
+		}
+	}
+	numberOfBuckets += len(unlinked)
+
 	if errCount > 0 {
 		s.logger.Error().Msgf("%d failure(s) out of %d bucket(s) to sync", errCount, numberOfBuckets)
 		return errors.Errorf("%d failure(s) out of %d bucket(s) to sync", errCount, numberOfBuckets)
 	}
+	if deferredCount > 0 {
+		s.logger.Info().Msgf("%d bucket(s) out of %d with deferred files", deferredCount, numberOfBuckets)
+		// without checkpoints deferred files are synced again only if the run doesn't count as successful
+		if s.checkpoints == nil {
+			return errors.Errorf("%d bucket(s) out of %d with deferred files", deferredCount, numberOfBuckets)
+		}
+	}
 
 	return nil
 }
@@ -81,13 +187,17 @@ func (s *batchStorageSync) GetPrometheusMetricsCollection() map[metrics.ID]prome
 }
 
 func New(handlers storageSync.Handlers, cfg Cfg, logger zerolog.Logger) storageSync.BatchSync {
-	logger = logger.With().Str("component", "sync/storage/batch").Logger()
+	if cfg.Direction == "" {
+		cfg.Direction = storageSync.LocalToCloud
+	}
+	logger = logger.With().Str("component", "sync/storage/batch").Str("direction", string(cfg.Direction)).Logger()
 
 	metricsCollection := make(map[metrics.ID]prometheus.Collector)
 	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace: "batch",
-		Name:      "file_version_sync_seconds",
-		Help:      "Time taken to sync file",
+		Namespace:   "batch",
+		Name:        "file_version_sync_seconds",
+		Help:        "Time taken to sync file",
+		ConstLabels: prometheus.Labels{"direction": string(cfg.Direction)},
 	}, []string{"operation", "success", "result"})
 	metricsCollection[syncSeconds] = h
 
@@ -96,38 +206,140 @@ func New(handlers storageSync.Handlers, cfg Cfg, logger zerolog.Logger) storageS
 		bucketsRateLimit:        cfg.BucketsRateLimit,
 		filesPerBucketRateLimit: cfg.FilesPerBucketRateLimit,
 		bucketsToSkip:           utils.SliceToMap(cfg.BucketsToSkip),
+		selector:                cfg.Selector,
+		evictOnUnlink:           cfg.EvictOnUnlink,
+		skipSyncedVersions:      cfg.SkipSyncedVersions,
+		skipSource:              cfg.SkipSource,
+		sinceReceived:           cfg.SinceReceived,
+		checkpoints:             cfg.Checkpoints,
+		scheduler:               cfg.Scheduler,
 		logger:                  logger,
 		metricsCollection:       metricsCollection,
 	}
 }
 
-func (s *batchStorageSync) syncBucket(ctx context.Context, lastSuccessfulRun time.Time, bucketID string, errCh chan *syncError, rateLimit chan bool) {
+// since returns time since which the bucket is synced, its checkpoint if it has one
+func (s *batchStorageSync) since(bucketID string, lastSuccessfulRun time.Time) time.Time {
+	if s.checkpoints != nil {
+		if checkpoint, ok := s.checkpoints.Get(bucketID); ok {
+			return checkpoint
+		}
+	}
+
+	return lastSuccessfulRun
+}
+
+func (s *batchStorageSync) syncBucket(ctx context.Context, start time.Time, run *bucketRun, errCh chan *syncError, rateLimit chan bool) {
 	lockSlot(rateLimit)
 	defer freeSlot(rateLimit)
 
+	if err := s.listFiles(ctx, run); err != nil {
+		errCh <- err
+		return
+	}
+
 	fileRateLimit := make(chan bool, s.filesPerBucketRateLimit)
+	for _, f := range run.files {
+		lockSlot(fileRateLimit)
+		go s.syncFile(ctx, run.since, run.bucketID, f.Name, run.results, fileRateLimit)
+	}
 
-	files, err := s.handlers.ListSourceFilesAsc(ctx, bucketID, strfmt.DateTime(lastSuccessfulRun))
-	if err != nil {
-		s.logger.Error().Err(err).Str("bucket", bucketID).Msg("failed to list source files")
-		errCh <- &syncError{bucketID, errors.Wrap(err, fmt.Sprintf("failed to list source files in bucket %s", bucketID))}
-		return
+	errCh <- s.finishBucket(run, start)
+}
+
+// syncScheduled lists files of all the buckets before any of them is synced so that files are synced in order of
+// their priority across buckets. Files are synced with as many concurrent syncs as all the buckets would use,
+// results are reported per bucket.
+func (s *batchStorageSync) syncScheduled(ctx context.Context, start time.Time, runs []*bucketRun, errCh chan *syncError, rateLimit chan bool) {
+	listed := make([]bool, len(runs))
+	var wg sync.WaitGroup
+	for i, run := range runs {
+		wg.Add(1)
+		go func(i int, run *bucketRun) {
+			defer wg.Done()
+			lockSlot(rateLimit)
+			defer freeSlot(rateLimit)
+
+			if err := s.listFiles(ctx, run); err != nil {
+				errCh <- err
+				return
+			}
+			listed[i] = true
+		}(i, run)
 	}
+	wg.Wait()
 
-	var syncCount int
-	var errCount int
-	ch := make(chan *syncError)
+	type candidate struct {
+		run  *bucketRun
+		file *models.FileDescriptor
+	}
+	candidates := []candidate{}
+	for i, run := range runs {
+		if !listed[i] {
+			continue
+		}
+		for _, f := range run.files {
+			candidates = append(candidates, candidate{run, f})
+		}
+	}
+	// files with higher priority are synced first, otherwise buckets keep their order
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return s.scheduler.Priority(candidates[i].file) < s.scheduler.Priority(candidates[j].file)
+	})
+
+	fileRateLimit := make(chan bool, s.bucketsRateLimit*s.filesPerBucketRateLimit)
+	for _, c := range candidates {
+		// slot is taken before the file sync starts so that files start in order of their priority
+		lockSlot(fileRateLimit)
+		go s.syncFile(ctx, c.run.since, c.run.bucketID, c.file.Name, c.run.results, fileRateLimit)
+	}
+
+	for i, run := range runs {
+		if listed[i] {
+			errCh <- s.finishBucket(run, start)
+		}
+	}
+}
+
+// listFiles lists files of the bucket changed since the bucket is synced
+func (s *batchStorageSync) listFiles(ctx context.Context, run *bucketRun) *syncError {
+	var files []*models.FileDescriptor
+	var err error
+	if s.sinceReceived {
+		files, err = s.handlers.ListSourceFilesReceivedAsc(ctx, run.bucketID, strfmt.DateTime(run.since.Add(-receivedOverlap)))
+	} else {
+		files, err = s.handlers.ListSourceFilesAsc(ctx, run.bucketID, strfmt.DateTime(run.since))
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Str("bucket", run.bucketID).Msg("failed to list source files")
+		return &syncError{run.bucketID, errors.Wrap(err, fmt.Sprintf("failed to list source files in bucket %s", run.bucketID))}
+	}
 
 	for _, f := range files {
-		if time.Time(f.Created).After(lastSuccessfulRun) {
-			syncCount++
-			go s.syncFile(ctx, lastSuccessfulRun, bucketID, f.Name, ch, fileRateLimit)
+		// latest versions of files listed by time of receipt are not necessarily the ones received
+		if s.sinceReceived || time.Time(f.Created).After(run.since) {
+			run.files = append(run.files, f)
 		}
 	}
+	// buffered as results are collected only after all the file syncs are started
+	run.results = make(chan *syncError, len(run.files))
 
+	return nil
+}
+
+// finishBucket collects results of file syncs of the bucket and saves its checkpoint if none of them failed
+func (s *batchStorageSync) finishBucket(run *bucketRun, start time.Time) *syncError {
+	bucketID, syncCount := run.bucketID, len(run.files)
+
+	var errCount int
+	var deferredCount int
 	for i := 0; i < syncCount; i++ {
-		syncErr := <-ch
-		if syncErr != nil {
+		syncErr := <-run.results
+		switch {
+		case syncErr == nil:
+		case syncErr.err == errDeferred:
+			deferredCount++
+		default:
 			s.logger.Error().Err(syncErr.err).Str("bucket", bucketID).Str("file", syncErr.id).Msg("failed to sync")
 			errCount++
 		}
@@ -135,18 +347,57 @@ func (s *batchStorageSync) syncBucket(ctx context.Context, lastSuccessfulRun tim
 
 	if errCount > 0 {
 		s.logger.Error().Str("bucket", bucketID).Msgf("%d failure(s) out of %d file(s) to sync", errCount, syncCount)
-		errCh <- &syncError{bucketID, errors.Errorf("%d failure(s) out of %d file(s) to sync in bucket %s", errCount, syncCount, bucketID)}
-		return
+		return &syncError{bucketID, errors.Errorf("%d failure(s) out of %d file(s) to sync in bucket %s", errCount, syncCount, bucketID)}
 	}
 
-	errCh <- nil
+	// bucket with deferred files keeps its checkpoint, otherwise next run resumes from the start of this one
+	// even if other buckets fail
+	checkpoint := start
+	if deferredCount > 0 {
+		s.logger.Info().Str("bucket", bucketID).Msgf("%d file(s) out of %d deferred", deferredCount, syncCount)
+		checkpoint = run.since
+	}
+	if s.checkpoints != nil {
+		if err := s.checkpoints.Save(bucketID, checkpoint); err != nil {
+			s.logger.Error().Err(err).Str("bucket", bucketID).Msg("failed to save checkpoint")
+		}
+	}
+	if deferredCount > 0 {
+		return &syncError{bucketID, errDeferred}
+	}
+
+	return nil
+}
+
+// unlinkBucket evicts the bucket of patient unlinked from the location if enabled and forgets it so that its
+// history is pulled again if the patient is linked back.
+func (s *batchStorageSync) unlinkBucket(ctx context.Context, bucketID string) error {
+	if s.evictOnUnlink {
+		if err := s.handlers.EvictDestinationBucket(ctx, bucketID); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to evict bucket %s", bucketID))
+		}
+		s.logger.Info().Str("bucket", bucketID).Msg("evicted bucket of unlinked patient")
+	}
+	if s.checkpoints != nil {
+		if err := s.checkpoints.Remove(bucketID); err != nil {
+			return err
+		}
+	}
+
+	return s.selector.Forget(bucketID)
 }
 
+// syncFile syncs versions of the file, the caller has to lock the rate limit slot freed once it's done
 func (s *batchStorageSync) syncFile(ctx context.Context, lastSuccessfulRun time.Time, bucketID, fileID string, errCh chan *syncError, rateLimit chan bool) {
-	lockSlot(rateLimit)
 	defer freeSlot(rateLimit)
 
-	versions, err := s.handlers.ListSourceFileVersionsAsc(ctx, bucketID, fileID, strfmt.DateTime(lastSuccessfulRun))
+	var versions []*models.FileDescriptor
+	var err error
+	if s.sinceReceived {
+		versions, err = s.handlers.ListSourceFileVersionsReceivedAsc(ctx, bucketID, fileID, strfmt.DateTime(lastSuccessfulRun.Add(-receivedOverlap)))
+	} else {
+		versions, err = s.handlers.ListSourceFileVersionsAsc(ctx, bucketID, fileID, strfmt.DateTime(lastSuccessfulRun))
+	}
 	if err != nil {
 		s.logger.Error().Err(err).Str("bucket", bucketID).Str("file", fileID).Msg("failed to list source versions")
 		errCh <- &syncError{fileID, errors.Wrap(err, fmt.Sprintf("failed to list source versions of file %s in bucket %s", fileID, bucketID))}
@@ -155,7 +406,9 @@ func (s *batchStorageSync) syncFile(ctx context.Context, lastSuccessfulRun time.
 
 	var syncCount int
 	var errCount int
+	var deferred bool
 
+versions:
 	for _, f := range versions {
 		select {
 		case <-ctx.Done():
@@ -163,9 +416,41 @@ func (s *batchStorageSync) syncFile(ctx context.Context, lastSuccessfulRun time.
 			errCh <- &syncError{fileID, errors.Wrap(ctx.Err(), fmt.Sprintf("aborting file sync due to context cancellation"))}
 			return
 		default:
-			if time.Time(f.Created).After(lastSuccessfulRun) {
+			if s.skipSyncedVersions && f.Source != "" {
+				s.logger.Debug().
+					Str("bucket", bucketID).
+					Str("file", fileID).
+					Str("version", f.Version).
+					Str("source", f.Source).
+					Msg("skipping version synced from other storage")
+				continue
+			}
+			if s.skipSource != "" && f.Source == s.skipSource {
+				s.logger.Debug().
+					Str("bucket", bucketID).
+					Str("file", fileID).
+					Str("version", f.Version).
+					Msg("skipping version created in destination storage")
+				continue
+			}
+			if s.sinceReceived || time.Time(f.Created).After(lastSuccessfulRun) {
+				// versions are synced in order, later versions wait for the deferred one
+				if s.scheduler != nil && !s.scheduler.Allowed(f) {
+					deferred = true
+					break versions
+				}
 				syncCount++
-				err := s.syncFileVersion(ctx, bucketID, fileID, f)
+				if s.scheduler != nil {
+					if err := s.scheduler.Wait(ctx, f); err != nil {
+						s.logger.Error().Err(err).Str("bucket", bucketID).Str("file", fileID).Str("version", f.Version).Msg("failed to wait for scheduled sync")
+						errCount++
+						continue
+					}
+				}
+				sent, err := s.syncFileVersion(ctx, bucketID, fileID, f)
+				if s.scheduler != nil {
+					s.scheduler.Sent(f, sent)
+				}
 				if err != nil {
 					errCount++
 				}
@@ -178,11 +463,16 @@ func (s *batchStorageSync) syncFile(ctx context.Context, lastSuccessfulRun time.
 		errCh <- &syncError{fileID, errors.Errorf("%d failure(s) out of %d version(s) to sync for file %s in bucket %s", errCount, syncCount, fileID, bucketID)}
 		return
 	}
+	if deferred {
+		errCh <- &syncError{fileID, errDeferred}
+		return
+	}
 
 	errCh <- nil
 }
 
-func (s *batchStorageSync) syncFileVersion(ctx context.Context, bucketID, fileID string, f *models.FileDescriptor) error {
+// syncFileVersion syncs the file version and returns number of bytes of its contents sent to destination storage
+func (s *batchStorageSync) syncFileVersion(ctx context.Context, bucketID, fileID string, f *models.FileDescriptor) (int64, error) {
 	// Make sure we record duration metrics even if processing fails, set default values for labels
 	start := time.Now()
 	success := false
@@ -195,9 +485,10 @@ func (s *batchStorageSync) syncFileVersion(ctx context.Context, bucketID, fileID
 	}()
 
 	var err error
+	var sent int64
 	switch f.Operation {
 	case models.FileDescriptorOperationW:
-		result, err = s.handlers.SyncFile(ctx, bucketID, fileID, f.Version, f.Created)
+		result, err = s.handlers.SyncFile(storageSync.WithSentBytes(ctx, &sent), bucketID, fileID, f.Version, f.Created)
 	case models.FileDescriptorOperationD:
 		result, err = s.handlers.SyncFileDelete(ctx, bucketID, fileID, f.Version, f.Created)
 	}
@@ -219,7 +510,7 @@ func (s *batchStorageSync) syncFileVersion(ctx context.Context, bucketID, fileID
 			Msg("successfully synced")
 	}
 
-	return err
+	return sent, err
 }
 
 func lockSlot(rateLimit chan bool) {
@@ -14,6 +14,8 @@ import (
 	"github.com/iryonetwork/wwm/gen/storage/models"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
 	"github.com/iryonetwork/wwm/sync/storage/mock"
+	schedulerMock "github.com/iryonetwork/wwm/sync/storage/scheduler/mock"
+	selectiveMock "github.com/iryonetwork/wwm/sync/storage/selective/mock"
 )
 
 var (
@@ -352,6 +354,310 @@ func TestContextCancelled(t *testing.T) {
 	}
 }
 
+func TestSelectiveSync(t *testing.T) {
+	bucket3 := &models.BucketDescriptor{Name: "Bucket3", Created: time1}
+	epoch := strfmt.DateTime(time.Unix(0, 0))
+
+	testCases := []struct {
+		description   string
+		evictOnUnlink bool
+		mockCalls     func(*mock.MockHandlers, *selectiveMock.MockSelector)
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"History of newly linked bucket is pulled",
+			false,
+			func(c *mock.MockHandlers, s *selectiveMock.MockSelector) {
+				s.EXPECT().Refresh(gomock.Any()).Return([]string{bucket1.Name}, []string{}, nil)
+				c.EXPECT().ListSourceBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1, bucket2, bucket3, bucketToSkip}, nil)
+				s.EXPECT().Selected(bucket1.Name).Return(true)
+				s.EXPECT().Selected(bucket2.Name).Return(true)
+				s.EXPECT().Selected(bucket3.Name).Return(false)
+				c.EXPECT().ListSourceFilesAsc(gomock.Any(), bucket1.Name, epoch).Return([]*models.FileDescriptor{file1V3}, nil)
+				c.EXPECT().ListSourceFileVersionsAsc(gomock.Any(), bucket1.Name, file1V3.Name, epoch).Return([]*models.FileDescriptor{file1V1, file1V3}, nil)
+				c.EXPECT().SyncFile(gomock.Any(), bucket1.Name, file1V1.Name, file1V1.Version, file1V1.Created).Return(storageSync.ResultSynced, nil)
+				c.EXPECT().SyncFileDelete(gomock.Any(), bucket1.Name, file1V3.Name, file1V3.Version, file1V3.Created).Return(storageSync.ResultSynced, nil)
+				c.EXPECT().ListSourceFilesAsc(gomock.Any(), bucket2.Name, time3).Return([]*models.FileDescriptor{}, nil)
+				s.EXPECT().Pulled(bucket1.Name).Return(nil)
+			},
+			noErrors,
+			nil,
+		},
+		{
+			"Failed pull is repeated",
+			false,
+			func(c *mock.MockHandlers, s *selectiveMock.MockSelector) {
+				s.EXPECT().Refresh(gomock.Any()).Return([]string{bucket1.Name}, []string{}, nil)
+				c.EXPECT().ListSourceBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil)
+				s.EXPECT().Selected(bucket1.Name).Return(true)
+				c.EXPECT().ListSourceFilesAsc(gomock.Any(), bucket1.Name, epoch).Return(nil, errors.Errorf("fail"))
+			},
+			withErrors,
+			errors.Errorf("1 failure(s) out of 1 bucket(s) to sync"),
+		},
+		{
+			"Unlinked bucket is forgotten",
+			false,
+			func(c *mock.MockHandlers, s *selectiveMock.MockSelector) {
+				s.EXPECT().Refresh(gomock.Any()).Return([]string{}, []string{bucket3.Name}, nil)
+				c.EXPECT().ListSourceBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket3}, nil)
+				s.EXPECT().Selected(bucket3.Name).Return(false)
+				s.EXPECT().Forget(bucket3.Name).Return(nil)
+			},
+			noErrors,
+			nil,
+		},
+		{
+			"Unlinked bucket is evicted",
+			true,
+			func(c *mock.MockHandlers, s *selectiveMock.MockSelector) {
+				s.EXPECT().Refresh(gomock.Any()).Return([]string{}, []string{bucket3.Name}, nil)
+				c.EXPECT().ListSourceBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket3}, nil)
+				s.EXPECT().Selected(bucket3.Name).Return(false)
+				gomock.InOrder(
+					c.EXPECT().EvictDestinationBucket(gomock.Any(), bucket3.Name).Return(nil),
+					s.EXPECT().Forget(bucket3.Name).Return(nil),
+				)
+			},
+			noErrors,
+			nil,
+		},
+		{
+			"Failed eviction is repeated",
+			true,
+			func(c *mock.MockHandlers, s *selectiveMock.MockSelector) {
+				s.EXPECT().Refresh(gomock.Any()).Return([]string{}, []string{bucket3.Name}, nil)
+				c.EXPECT().ListSourceBuckets(gomock.Any()).Return([]*models.BucketDescriptor{}, nil)
+				c.EXPECT().EvictDestinationBucket(gomock.Any(), bucket3.Name).Return(errors.Errorf("fail"))
+			},
+			withErrors,
+			errors.Errorf("1 failure(s) out of 1 bucket(s) to sync"),
+		},
+		{
+			"Failed to refresh linked patients",
+			false,
+			func(c *mock.MockHandlers, s *selectiveMock.MockSelector) {
+				s.EXPECT().Refresh(gomock.Any()).Return(nil, nil, errors.Errorf("fail"))
+			},
+			withErrors,
+			errors.Errorf("failed to refresh linked patients: fail"),
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			h, cleanup := getMockHandlers(t)
+			defer cleanup()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			selector := selectiveMock.NewMockSelector(ctrl)
+
+			test.mockCalls(h, selector)
+
+			s := New(h, Cfg{
+				BucketsRateLimit:        1,
+				FilesPerBucketRateLimit: 1,
+				BucketsToSkip:           []string{"BUCKET_TO_SKIP"},
+				Selector:                selector,
+				EvictOnUnlink:           test.evictOnUnlink,
+			}, zerolog.New(os.Stdout))
+
+			// call sync
+			err := s.Sync(context.Background(), time.Time(time3))
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && err.Error() != test.exactError.Error() {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
+
+func TestSkipSyncedVersions(t *testing.T) {
+	h, cleanup := getMockHandlers(t)
+	defer cleanup()
+
+	// version pulled from cloud storage is not pushed back
+	pulled := *file1V2
+	pulled.Source = storageSync.CloudStorageID
+	gomock.InOrder(
+		h.EXPECT().ListSourceBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+		h.EXPECT().ListSourceFilesAsc(gomock.Any(), bucket1.Name, time3).Return([]*models.FileDescriptor{file1V3}, nil),
+		h.EXPECT().ListSourceFileVersionsAsc(gomock.Any(), bucket1.Name, file1V3.Name, time3).Return([]*models.FileDescriptor{&pulled, file1V3}, nil),
+		h.EXPECT().SyncFileDelete(gomock.Any(), bucket1.Name, file1V3.Name, file1V3.Version, file1V3.Created).Return(storageSync.ResultSynced, nil),
+	)
+
+	s := New(h, Cfg{
+		BucketsRateLimit:        1,
+		FilesPerBucketRateLimit: 1,
+		SkipSyncedVersions:      true,
+	}, zerolog.New(os.Stdout))
+
+	if err := s.Sync(context.Background(), time.Time(time3)); err != nil {
+		t.Errorf("Expected error to be nil, got %v", err)
+	}
+}
+
+func TestSyncSinceReceived(t *testing.T) {
+	h, cleanup := getMockHandlers(t)
+	defer cleanup()
+
+	// version pushed to cloud storage late keeps its time of creation but is pulled by the time it was received,
+	// version pushed from the destination storage is not pulled back
+	late := *file1V1
+	late.Source = "CLINIC2"
+	own := *file1V2
+	own.Source = "CLINIC1"
+	since := strfmt.DateTime(time.Time(time3).Add(-receivedOverlap))
+	gomock.InOrder(
+		h.EXPECT().ListSourceBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1}, nil),
+		h.EXPECT().ListSourceFilesReceivedAsc(gomock.Any(), bucket1.Name, since).Return([]*models.FileDescriptor{&own}, nil),
+		h.EXPECT().ListSourceFileVersionsReceivedAsc(gomock.Any(), bucket1.Name, file1V1.Name, since).Return([]*models.FileDescriptor{&late, &own}, nil),
+		h.EXPECT().SyncFile(gomock.Any(), bucket1.Name, late.Name, late.Version, late.Created).Return(storageSync.ResultSynced, nil),
+	)
+
+	s := New(h, Cfg{
+		BucketsRateLimit:        1,
+		FilesPerBucketRateLimit: 1,
+		Direction:               storageSync.CloudToLocal,
+		SkipSource:              "CLINIC1",
+		SinceReceived:           true,
+	}, zerolog.New(os.Stdout))
+
+	if err := s.Sync(context.Background(), time.Time(time3)); err != nil {
+		t.Errorf("Expected error to be nil, got %v", err)
+	}
+}
+
+func TestBucketCheckpoints(t *testing.T) {
+	h, cleanup := getMockHandlers(t)
+	defer cleanup()
+	kv, cleanupStorage := getTestStorage(t)
+	defer cleanupStorage()
+
+	// bucket with checkpoint is synced since its checkpoint, other buckets since the last successful run
+	checkpoints := NewCheckpoints(kv, storageSync.LocalToCloud)
+	checkpoints.Save(bucket1.Name, time.Time(time4))
+	h.EXPECT().ListSourceBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1, bucket2}, nil)
+	h.EXPECT().ListSourceFilesAsc(gomock.Any(), bucket1.Name, time4).Return([]*models.FileDescriptor{file1V3}, nil)
+	h.EXPECT().ListSourceFileVersionsAsc(gomock.Any(), bucket1.Name, file1V3.Name, time4).Return([]*models.FileDescriptor{file1V3}, nil)
+	h.EXPECT().SyncFileDelete(gomock.Any(), bucket1.Name, file1V3.Name, file1V3.Version, file1V3.Created).Return(storageSync.ResultSynced, nil)
+	h.EXPECT().ListSourceFilesAsc(gomock.Any(), bucket2.Name, time3).Return(nil, errors.Errorf("fail"))
+
+	s := New(h, Cfg{
+		BucketsRateLimit:        1,
+		FilesPerBucketRateLimit: 1,
+		Checkpoints:             checkpoints,
+	}, zerolog.New(os.Stdout))
+
+	start := time.Now()
+	if err := s.Sync(context.Background(), time.Time(time3)); err == nil {
+		t.Error("Expected error, got nil")
+	}
+
+	// checkpoint of the synced bucket is updated even though the other bucket failed
+	if checkpoint, ok := checkpoints.Get(bucket1.Name); !ok || checkpoint.Before(start.Truncate(time.Millisecond)) {
+		t.Errorf("Expected checkpoint of %s to be updated, got %s", bucket1.Name, checkpoint)
+	}
+	if _, ok := checkpoints.Get(bucket2.Name); ok {
+		t.Errorf("Expected no checkpoint of failed bucket %s", bucket2.Name)
+	}
+}
+
+func TestScheduledSync(t *testing.T) {
+	h, cleanup := getMockHandlers(t)
+	defer cleanup()
+	schedulerCtrl := gomock.NewController(t)
+	defer schedulerCtrl.Finish()
+	scheduler := schedulerMock.NewMockScheduler(schedulerCtrl)
+	kv, cleanupStorage := getTestStorage(t)
+	defer cleanupStorage()
+
+	// image is synced after the clinical file even though it was changed first
+	scheduler.EXPECT().Priority(file2V2).Return(1).AnyTimes()
+	scheduler.EXPECT().Priority(file1V3).Return(0).AnyTimes()
+	h.EXPECT().ListSourceBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1, bucket2}, nil)
+	gomock.InOrder(
+		h.EXPECT().ListSourceFilesAsc(gomock.Any(), bucket1.Name, time2).Return([]*models.FileDescriptor{file2V2, file1V3}, nil),
+		h.EXPECT().ListSourceFileVersionsAsc(gomock.Any(), bucket1.Name, file1V3.Name, time2).Return([]*models.FileDescriptor{file1V2, file1V3}, nil),
+		scheduler.EXPECT().Allowed(file1V2).Return(true),
+		scheduler.EXPECT().Wait(gomock.Any(), file1V2).Return(nil),
+		h.EXPECT().SyncFile(gomock.Any(), bucket1.Name, file1V2.Name, file1V2.Version, file1V2.Created).Return(storageSync.ResultSynced, nil),
+		scheduler.EXPECT().Sent(file1V2, int64(0)),
+		scheduler.EXPECT().Allowed(file1V3).Return(true),
+		scheduler.EXPECT().Wait(gomock.Any(), file1V3).Return(nil),
+		h.EXPECT().SyncFileDelete(gomock.Any(), bucket1.Name, file1V3.Name, file1V3.Version, file1V3.Created).Return(storageSync.ResultSynced, nil),
+		scheduler.EXPECT().Sent(file1V3, int64(0)),
+		h.EXPECT().ListSourceFileVersionsAsc(gomock.Any(), bucket1.Name, file2V2.Name, time2).Return([]*models.FileDescriptor{file2V2}, nil),
+		// image is outside of its time window
+		scheduler.EXPECT().Allowed(file2V2).Return(false),
+	)
+	h.EXPECT().ListSourceFilesAsc(gomock.Any(), bucket2.Name, time2).Return([]*models.FileDescriptor{}, nil)
+
+	checkpoints := NewCheckpoints(kv, storageSync.LocalToCloud)
+	s := New(h, Cfg{
+		BucketsRateLimit:        1,
+		FilesPerBucketRateLimit: 1,
+		Checkpoints:             checkpoints,
+		Scheduler:               scheduler,
+	}, zerolog.New(os.Stdout))
+
+	// deferred files don't fail the sync
+	if err := s.Sync(context.Background(), time.Time(time2)); err != nil {
+		t.Errorf("Expected error to be nil, got %v", err)
+	}
+
+	// bucket with deferred file keeps its checkpoint for the next run to sync the file
+	if checkpoint, ok := checkpoints.Get(bucket1.Name); !ok || !checkpoint.Equal(time.Time(time2)) {
+		t.Errorf("Expected checkpoint of %s to be %s, got %s", bucket1.Name, time2, checkpoint)
+	}
+	if checkpoint, ok := checkpoints.Get(bucket2.Name); !ok || checkpoint.Equal(time.Time(time2)) {
+		t.Errorf("Expected checkpoint of %s to be updated, got %s", bucket2.Name, checkpoint)
+	}
+}
+
+func TestScheduledSyncAcrossBuckets(t *testing.T) {
+	h, cleanup := getMockHandlers(t)
+	defer cleanup()
+	schedulerCtrl := gomock.NewController(t)
+	defer schedulerCtrl.Finish()
+	scheduler := schedulerMock.NewMockScheduler(schedulerCtrl)
+
+	// clinical file of the second bucket is synced before the image of the first one
+	scheduler.EXPECT().Priority(file2V2).Return(1).AnyTimes()
+	scheduler.EXPECT().Priority(file3V3).Return(0).AnyTimes()
+	scheduler.EXPECT().Allowed(gomock.Any()).Return(true).AnyTimes()
+	scheduler.EXPECT().Wait(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	scheduler.EXPECT().Sent(gomock.Any(), int64(0)).AnyTimes()
+	h.EXPECT().ListSourceBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1, bucket2}, nil)
+	h.EXPECT().ListSourceFilesAsc(gomock.Any(), bucket1.Name, time2).Return([]*models.FileDescriptor{file2V2}, nil)
+	h.EXPECT().ListSourceFilesAsc(gomock.Any(), bucket2.Name, time2).Return([]*models.FileDescriptor{file3V3}, nil)
+	gomock.InOrder(
+		h.EXPECT().ListSourceFileVersionsAsc(gomock.Any(), bucket2.Name, file3V3.Name, time2).Return([]*models.FileDescriptor{file3V3}, nil),
+		h.EXPECT().SyncFile(gomock.Any(), bucket2.Name, file3V3.Name, file3V3.Version, file3V3.Created).Return(storageSync.ResultSynced, nil),
+		h.EXPECT().ListSourceFileVersionsAsc(gomock.Any(), bucket1.Name, file2V2.Name, time2).Return([]*models.FileDescriptor{file2V2}, nil),
+		h.EXPECT().SyncFileDelete(gomock.Any(), bucket1.Name, file2V2.Name, file2V2.Version, file2V2.Created).Return(storageSync.ResultSynced, nil),
+	)
+
+	s := New(h, Cfg{
+		BucketsRateLimit:        1,
+		FilesPerBucketRateLimit: 1,
+		Scheduler:               scheduler,
+	}, zerolog.New(os.Stdout))
+
+	if err := s.Sync(context.Background(), time.Time(time2)); err != nil {
+		t.Errorf("Expected error to be nil, got %v", err)
+	}
+}
+
 func getMockHandlers(t *testing.T) (*mock.MockHandlers, func()) {
 	mockHandlersCtrl := gomock.NewController(t)
 	mockHandlers := mock.NewMockHandlers(mockHandlersCtrl)
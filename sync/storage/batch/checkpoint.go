@@ -0,0 +1,109 @@
+package batch
+
+import (
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// checkpointBucket is the key value storage bucket holding time of the last successful run in each direction,
+// checkpoints of buckets synced in each direction are kept in buckets prefixed with it
+const checkpointBucket = "batchStorageSync"
+
+// checkpointKey returns key of the last successful run in the direction. Local to cloud sync keeps the key
+// it used before cloud to local sync was added.
+func checkpointKey(direction storageSync.Direction) string {
+	if direction == storageSync.LocalToCloud {
+		return "lastSuccessfulRun"
+	}
+	return "lastSuccessfulRun." + string(direction)
+}
+
+// LastSuccessfulRun returns start time of the last successful run of sync in the direction, beginning of Unix
+// time if there was none.
+func LastSuccessfulRun(storage keyvalue.Storage, direction storageSync.Direction) time.Time {
+	stored := storage.Get(checkpointBucket, checkpointKey(direction))
+	if stored != nil {
+		timestamp, err := strfmt.ParseDateTime(string(stored))
+		if err == nil {
+			return time.Time(timestamp)
+		}
+	}
+
+	return time.Unix(0, 0)
+}
+
+// SaveSuccessfulRun saves start time of the successful run of sync in the direction
+func SaveSuccessfulRun(storage keyvalue.Storage, direction storageSync.Direction, start time.Time) error {
+	return storage.Update(checkpointBucket, checkpointKey(direction), []byte(strfmt.DateTime(start).String()))
+}
+
+// Checkpoints keeps start time of the last run in which each bucket was synced successfully
+type Checkpoints interface {
+	// Get returns checkpoint of the bucket, ok is false if the bucket has none
+	Get(bucketID string) (checkpoint time.Time, ok bool)
+	// Save saves checkpoint of the bucket
+	Save(bucketID string, checkpoint time.Time) error
+	// List returns checkpoints of all the buckets
+	List() (map[string]time.Time, error)
+	// Reset makes the next run sync whole history of the bucket
+	Reset(bucketID string) error
+	// Remove removes checkpoint of the bucket
+	Remove(bucketID string) error
+}
+
+type checkpoints struct {
+	storage keyvalue.Storage
+	bucket  string
+}
+
+func (c *checkpoints) Get(bucketID string) (time.Time, bool) {
+	stored := c.storage.Get(c.bucket, bucketID)
+	if stored == nil {
+		return time.Time{}, false
+	}
+	timestamp, err := strfmt.ParseDateTime(string(stored))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Time(timestamp), true
+}
+
+func (c *checkpoints) Save(bucketID string, checkpoint time.Time) error {
+	return c.storage.Update(c.bucket, bucketID, []byte(strfmt.DateTime(checkpoint).String()))
+}
+
+func (c *checkpoints) List() (map[string]time.Time, error) {
+	list := make(map[string]time.Time)
+	err := c.storage.ForEach(c.bucket, func(bucketID string, value []byte) error {
+		timestamp, err := strfmt.ParseDateTime(string(value))
+		if err != nil {
+			return errors.Wrapf(err, "invalid checkpoint of bucket %s", bucketID)
+		}
+		list[bucketID] = time.Time(timestamp)
+		return nil
+	})
+
+	return list, err
+}
+
+func (c *checkpoints) Reset(bucketID string) error {
+	return c.Save(bucketID, time.Unix(0, 0))
+}
+
+func (c *checkpoints) Remove(bucketID string) error {
+	return c.storage.Delete(c.bucket, bucketID)
+}
+
+// NewCheckpoints returns checkpoints of buckets synced in the direction kept in the key value storage
+func NewCheckpoints(storage keyvalue.Storage, direction storageSync.Direction) Checkpoints {
+	return &checkpoints{
+		storage: storage,
+		bucket:  checkpointBucket + "." + string(direction),
+	}
+}
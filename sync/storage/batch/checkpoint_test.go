@@ -0,0 +1,102 @@
+package batch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+func TestLastSuccessfulRun(t *testing.T) {
+	kv, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	// no run yet
+	if run := LastSuccessfulRun(kv, storageSync.CloudToLocal); !run.Equal(time.Unix(0, 0)) {
+		t.Errorf("Expected last successful run to be beginning of Unix time, got %s", run)
+	}
+
+	// local to cloud checkpoint is kept under the key used before sync was bidirectional
+	if err := kv.Update(checkpointBucket, "lastSuccessfulRun", []byte(time2.String())); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if err := SaveSuccessfulRun(kv, storageSync.CloudToLocal, time.Time(time4)); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	if run := LastSuccessfulRun(kv, storageSync.LocalToCloud); !run.Equal(time.Time(time2)) {
+		t.Errorf("Expected last successful local to cloud run to be %s, got %s", time2, run)
+	}
+	if run := LastSuccessfulRun(kv, storageSync.CloudToLocal); !run.Equal(time.Time(time4)) {
+		t.Errorf("Expected last successful cloud to local run to be %s, got %s", time4, run)
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	kv, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	c := NewCheckpoints(kv, storageSync.LocalToCloud)
+	if _, ok := c.Get(bucket1.Name); ok {
+		t.Error("Expected bucket without checkpoint")
+	}
+
+	if err := c.Save(bucket1.Name, time.Time(time4)); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if err := c.Save(bucket2.Name, time.Time(time4)); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if err := c.Reset(bucket2.Name); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// checkpoints of other direction are kept separately
+	if _, ok := NewCheckpoints(kv, storageSync.CloudToLocal).Get(bucket1.Name); ok {
+		t.Error("Expected bucket without cloud to local checkpoint")
+	}
+
+	list, err := c.List()
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if len(list) != 2 || !list[bucket1.Name].Equal(time.Time(time4)) || !list[bucket2.Name].Equal(time.Unix(0, 0)) {
+		t.Errorf("Unexpected checkpoints %v", list)
+	}
+
+	if err := c.Remove(bucket1.Name); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if _, ok := c.Get(bucket1.Name); ok {
+		t.Error("Expected checkpoint to be removed")
+	}
+}
+
+func getTestStorage(t *testing.T) (keyvalue.Storage, func()) {
+	dir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	kv, err := keyvalue.NewBolt(ctx, filepath.Join(dir, "batchStorageSync.db"), zerolog.New(ioutil.Discard))
+	if err != nil {
+		cancel()
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to create key value storage, %v", err)
+	}
+
+	cleanup := func() {
+		cancel()
+		os.RemoveAll(dir)
+	}
+
+	return kv, cleanup
+}
@@ -6,13 +6,14 @@ import (
 	"sync"
 	"time"
 
-	"github.com/nats-io/go-nats-streaming"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 
 	"github.com/iryonetwork/wwm/log/errorChecker"
 	"github.com/iryonetwork/wwm/metrics"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/deadLetter"
+	"github.com/iryonetwork/wwm/sync/storage/transport"
 	"github.com/iryonetwork/wwm/utils"
 )
 
@@ -20,36 +21,40 @@ type contextKey string
 
 const subID contextKey = "ID"
 const taskSeconds metrics.ID = "taskSeconds"
+const deadLettered metrics.ID = "deadLettered"
 
 type Cfg struct {
-	Connection    stan.Conn
+	Transport     transport.Transport
 	AckWait       time.Duration
 	MaxInflight   int
 	BucketsToSkip []string
 	Handlers      storageSync.Handlers
+	// DeadLetters keeps events that conflicted or failed too many times, such events are acknowledged
+	DeadLetters deadLetter.Store
 }
 
-type stanConsumer struct {
+type consumer struct {
 	ctx               context.Context
-	conn              stan.Conn
+	transport         transport.Transport
 	ackWait           time.Duration
 	maxInflight       int
 	bucketsToSkip     map[string]bool
 	handlers          storageSync.Handlers
-	subs              []stan.Subscription
+	deadLetters       deadLetter.Store
+	subs              []transport.Subscription
 	subsLock          sync.Mutex
 	logger            zerolog.Logger
 	metricsCollection map[metrics.ID]prometheus.Collector
 }
 
-// Start starts new nats-streaming queue subscription.
-func (c *stanConsumer) StartSubscription(typ storageSync.EventType) error {
+// Start starts new queue subscription of the event transport.
+func (c *consumer) StartSubscription(typ storageSync.EventType) error {
 	c.subsLock.Lock()
 
 	// ID is a sequential number of subscription within consumer.
 	ID := len(c.subs) + 1
 	ctx := context.WithValue(c.ctx, subID, ID)
-	var mh stan.MsgHandler
+	var mh transport.MsgHandler
 	switch typ {
 	case storageSync.FileNew:
 		mh = c.getMsgHandler(ctx, typ, c.handlers.SyncFile)
@@ -63,21 +68,22 @@ func (c *stanConsumer) StartSubscription(typ storageSync.EventType) error {
 	}
 
 	// Subscribe to subject:EventType, queueGroup:EventType, durableName:EventType
-	sub, err := c.conn.QueueSubscribe(
-		string(typ),
+	sub, err := c.transport.QueueSubscribe(
 		string(typ),
+		transport.SubscriptionOpts{
+			Queue:       string(typ),
+			DurableName: string(typ),
+			AckWait:     c.ackWait,
+			MaxInflight: c.maxInflight,
+		},
 		mh,
-		stan.SetManualAckMode(),
-		stan.AckWait(c.ackWait),
-		stan.MaxInflight(c.maxInflight),
-		stan.DurableName(string(typ)),
 	)
 
 	if err != nil {
 		c.logger.Error().Err(err).
 			Str("subscription", fmt.Sprintf("%s:%d", typ, ID)).
 			Str("cmd", "StartSubscription").
-			Msg("Failed to start nats-streaming subscription")
+			Msg("Failed to start subscription")
 	} else {
 		c.subs = append(c.subs, sub)
 	}
@@ -87,28 +93,28 @@ func (c *stanConsumer) StartSubscription(typ storageSync.EventType) error {
 }
 
 // Returns number of subscriptions within consumer instance.
-func (c *stanConsumer) GetNumberOfSubsriptions() int {
+func (c *consumer) GetNumberOfSubsriptions() int {
 	return len(c.subs)
 }
 
-// Close closes nats-streaming connection
-func (c *stanConsumer) Close() {
+// Close closes subscriptions and underlying event transport
+func (c *consumer) Close() {
 	c.subsLock.Lock()
 	for _, sub := range c.subs {
 		sub.Close()
 	}
-	c.subs = []stan.Subscription{}
+	c.subs = []transport.Subscription{}
 	c.subsLock.Unlock()
-	c.conn.Close()
+	c.transport.Close()
 }
 
 // GetPrometheusMetricsCollection returns all prometheus metrics collectors to be registered
-func (c *stanConsumer) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
+func (c *consumer) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
 	return c.metricsCollection
 }
 
-func (c *stanConsumer) getMsgHandler(ctx context.Context, typ storageSync.EventType, h storageSync.Handler) stan.MsgHandler {
-	return func(msg *stan.Msg) {
+func (c *consumer) getMsgHandler(ctx context.Context, typ storageSync.EventType, h storageSync.Handler) transport.MsgHandler {
+	return func(msg transport.Msg) {
 		// Make sure we record duration metrics even if processing fails, set default values for labels
 		start := time.Now()
 		ack := false
@@ -124,10 +130,10 @@ func (c *stanConsumer) getMsgHandler(ctx context.Context, typ storageSync.EventT
 		ID := ctx.Value(subID).(int)
 		c.logger.Debug().
 			Str("subscription", fmt.Sprintf("%s:%d", typ, ID)).
-			Msgf("Received message: %s", msg)
+			Msgf("Received message: %s", msg.Data())
 
 		f := storageSync.NewFileInfo()
-		err := f.Unmarshal(msg.Data)
+		err := f.Unmarshal(msg.Data())
 		if err != nil {
 			c.logger.Error().Err(err).
 				Str("cmd", "MsgHandler").
@@ -145,7 +151,22 @@ func (c *stanConsumer) getMsgHandler(ctx context.Context, typ storageSync.EventT
 					Str("subscription", fmt.Sprintf("%s:%d", typ, ID)).
 					Msg("Failed handler invocation")
 
-				if result == storageSync.ResultConflict {
+				if c.deadLetters != nil {
+					dead, derr := c.deadLetters.Failed(typ, f, result, err)
+					if derr == nil && dead {
+						// message is kept as dead letter, ack the message
+						c.logger.Warn().
+							Str("cmd", "MsgHandler").
+							Str("subscription", fmt.Sprintf("%s:%d", typ, ID)).
+							Str("deadLetter", deadLetter.ID(typ, f)).
+							Msg("Message moved to dead letters")
+						c.metricsCollection[deadLettered].(*prometheus.CounterVec).
+							With(prometheus.Labels{"event": string(typ), "result": string(result)}).
+							Inc()
+						ack = true
+						errorChecker.LogError(msg.Ack())
+					}
+				} else if result == storageSync.ResultConflict {
 					// nothing can be done about this error, ack the message
 					ack = true
 					errorChecker.LogError(msg.Ack())
@@ -153,6 +174,10 @@ func (c *stanConsumer) getMsgHandler(ctx context.Context, typ storageSync.EventT
 
 				return
 			}
+
+			if c.deadLetters != nil {
+				errorChecker.LogError(c.deadLetters.Succeeded(typ, f))
+			}
 		}
 
 		// Change ack and result variables values for metrics
@@ -163,11 +188,11 @@ func (c *stanConsumer) getMsgHandler(ctx context.Context, typ storageSync.EventT
 		c.logger.Debug().
 			Str("subscription", fmt.Sprintf("%s:%d", typ, ID)).
 			Str("cmd", "MsgHandler").
-			Msgf("Acknowledged message: %s", msg)
+			Msgf("Acknowledged message: %s", msg.Data())
 	}
 }
 
-// New returns new consumer service with provided nats-streaming connection as underlying backend.
+// New returns new consumer service with provided event transport as underlying backend.
 func New(ctx context.Context, cfg Cfg, logger zerolog.Logger) storageSync.Consumer {
 	logger = logger.With().Str("component", "sync/storage/consumer").Logger()
 
@@ -178,11 +203,17 @@ func New(ctx context.Context, cfg Cfg, logger zerolog.Logger) storageSync.Consum
 		Help:      "Time taken to serve tasks",
 	}, []string{"event", "ack", "result"})
 	metricsCollection[taskSeconds] = h
+	metricsCollection[deadLettered] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "consumer",
+		Name:      "dead_lettered",
+		Help:      "Number of messages moved to dead letters",
+	}, []string{"event", "result"})
 
-	c := &stanConsumer{
+	c := &consumer{
 		ctx:               ctx,
-		conn:              cfg.Connection,
+		transport:         cfg.Transport,
 		handlers:          cfg.Handlers,
+		deadLetters:       cfg.DeadLetters,
 		maxInflight:       cfg.MaxInflight,
 		ackWait:           cfg.AckWait,
 		bucketsToSkip:     utils.SliceToMap(cfg.BucketsToSkip),
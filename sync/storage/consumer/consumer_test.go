@@ -17,8 +17,10 @@ import (
 	"github.com/rs/zerolog"
 
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	deadLetterMock "github.com/iryonetwork/wwm/sync/storage/deadLetter/mock"
 	"github.com/iryonetwork/wwm/sync/storage/mock"
 	"github.com/iryonetwork/wwm/sync/storage/publisher"
+	"github.com/iryonetwork/wwm/sync/storage/transport"
 )
 
 var (
@@ -333,6 +335,56 @@ func TestMessageHandlingNack(t *testing.T) {
 	<-time.After(time.Duration(50 * time.Millisecond))
 }
 
+func TestMessageHandlingDeadLetter(t *testing.T) {
+	h, cleanHandlers := getMockHandlers(t)
+	defer cleanHandlers()
+	c, cleanService := getTestService(t, context.Background(), "Consumer", h)
+	defer cleanService()
+	p, cleanPublisher := getTestPublisher(t)
+	defer cleanPublisher()
+	deadLettersCtrl := gomock.NewController(t)
+	defer deadLettersCtrl.Finish()
+	deadLetters := deadLetterMock.NewMockStore(deadLettersCtrl)
+	c.deadLetters = deadLetters
+
+	// Expect handler call, conflicting message is moved to dead letters and not redelivered
+	called := make(chan bool)
+	gomock.InOrder(
+		h.EXPECT().
+			SyncFile(gomock.Any(), file1.BucketID, file1.FileID, file1.Version, time1).
+			Return(storageSync.ResultConflict, fmt.Errorf("conflict")).
+			Times(1),
+		deadLetters.EXPECT().
+			Failed(storageSync.FileNew, file1, storageSync.ResultConflict, gomock.Any()).
+			Return(true, nil).
+			Do(func(_ storageSync.EventType, _ *storageSync.FileInfo, _ storageSync.SyncResult, _ error) {
+				called <- true
+			}).
+			Times(1),
+	)
+
+	// start consumer
+	err := c.StartSubscription(storageSync.FileNew)
+	if err != nil {
+		t.Fatal("Failed to start subscription")
+	}
+
+	err = p.Publish(context.Background(), storageSync.FileNew, file1)
+	if err != nil {
+		t.Fatal("Failed to publish to test nats-streaming server")
+	}
+
+	select {
+	case <-called:
+		// all good
+	case <-time.After(time.Duration(10 * time.Millisecond)):
+		t.Fatal("Message was not moved to dead letters during specified time")
+	}
+
+	// wait longer than AckWait to ensure message is not redelivered
+	<-time.After(time.Duration(1100 * time.Millisecond))
+}
+
 func TestDurability(t *testing.T) {
 	h, cleanHandlers := getMockHandlers(t)
 	defer cleanHandlers()
@@ -448,7 +500,7 @@ func getMockHandlers(t *testing.T) (*mock.MockHandlers, func()) {
 	return mockHandlers, cleanup
 }
 
-func getTestService(t *testing.T, ctx context.Context, clientID string, h storageSync.Handlers) (*stanConsumer, func()) {
+func getTestService(t *testing.T, ctx context.Context, clientID string, h storageSync.Handlers) (*consumer, func()) {
 	conn, err := stan.Connect(clusterID, clientID)
 	if err != nil {
 		t.Fatal("Connection to test stan-straming server failed")
@@ -456,7 +508,7 @@ func getTestService(t *testing.T, ctx context.Context, clientID string, h storag
 
 	// initalize consumer
 	cfg := Cfg{
-		Connection:    conn,
+		Transport:     transport.NewStan(conn),
 		AckWait:       time.Duration(time.Second),
 		MaxInflight:   1,
 		BucketsToSkip: []string{"BUCKET_TO_SKIP"},
@@ -469,7 +521,7 @@ func getTestService(t *testing.T, ctx context.Context, clientID string, h storag
 		c.Close()
 	}
 
-	return c.(*stanConsumer), cleanup
+	return c.(*consumer), cleanup
 }
 
 func getTestPublisher(t *testing.T) (storageSync.Publisher, func()) {
@@ -479,7 +531,7 @@ func getTestPublisher(t *testing.T) (storageSync.Publisher, func()) {
 	}
 
 	cfg := publisher.Cfg{
-		Connection:      conn,
+		Transport:       transport.NewStan(conn),
 		Retries:         5,
 		StartRetryWait:  time.Duration(time.Millisecond),
 		RetryWaitFactor: 1.0,
@@ -0,0 +1,216 @@
+package deadLetter
+
+//go:generate ../../../bin/mockgen.sh sync/storage/deadLetter Store $GOFILE
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+var (
+	attemptsBucket    = []byte("attempts")
+	deadLettersBucket = []byte("deadLetters")
+)
+
+// lockTimeout is the maximum time to wait for other process to release the store file
+const lockTimeout = 10 * time.Second
+
+// ErrNotFound is returned when dead letter does not exist
+var ErrNotFound = errors.New("dead letter not found")
+
+// Store keeps track of failed attempts to handle sync events and keeps the events that exceeded the retry budget
+// or conflicted as dead letters to be inspected, replayed or discarded.
+type Store interface {
+	// Failed records failed attempt to handle the event and returns true if the event is dead-lettered.
+	// Conflicting events are dead-lettered immediately.
+	Failed(typ storageSync.EventType, f *storageSync.FileInfo, result storageSync.SyncResult, err error) (bool, error)
+	// Succeeded forgets failed attempts to handle the event.
+	Succeeded(typ storageSync.EventType, f *storageSync.FileInfo) error
+	// List returns all the dead letters.
+	List() ([]*Entry, error)
+	// Get returns the dead letter.
+	Get(id string) (*Entry, error)
+	// Remove removes the dead letter.
+	Remove(id string) error
+}
+
+// Entry is the dead-lettered event
+type Entry struct {
+	ID          string                 `json:"id"`
+	Event       storageSync.EventType  `json:"event"`
+	File        *storageSync.FileInfo  `json:"file"`
+	Result      storageSync.SyncResult `json:"result"`
+	Error       string                 `json:"error"`
+	Attempts    int                    `json:"attempts"`
+	FirstFailed time.Time              `json:"firstFailed"`
+	LastFailed  time.Time              `json:"lastFailed"`
+}
+
+type store struct {
+	path        string
+	maxAttempts int
+	// mu serializes opening of the file within the process
+	mu     sync.Mutex
+	logger zerolog.Logger
+}
+
+func (s *store) Failed(typ storageSync.EventType, f *storageSync.FileInfo, result storageSync.SyncResult, err error) (bool, error) {
+	id := ID(typ, f)
+	now := time.Now().UTC()
+	deadLettered := false
+
+	uerr := s.update(func(tx *bolt.Tx) error {
+		attempts := tx.Bucket(attemptsBucket)
+		deadLetters := tx.Bucket(deadLettersBucket)
+
+		e := &Entry{ID: id, Event: typ, File: f, FirstFailed: now}
+		if v := deadLetters.Get([]byte(id)); v != nil {
+			deadLettered = true
+			if err := json.Unmarshal(v, e); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal dead letter %s", id)
+			}
+		} else if v := attempts.Get([]byte(id)); v != nil {
+			if err := json.Unmarshal(v, e); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal attempts of %s", id)
+			}
+		}
+		e.Attempts++
+		e.LastFailed = now
+		e.Result = result
+		if err != nil {
+			e.Error = err.Error()
+		}
+
+		b, merr := json.Marshal(e)
+		if merr != nil {
+			return merr
+		}
+		if deadLettered || result == storageSync.ResultConflict || e.Attempts >= s.maxAttempts {
+			deadLettered = true
+			if derr := attempts.Delete([]byte(id)); derr != nil {
+				return derr
+			}
+			return deadLetters.Put([]byte(id), b)
+		}
+
+		return attempts.Put([]byte(id), b)
+	})
+	if uerr != nil {
+		s.logger.Error().Err(uerr).Str("cmd", "Failed").Str("id", id).Msg("Failed to record failed attempt")
+		return false, uerr
+	}
+
+	return deadLettered, nil
+}
+
+func (s *store) Succeeded(typ storageSync.EventType, f *storageSync.FileInfo) error {
+	id := ID(typ, f)
+
+	err := s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(attemptsBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		s.logger.Error().Err(err).Str("cmd", "Succeeded").Str("id", id).Msg("Failed to forget failed attempts")
+	}
+
+	return err
+}
+
+func (s *store) List() ([]*Entry, error) {
+	entries := []*Entry{}
+
+	err := s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).ForEach(func(k, v []byte) error {
+			e := &Entry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal dead letter %s", k)
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (s *store) Get(id string) (*Entry, error) {
+	var e *Entry
+
+	err := s.update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(deadLettersBucket).Get([]byte(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		e = &Entry{}
+		return json.Unmarshal(v, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (s *store) Remove(id string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deadLettersBucket)
+		if b.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// update runs the function in read-write transaction of the store file. The file is opened only for the duration
+// of the transaction so that dead letters can be managed while storageSync is running.
+func (s *store) update(fn func(*bolt.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return errors.Wrapf(err, "failed to open dead letter store %s", s.path)
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{attemptsBucket, deadLettersBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return fn(tx)
+	})
+}
+
+// ID returns ID of the event
+func ID(typ storageSync.EventType, f *storageSync.FileInfo) string {
+	return fmt.Sprintf("%s:%s:%s:%s", typ, f.BucketID, f.FileID, f.Version)
+}
+
+// New returns new dead letter store in the bolt file at the path. Events are dead-lettered after maxAttempts
+// failed attempts.
+func New(path string, maxAttempts int, logger zerolog.Logger) (Store, error) {
+	logger = logger.With().Str("component", "sync/storage/deadLetter").Logger()
+
+	s := &store{path: path, maxAttempts: maxAttempts, logger: logger}
+
+	// make sure the file can be opened
+	if err := s.update(func(*bolt.Tx) error { return nil }); err != nil {
+		logger.Error().Err(err).Str("filepath", path).Msg("Failed to initialize dead letter store")
+		return nil, err
+	}
+
+	return s, nil
+}
@@ -0,0 +1,117 @@
+package deadLetter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/rs/zerolog"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+var (
+	time1, _ = strfmt.ParseDateTime("2018-02-05T15:16:15.123Z")
+	file1    = &storageSync.FileInfo{BucketID: "bucket", FileID: "file1", Version: "V1", Created: time1}
+	file2    = &storageSync.FileInfo{BucketID: "bucket", FileID: "file2", Version: "V1", Created: time1}
+)
+
+func TestFailed(t *testing.T) {
+	testCases := []struct {
+		description  string
+		results      []storageSync.SyncResult
+		succeeded    int
+		deadLettered []bool
+	}{
+		{"Event is dead-lettered after max attempts", []storageSync.SyncResult{storageSync.ResultError, storageSync.ResultError, storageSync.ResultError}, -1, []bool{false, false, true}},
+		{"Conflict is dead-lettered immediately", []storageSync.SyncResult{storageSync.ResultConflict}, -1, []bool{true}},
+		{"Success resets attempts", []storageSync.SyncResult{storageSync.ResultError, storageSync.ResultError, storageSync.ResultError}, 1, []bool{false, false, false}},
+		{"Dead letter stays dead-lettered", []storageSync.SyncResult{storageSync.ResultConflict, storageSync.ResultError}, 0, []bool{true, true}},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			s, cleanup := getTestStore(t)
+			defer cleanup()
+
+			for i, result := range test.results {
+				dead, err := s.Failed(storageSync.FileNew, file1, result, fmt.Errorf("error %d", i))
+				if err != nil {
+					t.Fatalf("Expected error to be nil, got %v", err)
+				}
+				if dead != test.deadLettered[i] {
+					t.Errorf("Expected attempt %d dead-lettered to be %t, got %t", i+1, test.deadLettered[i], dead)
+				}
+				if i == test.succeeded {
+					if err := s.Succeeded(storageSync.FileNew, file1); err != nil {
+						t.Fatalf("Expected error to be nil, got %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestManage(t *testing.T) {
+	s, cleanup := getTestStore(t)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		s.Failed(storageSync.FileUpdate, file1, storageSync.ResultError, fmt.Errorf("error %d", i))
+	}
+	s.Failed(storageSync.FileNew, file2, storageSync.ResultError, fmt.Errorf("error"))
+
+	// dead letters are visible to other store on the same file
+	other, err := New(s.(*store).path, 3, zerolog.New(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	entries, err := other.List()
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(entries))
+	}
+
+	id := ID(storageSync.FileUpdate, file1)
+	e, err := other.Get(id)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if e.ID != id || e.Event != storageSync.FileUpdate || *e.File != *file1 || e.Attempts != 3 || e.Error != "error 2" || e.Result != storageSync.ResultError {
+		t.Errorf("Unexpected dead letter %+v", e)
+	}
+	if e.FirstFailed.After(e.LastFailed) {
+		t.Errorf("Expected first failure %s before last failure %s", e.FirstFailed, e.LastFailed)
+	}
+
+	if err := other.Remove(id); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if _, err := s.Get(id); err != ErrNotFound {
+		t.Errorf("Expected error to equal '%v', got %v", ErrNotFound, err)
+	}
+	if err := s.Remove(id); err != ErrNotFound {
+		t.Errorf("Expected error to equal '%v', got %v", ErrNotFound, err)
+	}
+}
+
+func getTestStore(t *testing.T) (Store, func()) {
+	dir, err := ioutil.TempDir("", "deadLetter")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %v", err)
+	}
+
+	s, err := New(filepath.Join(dir, "deadLetters.db"), 3, zerolog.New(ioutil.Discard))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to create dead letter store, %v", err)
+	}
+
+	return s, func() { os.RemoveAll(dir) }
+}
@@ -1,9 +1,12 @@
 package storage
 
 import (
-	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/go-openapi/runtime"
@@ -13,6 +16,8 @@ import (
 
 	"github.com/iryonetwork/wwm/gen/storage/client/operations"
 	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/utils/contentEncoding"
+	"github.com/iryonetwork/wwm/utils/spool"
 )
 
 // Handlers describes public API for sync/storage event handlers
@@ -27,8 +32,39 @@ type Handlers interface {
 	ListSourceFilesAsc(ctx context.Context, bucketID string, createdAtSince strfmt.DateTime) ([]*models.FileDescriptor, error)
 	// ListSourceFileVersions lists all the file versions in the source storage ascending order by Created timestamp ensured.
 	ListSourceFileVersionsAsc(ctx context.Context, bucketID, fileID string, createdAtSince strfmt.DateTime) ([]*models.FileDescriptor, error)
+	// ListSourceFilesReceivedAsc lists all the files in the bucket of source storage with any version received by source storage since the time including files marked as delete, ascending order by Created timestamp ensured.
+	ListSourceFilesReceivedAsc(ctx context.Context, bucketID string, receivedSince strfmt.DateTime) ([]*models.FileDescriptor, error)
+	// ListSourceFileVersionsReceivedAsc lists all the file versions received by source storage since the time, ascending order by Created timestamp ensured.
+	ListSourceFileVersionsReceivedAsc(ctx context.Context, bucketID, fileID string, receivedSince strfmt.DateTime) ([]*models.FileDescriptor, error)
 	// ListDestinationFileVersions lists all the file versions in the destination storage ascending order by Created timestamp ensured.
 	ListDestinationFileVersionsAsc(ctx context.Context, bucketID, fileID string, createdAtSince strfmt.DateTime) ([]*models.FileDescriptor, error)
+	// FetchSourceFile downloads the file version from source storage into the spool file verifying its checksum.
+	FetchSourceFile(ctx context.Context, bucketID, fileID, version string, f *spool.File) error
+	// EvictDestinationBucket removes all the files of the bucket from destination storage without syncing their removal.
+	EvictDestinationBucket(ctx context.Context, bucketID string) error
+}
+
+// downloadAttempts is the number of attempts to fetch the file from source storage
+const downloadAttempts = 3
+
+// fileHeaders holds metadata of the file fetched from source storage
+type fileHeaders struct {
+	checksum    string
+	contentType string
+	created     strfmt.DateTime
+	archetype   string
+	labels      string
+	parents     string
+	source      string
+}
+
+// sentBytesKey is the context key of the counter of bytes sent to destination storage
+type sentBytesKey struct{}
+
+// WithSentBytes returns context in which SyncFile adds number of bytes of file contents sent to destination storage
+// to the counter, contents are counted as they are sent with their content coding.
+func WithSentBytes(ctx context.Context, sent *int64) context.Context {
+	return context.WithValue(ctx, sentBytesKey{}, sent)
 }
 
 // Handler describes sync/storage sync handler function
@@ -37,25 +73,18 @@ type Handler func(ctx context.Context, bucketID, fileID, version string, created
 type handlers struct {
 	source          *operations.Client
 	sourceAuth      runtime.ClientAuthInfoWriter
+	sourceID        string
 	destination     *operations.Client
 	destinationAuth runtime.ClientAuthInfoWriter
 	logger          zerolog.Logger
 }
 
-// SyncFile synchronizes new files and file updates to destination storage
+// SyncFile synchronizes new files and file updates to destination storage. Contents are fetched from source
+// storage only if the version is missing in destination storage or its contents differ there.
 func (h *handlers) SyncFile(ctx context.Context, bucketID, fileID, version string, timestamp strfmt.DateTime) (SyncResult, error) {
-	// Get file from source storage
-	var buf bytes.Buffer
-
-	getParams := operations.NewFileGetVersionParams().
-		WithBucket(strfmt.UUID(bucketID)).
-		WithFileID(fileID).
-		WithVersion(version).
-		WithContext(ctx)
-	resp, err := h.source.FileGetVersion(getParams, h.sourceAuth, &buf)
-
+	meta, err := h.sourceMetadata(ctx, bucketID, fileID, version)
 	if err != nil {
-		if _, ok := err.(*operations.FileGetVersionNotFound); ok {
+		if _, ok := err.(*operations.SyncFileMetadataNotFound); ok {
 			h.logger.Error().Err(err).
 				Str("bucket", bucketID).
 				Str("fileID", fileID).
@@ -70,12 +99,12 @@ func (h *handlers) SyncFile(ctx context.Context, bucketID, fileID, version strin
 			Str("bucket", bucketID).
 			Str("fileID", fileID).
 			Str("version", version).
-			Msg("Error on trying to fetch file from source storage.")
+			Msg("Error on trying to fetch file metadata from source storage.")
 		return ResultError, err
 	}
 
 	// Check if sync is needed
-	needsSync, err := h.needsSync(ctx, bucketID, fileID, version, resp.XChecksum)
+	needsSync, accepted, known, err := h.needsSync(ctx, bucketID, fileID, version, meta.XChecksum)
 	if err != nil {
 		return ResultError, err
 	}
@@ -85,22 +114,102 @@ func (h *handlers) SyncFile(ctx context.Context, bucketID, fileID, version strin
 		return ResultSyncNotNeeded, nil
 	}
 
+	// Get file from source storage; contents are spooled to a temporary file instead of memory
+	f, err := spool.New("")
+	if err != nil {
+		h.logger.Error().Err(err).Str("cmd", "SyncFile").Msg("Failed to create spool file")
+		return ResultError, err
+	}
+	defer f.Close()
+
+	resp, err := h.fetch(ctx, bucketID, fileID, version, known, f)
+
+	if err != nil {
+		switch err.(type) {
+		case *operations.FileGetVersionNotFound:
+			h.logger.Error().Err(err).
+				Str("bucket", bucketID).
+				Str("fileID", fileID).
+				Str("version", version).
+				Msg("File does not exist in source storage.")
+
+			// File might have been already deleted; mark as succesful
+			return ResultSyncNotNeeded, nil
+		case *operations.FileGetVersionNotModified:
+			h.logger.Debug().
+				Str("cmd", "SyncFile").
+				Str("bucket", bucketID).
+				Str("fileID", fileID).
+				Str("version", version).
+				Msg("File in source storage matches the one in destination storage")
+
+			return ResultSyncNotNeeded, nil
+		}
+
+		h.logger.Error().Err(err).
+			Str("bucket", bucketID).
+			Str("fileID", fileID).
+			Str("version", version).
+			Msg("Error on trying to fetch file from source storage.")
+		return ResultError, err
+	}
+
+	// Make sure the file was transferred correctly
+	if err := f.Verify(resp.checksum); err != nil {
+		h.logger.Error().Err(err).
+			Str("cmd", "SyncFile").
+			Str("bucket", bucketID).
+			Str("fileID", fileID).
+			Str("version", version).
+			Msg("Contents fetched from source storage don't match their checksum.")
+		return ResultError, err
+	}
+
 	// Sync file
 	syncParams := operations.NewSyncFileParams().
 		WithBucket(strfmt.UUID(bucketID)).
 		WithFileID(fileID).
 		WithVersion(version).
 		WithContext(ctx).
-		WithCreated(resp.XCreated)
-	if resp.XArchetype != "" {
-		syncParams.SetArchetype(&resp.XArchetype)
+		WithChecksum(resp.checksum).
+		WithCreated(resp.created)
+	if resp.archetype != "" {
+		syncParams.SetArchetype(&resp.archetype)
 	}
-	if resp.XLabels != "" {
-		syncParams.SetLabels(formatLabelsFromHeader(resp.XLabels))
+	if resp.labels != "" {
+		syncParams.SetLabels(formatLabelsFromHeader(resp.labels))
 	}
+	if resp.parents != "" {
+		syncParams.SetParents(formatLabelsFromHeader(resp.parents))
+	}
+	// version synced to the source storage keeps the ID of the storage where it was created
+	syncParams.SetSource(h.versionSource(resp.source))
 
-	syncParams.SetContentType(resp.XContentType)
-	syncParams.SetFile(runtime.NamedReader("FileReader", &buf))
+	var contents io.Reader
+	if contents, err = f.Reader(); err != nil {
+		return ResultError, err
+	}
+	// compressible contents are encoded with content coding accepted by destination storage which stores
+	// the original contents, checksum refers to them
+	encoding := contentEncoding.Identity
+	if contentEncoding.Compressible(resp.contentType) {
+		encoding = contentEncoding.Negotiate(accepted)
+	}
+	if encoding != contentEncoding.Identity {
+		syncParams.SetSize(swag.Int64(f.Size()))
+		encoded, err := contentEncoding.Encode(ioutil.NopCloser(contents), encoding)
+		if err != nil {
+			return ResultError, err
+		}
+		defer encoded.Close()
+		contents = encoded
+		syncParams.SetContentEncoding(&encoding)
+	}
+	if sent, ok := ctx.Value(sentBytesKey{}).(*int64); ok {
+		contents = &countingReader{contents, sent}
+	}
+	syncParams.SetContentType(resp.contentType)
+	syncParams.SetFile(runtime.NamedReader("FileReader", contents))
 	ok, created, err := h.destination.SyncFile(syncParams, h.destinationAuth)
 
 	switch {
@@ -111,6 +220,15 @@ func (h *handlers) SyncFile(ctx context.Context, bucketID, fileID, version strin
 			Str("fileID", fileID).
 			Str("version", version).
 			Msg("File already exists in destination storage")
+	case created != nil && created.Payload != nil && created.Payload.Conflict:
+		// concurrently written version is kept as a sibling in destination storage until the conflict is resolved
+		h.logger.Warn().
+			Str("cmd", "SyncFile").
+			Str("bucket", bucketID).
+			Str("fileID", fileID).
+			Str("version", version).
+			Strs("siblings", created.Payload.Siblings).
+			Msg("Synced file conflicts with concurrently written versions in destination storage")
 	case created != nil:
 		h.logger.Debug().
 			Str("cmd", "SyncFile").
@@ -125,19 +243,14 @@ func (h *handlers) SyncFile(ctx context.Context, bucketID, fileID, version strin
 			Str("fileID", fileID).
 			Str("version", version).
 			Msg("Failed to sync file to destination storage")
-		switch err.(type) {
-		case *operations.SyncFileConflict:
-			// another attempt at sync should not be performed
-			return ResultConflict, err
-		default:
-			return ResultError, err
-		}
+		return ResultError, err
 	}
 
 	return ResultSynced, nil
 }
 
-// SyncFileDelete synchronizes file deletion to destination operations.
+// SyncFileDelete synchronizes file deletion to destination operations. Deletion keeps versions it was derived from
+// so that deletion concurrent with an update is kept as a sibling in destination storage.
 func (h *handlers) SyncFileDelete(ctx context.Context, bucketID, fileID, version string, timestamp strfmt.DateTime) (SyncResult, error) {
 	params := operations.NewSyncFileDeleteParams().
 		WithBucket(strfmt.UUID(bucketID)).
@@ -145,7 +258,28 @@ func (h *handlers) SyncFileDelete(ctx context.Context, bucketID, fileID, version
 		WithVersion(version).
 		WithCreated(timestamp).
 		WithContext(ctx)
-	_, err := h.destination.SyncFileDelete(params, h.destinationAuth)
+
+	meta, err := h.sourceMetadata(ctx, bucketID, fileID, version)
+	switch err.(type) {
+	case nil:
+		if meta.XParents != "" {
+			params.SetParents(formatLabelsFromHeader(meta.XParents))
+		}
+		params.SetSource(h.versionSource(meta.XSource))
+	case *operations.SyncFileMetadataNotFound:
+		// deletion is synced without its lineage
+		params.SetSource(h.versionSource(""))
+	default:
+		h.logger.Error().Err(err).
+			Str("cmd", "SyncFileDelete").
+			Str("bucket", bucketID).
+			Str("fileID", fileID).
+			Str("version", version).
+			Msg("Error on trying to fetch file metadata from source storage.")
+		return ResultError, err
+	}
+
+	_, err = h.destination.SyncFileDelete(params, h.destinationAuth)
 
 	if err != nil {
 		h.logger.Error().Err(err).
@@ -155,8 +289,8 @@ func (h *handlers) SyncFileDelete(ctx context.Context, bucketID, fileID, version
 			Str("version", version).
 			Msg("Failed to sync file deletion")
 		switch err.(type) {
-		case *operations.SyncFileDeleteConflict:
-			// another attempt at sync should not be performed
+		case *operations.SyncFileDeleteConflict, *operations.SyncFileDeleteLocked:
+			// another attempt at sync should not be performed, file under legal hold stays in destination storage
 			return ResultConflict, err
 		default:
 			return ResultError, err
@@ -180,33 +314,164 @@ func (h *handlers) ListSourceBuckets(ctx context.Context) ([]*models.BucketDescr
 
 // ListSourceFiles lists all the files in the bucket of source storage including files marked as delete.
 func (h *handlers) ListSourceFilesAsc(ctx context.Context, bucketID string, createdAtSince strfmt.DateTime) ([]*models.FileDescriptor, error) {
-	return h.listFilesAsc(ctx, h.source, h.sourceAuth, bucketID, createdAtSince)
+	params := operations.NewSyncFileListParams().
+		WithCreatedAtSince(swag.String(createdAtSince.String()))
+	return h.listFilesAsc(ctx, h.source, h.sourceAuth, bucketID, params)
 }
 
 // ListSourceFileVersions lists all the file versions in the source storage.
 func (h *handlers) ListSourceFileVersionsAsc(ctx context.Context, bucketID, fileID string, createdAtSince strfmt.DateTime) ([]*models.FileDescriptor, error) {
-	return h.listFileVersionsAsc(ctx, h.source, h.sourceAuth, bucketID, fileID, createdAtSince)
+	params := operations.NewSyncFileListVersionsParams().
+		WithCreatedAtSince(swag.String(createdAtSince.String()))
+	return h.listFileVersionsAsc(ctx, h.source, h.sourceAuth, bucketID, fileID, params)
+}
+
+// ListSourceFilesReceivedAsc lists all the files in the bucket of source storage with any version received since the time.
+func (h *handlers) ListSourceFilesReceivedAsc(ctx context.Context, bucketID string, receivedSince strfmt.DateTime) ([]*models.FileDescriptor, error) {
+	params := operations.NewSyncFileListParams().
+		WithReceivedSince(swag.String(receivedSince.String()))
+	return h.listFilesAsc(ctx, h.source, h.sourceAuth, bucketID, params)
+}
+
+// ListSourceFileVersionsReceivedAsc lists all the file versions received by source storage since the time.
+func (h *handlers) ListSourceFileVersionsReceivedAsc(ctx context.Context, bucketID, fileID string, receivedSince strfmt.DateTime) ([]*models.FileDescriptor, error) {
+	params := operations.NewSyncFileListVersionsParams().
+		WithReceivedSince(swag.String(receivedSince.String()))
+	return h.listFileVersionsAsc(ctx, h.source, h.sourceAuth, bucketID, fileID, params)
 }
 
 // ListDestinationFileVersions lists all the file versions in the destination storage.
 func (h *handlers) ListDestinationFileVersionsAsc(ctx context.Context, bucketID, fileID string, createdAtSince strfmt.DateTime) ([]*models.FileDescriptor, error) {
-	return h.listFileVersionsAsc(ctx, h.destination, h.destinationAuth, bucketID, fileID, createdAtSince)
+	params := operations.NewSyncFileListVersionsParams().
+		WithCreatedAtSince(swag.String(createdAtSince.String()))
+	return h.listFileVersionsAsc(ctx, h.destination, h.destinationAuth, bucketID, fileID, params)
 }
 
-// NewApiHandlers returns Handlers with cloudStorage and localStorage API used.
-func NewHandlers(source *operations.Client, sourceAuth runtime.ClientAuthInfoWriter, destination *operations.Client, destinationAuth runtime.ClientAuthInfoWriter, logger zerolog.Logger) Handlers {
+// FetchSourceFile downloads the file version from source storage into the spool file verifying its checksum.
+func (h *handlers) FetchSourceFile(ctx context.Context, bucketID, fileID, version string, f *spool.File) error {
+	resp, err := h.fetch(ctx, bucketID, fileID, version, "", f)
+	if err != nil {
+		h.logger.Error().Err(err).
+			Str("cmd", "FetchSourceFile").
+			Str("bucket", bucketID).
+			Str("fileID", fileID).
+			Str("version", version).
+			Msg("Error on trying to fetch file from source storage.")
+		return err
+	}
+
+	return f.Verify(resp.checksum)
+}
+
+// EvictDestinationBucket removes all the files of the bucket from destination storage without syncing their removal.
+func (h *handlers) EvictDestinationBucket(ctx context.Context, bucketID string) error {
+	params := operations.NewSyncBucketEvictParams().
+		WithBucket(strfmt.UUID(bucketID)).
+		WithContext(ctx)
+	_, err := h.destination.SyncBucketEvict(params, h.destinationAuth)
+
+	if err != nil {
+		h.logger.Error().Err(err).
+			Str("cmd", "EvictDestinationBucket").
+			Str("bucket", bucketID).
+			Msg("Failed to evict bucket from destination storage")
+		return err
+	}
+
+	h.logger.Debug().
+		Str("cmd", "EvictDestinationBucket").
+		Str("bucket", bucketID).
+		Msg("Succesfully evicted bucket from destination storage")
+
+	return nil
+}
+
+// versionSource returns ID of the storage where the synced version was created, versions without source were
+// created in the source storage.
+func (h *handlers) versionSource(source string) *string {
+	if source == "" {
+		source = h.sourceID
+	}
+	if source == "" {
+		return nil
+	}
+	return &source
+}
+
+// NewApiHandlers returns Handlers with cloudStorage and localStorage API used. Source ID identifies the source storage
+// in versions synced to destination storage.
+func NewHandlers(source *operations.Client, sourceAuth runtime.ClientAuthInfoWriter, sourceID string, destination *operations.Client, destinationAuth runtime.ClientAuthInfoWriter, logger zerolog.Logger) Handlers {
 	logger = logger.With().Str("component", "sync/storage/handlers").Logger()
 
 	return &handlers{
 		source:          source,
 		sourceAuth:      sourceAuth,
+		sourceID:        sourceID,
 		destination:     destination,
 		destinationAuth: destinationAuth,
 		logger:          logger,
 	}
 }
 
-func (h *handlers) needsSync(ctx context.Context, bucketID, fileID, version, sourceChecksum string) (bool, error) {
+// fetch downloads the file version from source storage into the spool file. Interrupted downloads
+// are resumed with a range request starting after the contents already received. Contents with the known
+// checksum are not downloaded again, FileGetVersionNotModified is returned instead.
+func (h *handlers) fetch(ctx context.Context, bucketID, fileID, version, knownChecksum string, f *spool.File) (*fileHeaders, error) {
+	var err error
+	for attempt := 0; attempt < downloadAttempts; attempt++ {
+		params := operations.NewFileGetVersionParams().
+			WithBucket(strfmt.UUID(bucketID)).
+			WithFileID(fileID).
+			WithVersion(version).
+			WithContext(ctx)
+		if knownChecksum != "" {
+			params.SetIfNoneMatch(swag.String(knownETags(knownChecksum)))
+		}
+		if f.Size() > 0 {
+			params.SetRange(swag.String(fmt.Sprintf("bytes=%d-", f.Size())))
+		}
+
+		var ok *operations.FileGetVersionOK
+		var partial *operations.FileGetVersionPartialContent
+		ok, partial, err = h.source.FileGetVersion(params, h.sourceAuth, f)
+		switch {
+		case ok != nil:
+			return &fileHeaders{ok.XChecksum, ok.XContentType, ok.XCreated, ok.XArchetype, ok.XLabels, ok.XParents, ok.XSource}, nil
+		case partial != nil:
+			return &fileHeaders{partial.XChecksum, partial.XContentType, partial.XCreated, partial.XArchetype, partial.XLabels, partial.XParents, partial.XSource}, nil
+		}
+
+		switch err.(type) {
+		case *operations.FileGetVersionNotFound, *operations.FileGetVersionForbidden, *operations.FileGetVersionNotModified:
+			return nil, err
+		}
+		if f.Size() == 0 || ctx.Err() != nil {
+			return nil, err
+		}
+		h.logger.Info().Err(err).
+			Str("cmd", "SyncFile").
+			Str("bucket", bucketID).
+			Str("fileID", fileID).
+			Str("version", version).
+			Msgf("Download interrupted after %d bytes, resuming.", f.Size())
+	}
+
+	return nil, err
+}
+
+// sourceMetadata returns metadata of the file version in source storage without fetching its contents
+func (h *handlers) sourceMetadata(ctx context.Context, bucketID, fileID, version string) (*operations.SyncFileMetadataOK, error) {
+	params := operations.NewSyncFileMetadataParams().
+		WithBucket(strfmt.UUID(bucketID)).
+		WithFileID(fileID).
+		WithVersion(version).
+		WithContext(ctx)
+	return h.source.SyncFileMetadata(params, h.sourceAuth)
+}
+
+// needsSync returns true if the file version has to be synced, content codings accepted by destination storage
+// and checksum of the file version if destination storage holds it already
+func (h *handlers) needsSync(ctx context.Context, bucketID, fileID, version, sourceChecksum string) (bool, string, string, error) {
 	// Verify in case file already exists in destination storage
 	params := operations.NewSyncFileMetadataParams().
 		WithBucket(strfmt.UUID(bucketID)).
@@ -225,17 +490,24 @@ func (h *handlers) needsSync(ctx context.Context, bucketID, fileID, version, sou
 				Str("version", version).
 				Msg("File already exists in destination storage and has different checksum, resync.")
 
-			return true, nil
+			return true, resp.AcceptEncoding, resp.XChecksum, nil
 		}
 		// Nothing to do
-		return false, nil
+		return false, resp.AcceptEncoding, resp.XChecksum, nil
 	}
 	// If file not found it needs sync, otherwise return error
-	if _, ok := err.(*operations.SyncFileMetadataNotFound); !ok {
-		return false, err
+	notFound, ok := err.(*operations.SyncFileMetadataNotFound)
+	if !ok {
+		return false, "", "", err
 	}
 
-	return true, nil
+	return true, notFound.AcceptEncoding, "", nil
+}
+
+// knownETags returns If-None-Match header matching entity tags of the contents with the checksum in all the
+// content codings source storage might encode them with
+func knownETags(checksum string) string {
+	return fmt.Sprintf("%s, %s", strconv.Quote(checksum), strconv.Quote(checksum+"-"+contentEncoding.Gzip))
 }
 
 func (h *handlers) listBuckets(ctx context.Context, c *operations.Client, auth runtime.ClientAuthInfoWriter) ([]*models.BucketDescriptor, error) {
@@ -254,10 +526,9 @@ func (h *handlers) listBuckets(ctx context.Context, c *operations.Client, auth r
 	return resp.Payload, nil
 }
 
-func (h *handlers) listFilesAsc(ctx context.Context, c *operations.Client, auth runtime.ClientAuthInfoWriter, bucketID string, createdAtSince strfmt.DateTime) ([]*models.FileDescriptor, error) {
-	params := operations.NewSyncFileListParams().
+func (h *handlers) listFilesAsc(ctx context.Context, c *operations.Client, auth runtime.ClientAuthInfoWriter, bucketID string, params *operations.SyncFileListParams) ([]*models.FileDescriptor, error) {
+	params = params.
 		WithBucket(strfmt.UUID(bucketID)).
-		WithCreatedAtSince(swag.String(createdAtSince.String())).
 		WithContext(ctx)
 	resp, err := c.SyncFileList(params, auth)
 
@@ -277,11 +548,10 @@ func (h *handlers) listFilesAsc(ctx context.Context, c *operations.Client, auth
 	return files, nil
 }
 
-func (h *handlers) listFileVersionsAsc(ctx context.Context, c *operations.Client, auth runtime.ClientAuthInfoWriter, bucketID, fileID string, createdAtSince strfmt.DateTime) ([]*models.FileDescriptor, error) {
-	params := operations.NewSyncFileListVersionsParams().
+func (h *handlers) listFileVersionsAsc(ctx context.Context, c *operations.Client, auth runtime.ClientAuthInfoWriter, bucketID, fileID string, params *operations.SyncFileListVersionsParams) ([]*models.FileDescriptor, error) {
+	params = params.
 		WithBucket(strfmt.UUID(bucketID)).
 		WithFileID(fileID).
-		WithCreatedAtSince(swag.String(createdAtSince.String())).
 		WithContext(ctx)
 	resp, err := c.SyncFileListVersions(params, auth)
 
@@ -304,3 +574,15 @@ func (h *handlers) listFileVersionsAsc(ctx context.Context, c *operations.Client
 func formatLabelsFromHeader(h string) []string {
 	return strings.Split(h, "|")
 }
+
+// countingReader adds number of read bytes to the counter
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	*r.n += int64(n)
+	return n, err
+}
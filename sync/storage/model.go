@@ -1,6 +1,6 @@
 package storage
 
-//go:generate ../../bin/mockgen.sh sync/storage Publisher,Consumer,Handlers $GOFILE
+//go:generate ../../bin/mockgen.sh sync/storage Publisher,Recorder,Consumer,Handlers $GOFILE
 
 import (
 	"context"
@@ -26,6 +26,18 @@ const (
 	FileDelete EventType = "file.delete"
 )
 
+// Direction defines direction of sync between local and cloud storage
+type Direction string
+
+// Direction constants
+const (
+	LocalToCloud Direction = "localToCloud"
+	CloudToLocal Direction = "cloudToLocal"
+)
+
+// CloudStorageID is the ID of cloud storage recorded as the source of file versions pulled from it
+const CloudStorageID = "cloud"
+
 // Publisher describes sync/storage publisher public methods.
 type Publisher interface {
 	// Publish pushes sync/storage event and returns synchronous response.
@@ -38,6 +50,17 @@ type Publisher interface {
 	GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector
 }
 
+// Recorder describes publisher recording events before the change they describe is made, so that events of changes
+// made just before the process stopped are not lost.
+type Recorder interface {
+	// Record stores the event as pending and returns its key.
+	Record(ctx context.Context, typ EventType, f *FileInfo) (string, error)
+	// Commit marks the pending event as ready to be published once the change was made.
+	Commit(key string) error
+	// Discard removes the pending event of the change that was not made.
+	Discard(key string) error
+}
+
 // Consumer describes public methods of consumer used by storageSync service.
 type Consumer interface {
 	// StartConsumer starts consumer following service configration.
@@ -0,0 +1,509 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/metrics"
+	"github.com/iryonetwork/wwm/status"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+const (
+	outboxDepth   metrics.ID = "outboxDepth"
+	relayedEvents metrics.ID = "relayedEvents"
+	eventsBucket  string     = "events"
+	pendingBucket string     = "pending"
+)
+
+const (
+	defaultRelayInterval  = 10 * time.Second
+	defaultStartRetryWait = time.Second
+)
+
+// Outbox is storage sync publisher that durably stores events in local key-value storage before they are
+// relayed to the underlying publisher. Events recorded before the change they describe is made are kept pending
+// until they are committed; events pending before restart are committed or discarded according to Cfg.Check.
+type Outbox interface {
+	storageSync.Publisher
+	storageSync.Recorder
+	status.Component
+	// Depth returns number of events waiting to be relayed.
+	Depth() int
+}
+
+type Cfg struct {
+	// Storage keeps events until they are relayed
+	Storage keyvalue.Storage
+	// Publisher to which events are relayed, events are only stored if it's nil
+	Publisher storageSync.Publisher
+	// RelayInterval is the interval in which stored events are relayed if no new events are published
+	RelayInterval   time.Duration
+	StartRetryWait  time.Duration
+	RetryWaitFactor float32
+	MaxRetryWait    time.Duration
+	// DepthWarning is the depth above which outbox reports warning status
+	DepthWarning int
+	// Check reports whether the change described by the event pending before restart was made, pending events
+	// are kept until next restart if it's nil
+	Check CheckFunc
+}
+
+// CheckFunc reports whether the change described by the event was made
+type CheckFunc func(ctx context.Context, typ storageSync.EventType, f *storageSync.FileInfo) (bool, error)
+
+type outbox struct {
+	storage           keyvalue.Storage
+	publisher         storageSync.Publisher
+	relayInterval     time.Duration
+	startRetryWait    time.Duration
+	retryWaitFactor   float32
+	maxRetryWait      time.Duration
+	depthWarning      int
+	mu                sync.Mutex
+	seq               uint64
+	depth             int
+	relayErr          error
+	notify            chan struct{}
+	cancel            context.CancelFunc
+	done              chan struct{}
+	closeOnce         sync.Once
+	logger            zerolog.Logger
+	metricsCollection map[metrics.ID]prometheus.Collector
+}
+
+type event struct {
+	Type storageSync.EventType `json:"type"`
+	File *storageSync.FileInfo `json:"file"`
+}
+
+// Publish durably stores the event to be relayed.
+func (o *outbox) Publish(_ context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
+	b, err := json.Marshal(&event{Type: typ, File: f})
+	if err != nil {
+		o.logger.Error().Err(err).
+			Str("cmd", "Publish").
+			Msg("Failed to marshal event")
+		return err
+	}
+
+	o.mu.Lock()
+	k := key(o.nextSeq())
+	err = o.storage.Add(eventsBucket, k, b)
+	if err == nil {
+		o.added()
+	}
+	o.mu.Unlock()
+
+	if err != nil {
+		o.logger.Error().Err(err).
+			Str("cmd", "Publish").
+			Str("type", string(typ)).
+			Msg("Failed to store event in outbox")
+		return err
+	}
+	o.wake()
+
+	return nil
+}
+
+// PublishAsyncWithRetries durably stores the event to be relayed, the underlying publisher retries relaying it.
+func (o *outbox) PublishAsyncWithRetries(ctx context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
+	return o.Publish(ctx, typ, f)
+}
+
+// Record durably stores the event as pending, it's relayed only after it's committed.
+func (o *outbox) Record(_ context.Context, typ storageSync.EventType, f *storageSync.FileInfo) (string, error) {
+	b, err := json.Marshal(&event{Type: typ, File: f})
+	if err != nil {
+		o.logger.Error().Err(err).
+			Str("cmd", "Record").
+			Msg("Failed to marshal event")
+		return "", err
+	}
+
+	o.mu.Lock()
+	k := key(o.nextSeq())
+	err = o.storage.Add(pendingBucket, k, b)
+	o.mu.Unlock()
+
+	if err != nil {
+		o.logger.Error().Err(err).
+			Str("cmd", "Record").
+			Str("type", string(typ)).
+			Msg("Failed to store pending event in outbox")
+		return "", err
+	}
+
+	return k, nil
+}
+
+// Commit moves the pending event among events to be relayed keeping its place in the sequence.
+func (o *outbox) Commit(k string) error {
+	b := o.storage.Get(pendingBucket, k)
+	if b == nil {
+		return errors.Errorf("pending event %s not found", k)
+	}
+
+	o.mu.Lock()
+	err := o.storage.Add(eventsBucket, k, b)
+	if err == nil {
+		o.added()
+	}
+	o.mu.Unlock()
+
+	if err != nil {
+		o.logger.Error().Err(err).
+			Str("cmd", "Commit").
+			Str("key", k).
+			Msg("Failed to store event in outbox")
+		return err
+	}
+	o.wake()
+
+	// event that stays pending is committed again after restart, it's already among events
+	return o.storage.Delete(pendingBucket, k)
+}
+
+// Discard removes the pending event.
+func (o *outbox) Discard(k string) error {
+	return o.storage.Delete(pendingBucket, k)
+}
+
+// nextSeq returns next sequence number, caller has to hold the lock
+func (o *outbox) nextSeq() uint64 {
+	seq := uint64(time.Now().UnixNano())
+	if seq <= o.seq {
+		seq = o.seq + 1
+	}
+	o.seq = seq
+
+	return seq
+}
+
+// added counts stored event, caller has to hold the lock
+func (o *outbox) added() {
+	o.depth++
+	o.metricsCollection[outboxDepth].(prometheus.Gauge).Set(float64(o.depth))
+}
+
+// wake wakes up relay
+func (o *outbox) wake() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// reconcile commits events pending before restart if the change they describe was made and discards the others
+func (o *outbox) reconcile(ctx context.Context, check CheckFunc) error {
+	pending := make(map[string][]byte)
+	err := o.storage.ForEach(pendingBucket, func(k string, v []byte) error {
+		// value is valid only during iteration
+		pending[k] = append([]byte(nil), v...)
+		return nil
+	})
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+	if check == nil {
+		o.logger.Warn().
+			Str("cmd", "reconcile").
+			Msgf("%d pending events are kept, they can't be checked", len(pending))
+		return nil
+	}
+
+	for k, v := range pending {
+		// event was committed before the pending entry was removed
+		if o.storage.Get(eventsBucket, k) != nil {
+			if err := o.storage.Delete(pendingBucket, k); err != nil {
+				return err
+			}
+			continue
+		}
+
+		e := &event{}
+		if err := json.Unmarshal(v, e); err != nil || e.File == nil {
+			o.logger.Error().Err(err).
+				Str("cmd", "reconcile").
+				Str("key", k).
+				Msg("Failed to unmarshal pending event, it will be removed")
+			if err := o.Discard(k); err != nil {
+				return err
+			}
+			continue
+		}
+
+		made, err := check(ctx, e.Type, e.File)
+		if err != nil {
+			o.logger.Error().Err(err).
+				Str("cmd", "reconcile").
+				Str("key", k).
+				Msg("Failed to check pending event, it's kept until restart")
+			continue
+		}
+		if made {
+			err = o.Commit(k)
+		} else {
+			err = o.Discard(k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close stops relaying events and closes the underlying publisher. Events that were not relayed are kept in the
+// storage and relayed after restart.
+func (o *outbox) Close() {
+	o.closeOnce.Do(func() {
+		o.cancel()
+		<-o.done
+		if o.publisher != nil {
+			o.publisher.Close()
+		}
+	})
+}
+
+// GetPrometheusMetricsCollection returns outbox metrics together with metrics of the underlying publisher
+func (o *outbox) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
+	m := make(map[metrics.ID]prometheus.Collector)
+	if o.publisher != nil {
+		for id, c := range o.publisher.GetPrometheusMetricsCollection() {
+			m[id] = c
+		}
+	}
+	for id, c := range o.metricsCollection {
+		m[id] = c
+	}
+
+	return m
+}
+
+// Depth returns number of events waiting to be relayed.
+func (o *outbox) Depth() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.depth
+}
+
+// Status reports warning if events can't be relayed or too many events are waiting
+func (o *outbox) Status() *status.Response {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch {
+	case o.publisher == nil:
+		return &status.Response{Status: status.Warning, Msg: fmt.Sprintf("%d events waiting, publisher is not connected", o.depth)}
+	case o.relayErr != nil:
+		return &status.Response{Status: status.Warning, Msg: fmt.Sprintf("%d events waiting, failed to relay: %v", o.depth, o.relayErr)}
+	case o.depthWarning > 0 && o.depth > o.depthWarning:
+		return &status.Response{Status: status.Warning, Msg: fmt.Sprintf("%d events waiting", o.depth)}
+	}
+
+	return &status.Response{Status: status.OK, Msg: fmt.Sprintf("%d events waiting", o.depth)}
+}
+
+// relay publishes stored events in order until the context is cancelled
+func (o *outbox) relay(ctx context.Context) {
+	defer close(o.done)
+
+	ticker := time.NewTicker(o.relayInterval)
+	defer ticker.Stop()
+
+	retryWait := o.startRetryWait
+	for {
+		wait, notify := ticker.C, o.notify
+		var retry <-chan time.Time
+		if err := o.drain(ctx); err != nil {
+			o.logger.Error().Err(err).
+				Str("cmd", "relay").
+				Msgf("Failed to relay events, retry in %s", retryWait)
+
+			// new events don't interrupt waiting for the retry
+			retry, wait, notify = time.After(retryWait), nil, nil
+			retryWait = time.Duration(float32(retryWait) * o.retryWaitFactor)
+			if o.maxRetryWait > 0 && retryWait > o.maxRetryWait {
+				retryWait = o.maxRetryWait
+			}
+		} else {
+			retryWait = o.startRetryWait
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-retry:
+		case <-wait:
+		case <-notify:
+		}
+	}
+}
+
+// drain publishes stored events, it stops on first failure so that order of events is kept
+func (o *outbox) drain(ctx context.Context) error {
+	keys, events, err := o.stored()
+	if err != nil {
+		return err
+	}
+
+	for i, e := range events {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if e != nil {
+			err := o.publisher.Publish(ctx, e.Type, e.File)
+			o.setRelayErr(err)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := o.storage.Delete(eventsBucket, keys[i]); err != nil {
+			return err
+		}
+		o.metricsCollection[relayedEvents].(prometheus.Counter).Inc()
+
+		o.mu.Lock()
+		o.depth--
+		o.metricsCollection[outboxDepth].(prometheus.Gauge).Set(float64(o.depth))
+		o.mu.Unlock()
+	}
+
+	return nil
+}
+
+// stored returns stored events in order, events that can't be unmarshalled are returned as nil to be removed
+func (o *outbox) stored() ([]string, []*event, error) {
+	var keys []string
+	var events []*event
+
+	err := o.storage.ForEach(eventsBucket, func(k string, v []byte) error {
+		e := &event{}
+		if err := json.Unmarshal(v, e); err != nil || e.File == nil {
+			o.logger.Error().Err(err).
+				Str("cmd", "relay").
+				Str("key", k).
+				Msg("Failed to unmarshal stored event, it will be removed")
+			e = nil
+		}
+		keys = append(keys, k)
+		events = append(events, e)
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, events, nil
+}
+
+func (o *outbox) setRelayErr(err error) {
+	o.mu.Lock()
+	o.relayErr = err
+	o.mu.Unlock()
+}
+
+// seen continues sequence of the stored key
+func (o *outbox) seen(k string) {
+	if seq, err := strconv.ParseUint(k, 10, 64); err == nil && seq > o.seq {
+		o.seq = seq
+	}
+}
+
+// key returns zero padded sequence number so that the keys are ordered
+func key(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// New returns new outbox storing events in the provided storage and relaying them to the provided publisher.
+func New(ctx context.Context, cfg Cfg, logger zerolog.Logger) (Outbox, error) {
+	logger = logger.With().Str("component", "sync/storage/outbox").Logger()
+
+	metricsCollection := make(map[metrics.ID]prometheus.Collector)
+	metricsCollection[outboxDepth] = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "outbox",
+		Name:      "depth",
+		Help:      "Number of storage sync events waiting to be relayed to publisher",
+	})
+	metricsCollection[relayedEvents] = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "outbox",
+		Name:      "relayed_events",
+		Help:      "Number of storage sync events relayed to publisher",
+	})
+
+	relayInterval := cfg.RelayInterval
+	if relayInterval <= 0 {
+		relayInterval = defaultRelayInterval
+	}
+	startRetryWait := cfg.StartRetryWait
+	if startRetryWait <= 0 {
+		startRetryWait = defaultStartRetryWait
+	}
+	retryWaitFactor := cfg.RetryWaitFactor
+	if retryWaitFactor < 1 {
+		retryWaitFactor = 1
+	}
+
+	o := &outbox{
+		storage:           cfg.Storage,
+		publisher:         cfg.Publisher,
+		relayInterval:     relayInterval,
+		startRetryWait:    startRetryWait,
+		retryWaitFactor:   retryWaitFactor,
+		maxRetryWait:      cfg.MaxRetryWait,
+		depthWarning:      cfg.DepthWarning,
+		notify:            make(chan struct{}, 1),
+		done:              make(chan struct{}),
+		logger:            logger,
+		metricsCollection: metricsCollection,
+	}
+
+	// count events stored before restart and continue their sequence
+	err := o.storage.ForEach(eventsBucket, func(k string, _ []byte) error {
+		o.depth++
+		o.seen(k)
+		return nil
+	})
+	if err == nil {
+		err = o.storage.ForEach(pendingBucket, func(k string, _ []byte) error {
+			o.seen(k)
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	metricsCollection[outboxDepth].(prometheus.Gauge).Set(float64(o.depth))
+	if err := o.reconcile(ctx, cfg.Check); err != nil {
+		return nil, err
+	}
+
+	ctx, o.cancel = context.WithCancel(ctx)
+	if o.publisher != nil {
+		go o.relay(ctx)
+	} else {
+		close(o.done)
+	}
+
+	// Close if context is Done()
+	go func() {
+		<-ctx.Done()
+		o.Close()
+	}()
+
+	return o, nil
+}
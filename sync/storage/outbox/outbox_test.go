@@ -0,0 +1,324 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/golang/mock/gomock"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/status"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	keyvalueMock "github.com/iryonetwork/wwm/storage/keyvalue/mock"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/mock"
+)
+
+var (
+	time1, _ = strfmt.ParseDateTime("2018-02-05T15:16:15.123Z")
+	file1    = &storageSync.FileInfo{BucketID: "bucket", FileID: "file1", Version: "V1", Created: time1}
+	file2    = &storageSync.FileInfo{BucketID: "bucket", FileID: "file2", Version: "V1", Created: time1}
+	file3    = &storageSync.FileInfo{BucketID: "bucket", FileID: "file3", Version: "V1", Created: time1}
+)
+
+func TestRelay(t *testing.T) {
+	kv, cleanup := getTestStorage(t)
+	defer cleanup()
+	p, done := getMockPublisher(t)
+	defer done()
+
+	relayed := make(chan struct{}, 10)
+	relay := func(_ context.Context, _ storageSync.EventType, _ *storageSync.FileInfo) { relayed <- struct{}{} }
+	gomock.InOrder(
+		p.EXPECT().Publish(gomock.Any(), storageSync.FileNew, file1).Do(relay).Return(nil),
+		p.EXPECT().Publish(gomock.Any(), storageSync.FileUpdate, file2).Do(relay).Return(nil),
+		p.EXPECT().Publish(gomock.Any(), storageSync.FileDelete, file3).Do(relay).Return(nil),
+		p.EXPECT().Close(),
+	)
+
+	o := getTestOutbox(t, kv, p)
+
+	for _, e := range []event{{storageSync.FileNew, file1}, {storageSync.FileUpdate, file2}, {storageSync.FileDelete, file3}} {
+		if err := o.PublishAsyncWithRetries(context.Background(), e.Type, e.File); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		wait(t, relayed)
+	}
+	o.Close()
+
+	if depth := o.Depth(); depth != 0 {
+		t.Errorf("Expected depth 0, got %d", depth)
+	}
+	if s := o.Status(); s.Status != status.OK {
+		t.Errorf("Expected status %s, got %s", status.OK, s.Status)
+	}
+}
+
+func TestRelayRetries(t *testing.T) {
+	kv, cleanup := getTestStorage(t)
+	defer cleanup()
+	p, done := getMockPublisher(t)
+	defer done()
+
+	failed := make(chan struct{}, 10)
+	relayed := make(chan struct{}, 10)
+	gomock.InOrder(
+		p.EXPECT().Publish(gomock.Any(), storageSync.FileNew, file1).
+			Do(func(_ context.Context, _ storageSync.EventType, _ *storageSync.FileInfo) { failed <- struct{}{} }).
+			Return(fmt.Errorf("error")),
+		p.EXPECT().Publish(gomock.Any(), storageSync.FileNew, file1).
+			Do(func(_ context.Context, _ storageSync.EventType, _ *storageSync.FileInfo) { relayed <- struct{}{} }).
+			Return(nil),
+		p.EXPECT().Publish(gomock.Any(), storageSync.FileNew, file2).
+			Do(func(_ context.Context, _ storageSync.EventType, _ *storageSync.FileInfo) { relayed <- struct{}{} }).
+			Return(nil),
+		p.EXPECT().Close(),
+	)
+
+	o, err := New(context.Background(), Cfg{Storage: kv, Publisher: p, StartRetryWait: 200 * time.Millisecond}, zerolog.New(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	defer o.Close()
+
+	if err := o.Publish(context.Background(), storageSync.FileNew, file1); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	wait(t, failed)
+
+	// events are kept in order until relay succeeds
+	if err := o.Publish(context.Background(), storageSync.FileNew, file2); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if depth := o.Depth(); depth != 2 {
+		t.Errorf("Expected depth 2, got %d", depth)
+	}
+	if s := o.Status(); s.Status != status.Warning {
+		t.Errorf("Expected status %s, got %s", status.Warning, s.Status)
+	}
+
+	wait(t, relayed)
+	wait(t, relayed)
+	o.Close()
+
+	if s := o.Status(); s.Status != status.OK {
+		t.Errorf("Expected status %s, got %s", status.OK, s.Status)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	kv, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	// events are only stored without publisher
+	o, err := New(context.Background(), Cfg{Storage: kv, DepthWarning: 1}, zerolog.New(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	for _, f := range []*storageSync.FileInfo{file1, file2} {
+		if err := o.PublishAsyncWithRetries(context.Background(), storageSync.FileNew, f); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+	if s := o.Status(); s.Status != status.Warning {
+		t.Errorf("Expected status %s, got %s", status.Warning, s.Status)
+	}
+	o.Close()
+
+	// stored events are relayed after restart
+	p, done := getMockPublisher(t)
+	defer done()
+	relayed := make(chan struct{}, 10)
+	relay := func(_ context.Context, _ storageSync.EventType, _ *storageSync.FileInfo) { relayed <- struct{}{} }
+	gomock.InOrder(
+		p.EXPECT().Publish(gomock.Any(), storageSync.FileNew, file1).Do(relay).Return(nil),
+		p.EXPECT().Publish(gomock.Any(), storageSync.FileNew, file2).Do(relay).Return(nil),
+		p.EXPECT().Close(),
+	)
+
+	o = getTestOutbox(t, kv, p)
+	wait(t, relayed)
+	wait(t, relayed)
+	o.Close()
+
+	if depth := o.Depth(); depth != 0 {
+		t.Errorf("Expected depth 0, got %d", depth)
+	}
+}
+
+func TestStorageFailure(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	kv := keyvalueMock.NewMockStorage(ctrl)
+	p := mock.NewMockPublisher(ctrl)
+
+	// error is returned if event can't be stored
+	gomock.InOrder(
+		kv.EXPECT().ForEach(eventsBucket, gomock.Any()).Return(nil),
+		kv.EXPECT().ForEach(pendingBucket, gomock.Any()).Return(nil),
+		kv.EXPECT().ForEach(pendingBucket, gomock.Any()).Return(nil),
+		kv.EXPECT().Add(eventsBucket, gomock.Any(), gomock.Any()).Return(fmt.Errorf("error")),
+	)
+	kv.EXPECT().ForEach(eventsBucket, gomock.Any()).Return(nil).AnyTimes()
+	p.EXPECT().Close()
+
+	o := getTestOutbox(t, kv, p)
+	defer o.Close()
+
+	if err := o.PublishAsyncWithRetries(context.Background(), storageSync.FileNew, file1); err == nil {
+		t.Error("Expected error, got nil")
+	}
+	if depth := o.Depth(); depth != 0 {
+		t.Errorf("Expected depth 0, got %d", depth)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	kv, cleanup := getTestStorage(t)
+	defer cleanup()
+	p, done := getMockPublisher(t)
+	defer done()
+
+	relayed := make(chan struct{}, 10)
+	relay := func(_ context.Context, _ storageSync.EventType, _ *storageSync.FileInfo) { relayed <- struct{}{} }
+	gomock.InOrder(
+		p.EXPECT().Publish(gomock.Any(), storageSync.FileNew, file1).Do(relay).Return(nil),
+		p.EXPECT().Publish(gomock.Any(), storageSync.FileUpdate, file3).Do(relay).Return(nil),
+		p.EXPECT().Close(),
+	)
+
+	o := getTestOutbox(t, kv, p)
+
+	// committed events are relayed, discarded ones are not
+	keys := make([]string, 3)
+	for i, e := range []event{{storageSync.FileNew, file1}, {storageSync.FileNew, file2}, {storageSync.FileUpdate, file3}} {
+		var err error
+		if keys[i], err = o.Record(context.Background(), e.Type, e.File); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+	for _, err := range []error{o.Commit(keys[0]), o.Discard(keys[1]), o.Commit(keys[2])} {
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+	wait(t, relayed)
+	wait(t, relayed)
+	o.Close()
+
+	if err := o.Commit(keys[1]); err == nil {
+		t.Error("Expected discarded event not to be committed")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	kv, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	// pending events are kept while they can't be checked
+	o, err := New(context.Background(), Cfg{Storage: kv}, zerolog.New(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	for _, f := range []*storageSync.FileInfo{file1, file2, file3} {
+		if _, err := o.Record(context.Background(), storageSync.FileNew, f); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+	o.Close()
+	o, err = New(context.Background(), Cfg{Storage: kv}, zerolog.New(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	o.Close()
+
+	// after restart events of changes that were made are relayed, the others are discarded and events that
+	// can't be checked are kept
+	p, done := getMockPublisher(t)
+	defer done()
+	relayed := make(chan struct{}, 10)
+	relay := func(_ context.Context, _ storageSync.EventType, _ *storageSync.FileInfo) { relayed <- struct{}{} }
+	gomock.InOrder(
+		p.EXPECT().Publish(gomock.Any(), storageSync.FileNew, file1).Do(relay).Return(nil),
+		p.EXPECT().Close(),
+	)
+	check := func(_ context.Context, _ storageSync.EventType, f *storageSync.FileInfo) (bool, error) {
+		switch f.FileID {
+		case file1.FileID:
+			return true, nil
+		case file2.FileID:
+			return false, nil
+		}
+		return false, fmt.Errorf("error")
+	}
+
+	o, err = New(context.Background(), Cfg{Storage: kv, Publisher: p, Check: check, StartRetryWait: time.Millisecond}, zerolog.New(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	wait(t, relayed)
+	o.Close()
+
+	var pending []string
+	kv.ForEach(pendingBucket, func(k string, v []byte) error {
+		pending = append(pending, k)
+		return nil
+	})
+	if len(pending) != 1 {
+		t.Errorf("Expected 1 pending event, got %d", len(pending))
+	}
+}
+
+func getTestOutbox(t *testing.T, kv keyvalue.Storage, p storageSync.Publisher) Outbox {
+	o, err := New(context.Background(), Cfg{Storage: kv, Publisher: p, StartRetryWait: time.Millisecond}, zerolog.New(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("Failed to create outbox, %v", err)
+	}
+
+	return o
+}
+
+func getTestStorage(t *testing.T) (keyvalue.Storage, func()) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	kv, err := keyvalue.NewBolt(ctx, filepath.Join(dir, "outbox.db"), zerolog.New(ioutil.Discard))
+	if err != nil {
+		cancel()
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to create key value storage, %v", err)
+	}
+
+	cleanup := func() {
+		cancel()
+		os.RemoveAll(dir)
+	}
+
+	return kv, cleanup
+}
+
+func getMockPublisher(t *testing.T) (*mock.MockPublisher, func()) {
+	ctrl := gomock.NewController(t)
+	p := mock.NewMockPublisher(ctrl)
+
+	return p, ctrl.Finish
+}
+
+func wait(t *testing.T, ch chan struct{}) {
+	select {
+	case <-ch:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected event to be relayed")
+	}
+}
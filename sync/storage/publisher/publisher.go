@@ -1,7 +1,5 @@
 package publisher
 
-//go:generate ../../../bin/mockgen.sh sync/storage/publisher StanConnection $GOFILE
-
 import (
 	"context"
 	"sync"
@@ -12,27 +10,22 @@ import (
 
 	"github.com/iryonetwork/wwm/metrics"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/transport"
 )
 
 const publishSeconds metrics.ID = "publishSeconds"
 const publishCalls metrics.ID = "publishCalls"
 
-// Connection interface describes actions that have to be supported by underlying connection with nats-streaming. For testing purposes.
-type StanConnection interface {
-	Publish(subject string, data []byte) error
-	Close() error
-}
-
 type Cfg struct {
-	Connection      StanConnection
+	Transport       transport.Transport
 	Retries         int
 	StartRetryWait  time.Duration
 	RetryWaitFactor float32
 }
 
-type stanPublisher struct {
+type publisher struct {
 	ctx               context.Context
-	conn              StanConnection
+	transport         transport.Transport
 	retries           int
 	startRetryWait    time.Duration
 	retryWaitFactor   float32
@@ -65,7 +58,7 @@ func (p *nullPublisher) GetPrometheusMetricsCollection() map[metrics.ID]promethe
 }
 
 // Publish pushes sync/storage event and returns synchronous response.
-func (p *stanPublisher) Publish(_ context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
+func (p *publisher) Publish(_ context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
 	// Make sure we record duration metrics even if processing fails
 	start := time.Now()
 	defer func() {
@@ -82,7 +75,7 @@ func (p *stanPublisher) Publish(_ context.Context, typ storageSync.EventType, f
 		return err
 	}
 
-	err = p.conn.Publish(string(typ), msg)
+	err = p.transport.Publish(string(typ), msg)
 	p.metricsCollection[publishCalls].(prometheus.Counter).Inc() // increase publish calls counter metrics
 
 	if err != nil {
@@ -95,7 +88,7 @@ func (p *stanPublisher) Publish(_ context.Context, typ storageSync.EventType, f
 }
 
 // Publish starts goroutine that pushes sync/storage events and retries if publishing failed.
-func (p *stanPublisher) PublishAsyncWithRetries(ctx context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
+func (p *publisher) PublishAsyncWithRetries(ctx context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
 	// Make sure we record duration metrics even if processing fails
 	start := time.Now()
 	defer func() {
@@ -124,7 +117,7 @@ func (p *stanPublisher) PublishAsyncWithRetries(ctx context.Context, typ storage
 					Msg("Async publishing stopped due to context cancellation")
 				break RetryLoop
 			default:
-				err = p.conn.Publish(string(typ), msg)
+				err = p.transport.Publish(string(typ), msg)
 				p.metricsCollection[publishCalls].(prometheus.Counter).Inc() // increase publish calls counter metrics
 
 				if err == nil {
@@ -156,18 +149,18 @@ func (p *stanPublisher) PublishAsyncWithRetries(ctx context.Context, typ storage
 	return nil
 }
 
-// Close waits for all async publish routines to finish and closes underlying connection.
-func (p *stanPublisher) Close() {
+// Close waits for all async publish routines to finish and closes underlying transport.
+func (p *publisher) Close() {
 	p.wg.Wait()
-	p.conn.Close()
+	p.transport.Close()
 }
 
 // GetPrometheusMetricsCollection returns all prometheus metrics collectors needed to be registered
-func (p *stanPublisher) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
+func (p *publisher) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
 	return p.metricsCollection
 }
 
-// New returns new stanPublisher with provided nats-streaming connectiom as underlying backend.
+// New returns new publisher with provided event transport as underlying backend.
 func New(ctx context.Context, cfg Cfg, logger zerolog.Logger) storageSync.Publisher {
 	logger = logger.With().Str("component", "sync/storage/publisher").Logger()
 
@@ -182,13 +175,13 @@ func New(ctx context.Context, cfg Cfg, logger zerolog.Logger) storageSync.Publis
 	c := prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "publisher",
 		Name:      "publish_calls",
-		Help:      "Number of publish calls to nats-streaming",
+		Help:      "Number of publish calls to event transport",
 	})
 	metricsCollection[publishCalls] = c
 
-	p := &stanPublisher{
+	p := &publisher{
 		ctx:               ctx,
-		conn:              cfg.Connection,
+		transport:         cfg.Transport,
 		retries:           cfg.Retries,
 		startRetryWait:    cfg.StartRetryWait,
 		retryWaitFactor:   cfg.RetryWaitFactor,
@@ -13,7 +13,7 @@ import (
 
 	"github.com/iryonetwork/wwm/log/errorChecker"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
-	"github.com/iryonetwork/wwm/sync/storage/publisher/mock"
+	"github.com/iryonetwork/wwm/sync/storage/transport/mock"
 )
 
 var (
@@ -28,13 +28,13 @@ func TestPublish(t *testing.T) {
 
 	testCases := []struct {
 		description   string
-		mockCalls     func(*mock.MockStanConnection) []*gomock.Call
+		mockCalls     func(*mock.MockTransport) []*gomock.Call
 		errorExpected bool
 		exactError    error
 	}{
 		{
 			"Publish succeeds",
-			func(c *mock.MockStanConnection) []*gomock.Call {
+			func(c *mock.MockTransport) []*gomock.Call {
 				msg, _ := file.Marshal()
 				return []*gomock.Call{
 					c.EXPECT().Publish(string(storageSync.FileNew), msg).Return(nil).Times(1),
@@ -45,7 +45,7 @@ func TestPublish(t *testing.T) {
 		},
 		{
 			"Publish fails",
-			func(c *mock.MockStanConnection) []*gomock.Call {
+			func(c *mock.MockTransport) []*gomock.Call {
 				msg, _ := file.Marshal()
 				return []*gomock.Call{
 					c.EXPECT().Publish(string(storageSync.FileNew), msg).Return(expectedError).Times(1),
@@ -84,12 +84,12 @@ func TestPublish(t *testing.T) {
 func TestPublishAsyncWithRetries(t *testing.T) {
 	testCases := []struct {
 		description   string
-		mockCalls     func(*mock.MockStanConnection) []*gomock.Call
+		mockCalls     func(*mock.MockTransport) []*gomock.Call
 		errorExpected bool
 	}{
 		{
 			"Publish succeeds without retries",
-			func(c *mock.MockStanConnection) []*gomock.Call {
+			func(c *mock.MockTransport) []*gomock.Call {
 				msg, _ := file.Marshal()
 				return []*gomock.Call{
 					c.EXPECT().Publish(string(storageSync.FileNew), msg).Return(nil).Times(1),
@@ -99,7 +99,7 @@ func TestPublishAsyncWithRetries(t *testing.T) {
 		},
 		{
 			"Publish succeeds on second retry",
-			func(c *mock.MockStanConnection) []*gomock.Call {
+			func(c *mock.MockTransport) []*gomock.Call {
 				msg, _ := file.Marshal()
 				return []*gomock.Call{
 					c.EXPECT().Publish(string(storageSync.FileNew), msg).Return(fmt.Errorf("error")).Times(2),
@@ -110,7 +110,7 @@ func TestPublishAsyncWithRetries(t *testing.T) {
 		},
 		{
 			"Publish fails after retry limit",
-			func(c *mock.MockStanConnection) []*gomock.Call {
+			func(c *mock.MockTransport) []*gomock.Call {
 				msg, _ := file.Marshal()
 				return []*gomock.Call{
 					c.EXPECT().Publish(string(storageSync.FileNew), msg).Return(fmt.Errorf("error")).Times(5),
@@ -192,24 +192,24 @@ func TestGeneralContextCancelled(t *testing.T) {
 	time.Sleep(time.Duration(50 * time.Millisecond))
 }
 
-func getTestPublisher(t *testing.T, ctx context.Context) (*stanPublisher, *mock.MockStanConnection, func()) {
+func getTestPublisher(t *testing.T, ctx context.Context) (*publisher, *mock.MockTransport, func()) {
 	mockCtrl := gomock.NewController(t)
-	mockConn := mock.NewMockStanConnection(mockCtrl)
+	mockTransport := mock.NewMockTransport(mockCtrl)
 
 	cfg := Cfg{
-		Connection:      mockConn,
+		Transport:       mockTransport,
 		Retries:         5,
 		StartRetryWait:  time.Millisecond,
 		RetryWaitFactor: 1.0,
 	}
 
-	publisher := New(ctx, cfg, zerolog.New(os.Stdout))
+	p := New(ctx, cfg, zerolog.New(os.Stdout))
 
 	cleanup := func() {
-		mockConn.EXPECT().Close().Times(1)
-		publisher.Close()
+		mockTransport.EXPECT().Close().Times(1)
+		p.Close()
 		mockCtrl.Finish()
 	}
 
-	return publisher.(*stanPublisher), mockConn, cleanup
+	return p.(*publisher), mockTransport, cleanup
 }
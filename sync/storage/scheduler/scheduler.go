@@ -0,0 +1,357 @@
+package scheduler
+
+//go:generate ../../../bin/mockgen.sh sync/storage/scheduler Scheduler $GOFILE
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/metrics"
+	"github.com/iryonetwork/wwm/utils"
+)
+
+// defaultClass is the priority class of files not matching any configured class
+const defaultClass = "default"
+
+const (
+	queuedBytes   metrics.ID = "queuedBytes"
+	deferredBytes metrics.ID = "deferredBytes"
+)
+
+// Scheduler decides order and time in which file versions are synced
+type Scheduler interface {
+	// Priority returns priority of the file version, versions with lower priority are synced first.
+	Priority(fd *models.FileDescriptor) int
+	// Allowed returns true if the file version can be synced now, versions outside of the time window of their
+	// priority class are deferred.
+	Allowed(fd *models.FileDescriptor) bool
+	// Wait blocks until the file version is the next one to be synced within the bandwidth limit. Waiting
+	// versions are let through in order of their priority, bandwidth for the size of the version is reserved.
+	Wait(ctx context.Context, fd *models.FileDescriptor) error
+	// Sent settles bandwidth reserved for the file version let through by Wait with the number of bytes actually
+	// sent, compressed contents take less than their size and versions that didn't need sync take nothing.
+	Sent(fd *models.FileDescriptor, bytes int64)
+	// GetPrometheusMetricsCollection returns all prometheus metrics collectors to be registered
+	GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector
+}
+
+// Rules configure the scheduler
+type Rules struct {
+	// BytesPerSecond limits average throughput of synced file contents, it's not limited if 0
+	BytesPerSecond int64 `json:"bytesPerSecond"`
+	// Classes lists priority classes from the highest priority, files not matching any class are synced last
+	Classes []*Class `json:"classes"`
+}
+
+// Class describes files of the priority class
+type Class struct {
+	Name string `json:"name"`
+	// ContentTypes lists content types of files in the class, "image/*" matches all image content types
+	ContentTypes []string `json:"contentTypes"`
+	// Labels lists labels of files in the class, files with any of them belong to the class
+	Labels []string `json:"labels"`
+	// MinSize limits the class to files of at least the size in bytes
+	MinSize int64 `json:"minSize"`
+	// Window limits sync of files in the class to daily time window in local time, e.g. "22:00-06:00"
+	Window string `json:"window"`
+}
+
+// window is daily time window given by offsets from midnight
+type window struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// contains returns true if the time of day is within the window, windows ending before they start span midnight
+func (w *window) contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start <= w.end {
+		return d >= w.start && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+// waiter is file version waiting to be synced
+type waiter struct {
+	class    string
+	priority int
+	seq      uint64
+	size     int64
+	ready    chan struct{}
+	index    int
+}
+
+// queue orders waiting file versions by priority and then by arrival
+type queue []*waiter
+
+func (q queue) Len() int { return len(q) }
+
+func (q queue) Less(i, j int) bool {
+	if q[i].priority == q[j].priority {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].priority < q[j].priority
+}
+
+func (q queue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *queue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *queue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+type scheduler struct {
+	classes           []*Class
+	windows           map[string]*window
+	bytesPerSecond    int64
+	mu                sync.Mutex
+	queue             queue
+	seq               uint64
+	next              time.Time
+	timer             *time.Timer
+	logger            zerolog.Logger
+	metricsCollection map[metrics.ID]prometheus.Collector
+}
+
+// classify returns the priority class of the file version and its priority
+func (s *scheduler) classify(fd *models.FileDescriptor) (string, int) {
+	for i, c := range s.classes {
+		if matches(c, fd) {
+			return c.Name, i
+		}
+	}
+
+	return defaultClass, len(s.classes)
+}
+
+func (s *scheduler) Priority(fd *models.FileDescriptor) int {
+	_, priority := s.classify(fd)
+	return priority
+}
+
+func (s *scheduler) Allowed(fd *models.FileDescriptor) bool {
+	class, _ := s.classify(fd)
+	w, ok := s.windows[class]
+	if !ok || w.contains(getTime()) {
+		return true
+	}
+
+	s.metricsCollection[deferredBytes].(*prometheus.CounterVec).With(prometheus.Labels{"class": class}).Add(float64(fd.Size))
+	s.logger.Debug().
+		Str("class", class).
+		Str("file", fd.Name).
+		Str("version", fd.Version).
+		Msg("file version deferred to the time window of its class")
+
+	return false
+}
+
+func (s *scheduler) Wait(ctx context.Context, fd *models.FileDescriptor) error {
+	class, priority := s.classify(fd)
+	w := &waiter{class: class, priority: priority, size: fd.Size, ready: make(chan struct{})}
+
+	s.mu.Lock()
+	w.seq = s.seq
+	s.seq++
+	heap.Push(&s.queue, w)
+	s.queued(w, 1)
+	s.dispatch()
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// the version might have been let through in the meantime
+		if w.index < 0 {
+			return nil
+		}
+		heap.Remove(&s.queue, w.index)
+		s.queued(w, -1)
+		return ctx.Err()
+	}
+}
+
+func (s *scheduler) Sent(fd *models.FileDescriptor, bytes int64) {
+	if s.bytesPerSecond <= 0 || bytes == fd.Size {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.next = s.next.Add(s.duration(bytes - fd.Size))
+	// waiting versions might go through earlier
+	if s.timer != nil && s.timer.Stop() {
+		s.timer = nil
+	}
+	s.dispatch()
+}
+
+// dispatch lets waiting versions through in order of priority as the bandwidth limit allows. Next version is
+// picked only once the previous transfer fits the limit so that versions with higher priority can get ahead.
+// It has to be called with the lock held.
+func (s *scheduler) dispatch() {
+	for s.queue.Len() > 0 {
+		now := time.Now()
+		if wait := s.next.Sub(now); wait > 0 {
+			if s.timer == nil {
+				s.timer = time.AfterFunc(wait, func() {
+					s.mu.Lock()
+					defer s.mu.Unlock()
+					s.timer = nil
+					s.dispatch()
+				})
+			}
+			return
+		}
+
+		w := heap.Pop(&s.queue).(*waiter)
+		s.queued(w, -1)
+		if s.bytesPerSecond > 0 {
+			s.next = now.Add(s.duration(w.size))
+		}
+		close(w.ready)
+	}
+}
+
+// duration returns time it takes to send the bytes within the bandwidth limit
+func (s *scheduler) duration(bytes int64) time.Duration {
+	return time.Duration(float64(bytes) / float64(s.bytesPerSecond) * float64(time.Second))
+}
+
+// queued updates queued bytes of the waiter's class
+func (s *scheduler) queued(w *waiter, sign float64) {
+	s.metricsCollection[queuedBytes].(*prometheus.GaugeVec).With(prometheus.Labels{"class": w.class}).Add(sign * float64(w.size))
+}
+
+// GetPrometheusMetricsCollection returns all prometheus metrics collectors to be registered
+func (s *scheduler) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
+	return s.metricsCollection
+}
+
+// matches returns true if the file version belongs to the class
+func matches(c *Class, fd *models.FileDescriptor) bool {
+	if fd.Size < c.MinSize {
+		return false
+	}
+	if len(c.ContentTypes) != 0 && !matchesContentType(c.ContentTypes, fd.ContentType) {
+		return false
+	}
+
+	return len(c.Labels) == 0 || utils.SliceContainsAny(c.Labels, fd.Labels)
+}
+
+// matchesContentType returns true if the content type is listed, "type/*" matches all the subtypes
+func matchesContentType(contentTypes []string, contentType string) bool {
+	for _, t := range contentTypes {
+		if t == contentType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseWindow parses daily time window in the HH:MM-HH:MM format
+func parseWindow(s string) (*window, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid time window %s", s)
+	}
+
+	offsets := make([]time.Duration, 2)
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid time window %s", s)
+		}
+		offsets[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+
+	return &window{start: offsets[0], end: offsets[1]}, nil
+}
+
+// New returns new scheduler following the rules
+func New(rules *Rules, logger zerolog.Logger) (Scheduler, error) {
+	logger = logger.With().Str("component", "sync/storage/scheduler").Logger()
+
+	windows := make(map[string]*window)
+	for _, c := range rules.Classes {
+		if c.Name == "" || c.Name == defaultClass {
+			return nil, errors.Errorf("invalid name of priority class '%s'", c.Name)
+		}
+		if c.Window == "" {
+			continue
+		}
+		w, err := parseWindow(c.Window)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid priority class %s", c.Name)
+		}
+		windows[c.Name] = w
+	}
+
+	metricsCollection := make(map[metrics.ID]prometheus.Collector)
+	metricsCollection[queuedBytes] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "scheduler",
+		Name:      "queued_bytes",
+		Help:      "Size of file versions waiting to be synced",
+	}, []string{"class"})
+	metricsCollection[deferredBytes] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scheduler",
+		Name:      "deferred_bytes",
+		Help:      "Size of file versions deferred to the time window of their class",
+	}, []string{"class"})
+
+	return &scheduler{
+		classes:           rules.Classes,
+		windows:           windows,
+		bytesPerSecond:    rules.BytesPerSecond,
+		logger:            logger,
+		metricsCollection: metricsCollection,
+	}, nil
+}
+
+// LoadRules reads scheduler rules from JSON file
+func LoadRules(path string) (*Rules, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read scheduler rules")
+	}
+
+	rules := &Rules{}
+	if err := json.Unmarshal(b, rules); err != nil {
+		return nil, errors.Wrap(err, "failed to parse scheduler rules")
+	}
+
+	return rules, nil
+}
+
+var getTime = func() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,169 @@
+package scheduler
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+)
+
+var (
+	encounter = &models.FileDescriptor{Name: "encounter", ContentType: "application/json", Labels: []string{"encounter"}, Size: 100}
+	vitals    = &models.FileDescriptor{Name: "vitals", ContentType: "text/openEhrXml", Labels: []string{"vitalSign"}, Size: 100}
+	photo     = &models.FileDescriptor{Name: "photo", ContentType: "image/jpeg", Size: 100}
+	scan      = &models.FileDescriptor{Name: "scan", ContentType: "image/png", Size: 10 * 1024 * 1024}
+	report    = &models.FileDescriptor{Name: "report", ContentType: "application/pdf", Size: 100}
+	rules     = &Rules{
+		Classes: []*Class{
+			{Name: "clinical", ContentTypes: []string{"application/json", "text/openEhrXml"}},
+			{Name: "large", MinSize: 1024 * 1024, Window: "22:00-06:00"},
+			{Name: "images", ContentTypes: []string{"image/*"}},
+		},
+	}
+)
+
+func TestPriority(t *testing.T) {
+	s := getTestScheduler(t, rules)
+
+	testCases := []struct {
+		fd       *models.FileDescriptor
+		priority int
+	}{
+		{encounter, 0},
+		{vitals, 0},
+		{scan, 1},
+		{photo, 2},
+		{report, 3},
+	}
+
+	for _, test := range testCases {
+		if priority := s.Priority(test.fd); priority != test.priority {
+			t.Errorf("Expected priority of %s to be %d, got %d", test.fd.Name, test.priority, priority)
+		}
+	}
+
+	labelled := getTestScheduler(t, &Rules{Classes: []*Class{{Name: "vitals", Labels: []string{"vitalSign"}}}})
+	if labelled.Priority(vitals) != 0 || labelled.Priority(encounter) != 1 {
+		t.Error("Expected only files with the label to be in the class")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	s := getTestScheduler(t, rules)
+	defer func() { getTime = time.Now }()
+
+	testCases := []struct {
+		time    string
+		allowed bool
+	}{
+		{"12:00", false},
+		{"21:59", false},
+		{"22:00", true},
+		{"23:30", true},
+		{"05:59", true},
+		{"06:00", false},
+	}
+
+	for _, test := range testCases {
+		now, _ := time.Parse("15:04", test.time)
+		getTime = func() time.Time { return now }
+
+		if allowed := s.Allowed(scan); allowed != test.allowed {
+			t.Errorf("Expected large file allowed at %s to be %t, got %t", test.time, test.allowed, allowed)
+		}
+		if !s.Allowed(photo) {
+			t.Errorf("Expected file without time window to be allowed at %s", test.time)
+		}
+	}
+}
+
+func TestInvalidWindow(t *testing.T) {
+	if _, err := New(&Rules{Classes: []*Class{{Name: "large", Window: "nightly"}}}, zerolog.New(ioutil.Discard)); err == nil {
+		t.Error("Expected error, got nil")
+	}
+}
+
+func TestWait(t *testing.T) {
+	// 100 bytes take 50ms
+	s := getTestScheduler(t, &Rules{BytesPerSecond: 2000, Classes: rules.Classes})
+
+	// first version goes through immediately
+	start := time.Now()
+	if err := s.Wait(context.Background(), photo); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// versions waiting for bandwidth go through in order of priority
+	order := make(chan string, 2)
+	go func() {
+		s.Wait(context.Background(), report)
+		order <- report.Name
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		s.Wait(context.Background(), encounter)
+		order <- encounter.Name
+	}()
+
+	if first := <-order; first != encounter.Name {
+		t.Errorf("Expected %s to go first, got %s", encounter.Name, first)
+	}
+	if second := <-order; second != report.Name {
+		t.Errorf("Expected %s to go second, got %s", report.Name, second)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected bandwidth limit to hold versions for at least 100ms, took %s", elapsed)
+	}
+
+	// waiting is cancelled with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Wait(ctx, photo); err != context.Canceled {
+		t.Errorf("Expected error to equal '%v', got %v", context.Canceled, err)
+	}
+}
+
+func TestSent(t *testing.T) {
+	// 100 bytes take 50ms
+	s := getTestScheduler(t, &Rules{BytesPerSecond: 2000, Classes: rules.Classes})
+
+	// bandwidth reserved for the size is released once contents are sent compressed
+	start := time.Now()
+	if err := s.Wait(context.Background(), report); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	s.Sent(report, 0)
+	if err := s.Wait(context.Background(), report); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 25*time.Millisecond {
+		t.Errorf("Expected version to go through immediately, took %s", elapsed)
+	}
+
+	// waiting version goes through once bandwidth is released
+	done := make(chan struct{})
+	go func() {
+		s.Wait(context.Background(), report)
+		close(done)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	s.Sent(report, 0)
+	select {
+	case <-done:
+	case <-time.After(25 * time.Millisecond):
+		t.Error("Expected waiting version to go through")
+	}
+}
+
+func getTestScheduler(t *testing.T, rules *Rules) Scheduler {
+	s, err := New(rules, zerolog.New(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("Failed to create scheduler, %v", err)
+	}
+
+	return s
+}
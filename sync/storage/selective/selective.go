@@ -0,0 +1,135 @@
+package selective
+
+//go:generate ../../../bin/mockgen.sh sync/storage/selective Selector $GOFILE
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/strfmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/discovery/client/operations"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+)
+
+// pulledBucket is the key value storage bucket holding buckets whose history was pulled
+const pulledBucket = "selectiveSync"
+
+// Selector selects buckets of patients linked to the location for cloud to local sync. Buckets of patients are
+// named after patient IDs.
+type Selector interface {
+	// Refresh fetches patients linked to the location. Returns buckets that were linked since their history was
+	// pulled and buckets that were unlinked since their history was pulled.
+	Refresh(ctx context.Context) (linked, unlinked []string, err error)
+	// Selected returns true if the bucket belongs to patient linked to the location on the last refresh.
+	Selected(bucketID string) bool
+	// Pulled records that history of the linked bucket was pulled.
+	Pulled(bucketID string) error
+	// Forget forgets that history of the unlinked bucket was pulled.
+	Forget(bucketID string) error
+}
+
+// PatientsFunc returns IDs of patients linked to the location
+type PatientsFunc func(ctx context.Context) ([]string, error)
+
+type selector struct {
+	patients PatientsFunc
+	storage  keyvalue.Storage
+	linked   map[string]bool
+	logger   zerolog.Logger
+}
+
+func (s *selector) Refresh(ctx context.Context) ([]string, []string, error) {
+	ids, err := s.patients(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Str("cmd", "Refresh").Msg("Failed to fetch linked patients")
+		return nil, nil, errors.Wrap(err, "failed to fetch linked patients")
+	}
+
+	// bucket names are always lower case
+	s.linked = make(map[string]bool)
+	for _, id := range ids {
+		s.linked[strings.ToLower(id)] = true
+	}
+
+	pulled := make(map[string]bool)
+	err = s.storage.ForEach(pulledBucket, func(bucketID string, _ []byte) error {
+		pulled[bucketID] = true
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	linked := []string{}
+	for bucketID := range s.linked {
+		if !pulled[bucketID] {
+			linked = append(linked, bucketID)
+		}
+	}
+	unlinked := []string{}
+	for bucketID := range pulled {
+		if !s.linked[bucketID] {
+			unlinked = append(unlinked, bucketID)
+		}
+	}
+	sort.Strings(linked)
+	sort.Strings(unlinked)
+
+	s.logger.Info().
+		Strs("linked", linked).
+		Strs("unlinked", unlinked).
+		Msgf("%d patient(s) linked to the location", len(s.linked))
+
+	return linked, unlinked, nil
+}
+
+func (s *selector) Selected(bucketID string) bool {
+	return s.linked[bucketID]
+}
+
+func (s *selector) Pulled(bucketID string) error {
+	return s.storage.Update(pulledBucket, bucketID, []byte(strfmt.DateTime(time.Now()).String()))
+}
+
+func (s *selector) Forget(bucketID string) error {
+	return s.storage.Delete(pulledBucket, bucketID)
+}
+
+// New returns new selector of buckets of patients returned by patients func. Buckets whose history was pulled are
+// kept in the key value storage.
+func New(patients PatientsFunc, storage keyvalue.Storage, logger zerolog.Logger) Selector {
+	logger = logger.With().Str("component", "sync/storage/selective").Logger()
+
+	return &selector{
+		patients: patients,
+		storage:  storage,
+		linked:   make(map[string]bool),
+		logger:   logger,
+	}
+}
+
+// DiscoveryPatients returns func fetching patients linked to the location from discovery API
+func DiscoveryPatients(c *operations.Client, auth runtime.ClientAuthInfoWriter, locationID string) PatientsFunc {
+	return func(ctx context.Context) ([]string, error) {
+		params := operations.NewLocationPatientsParams().
+			WithLocationID(strfmt.UUID(locationID)).
+			WithContext(ctx)
+		resp, err := c.LocationPatients(params, auth)
+		if err != nil {
+			return nil, err
+		}
+
+		ids := make([]string, len(resp.Payload))
+		for i, id := range resp.Payload {
+			ids[i] = id.String()
+		}
+
+		return ids, nil
+	}
+}
@@ -0,0 +1,102 @@
+package selective
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+)
+
+func TestRefresh(t *testing.T) {
+	kv, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	patients := []string{"A3A1E0C5-8C9E-4A62-9B57-7B4E4D1C8A10", "b9e2f6d1-0c3b-4e8f-8f0e-3c1d2a7b6e54"}
+	s := New(func(context.Context) ([]string, error) { return patients, nil }, kv, zerolog.New(ioutil.Discard))
+
+	// all linked patients are new at first
+	linked, unlinked, err := s.Refresh(context.Background())
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	expectBuckets(t, "linked", linked, []string{"a3a1e0c5-8c9e-4a62-9b57-7b4e4d1c8a10", "b9e2f6d1-0c3b-4e8f-8f0e-3c1d2a7b6e54"})
+	expectBuckets(t, "unlinked", unlinked, []string{})
+	if !s.Selected("a3a1e0c5-8c9e-4a62-9b57-7b4e4d1c8a10") || s.Selected("c0ffee00-0000-4000-8000-000000000000") {
+		t.Error("Expected only buckets of linked patients to be selected")
+	}
+
+	// pulled buckets are remembered across selectors
+	for _, bucketID := range linked {
+		if err := s.Pulled(bucketID); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+	patients = []string{"b9e2f6d1-0c3b-4e8f-8f0e-3c1d2a7b6e54", "c0ffee00-0000-4000-8000-000000000000"}
+	s = New(func(context.Context) ([]string, error) { return patients, nil }, kv, zerolog.New(ioutil.Discard))
+
+	linked, unlinked, err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	expectBuckets(t, "linked", linked, []string{"c0ffee00-0000-4000-8000-000000000000"})
+	expectBuckets(t, "unlinked", unlinked, []string{"a3a1e0c5-8c9e-4a62-9b57-7b4e4d1c8a10"})
+	if s.Selected("a3a1e0c5-8c9e-4a62-9b57-7b4e4d1c8a10") {
+		t.Error("Expected bucket of unlinked patient not to be selected")
+	}
+
+	// forgotten bucket is not reported as unlinked again
+	if err := s.Forget("a3a1e0c5-8c9e-4a62-9b57-7b4e4d1c8a10"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	_, unlinked, err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	expectBuckets(t, "unlinked", unlinked, []string{})
+}
+
+func TestRefreshFails(t *testing.T) {
+	kv, cleanup := getTestStorage(t)
+	defer cleanup()
+
+	s := New(func(context.Context) ([]string, error) { return nil, fmt.Errorf("error") }, kv, zerolog.New(ioutil.Discard))
+
+	if _, _, err := s.Refresh(context.Background()); err == nil {
+		t.Error("Expected error, got nil")
+	}
+}
+
+func expectBuckets(t *testing.T, kind string, buckets, expected []string) {
+	if !reflect.DeepEqual(buckets, expected) {
+		t.Errorf("Expected %s buckets to equal %v, got %v", kind, expected, buckets)
+	}
+}
+
+func getTestStorage(t *testing.T) (keyvalue.Storage, func()) {
+	dir, err := ioutil.TempDir("", "selective")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	kv, err := keyvalue.NewBolt(ctx, filepath.Join(dir, "selective.db"), zerolog.New(ioutil.Discard))
+	if err != nil {
+		cancel()
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to create key value storage, %v", err)
+	}
+
+	cleanup := func() {
+		cancel()
+		os.RemoveAll(dir)
+	}
+
+	return kv, cleanup
+}
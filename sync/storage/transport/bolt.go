@@ -0,0 +1,450 @@
+package transport
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Bolt queue layout:
+//
+//	messages/<subject>/<seq>                      message data
+//	durables/<subject>/<durable>/floor            all the messages up to the floor are acknowledged
+//	durables/<subject>/<durable>/acked/<seq>      messages above the floor acknowledged out of order
+//	durables/<subject>/<durable>/pending/<seq>    deadline of acknowledgement of delivered message
+//
+// Messages are removed once they are acknowledged by all the durable subscriptions of the subject. Messages
+// published before the first durable subscription of the subject is started are kept for it.
+var (
+	messagesBucket = []byte("messages")
+	durablesBucket = []byte("durables")
+	ackedBucket    = []byte("acked")
+	pendingBucket  = []byte("pending")
+	floorKey       = []byte("floor")
+)
+
+const (
+	defaultAckWait      = 30 * time.Second
+	defaultMaxInflight  = 1
+	defaultPollInterval = time.Second
+	// boltLockTimeout is the maximum time to wait for other process to release the queue file
+	boltLockTimeout = 10 * time.Second
+)
+
+// boltTransport is the embedded durable queue stored in bolt file. The file is opened only for the duration
+// of every operation so that it can be shared by the publishing and consuming processes on the same host.
+type boltTransport struct {
+	path         string
+	pollInterval time.Duration
+	// mu serializes opening of the file within the process
+	mu     sync.Mutex
+	subs   map[*boltSubscription]bool
+	closed bool
+	logger zerolog.Logger
+}
+
+type boltSubscription struct {
+	t        *boltTransport
+	subject  string
+	opts     SubscriptionOpts
+	handler  MsgHandler
+	notify   chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	mu       sync.Mutex
+	inflight map[uint64]time.Time
+}
+
+type boltMsg struct {
+	sub  *boltSubscription
+	seq  uint64
+	data []byte
+}
+
+// Data returns payload of the message.
+func (m *boltMsg) Data() []byte {
+	return m.data
+}
+
+// Ack acknowledges the message so that it's not redelivered.
+func (m *boltMsg) Ack() error {
+	err := m.sub.t.update(func(tx *bolt.Tx) error {
+		return ack(tx, m.sub.subject, m.sub.opts.DurableName, m.seq)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.sub.mu.Lock()
+	delete(m.sub.inflight, m.seq)
+	m.sub.mu.Unlock()
+
+	return nil
+}
+
+// Publish durably stores the message published to the subject.
+func (t *boltTransport) Publish(subject string, data []byte) error {
+	err := t.update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, messagesBucket, []byte(subject))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		return b.Put(itob(seq), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	// wake up subscriptions of the process, other processes poll
+	t.mu.Lock()
+	for s := range t.subs {
+		if s.subject == subject {
+			select {
+			case s.notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	return nil
+}
+
+// QueueSubscribe starts durable queue subscription to the subject. Subscriptions with the same durable name
+// share the position and form the queue group, queue name is not used.
+func (t *boltTransport) QueueSubscribe(subject string, opts SubscriptionOpts, h MsgHandler) (Subscription, error) {
+	if opts.DurableName == "" {
+		return nil, errors.New("durable name is required")
+	}
+	if opts.AckWait <= 0 {
+		opts.AckWait = defaultAckWait
+	}
+	if opts.MaxInflight <= 0 {
+		opts.MaxInflight = defaultMaxInflight
+	}
+
+	// make sure the durable is known so that messages are kept for it
+	err := t.update(func(tx *bolt.Tx) error {
+		_, err := bucket(tx, durablesBucket, []byte(subject), []byte(opts.DurableName))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &boltSubscription{
+		t:        t,
+		subject:  subject,
+		opts:     opts,
+		handler:  h,
+		notify:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		inflight: make(map[uint64]time.Time),
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, ErrClosed
+	}
+	t.subs[s] = true
+	t.mu.Unlock()
+
+	go s.run()
+
+	return s, nil
+}
+
+// Close stops all the subscriptions.
+func (t *boltTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	subs := t.subs
+	t.subs = make(map[*boltSubscription]bool)
+	t.mu.Unlock()
+
+	for s := range subs {
+		s.close()
+	}
+
+	return nil
+}
+
+// update runs the function in read-write transaction of the queue file
+func (t *boltTransport) update(fn func(*bolt.Tx) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return ErrClosed
+	}
+
+	db, err := bolt.Open(t.path, 0600, &bolt.Options{Timeout: boltLockTimeout})
+	if err != nil {
+		t.logger.Error().Err(err).Str("filepath", t.path).Msg("failed to open queue file")
+		return errors.Wrapf(err, "failed to open queue file %s", t.path)
+	}
+	defer db.Close()
+
+	return db.Update(fn)
+}
+
+// Close stops the subscription, its durable position is kept.
+func (s *boltSubscription) Close() error {
+	s.t.mu.Lock()
+	delete(s.t.subs, s)
+	s.t.mu.Unlock()
+
+	s.close()
+
+	return nil
+}
+
+func (s *boltSubscription) close() {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	<-s.done
+}
+
+// run delivers messages until the subscription is closed
+func (s *boltSubscription) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.t.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for s.available() {
+			msg, err := s.next()
+			if err != nil {
+				s.t.logger.Error().Err(err).Str("subject", s.subject).Str("durable", s.opts.DurableName).Msg("failed to get next message")
+				break
+			}
+			if msg == nil {
+				break
+			}
+			s.handler(msg)
+
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		case <-s.notify:
+		}
+	}
+}
+
+// available returns true if number of unacknowledged messages delivered to the subscription is below the limit
+func (s *boltSubscription) available() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for seq, deadline := range s.inflight {
+		if now.After(deadline) {
+			delete(s.inflight, seq)
+		}
+	}
+
+	return len(s.inflight) < s.opts.MaxInflight
+}
+
+// next claims the oldest message that is neither acknowledged nor waiting for acknowledgement
+func (s *boltSubscription) next() (*boltMsg, error) {
+	var msg *boltMsg
+	now := time.Now()
+	deadline := now.Add(s.opts.AckWait)
+
+	err := s.t.update(func(tx *bolt.Tx) error {
+		messages := tx.Bucket(messagesBucket)
+		if messages != nil {
+			messages = messages.Bucket([]byte(s.subject))
+		}
+		if messages == nil {
+			return nil
+		}
+		durable, err := bucket(tx, durablesBucket, []byte(s.subject), []byte(s.opts.DurableName))
+		if err != nil {
+			return err
+		}
+		acked, err := durable.CreateBucketIfNotExists(ackedBucket)
+		if err != nil {
+			return err
+		}
+		pending, err := durable.CreateBucketIfNotExists(pendingBucket)
+		if err != nil {
+			return err
+		}
+
+		c := messages.Cursor()
+		for k, v := c.Seek(itob(floor(durable) + 1)); k != nil; k, v = c.Next() {
+			if acked.Get(k) != nil {
+				continue
+			}
+			if d := pending.Get(k); d != nil && now.Before(time.Unix(0, int64(btoi(d)))) {
+				continue
+			}
+			if err := pending.Put(k, itob(uint64(deadline.UnixNano()))); err != nil {
+				return err
+			}
+			msg = &boltMsg{sub: s, seq: btoi(k), data: append([]byte{}, v...)}
+			return nil
+		}
+
+		return nil
+	})
+	if err != nil || msg == nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.inflight[msg.seq] = deadline
+	s.mu.Unlock()
+
+	return msg, nil
+}
+
+// ack acknowledges the message for the durable and removes messages acknowledged by all the durables
+func ack(tx *bolt.Tx, subject, durableName string, seq uint64) error {
+	durables, err := bucket(tx, durablesBucket, []byte(subject))
+	if err != nil {
+		return err
+	}
+	durable, err := durables.CreateBucketIfNotExists([]byte(durableName))
+	if err != nil {
+		return err
+	}
+	acked, err := durable.CreateBucketIfNotExists(ackedBucket)
+	if err != nil {
+		return err
+	}
+	pending, err := durable.CreateBucketIfNotExists(pendingBucket)
+	if err != nil {
+		return err
+	}
+
+	if err := pending.Delete(itob(seq)); err != nil {
+		return err
+	}
+	f := floor(durable)
+	if seq <= f {
+		return nil
+	}
+	if err := acked.Put(itob(seq), []byte{}); err != nil {
+		return err
+	}
+
+	// advance the floor over continuous acknowledged messages
+	for acked.Get(itob(f+1)) != nil {
+		f++
+		if err := acked.Delete(itob(f)); err != nil {
+			return err
+		}
+	}
+	if err := durable.Put(floorKey, itob(f)); err != nil {
+		return err
+	}
+
+	// remove messages acknowledged by all the durables
+	low := f
+	err = durables.ForEach(func(k, v []byte) error {
+		if b := durables.Bucket(k); b != nil && floor(b) < low {
+			low = floor(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	messages := tx.Bucket(messagesBucket).Bucket([]byte(subject))
+	if messages == nil {
+		return nil
+	}
+	c := messages.Cursor()
+	for k, _ := c.First(); k != nil && btoi(k) <= low; k, _ = c.Next() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bucket returns nested bucket creating it if needed
+func bucket(tx *bolt.Tx, names ...[]byte) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists(names[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names[1:] {
+		if b, err = b.CreateBucketIfNotExists(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+func floor(durable *bolt.Bucket) uint64 {
+	if v := durable.Get(floorKey); v != nil {
+		return btoi(v)
+	}
+	return 0
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+// NewBolt returns embedded durable queue stored in the bolt file at the path. Messages published by other
+// processes sharing the file are checked for every poll interval.
+func NewBolt(path string, pollInterval time.Duration, logger zerolog.Logger) (Transport, error) {
+	logger = logger.With().Str("component", "sync/storage/transport").Logger()
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+
+	t := &boltTransport{
+		path:         path,
+		pollInterval: pollInterval,
+		subs:         make(map[*boltSubscription]bool),
+		logger:       logger,
+	}
+
+	// make sure the file can be opened
+	err := t.update(func(tx *bolt.Tx) error {
+		_, err := bucket(tx, messagesBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
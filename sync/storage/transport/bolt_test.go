@@ -0,0 +1,252 @@
+package transport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	subject     = "file.new"
+	testTimeout = 2 * time.Second
+)
+
+var opts = SubscriptionOpts{Queue: subject, DurableName: subject, AckWait: time.Second, MaxInflight: 1}
+
+func TestBoltPublishSubscribe(t *testing.T) {
+	tr, path, cleanup := getTestTransport(t)
+	defer cleanup()
+
+	// messages published before the first subscription are kept
+	publish(t, tr, "1", "2")
+
+	received := make(chan Msg, 10)
+	if _, err := tr.QueueSubscribe(subject, opts, func(msg Msg) { received <- msg }); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	publish(t, tr, "3")
+
+	for _, expected := range []string{"1", "2", "3"} {
+		msg := receive(t, received)
+		if string(msg.Data()) != expected {
+			t.Errorf("Expected message '%s', got '%s'", expected, msg.Data())
+		}
+		if err := msg.Ack(); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+	expectNone(t, received)
+	tr.Close()
+
+	// acknowledged messages are not redelivered after reopen and are removed
+	tr, err := NewBolt(path, 10*time.Millisecond, zerolog.New(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	defer tr.Close()
+	if _, err := tr.QueueSubscribe(subject, opts, func(msg Msg) { received <- msg }); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	expectNone(t, received)
+}
+
+func TestBoltRedelivery(t *testing.T) {
+	tr, _, cleanup := getTestTransport(t)
+	defer cleanup()
+
+	received := make(chan Msg, 10)
+	o := opts
+	o.AckWait = 100 * time.Millisecond
+	if _, err := tr.QueueSubscribe(subject, o, func(msg Msg) { received <- msg }); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	publish(t, tr, "1")
+
+	// unacknowledged message is redelivered after ack wait
+	first := receive(t, received)
+	start := time.Now()
+	second := receive(t, received)
+	if string(first.Data()) != "1" || string(second.Data()) != "1" {
+		t.Errorf("Expected message '1' to be delivered twice, got '%s' and '%s'", first.Data(), second.Data())
+	}
+	if wait := time.Since(start); wait < 50*time.Millisecond {
+		t.Errorf("Expected message to be redelivered after ack wait, got %s", wait)
+	}
+
+	if err := second.Ack(); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	time.Sleep(2 * o.AckWait)
+	expectNone(t, received)
+}
+
+func TestBoltMaxInflight(t *testing.T) {
+	tr, _, cleanup := getTestTransport(t)
+	defer cleanup()
+
+	received := make(chan Msg, 10)
+	o := opts
+	o.MaxInflight = 2
+	o.AckWait = time.Minute
+	if _, err := tr.QueueSubscribe(subject, o, func(msg Msg) { received <- msg }); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	publish(t, tr, "1", "2", "3")
+
+	// delivery is suspended until number of unacknowledged messages drops below the limit
+	first := receive(t, received)
+	receive(t, received)
+	expectNone(t, received)
+
+	if err := first.Ack(); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if msg := receive(t, received); string(msg.Data()) != "3" {
+		t.Errorf("Expected message '3', got '%s'", msg.Data())
+	}
+}
+
+func TestBoltQueueGroup(t *testing.T) {
+	tr, path, cleanup := getTestTransport(t)
+	defer cleanup()
+
+	// second subscription of the group uses other transport on the same file as other process would
+	other, err := NewBolt(path, 10*time.Millisecond, zerolog.New(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	defer other.Close()
+
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	received := make(chan Msg, 10)
+	handler := func(msg Msg) {
+		mu.Lock()
+		counts[string(msg.Data())]++
+		mu.Unlock()
+		msg.Ack()
+		received <- msg
+	}
+	for _, tr := range []Transport{tr, other} {
+		if _, err := tr.QueueSubscribe(subject, opts, handler); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+
+	n := 20
+	for i := 0; i < n; i++ {
+		publish(t, tr, fmt.Sprintf("%d", i))
+	}
+	for i := 0; i < n; i++ {
+		receive(t, received)
+	}
+	expectNone(t, received)
+
+	for i := 0; i < n; i++ {
+		if c := counts[fmt.Sprintf("%d", i)]; c != 1 {
+			t.Errorf("Expected message '%d' to be delivered once, got %d", i, c)
+		}
+	}
+}
+
+func TestBoltDurables(t *testing.T) {
+	tr, _, cleanup := getTestTransport(t)
+	defer cleanup()
+
+	// every durable receives all the messages
+	first := make(chan Msg, 10)
+	second := make(chan Msg, 10)
+	sub, err := tr.QueueSubscribe(subject, opts, func(msg Msg) { msg.Ack(); first <- msg })
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	o := opts
+	o.DurableName = "other"
+	if _, err := tr.QueueSubscribe(subject, o, func(msg Msg) { msg.Ack(); second <- msg }); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	publish(t, tr, "1")
+	receive(t, first)
+	receive(t, second)
+
+	// durable position is kept after the subscription is closed
+	sub.Close()
+	publish(t, tr, "2")
+	receive(t, second)
+	expectNone(t, first)
+	if _, err := tr.QueueSubscribe(subject, opts, func(msg Msg) { msg.Ack(); first <- msg }); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if msg := receive(t, first); string(msg.Data()) != "2" {
+		t.Errorf("Expected message '2', got '%s'", msg.Data())
+	}
+	expectNone(t, first)
+}
+
+func TestBoltClose(t *testing.T) {
+	tr, _, cleanup := getTestTransport(t)
+	defer cleanup()
+
+	tr.Close()
+
+	if _, err := tr.QueueSubscribe(subject, opts, func(msg Msg) {}); err != ErrClosed {
+		t.Errorf("Expected error to equal '%v', got %v", ErrClosed, err)
+	}
+	if err := tr.Publish(subject, []byte("1")); err != ErrClosed {
+		t.Errorf("Expected error to equal '%v', got %v", ErrClosed, err)
+	}
+}
+
+func getTestTransport(t *testing.T) (Transport, string, func()) {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %v", err)
+	}
+	path := filepath.Join(dir, "queue.db")
+
+	tr, err := NewBolt(path, 10*time.Millisecond, zerolog.New(ioutil.Discard))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to create bolt transport, %v", err)
+	}
+
+	cleanup := func() {
+		tr.Close()
+		os.RemoveAll(dir)
+	}
+
+	return tr, path, cleanup
+}
+
+func publish(t *testing.T, tr Transport, messages ...string) {
+	for _, m := range messages {
+		if err := tr.Publish(subject, []byte(m)); err != nil {
+			t.Fatalf("Failed to publish message, %v", err)
+		}
+	}
+}
+
+func receive(t *testing.T, ch chan Msg) Msg {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatal("Expected message to be received")
+	}
+
+	return nil
+}
+
+func expectNone(t *testing.T, ch chan Msg) {
+	select {
+	case msg := <-ch:
+		t.Errorf("Expected no message, got '%s'", msg.Data())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
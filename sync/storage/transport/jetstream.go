@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+type jetStreamTransport struct {
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	stream string
+}
+
+type jetStreamSubscription struct {
+	*nats.Subscription
+}
+
+// Close stops the subscription, durable consumer is kept in the stream.
+func (s jetStreamSubscription) Close() error {
+	return s.Subscription.Unsubscribe()
+}
+
+type jetStreamMsg struct {
+	*nats.Msg
+}
+
+// Data returns payload of the message.
+func (m jetStreamMsg) Data() []byte {
+	return m.Msg.Data
+}
+
+// Ack acknowledges the message and waits for the server to confirm it.
+func (m jetStreamMsg) Ack() error {
+	return m.Msg.AckSync()
+}
+
+// Publish durably stores the message published to the subject and waits for the server to confirm it.
+func (t *jetStreamTransport) Publish(subject string, data []byte) error {
+	_, err := t.js.Publish(subject, data)
+	return err
+}
+
+// QueueSubscribe starts durable queue subscription to the subject. The durable consumer is created by the
+// transport so that it's not deleted when the subscription is closed. JetStream requires durable name of queue
+// subscriptions to be the same as the queue name, queue name is used if they differ.
+func (t *jetStreamTransport) QueueSubscribe(subject string, opts SubscriptionOpts, h MsgHandler) (Subscription, error) {
+	_, err := t.js.ConsumerInfo(t.stream, opts.Queue)
+	switch err {
+	case nil:
+	case nats.ErrConsumerNotFound:
+		_, err = t.js.AddConsumer(t.stream, &nats.ConsumerConfig{
+			Durable:        opts.Queue,
+			DeliverSubject: nats.NewInbox(),
+			DeliverGroup:   opts.Queue,
+			DeliverPolicy:  nats.DeliverAllPolicy,
+			FilterSubject:  subject,
+			AckPolicy:      nats.AckExplicitPolicy,
+			AckWait:        opts.AckWait,
+			MaxAckPending:  opts.MaxInflight,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create consumer %s", opts.Queue)
+		}
+	default:
+		return nil, errors.Wrapf(err, "failed to get consumer %s", opts.Queue)
+	}
+
+	sub, err := t.js.QueueSubscribe(
+		subject,
+		opts.Queue,
+		func(msg *nats.Msg) { h(jetStreamMsg{msg}) },
+		nats.Bind(t.stream, opts.Queue),
+		nats.ManualAck(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return jetStreamSubscription{sub}, nil
+}
+
+// Close drains and closes nats connection.
+func (t *jetStreamTransport) Close() error {
+	return t.conn.Drain()
+}
+
+// NewJetStream returns transport using JetStream over provided nats connection. The stream is created to store
+// messages published to the subjects if it doesn't exist.
+func NewJetStream(conn *nats.Conn, stream string, subjects []string) (Transport, error) {
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get JetStream context")
+	}
+
+	_, err = js.StreamInfo(stream)
+	switch err {
+	case nil:
+	case nats.ErrStreamNotFound:
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:      stream,
+			Subjects:  subjects,
+			Storage:   nats.FileStorage,
+			Retention: nats.WorkQueuePolicy,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create stream %s", stream)
+		}
+	default:
+		return nil, errors.Wrapf(err, "failed to get stream %s", stream)
+	}
+
+	return &jetStreamTransport{conn: conn, js: js, stream: stream}, nil
+}
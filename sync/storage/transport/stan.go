@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"github.com/nats-io/go-nats-streaming"
+)
+
+type stanTransport struct {
+	conn stan.Conn
+}
+
+type stanMsg struct {
+	*stan.Msg
+}
+
+// Data returns payload of the message.
+func (m stanMsg) Data() []byte {
+	return m.Msg.Data
+}
+
+// Publish durably stores the message published to the subject.
+func (t *stanTransport) Publish(subject string, data []byte) error {
+	return t.conn.Publish(subject, data)
+}
+
+// QueueSubscribe starts durable queue subscription to the subject.
+func (t *stanTransport) QueueSubscribe(subject string, opts SubscriptionOpts, h MsgHandler) (Subscription, error) {
+	return t.conn.QueueSubscribe(
+		subject,
+		opts.Queue,
+		func(msg *stan.Msg) { h(stanMsg{msg}) },
+		stan.SetManualAckMode(),
+		stan.AckWait(opts.AckWait),
+		stan.MaxInflight(opts.MaxInflight),
+		stan.DurableName(opts.DurableName),
+	)
+}
+
+// Close closes nats-streaming connection.
+func (t *stanTransport) Close() error {
+	return t.conn.Close()
+}
+
+// NewStan returns transport using provided nats-streaming connection.
+func NewStan(conn stan.Conn) Transport {
+	return &stanTransport{conn: conn}
+}
@@ -0,0 +1,66 @@
+/*
+Package transport abstracts the messaging system carrying storage sync events
+from the publisher in local storage to the consumer in storage sync.
+
+Three implementations are provided:
+  - NATS Streaming (legacy, deprecated upstream)
+  - NATS JetStream
+  - embedded durable on-disk queue based on bolt for sites without NATS server
+
+All of them deliver messages at least once to durable queue subscriptions
+with manual acknowledgements; unacknowledged messages are redelivered after
+the ack wait and number of unacknowledged messages delivered to a single
+subscription is limited by max in-flight.
+*/
+package transport
+
+//go:generate ../../../bin/mockgen.sh sync/storage/transport Transport,Msg,Subscription $GOFILE
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Transport describes the messaging system underlying storage sync publisher and consumer
+type Transport interface {
+	// Publish durably stores the message published to the subject.
+	Publish(subject string, data []byte) error
+	// QueueSubscribe starts durable queue subscription to the subject, messages are passed to the handler
+	// one by one and have to be acknowledged.
+	QueueSubscribe(subject string, opts SubscriptionOpts, h MsgHandler) (Subscription, error)
+	// Close closes the transport and underlying connection.
+	Close() error
+}
+
+// SubscriptionOpts hold subscription semantics
+type SubscriptionOpts struct {
+	// Queue is the name of the queue group, every message is delivered to only one subscription of the group
+	Queue string
+	// DurableName is the name under which position of the subscription is remembered
+	DurableName string
+	// AckWait is the time after which unacknowledged message is redelivered
+	AckWait time.Duration
+	// MaxInflight is the maximum number of unacknowledged messages delivered to the subscription
+	MaxInflight int
+}
+
+// Msg is the received message
+type Msg interface {
+	// Data returns payload of the message.
+	Data() []byte
+	// Ack acknowledges the message so that it's not redelivered.
+	Ack() error
+}
+
+// MsgHandler handles received messages
+type MsgHandler func(msg Msg)
+
+// Subscription is the started subscription
+type Subscription interface {
+	// Close stops the subscription, its durable position is kept.
+	Close() error
+}
+
+// ErrClosed is returned when using closed transport
+var ErrClosed = errors.New("transport is closed")
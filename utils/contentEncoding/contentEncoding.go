@@ -0,0 +1,233 @@
+package contentEncoding
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// content codings
+const (
+	Identity = "identity"
+	Gzip     = "gzip"
+)
+
+// ErrUnsupported is returned for content codings that are not supported
+var ErrUnsupported = errors.New("Unsupported content encoding")
+
+// ErrTooLarge is returned by limited readers once contents exceed the limit
+var ErrTooLarge = errors.New("Decoded contents exceed their declared size")
+
+// supported lists supported content codings other than identity in order of preference, only gzip is supported
+// so that no compression library beyond the standard library is needed
+var supported = []string{Gzip}
+
+// Accepted returns supported content codings formatted for the Accept-Encoding header
+func Accepted() string {
+	return strings.Join(supported, ", ")
+}
+
+// Negotiate returns the preferred supported content coding accepted by the Accept-Encoding header value,
+// identity if none of them is accepted
+func Negotiate(accept string) string {
+	encoding := Identity
+	var quality float64
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if !isSupported(coding) {
+			continue
+		}
+
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > quality {
+			encoding = coding
+			quality = q
+		}
+	}
+
+	return encoding
+}
+
+// Compressible returns true if contents of the content type are worth compressing. Images, videos and archives
+// are compressed already.
+func Compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/json",
+		mediaType == "application/xml",
+		mediaType == "image/svg+xml":
+		return true
+	}
+
+	return false
+}
+
+// NewReader returns reader decoding contents encoded with the content coding
+func NewReader(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "", Identity:
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	}
+
+	return nil, ErrUnsupported
+}
+
+// LimitReader returns reader of at most limit bytes of r, it fails with ErrTooLarge once r has more so that
+// contents decoded to more than their declared size are refused instead of being truncated
+func LimitReader(r io.ReadCloser, limit int64) io.ReadCloser {
+	if limit < 0 {
+		limit = 0
+	}
+	return &limitedReader{r, limit}
+}
+
+// NewWriter returns writer encoding contents with the content coding, it has to be closed to flush them
+func NewWriter(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "", Identity:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	}
+
+	return nil, ErrUnsupported
+}
+
+// Encode returns reader of contents of r encoded with the content coding. Contents are encoded while they are
+// read, r is closed once they are read or the returned reader is closed.
+func Encode(r io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	w, err := NewWriter(pw, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer r.Close()
+		_, err := io.Copy(w, r)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// Transport returns round tripper requesting responses encoded with supported content codings and decoding them.
+// Range requests are sent without Accept-Encoding so that ranges refer to the original contents.
+func Transport(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Accept-Encoding") != "" || req.Header.Get("Range") != "" {
+			return next.RoundTrip(req)
+		}
+
+		// request is cloned as round trippers must not modify it
+		r := new(http.Request)
+		*r = *req
+		r.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.Header.Set("Accept-Encoding", Accepted())
+
+		resp, err := next.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+
+		encoding := resp.Header.Get("Content-Encoding")
+		if encoding == "" || encoding == Identity {
+			return resp, nil
+		}
+		body, err := NewReader(resp.Body, encoding)
+		if err != nil {
+			resp.Body.Close()
+			return nil, errors.Wrapf(err, "failed to decode response encoded with %s", encoding)
+		}
+		resp.Body = &decodedBody{body, resp.Body}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+
+		return resp, nil
+	})
+}
+
+func isSupported(encoding string) bool {
+	for _, e := range supported {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// one more byte than the limit is allowed to be read to tell contents of the exact limit from larger ones
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.n -= int64(n)
+	if r.n < 0 {
+		return 0, ErrTooLarge
+	}
+
+	return n, err
+}
+
+// decodedBody closes both the decoder and the original response body
+type decodedBody struct {
+	io.ReadCloser
+	body io.ReadCloser
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.body.Close()
+}
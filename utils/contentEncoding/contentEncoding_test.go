@@ -0,0 +1,140 @@
+package contentEncoding
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const contents = `{"resourceType":"Observation","status":"final","code":{"text":"Blood pressure"}}`
+
+func TestNegotiate(t *testing.T) {
+	testCases := []struct {
+		accept   string
+		encoding string
+	}{
+		{"", Identity},
+		{"gzip", Gzip},
+		{"deflate, gzip;q=0.5", Gzip},
+		{"GZIP", Gzip},
+		{"gzip;q=0", Identity},
+		{"br, deflate", Identity},
+	}
+
+	for _, test := range testCases {
+		if encoding := Negotiate(test.accept); encoding != test.encoding {
+			t.Errorf("Expected encoding negotiated for '%s' to be %s, got %s", test.accept, test.encoding, encoding)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	testCases := []struct {
+		contentType  string
+		compressible bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"application/x-collection+json", true},
+		{"text/openEhrXml", true},
+		{"image/jpeg", false},
+		{"application/pdf", false},
+		{"", false},
+	}
+
+	for _, test := range testCases {
+		if compressible := Compressible(test.contentType); compressible != test.compressible {
+			t.Errorf("Expected %s compressible to be %t, got %t", test.contentType, test.compressible, compressible)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	for _, encoding := range []string{Identity, Gzip} {
+		encoded, err := Encode(ioutil.NopCloser(strings.NewReader(contents)), encoding)
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		r, err := NewReader(encoded, encoding)
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		if string(decoded) != contents {
+			t.Errorf("Expected contents encoded with %s to be decoded, got %s", encoding, decoded)
+		}
+	}
+
+	if _, err := Encode(ioutil.NopCloser(strings.NewReader(contents)), "zstd"); err != ErrUnsupported {
+		t.Errorf("Expected error to equal '%v', got %v", ErrUnsupported, err)
+	}
+	if _, err := NewReader(strings.NewReader(contents), "zstd"); err != ErrUnsupported {
+		t.Errorf("Expected error to equal '%v', got %v", ErrUnsupported, err)
+	}
+}
+
+func TestLimitReader(t *testing.T) {
+	testCases := []struct {
+		limit int64
+		err   error
+	}{
+		{int64(len(contents)), nil},
+		{int64(len(contents)) + 1, nil},
+		{int64(len(contents)) - 1, ErrTooLarge},
+		{0, ErrTooLarge},
+		{-1, ErrTooLarge},
+	}
+
+	for _, test := range testCases {
+		r := LimitReader(ioutil.NopCloser(strings.NewReader(contents)), test.limit)
+		b, err := ioutil.ReadAll(r)
+		if err != test.err {
+			t.Errorf("Expected error reading with limit %d to equal '%v', got %v", test.limit, test.err, err)
+		}
+		if err == nil && string(b) != contents {
+			t.Errorf("Expected contents read with limit %d, got %s", test.limit, b)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := Negotiate(r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", encoding)
+		enc, _ := NewWriter(w, encoding)
+		enc.Write([]byte(contents))
+		enc.Close()
+	}))
+	defer server.Close()
+
+	// responses are decoded and ranges refer to the original contents
+	client := &http.Client{Transport: Transport(&http.Transport{DisableCompression: true})}
+	for _, header := range []string{"", "Range"} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		if header != "" {
+			req.Header.Set(header, "bytes=0-")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if !bytes.Equal(body, []byte(contents)) {
+			t.Errorf("Expected decoded contents, got %s", body)
+		}
+		if header != "" && resp.Uncompressed {
+			t.Error("Expected range response not to be encoded")
+		}
+		if header == "" && !resp.Uncompressed {
+			t.Error("Expected response to be encoded")
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package keyProvider
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// keyInfo is the context string used when deriving bucket keys
+const keyInfo = "wwm/storage/s3"
+
+// ErrUnknownVersion is returned when key of requested version is not in the keyring
+var ErrUnknownVersion = errors.New("Unknown key version")
+
+// keyringFile describes the format of the keyring file
+type keyringFile struct {
+	// Current is the version of the master key used to encrypt new objects
+	Current string `json:"current"`
+	// Keys holds base64-encoded master keys by their version
+	Keys map[string]string `json:"keys"`
+}
+
+// keyring derives a distinct key for every bucket from versioned master keys
+// with HKDF-SHA256. Derived keys are cached.
+type keyring struct {
+	current    string
+	masterKeys map[string][]byte
+	legacyKey  string
+	cache      map[string]string
+	cacheLock  sync.RWMutex
+}
+
+// Get returns the current key of the bucket.
+func (k *keyring) Get(id string) (string, error) {
+	return k.GetVersion(id, k.current)
+}
+
+// GetVersion returns the key of the bucket derived from the master key with
+// given version. Empty version returns the legacy key shared by all buckets.
+func (k *keyring) GetVersion(id, version string) (string, error) {
+	if version == "" {
+		return k.legacyKey, nil
+	}
+
+	cacheKey := version + "/" + id
+	k.cacheLock.RLock()
+	key, ok := k.cache[cacheKey]
+	k.cacheLock.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	master, ok := k.masterKeys[version]
+	if !ok {
+		return "", ErrUnknownVersion
+	}
+	key = string(deriveKey(master, []byte(id), []byte(keyInfo)))
+
+	k.cacheLock.Lock()
+	k.cache[cacheKey] = key
+	k.cacheLock.Unlock()
+
+	return key, nil
+}
+
+// CurrentVersion returns the version of the current master key.
+func (k *keyring) CurrentVersion(id string) (string, error) {
+	return k.current, nil
+}
+
+// NewKeyring returns a key provider deriving per bucket keys from the master
+// keys stored in the keyring file. Legacy key is returned for objects that
+// were encrypted before keys were versioned.
+func NewKeyring(filepath, legacyKey string) (*keyring, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open keyring file %s", filepath)
+	}
+	defer f.Close()
+
+	var kf keyringFile
+	if err := json.NewDecoder(f).Decode(&kf); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode keyring file %s", filepath)
+	}
+
+	k := &keyring{
+		current:    kf.Current,
+		masterKeys: make(map[string][]byte),
+		legacyKey:  legacyKey,
+		cache:      make(map[string]string),
+	}
+	for version, encoded := range kf.Keys {
+		if version == "" {
+			return nil, errors.New("empty key version is reserved for the legacy key")
+		}
+		master, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode master key version %s", version)
+		}
+		k.masterKeys[version] = master
+	}
+	if _, ok := k.masterKeys[k.current]; !ok {
+		return nil, errors.Wrapf(ErrUnknownVersion, "current key version %s is not in the keyring", k.current)
+	}
+
+	return k, nil
+}
+
+// deriveKey implements HKDF-SHA256 (RFC 5869) returning a 32 bytes long key.
+func deriveKey(secret, salt, info []byte) []byte {
+	// extract
+	extractor := hmac.New(sha256.New, salt)
+	extractor.Write(secret)
+	prk := extractor.Sum(nil)
+
+	// expand; single block is enough for the key size used
+	expander := hmac.New(sha256.New, prk)
+	expander.Write(info)
+	expander.Write([]byte{1})
+
+	return expander.Sum(nil)
+}
@@ -0,0 +1,111 @@
+package keyProvider
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testKeyring = `{
+	"current": "2",
+	"keys": {
+		"1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		"2": "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+	}
+}`
+
+func getTestKeyring(t *testing.T, contents string) (*keyring, error) {
+	f, err := ioutil.TempFile("", "keyring")
+	if err != nil {
+		t.Fatalf("failed to create temporary file; %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatalf("failed to write temporary file; %v", err)
+	}
+	f.Close()
+
+	return NewKeyring(f.Name(), "LEGACY")
+}
+
+func TestDeriveKey(t *testing.T) {
+	// RFC 5869 test case 1, first 32 bytes of OKM
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	expected, _ := hex.DecodeString("3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf")
+
+	if key := deriveKey(ikm, salt, info); !bytes.Equal(key, expected) {
+		t.Errorf("Expected key to equal %x; got %x", expected, key)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	k, err := getTestKeyring(t, testKeyring)
+	if err != nil {
+		t.Fatalf("Expected error to be nil; got %v", err)
+	}
+
+	// current version
+	if v, _ := k.CurrentVersion("BUCKET1"); v != "2" {
+		t.Errorf("Expected current version to equal '2'; got '%s'", v)
+	}
+
+	// current key equals key of the current version
+	current, err := k.Get("BUCKET1")
+	if err != nil {
+		t.Fatalf("Expected error to be nil; got %v", err)
+	}
+	if len(current) != 32 {
+		t.Errorf("Expected key to be 32 bytes long; got %d", len(current))
+	}
+	if v2, _ := k.GetVersion("BUCKET1", "2"); v2 != current {
+		t.Error("Expected current key to equal key of version 2")
+	}
+
+	// keys differ between buckets and versions
+	if other, _ := k.GetVersion("BUCKET2", "2"); other == current {
+		t.Error("Expected keys of different buckets to differ")
+	}
+	if v1, _ := k.GetVersion("BUCKET1", "1"); v1 == current {
+		t.Error("Expected keys of different versions to differ")
+	}
+
+	// cached key is returned on subsequent calls
+	if again, _ := k.Get("BUCKET1"); again != current {
+		t.Error("Expected subsequent call to return the same key")
+	}
+
+	// legacy key
+	if legacy, _ := k.GetVersion("BUCKET1", ""); legacy != "LEGACY" {
+		t.Errorf("Expected legacy key to equal 'LEGACY'; got '%s'", legacy)
+	}
+
+	// unknown version
+	if _, err := k.GetVersion("BUCKET1", "3"); err != ErrUnknownVersion {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrUnknownVersion, err)
+	}
+}
+
+func TestKeyringInvalid(t *testing.T) {
+	testCases := []struct {
+		description string
+		contents    string
+	}{
+		{"invalid JSON", "{"},
+		{"invalid base64", `{"current": "1", "keys": {"1": "***"}}`},
+		{"missing current version", `{"current": "2", "keys": {"1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}}`},
+		{"empty version", `{"current": "", "keys": {"": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}}`},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			if _, err := getTestKeyring(t, test.contents); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
@@ -9,6 +9,14 @@ func (k *keyProvider) Get(id string) (string, error) {
 	return k.key, nil
 }
 
+func (k *keyProvider) GetVersion(id, version string) (string, error) {
+	return k.key, nil
+}
+
+func (k *keyProvider) CurrentVersion(id string) (string, error) {
+	return "", nil
+}
+
 func New(key string) *keyProvider {
 	return &keyProvider{key}
 }
@@ -0,0 +1,138 @@
+/*
+Package spool streams contents of unknown size into temporary files on disk
+instead of buffering them in memory.
+
+Size and sha256 checksum of the contents are calculated while they are
+written, so that contents can be verified against the expected checksum
+before they are stored and then read again from the beginning:
+
+	f, err := spool.Copy("", r)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Verify(checksum); err != nil {
+		return err
+	}
+	contents, err := f.Reader()
+
+Closing the file removes it from the disk.
+*/
+package spool
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrChecksumMismatch is returned when spooled contents don't match the expected checksum
+var ErrChecksumMismatch = errors.New("Checksum mismatch")
+
+// File spools streamed contents into a temporary file calculating their size and
+// sha256 checksum while writing, so that the contents don't have to be held in memory
+// before the checksum is known.
+type File struct {
+	file *os.File
+	hash hash.Hash
+	size int64
+}
+
+// New creates a new spool file in the directory dir. If dir is empty, the default
+// directory for temporary files is used.
+func New(dir string) (*File, error) {
+	f, err := ioutil.TempFile(dir, "wwm-spool-")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create spool file")
+	}
+
+	return &File{file: f, hash: sha256.New()}, nil
+}
+
+// Copy spools contents of the reader into a new spool file in the directory dir.
+// Spool file is removed if copying fails.
+func Copy(dir string, r io.Reader) (*File, error) {
+	f, err := New(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "Failed to spool contents")
+	}
+
+	return f, nil
+}
+
+// Write appends p to the spool file updating its size and checksum.
+func (f *File) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.hash.Write(p[:n])
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Checksum returns base64 URL encoded sha256 checksum of the contents written so far.
+func (f *File) Checksum() string {
+	return base64.URLEncoding.EncodeToString(f.hash.Sum(nil))
+}
+
+// Size returns number of bytes written so far.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Verify returns ErrChecksumMismatch if spooled contents don't match the checksum.
+func (f *File) Verify(checksum string) error {
+	if f.Checksum() != checksum {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+// Contents reads spooled contents from the beginning. Checksum and size of the contents
+// are known so that readers passing them on don't have to spool them again.
+type Contents struct {
+	// underlying file is hidden so that it can't be closed through the reader
+	io.Reader
+	f *File
+}
+
+// Checksum returns base64 URL encoded sha256 checksum of the spooled contents.
+func (c *Contents) Checksum() string {
+	return c.f.Checksum()
+}
+
+// Size returns size of the spooled contents.
+func (c *Contents) Size() int64 {
+	return c.f.Size()
+}
+
+// Reader returns a reader of the spooled contents from the beginning. Reader is
+// valid until the spool file is closed and must not be closed by the caller.
+func (f *File) Reader() (*Contents, error) {
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "Failed to rewind spool file")
+	}
+
+	return &Contents{Reader: struct{ io.Reader }{f.file}, f: f}, nil
+}
+
+// Close closes and removes the spool file.
+func (f *File) Close() error {
+	closeErr := f.file.Close()
+	if err := os.Remove(f.file.Name()); err != nil {
+		return errors.Wrap(err, "Failed to remove spool file")
+	}
+
+	return closeErr
+}
@@ -0,0 +1,55 @@
+package spool
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	f, err := Copy("", bytes.NewBufferString("content"))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	expectedChecksum := "7XACtDnprIRfIjV9giusFERzD722AW0-yUMil7nsn3M="
+	if f.Checksum() != expectedChecksum {
+		t.Errorf("Expected checksum to equal %s, got %s", expectedChecksum, f.Checksum())
+	}
+	if f.Size() != 7 {
+		t.Errorf("Expected size to equal 7, got %d", f.Size())
+	}
+	if err := f.Verify(expectedChecksum); err != nil {
+		t.Errorf("Expected error to be nil, got %v", err)
+	}
+	if err := f.Verify("CHS"); err != ErrChecksumMismatch {
+		t.Errorf("Expected error to equal %v, got %v", ErrChecksumMismatch, err)
+	}
+
+	// contents can be read more than once
+	for i := 0; i < 2; i++ {
+		r, err := f.Reader()
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		if string(b) != "content" {
+			t.Errorf("Expected contents to equal 'content', got '%s'", string(b))
+		}
+		if r.Checksum() != expectedChecksum || r.Size() != 7 {
+			t.Errorf("Expected contents checksum %s and size 7, got %s and %d", expectedChecksum, r.Checksum(), r.Size())
+		}
+	}
+
+	name := f.file.Name()
+	if err := f.Close(); err != nil {
+		t.Errorf("Expected error to be nil, got %v", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Expected spool file to be removed, got %v", err)
+	}
+}